@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// BotTokenPrefix starts every bot token, which tells them apart from the JWTs
+// people sign in with.
+const BotTokenPrefix = "dbb_"
+
+// botTokenShownLength is how much of a token is kept in the clear, so owners
+// can tell their tokens apart.
+const botTokenShownLength = len(BotTokenPrefix) + 6
+
+// NewBotToken returns a random bot token and the prefix to show for it.
+func NewBotToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := BotTokenPrefix + hex.EncodeToString(raw)
+	return token, token[:botTokenShownLength], nil
+}
+
+// IsBotToken reports whether a bearer token looks like a bot token.
+func IsBotToken(token string) bool {
+	return strings.HasPrefix(token, BotTokenPrefix)
+}
+
+// HashBotToken returns what is stored for token. Tokens are random and
+// long, so a plain SHA-256 is enough to keep them out of the database.
+func HashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+func digestUnsubscribeSignature(userID int64) []byte {
+	mac := hmac.New(sha256.New, getSecret())
+	fmt.Fprintf(mac, "digest-unsubscribe\n%d", userID)
+	return mac.Sum(nil)
+}
+
+// SignDigestUnsubscribe returns the hex signature that lets anyone holding a
+// digest email turn off userID's digests. It does not expire, so links in old
+// emails keep working.
+func SignDigestUnsubscribe(userID int64) string {
+	return hex.EncodeToString(digestUnsubscribeSignature(userID))
+}
+
+// VerifyDigestUnsubscribe checks a signature produced by SignDigestUnsubscribe.
+func VerifyDigestUnsubscribe(userID int64, signature string) bool {
+	provided, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(provided, digestUnsubscribeSignature(userID))
+}
+
+func digestEmailSignature(userID int64, email string) []byte {
+	mac := hmac.New(sha256.New, getSecret())
+	fmt.Fprintf(mac, "digest-email\n%d\n%s", userID, email)
+	return mac.Sum(nil)
+}
+
+// SignDigestEmail returns the hex signature that proves whoever holds it
+// received mail at email, letting it confirm email as userID's digest address.
+func SignDigestEmail(userID int64, email string) string {
+	return hex.EncodeToString(digestEmailSignature(userID, email))
+}
+
+// VerifyDigestEmail checks a signature produced by SignDigestEmail.
+func VerifyDigestEmail(userID int64, email string, signature string) bool {
+	provided, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(provided, digestEmailSignature(userID, email))
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// RelatedUser is an entry in a user's block or mute list.
+type RelatedUser struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlockUser records that blockerID blocked blockedID and severs what they
+// share: follows both ways and notifications between them. It returns false
+// if the block already existed.
+func BlockUser(blockerID int64, blockedID int64) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start block transaction: %w", err)
+	}
+
+	rollback := func(original error) error {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", original, rollbackErr)
+		}
+		return original
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO userblocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING;`,
+		blockerID,
+		blockedID,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return false, rollback(fmt.Errorf("failed to block user: %w", err))
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return false, rollback(fmt.Errorf("failed to block user: %w", err))
+	}
+
+	if _, err := tx.Exec(
+		`DELETE FROM userfollows WHERE (follower_id = $1 AND followed_id = $2) OR (follower_id = $2 AND followed_id = $1);`,
+		blockerID,
+		blockedID,
+	); err != nil {
+		return false, rollback(fmt.Errorf("failed to remove follows for block: %w", err))
+	}
+
+	if _, err := tx.Exec(
+		`DELETE FROM notifications WHERE (user_id = $1 AND actor_id = $2) OR (user_id = $2 AND actor_id = $1);`,
+		blockerID,
+		blockedID,
+	); err != nil {
+		return false, rollback(fmt.Errorf("failed to remove notifications for block: %w", err))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit block: %w", err)
+	}
+	return added > 0, nil
+}
+
+func UnblockUser(blockerID int64, blockedID int64) (bool, error) {
+	removed, err := ExecUpdate(`DELETE FROM userblocks WHERE blocker_id = $1 AND blocked_id = $2;`, blockerID, blockedID)
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock user: %w", err)
+	}
+	return removed > 0, nil
+}
+
+func MuteUser(muterID int64, mutedID int64) (bool, error) {
+	added, err := ExecUpdate(
+		`INSERT INTO usermutes (muter_id, muted_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (muter_id, muted_id) DO NOTHING;`,
+		muterID,
+		mutedID,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to mute user: %w", err)
+	}
+	return added > 0, nil
+}
+
+func UnmuteUser(muterID int64, mutedID int64) (bool, error) {
+	removed, err := ExecUpdate(`DELETE FROM usermutes WHERE muter_id = $1 AND muted_id = $2;`, muterID, mutedID)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmute user: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// IsBlockedBetween reports whether either user has blocked the other.
+func IsBlockedBetween(userID int64, otherID int64) (bool, error) {
+	var count int
+	err := DB.QueryRow(
+		`SELECT COUNT(*) FROM userblocks
+		WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1);`,
+		userID,
+		otherID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check blocks: %w", err)
+	}
+	return count > 0, nil
+}
+
+// QueryBlockedUserIDs returns everyone userID blocked or was blocked by.
+func QueryBlockedUserIDs(userID int64) (map[int64]struct{}, error) {
+	rows, err := DB.Query(
+		`SELECT blocked_id FROM userblocks WHERE blocker_id = $1
+		UNION
+		SELECT blocker_id FROM userblocks WHERE blocked_id = $1;`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]struct{})
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan block: %w", err)
+		}
+		ids[id] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("block rows error: %w", err)
+	}
+	return ids, nil
+}
+
+func QueryBlockedUsers(userID int64) ([]RelatedUser, error) {
+	return queryRelatedUsers(
+		`SELECT u.username, b.created_at FROM userblocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC;`,
+		userID,
+	)
+}
+
+func QueryMutedUsers(userID int64) ([]RelatedUser, error) {
+	return queryRelatedUsers(
+		`SELECT u.username, m.created_at FROM usermutes m
+		JOIN users u ON u.id = m.muted_id
+		WHERE m.muter_id = $1
+		ORDER BY m.created_at DESC;`,
+		userID,
+	)
+}
+
+func queryRelatedUsers(query string, userID int64) ([]RelatedUser, error) {
+	rows, err := DB.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]RelatedUser, 0)
+	for rows.Next() {
+		var user RelatedUser
+		if err := rows.Scan(&user.Username, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("user rows error: %w", err)
+	}
+	return users, nil
+}
+
+// hiddenAuthorsFilter returns an SQL condition excluding rows whose author
+// column belongs to someone the viewer (bound as $N) blocked or was blocked
+// by, and with withMutes also anyone the viewer muted. It is empty for
+// anonymous viewers.
+func hiddenAuthorsFilter(column string, viewerParam int, viewerID int64, withMutes bool) string {
+	if viewerID <= 0 {
+		return ""
+	}
+	filter := fmt.Sprintf(`%[1]s NOT IN (
+		SELECT blocked_id FROM userblocks WHERE blocker_id = $%[2]d
+		UNION SELECT blocker_id FROM userblocks WHERE blocked_id = $%[2]d`, column, viewerParam)
+	if withMutes {
+		filter += fmt.Sprintf(`
+		UNION SELECT muted_id FROM usermutes WHERE muter_id = $%d`, viewerParam)
+	}
+	return filter + ")"
+}
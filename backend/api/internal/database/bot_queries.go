@@ -0,0 +1,377 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// BotOwner is the user or project a bot account belongs to. Exactly one of
+// UserID and ProjectID is set.
+type BotOwner struct {
+	UserID      int64  `json:"user_id,omitempty"`
+	Username    string `json:"username,omitempty"`
+	ProjectID   int64  `json:"project_id,omitempty"`
+	ProjectName string `json:"project_name,omitempty"`
+}
+
+// BotToken is a credential a bot signs in with. Only a hash of the token is
+// stored; Prefix is kept so owners can tell their tokens apart.
+type BotToken struct {
+	ID          int64      `json:"id"`
+	BotID       int64      `json:"bot_id"`
+	BotUsername string     `json:"-"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Scopes      []string   `json:"scopes"`
+	CreatedBy   *int64     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// BotProjectGrant lets a bot post to a project it does not belong to.
+type BotProjectGrant struct {
+	ProjectID   int64     `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	GrantedBy   *int64    `json:"granted_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateBot creates a bot account owned by owner.UserID or owner.ProjectID
+// and returns its id. Bots get no login info, so nobody can sign in as one
+// with a password.
+func CreateBot(user *ApiUser, owner BotOwner, createdBy *int64, now time.Time) (int64, error) {
+	var ownerUserID, ownerProjectID interface{}
+	if owner.UserID != 0 {
+		ownerUserID = owner.UserID
+	}
+	if owner.ProjectID != 0 {
+		ownerProjectID = owner.ProjectID
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start bot transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user.IsBot = true
+	id, err := insertUser(tx, user)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO bots (user_id, owner_user_id, owner_project_id, created_by, created_at) VALUES ($1, $2, $3, $4, $5);`,
+		id,
+		ownerUserID,
+		ownerProjectID,
+		createdBy,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create bot: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit bot: %w", err)
+	}
+	return int64(id), nil
+}
+
+// GetBotOwner returns who owns botID, or nil if it is not a bot.
+func GetBotOwner(botID int64) (*BotOwner, error) {
+	var ownerUserID, ownerProjectID sql.NullInt64
+	var username, projectName sql.NullString
+	err := DB.QueryRow(
+		`SELECT b.owner_user_id, u.username, b.owner_project_id, p.name
+		FROM bots b
+		LEFT JOIN users u ON u.id = b.owner_user_id
+		LEFT JOIN projects p ON p.id = b.owner_project_id
+		WHERE b.user_id = $1;`,
+		botID,
+	).Scan(&ownerUserID, &username, &ownerProjectID, &projectName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bot owner: %w", err)
+	}
+	return &BotOwner{
+		UserID:      ownerUserID.Int64,
+		Username:    username.String,
+		ProjectID:   ownerProjectID.Int64,
+		ProjectName: projectName.String,
+	}, nil
+}
+
+// QueryOwnedBots returns the bots owned by the user or project in owner,
+// oldest first.
+func QueryOwnedBots(owner BotOwner) ([]*ApiUser, error) {
+	rows, err := DB.Query(
+		`SELECT u.id, u.username, u.picture, u.bio, u.links, u.settings, u.creation_date, u.is_bot
+		FROM bots b
+		JOIN users u ON u.id = b.user_id
+		WHERE b.owner_user_id = $1 OR b.owner_project_id = $2
+		ORDER BY u.id;`,
+		owner.UserID,
+		owner.ProjectID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bots: %w", err)
+	}
+	defer rows.Close()
+
+	bots := make([]*ApiUser, 0)
+	for rows.Next() {
+		bot, err := scanApiUserRow(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan bot: %w", err)
+		}
+		if bot != nil {
+			bots = append(bots, bot)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("bot rows error: %w", err)
+	}
+	return bots, nil
+}
+
+// CanManageBot reports whether userID owns botID, or owns the project that
+// does.
+func CanManageBot(botID int64, userID int64) (bool, error) {
+	var count int
+	err := DB.QueryRow(
+		`SELECT COUNT(*) FROM bots b
+		LEFT JOIN projects p ON p.id = b.owner_project_id
+		WHERE b.user_id = $1 AND (b.owner_user_id = $2 OR p.owner = $2);`,
+		botID,
+		userID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check bot owner: %w", err)
+	}
+	return count > 0, nil
+}
+
+// IsBotAllowedInProject reports whether botID may post to projectID: bots
+// may post to the project that owns them and to projects that granted them.
+func IsBotAllowedInProject(botID int64, projectID int64) (bool, error) {
+	var count int
+	err := DB.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM bots WHERE user_id = $1 AND owner_project_id = $2)
+			+ (SELECT COUNT(*) FROM botprojects WHERE bot_id = $1 AND project_id = $2);`,
+		botID,
+		projectID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check bot project access: %w", err)
+	}
+	return count > 0, nil
+}
+
+// GrantBotProject lets botID post to projectID and reports whether it could
+// not already.
+func GrantBotProject(botID int64, projectID int64, grantedBy int64, now time.Time) (bool, error) {
+	granted, err := ExecUpdate(
+		`INSERT INTO botprojects (bot_id, project_id, granted_by, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (bot_id, project_id) DO NOTHING;`,
+		botID,
+		projectID,
+		grantedBy,
+		now.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to grant bot project: %w", err)
+	}
+	return granted > 0, nil
+}
+
+// RevokeBotProject takes back a grant and reports whether there was one.
+func RevokeBotProject(botID int64, projectID int64) (bool, error) {
+	revoked, err := ExecUpdate(`DELETE FROM botprojects WHERE bot_id = $1 AND project_id = $2;`, botID, projectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke bot project: %w", err)
+	}
+	return revoked > 0, nil
+}
+
+// QueryBotProjects returns the projects that granted botID, oldest grant
+// first.
+func QueryBotProjects(botID int64) ([]BotProjectGrant, error) {
+	rows, err := DB.Query(
+		`SELECT g.project_id, p.name, g.granted_by, g.created_at
+		FROM botprojects g
+		JOIN projects p ON p.id = g.project_id
+		WHERE g.bot_id = $1
+		ORDER BY g.created_at, g.project_id;`,
+		botID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bot projects: %w", err)
+	}
+	defer rows.Close()
+
+	grants := make([]BotProjectGrant, 0)
+	for rows.Next() {
+		var grant BotProjectGrant
+		var grantedBy sql.NullInt64
+		if err := rows.Scan(&grant.ProjectID, &grant.ProjectName, &grantedBy, &grant.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan bot project: %w", err)
+		}
+		grant.GrantedBy = nullInt64Pointer(grantedBy)
+		grants = append(grants, grant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("bot project rows error: %w", err)
+	}
+	return grants, nil
+}
+
+const botTokenColumns = `t.id, t.bot_id, u.username, t.name, t.token_prefix, t.scopes, t.created_by, t.created_at,
+	t.last_used_at, t.expires_at`
+
+func scanBotToken(row rowScanner) (*BotToken, error) {
+	var token BotToken
+	var scopesJSON string
+	var createdBy sql.NullInt64
+	var lastUsedAt, expiresAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.BotID,
+		&token.BotUsername,
+		&token.Name,
+		&token.Prefix,
+		&scopesJSON,
+		&createdBy,
+		&token.CreatedAt,
+		&lastUsedAt,
+		&expiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = []string{}
+	if err := UnmarshalFromJSON(scopesJSON, &token.Scopes); err != nil {
+		return nil, fmt.Errorf("failed to decode token scopes: %w", err)
+	}
+	token.CreatedBy = nullInt64Pointer(createdBy)
+	token.LastUsedAt = nullTimePointer(lastUsedAt)
+	token.ExpiresAt = nullTimePointer(expiresAt)
+	return &token, nil
+}
+
+// CreateBotToken stores a token for token.BotID under hash and returns its
+// id.
+func CreateBotToken(token BotToken, hash string, now time.Time) (int64, error) {
+	scopesJSON, err := MarshalToJSON(token.Scopes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode token scopes: %w", err)
+	}
+	var expiresAt interface{}
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+	var id int64
+	err = DB.QueryRow(
+		`INSERT INTO bottokens (bot_id, name, token_hash, token_prefix, scopes, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;`,
+		token.BotID,
+		token.Name,
+		hash,
+		token.Prefix,
+		scopesJSON,
+		token.CreatedBy,
+		now.UTC(),
+		expiresAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create bot token: %w", err)
+	}
+	return id, nil
+}
+
+// QueryBotTokens returns botID's tokens, oldest first.
+func QueryBotTokens(botID int64) ([]BotToken, error) {
+	rows, err := DB.Query(
+		`SELECT `+botTokenColumns+` FROM bottokens t JOIN users u ON u.id = t.bot_id WHERE t.bot_id = $1 ORDER BY t.id;`,
+		botID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bot tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]BotToken, 0)
+	for rows.Next() {
+		token, err := scanBotToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan bot token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("bot token rows error: %w", err)
+	}
+	return tokens, nil
+}
+
+// GetBotTokenByHash returns the token stored under hash.
+func GetBotTokenByHash(hash string) (*BotToken, error) {
+	token, err := scanBotToken(DB.QueryRow(
+		`SELECT `+botTokenColumns+` FROM bottokens t JOIN users u ON u.id = t.bot_id WHERE t.token_hash = $1;`,
+		hash,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bot token: %w", err)
+	}
+	return token, nil
+}
+
+// DeleteBotToken revokes tokenID and reports whether it belonged to botID.
+func DeleteBotToken(botID int64, tokenID int64) (bool, error) {
+	deleted, err := ExecUpdate(`DELETE FROM bottokens WHERE id = $1 AND bot_id = $2;`, tokenID, botID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete bot token: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// TouchBotToken records that tokenID was used at now. It writes at most
+// once a minute per token, so busy bots do not write on every request.
+func TouchBotToken(tokenID int64, now time.Time) error {
+	_, err := DB.Exec(
+		`UPDATE bottokens SET last_used_at = $1 WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3);`,
+		now.UTC(),
+		tokenID,
+		now.Add(-time.Minute).UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to touch bot token: %w", err)
+	}
+	return nil
+}
+
+// deleteOwnedBots deletes the bots whose ids botIDs, a subquery over arg,
+// selects. Comments left on their posts go too, as they would for a person.
+func deleteOwnedBots(tx *sql.Tx, botIDs string, arg interface{}) error {
+	_, err := tx.Exec(
+		`DELETE FROM comments WHERE id IN (
+			SELECT pc.comment_id
+			FROM postcomments pc
+			JOIN posts p ON p.id = pc.post_id
+			WHERE p.user_id IN (`+botIDs+`)
+		);`,
+		arg,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete comments on bot posts: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id IN (`+botIDs+`);`, arg); err != nil {
+		return fmt.Errorf("failed to delete owned bots: %w", err)
+	}
+	return nil
+}
@@ -47,6 +47,7 @@ type Comment struct {
 	CreationDate  time.Time     `json:"created_on"`
 	Content       string        `json:"content" binding:"required"`
 	Media         []string      `json:"media"`
+	Mentions      []Mention     `json:"mentions,omitempty"`
 }
 
 // QueryComment retrieves a comment by its ID from the database.
@@ -83,6 +84,12 @@ func QueryComment(id int) (*Comment, error) {
 		return nil, err
 	}
 
+	mentions, err := queryMentions(MentionInComment, []int64{comment.ID})
+	if err != nil {
+		return nil, err
+	}
+	comment.Mentions = mentions[comment.ID]
+
 	return &comment, nil
 }
 
@@ -171,6 +178,9 @@ func QueryCommentsByUserId(userId int) ([]Comment, int, error) {
 	}
 
 	comments := append(projComments, postComments...)
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return comments, http.StatusOK, nil
 }
 
@@ -227,6 +237,9 @@ func QueryCommentsByProjectId(id int) ([]Comment, int, error) {
 		}
 		comments = append(comments, comment)
 	}
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return comments, http.StatusOK, nil
 }
 
@@ -283,6 +296,9 @@ func QueryCommentsByPostId(id int) ([]Comment, int, error) {
 		}
 		comments = append(comments, comment)
 	}
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return comments, http.StatusOK, nil
 }
 
@@ -338,6 +354,9 @@ func QueryCommentsByCommentId(id int) ([]Comment, int, error) {
 		}
 		comments = append(comments, comment)
 	}
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return comments, http.StatusOK, nil
 }
 
@@ -577,6 +596,9 @@ func QueryCommentsByFilter(filter string) ([]Comment, error) {
 		comments = append(comments, comment)
 	}
 
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, err
+	}
 	return comments, nil
 }
 
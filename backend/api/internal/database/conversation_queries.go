@@ -0,0 +1,576 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Participant roles in a group conversation. Owners and admins manage the
+// participant list and title; there is always exactly one owner.
+const (
+	ConversationRoleOwner  = "owner"
+	ConversationRoleAdmin  = "admin"
+	ConversationRoleMember = "member"
+)
+
+type Conversation struct {
+	ID           int64                     `json:"id"`
+	Title        string                    `json:"title"`
+	ProjectID    *int64                    `json:"project_id"`
+	CreatedBy    *int64                    `json:"created_by"`
+	CreatedAt    time.Time                 `json:"created_at"`
+	Participants []ConversationParticipant `json:"participants"`
+}
+
+type ConversationParticipant struct {
+	UserID            int64     `json:"user_id"`
+	Username          string    `json:"username"`
+	Role              string    `json:"role"`
+	JoinedAt          time.Time `json:"joined_at"`
+	LastReadMessageID int64     `json:"last_read_message_id"`
+}
+
+type ConversationMessage struct {
+	ID             int64      `json:"id"`
+	ConversationID int64      `json:"conversation_id"`
+	SenderID       int64      `json:"sender_id"`
+	SenderName     string     `json:"sender_name"`
+	Content        string     `json:"content"`
+	Media          []string   `json:"media"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EditedAt       *time.Time `json:"edited_at"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+}
+
+// ConversationThread is the inbox entry for a group conversation.
+type ConversationThread struct {
+	ConversationID int64      `json:"conversation_id"`
+	Title          string     `json:"title"`
+	ProjectID      *int64     `json:"project_id"`
+	Role           string     `json:"role"`
+	LastSender     string     `json:"last_sender"`
+	LastContent    string     `json:"last_content"`
+	LastMedia      []string   `json:"last_media"`
+	LastAt         *time.Time `json:"last_at"`
+	UnreadCount    int        `json:"unread_count"`
+}
+
+func nullInt64Pointer(value sql.NullInt64) *int64 {
+	if !value.Valid {
+		return nil
+	}
+	result := value.Int64
+	return &result
+}
+
+// CreateConversation creates a conversation owned by createdBy with the given
+// members. projectID links it to a project; pass nil for ad-hoc groups.
+func CreateConversation(title string, projectID *int64, createdBy int64, memberIDs []int64) (*Conversation, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start conversation transaction: %w", err)
+	}
+
+	rollback := func(original error) error {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", original, rollbackErr)
+		}
+		return original
+	}
+
+	createdAt := time.Now().UTC()
+	var conversationID int64
+	err = tx.QueryRow(
+		`INSERT INTO conversations (title, project_id, created_by, created_at) VALUES ($1, $2, $3, $4) RETURNING id;`,
+		title,
+		projectID,
+		createdBy,
+		createdAt,
+	).Scan(&conversationID)
+	if err != nil {
+		return nil, rollback(fmt.Errorf("failed to create conversation: %w", err))
+	}
+
+	insertParticipant := `INSERT INTO conversationparticipants (conversation_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (conversation_id, user_id) DO NOTHING;`
+	if _, err := tx.Exec(insertParticipant, conversationID, createdBy, ConversationRoleOwner, createdAt); err != nil {
+		return nil, rollback(fmt.Errorf("failed to add conversation owner: %w", err))
+	}
+	for _, memberID := range memberIDs {
+		if _, err := tx.Exec(insertParticipant, conversationID, memberID, ConversationRoleMember, createdAt); err != nil {
+			return nil, rollback(fmt.Errorf("failed to add conversation participant: %w", err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit conversation: %w", err)
+	}
+
+	return GetConversation(conversationID)
+}
+
+// GetConversation returns a conversation with its participants, or nil if it
+// does not exist.
+func GetConversation(conversationID int64) (*Conversation, error) {
+	var conversation Conversation
+	var title sql.NullString
+	var projectID, createdBy sql.NullInt64
+	err := DB.QueryRow(
+		`SELECT id, title, project_id, created_by, created_at FROM conversations WHERE id = $1;`,
+		conversationID,
+	).Scan(&conversation.ID, &title, &projectID, &createdBy, &conversation.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch conversation: %w", err)
+	}
+	conversation.Title = title.String
+	conversation.ProjectID = nullInt64Pointer(projectID)
+	conversation.CreatedBy = nullInt64Pointer(createdBy)
+
+	participants, err := QueryConversationParticipants(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	conversation.Participants = participants
+	return &conversation, nil
+}
+
+// GetConversationIDForProject returns the id of a project's conversation, or
+// 0 if the project has none yet.
+func GetConversationIDForProject(projectID int64) (int64, error) {
+	var conversationID int64
+	err := DB.QueryRow(`SELECT id FROM conversations WHERE project_id = $1;`, projectID).Scan(&conversationID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to fetch project conversation: %w", err)
+	}
+	return conversationID, nil
+}
+
+func QueryConversationParticipants(conversationID int64) ([]ConversationParticipant, error) {
+	query := `SELECT cp.user_id, u.username, cp.role, cp.joined_at, cp.last_read_message_id
+	FROM conversationparticipants cp
+	JOIN users u ON u.id = cp.user_id
+	WHERE cp.conversation_id = $1
+	ORDER BY cp.joined_at ASC, u.username ASC;`
+
+	rows, err := DB.Query(query, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation participants: %w", err)
+	}
+	defer rows.Close()
+
+	participants := make([]ConversationParticipant, 0)
+	for rows.Next() {
+		var participant ConversationParticipant
+		if err := rows.Scan(&participant.UserID, &participant.Username, &participant.Role, &participant.JoinedAt, &participant.LastReadMessageID); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation participant: %w", err)
+		}
+		participants = append(participants, participant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("conversation participant rows error: %w", err)
+	}
+	return participants, nil
+}
+
+// GetConversationParticipant returns the user's membership, or nil if they
+// are not in the conversation.
+func GetConversationParticipant(conversationID int64, userID int64) (*ConversationParticipant, error) {
+	query := `SELECT cp.user_id, u.username, cp.role, cp.joined_at, cp.last_read_message_id
+	FROM conversationparticipants cp
+	JOIN users u ON u.id = cp.user_id
+	WHERE cp.conversation_id = $1 AND cp.user_id = $2;`
+
+	var participant ConversationParticipant
+	err := DB.QueryRow(query, conversationID, userID).Scan(
+		&participant.UserID,
+		&participant.Username,
+		&participant.Role,
+		&participant.JoinedAt,
+		&participant.LastReadMessageID,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch conversation participant: %w", err)
+	}
+	return &participant, nil
+}
+
+// AddConversationParticipant adds a user to a conversation. It returns false
+// when the user was already a participant.
+func AddConversationParticipant(conversationID int64, userID int64, role string) (bool, error) {
+	added, err := ExecUpdate(
+		`INSERT INTO conversationparticipants (conversation_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (conversation_id, user_id) DO NOTHING;`,
+		conversationID,
+		userID,
+		role,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to add conversation participant: %w", err)
+	}
+	return added > 0, nil
+}
+
+func RemoveConversationParticipant(conversationID int64, userID int64) (bool, error) {
+	removed, err := ExecUpdate(
+		`DELETE FROM conversationparticipants WHERE conversation_id = $1 AND user_id = $2;`,
+		conversationID,
+		userID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove conversation participant: %w", err)
+	}
+	return removed > 0, nil
+}
+
+func SetConversationParticipantRole(conversationID int64, userID int64, role string) error {
+	_, err := DB.Exec(
+		`UPDATE conversationparticipants SET role = $1 WHERE conversation_id = $2 AND user_id = $3;`,
+		role,
+		conversationID,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation role: %w", err)
+	}
+	return nil
+}
+
+func UpdateConversationTitle(conversationID int64, title string) error {
+	if _, err := DB.Exec(`UPDATE conversations SET title = $1 WHERE id = $2;`, title, conversationID); err != nil {
+		return fmt.Errorf("failed to update conversation title: %w", err)
+	}
+	return nil
+}
+
+func DeleteConversation(conversationID int64) error {
+	if _, err := DB.Exec(`DELETE FROM conversations WHERE id = $1;`, conversationID); err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	return nil
+}
+
+// CreateConversationMessage stores a message and attaches the sender's
+// privateMedia to it. Nothing is stored if any attachment fails.
+func CreateConversationMessage(conversationID int64, senderID int64, content string, media []string, privateMedia []string) (*ConversationMessage, error) {
+	if media == nil {
+		media = []string{}
+	}
+	mediaJSON, err := MarshalToJSON(media)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message media: %w", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	createdAt := time.Now().UTC()
+	var messageID int64
+	err = tx.QueryRow(
+		`INSERT INTO conversationmessages (conversation_id, sender_id, content, media, creation_date) VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		conversationID,
+		senderID,
+		content,
+		mediaJSON,
+		createdAt,
+	).Scan(&messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert conversation message: %w", err)
+	}
+	if err := attachPrivateMedia(tx, privateMedia, senderID, "conversation_message", messageID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit conversation message: %w", err)
+	}
+
+	sender, err := GetUserById(int(senderID))
+	if err != nil || sender == nil {
+		return nil, fmt.Errorf("failed to resolve sender username: %w", err)
+	}
+
+	return &ConversationMessage{
+		ID:             messageID,
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		SenderName:     sender.Username,
+		Content:        content,
+		Media:          media,
+		CreatedAt:      createdAt,
+	}, nil
+}
+
+// conversationMessageColumns is the select list read by
+// scanConversationMessage. It expects the message as m and its sender as u.
+const conversationMessageColumns = `m.id, m.conversation_id, m.sender_id, u.username, m.content, COALESCE(m.media, '[]'),
+		m.creation_date, m.edited_at, m.deleted_at`
+
+func scanConversationMessage(row rowScanner) (*ConversationMessage, error) {
+	var message ConversationMessage
+	var mediaJSON string
+	var editedAt, deletedAt sql.NullTime
+	if err := row.Scan(
+		&message.ID,
+		&message.ConversationID,
+		&message.SenderID,
+		&message.SenderName,
+		&message.Content,
+		&mediaJSON,
+		&message.CreatedAt,
+		&editedAt,
+		&deletedAt,
+	); err != nil {
+		return nil, err
+	}
+	if err := UnmarshalFromJSON(mediaJSON, &message.Media); err != nil {
+		return nil, fmt.Errorf("failed to decode conversation message media: %w", err)
+	}
+	message.EditedAt = nullTimePointer(editedAt)
+	message.DeletedAt = nullTimePointer(deletedAt)
+	return &message, nil
+}
+
+func QueryConversationMessages(conversationID int64, start int, count int) ([]ConversationMessage, int, error) {
+	if start < 0 || count <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid pagination params")
+	}
+
+	query := `SELECT ` + conversationMessageColumns + `
+	FROM conversationmessages m
+	JOIN users u ON u.id = m.sender_id
+	WHERE m.conversation_id = $1
+	ORDER BY m.creation_date ASC, m.id ASC
+	LIMIT $2 OFFSET $3;`
+
+	rows, err := DB.Query(query, conversationID, count, start)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to query conversation messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]ConversationMessage, 0)
+	for rows.Next() {
+		message, err := scanConversationMessage(rows)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to scan conversation message: %w", err)
+		}
+		messages = append(messages, *message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("conversation message rows error: %w", err)
+	}
+	return messages, http.StatusOK, nil
+}
+
+// MarkConversationRead moves the user's read pointer forward to upToID, or to
+// the latest message when upToID is 0. The pointer never moves backwards.
+// It returns the resulting pointer and, if it moved, when.
+func MarkConversationRead(conversationID int64, userID int64, upToID int64) (int64, *time.Time, error) {
+	if upToID <= 0 {
+		var latest sql.NullInt64
+		if err := DB.QueryRow(`SELECT MAX(id) FROM conversationmessages WHERE conversation_id = $1;`, conversationID).Scan(&latest); err != nil {
+			return 0, nil, fmt.Errorf("failed to find latest conversation message: %w", err)
+		}
+		upToID = latest.Int64
+	}
+
+	readAt := time.Now().UTC()
+	updated, err := ExecUpdate(
+		`UPDATE conversationparticipants SET last_read_message_id = $1, last_read_at = $2
+		WHERE conversation_id = $3 AND user_id = $4 AND last_read_message_id < $5;`,
+		upToID,
+		readAt,
+		conversationID,
+		userID,
+		upToID,
+	)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to mark conversation read: %w", err)
+	}
+
+	participant, err := GetConversationParticipant(conversationID, userID)
+	if err != nil || participant == nil {
+		return 0, nil, err
+	}
+	if updated == 0 {
+		return participant.LastReadMessageID, nil, nil
+	}
+	return participant.LastReadMessageID, &readAt, nil
+}
+
+// QueryConversationMessagesSince returns up to limit messages with an id
+// above afterID from the group conversations userID is in, oldest first. It
+// is used to replay what a client missed while disconnected.
+func QueryConversationMessagesSince(userID int64, afterID int64, limit int) ([]ConversationMessage, error) {
+	query := `SELECT ` + conversationMessageColumns + `
+	FROM conversationmessages m
+	JOIN users u ON u.id = m.sender_id
+	JOIN conversationparticipants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = $1
+	WHERE m.id > $2
+	ORDER BY m.id ASC
+	LIMIT $3;`
+
+	rows, err := DB.Query(query, userID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query missed conversation messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]ConversationMessage, 0)
+	for rows.Next() {
+		message, err := scanConversationMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan conversation message: %w", err)
+		}
+		messages = append(messages, *message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("conversation message rows error: %w", err)
+	}
+	return messages, nil
+}
+
+// ConversationReadPosition is how far one participant has read.
+type ConversationReadPosition struct {
+	ConversationID    int64
+	Username          string
+	LastReadMessageID int64
+	LastReadAt        time.Time
+}
+
+// QueryConversationReadsSince returns up to limit read pointers that moved
+// after since in the group conversations userID is in, oldest first.
+func QueryConversationReadsSince(userID int64, since time.Time, limit int) ([]ConversationReadPosition, error) {
+	query := `SELECT cp.conversation_id, u.username, cp.last_read_message_id, cp.last_read_at
+	FROM conversationparticipants cp
+	JOIN users u ON u.id = cp.user_id
+	JOIN conversationparticipants viewer ON viewer.conversation_id = cp.conversation_id AND viewer.user_id = $1
+	WHERE cp.last_read_at > $2
+	ORDER BY cp.last_read_at ASC
+	LIMIT $3;`
+
+	rows, err := DB.Query(query, userID, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation reads: %w", err)
+	}
+	defer rows.Close()
+
+	positions := make([]ConversationReadPosition, 0)
+	for rows.Next() {
+		var position ConversationReadPosition
+		if err := rows.Scan(&position.ConversationID, &position.Username, &position.LastReadMessageID, &position.LastReadAt); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation read: %w", err)
+		}
+		positions = append(positions, position)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("conversation read rows error: %w", err)
+	}
+	return positions, nil
+}
+
+// QueryConversationThreads lists the user's group conversations, most recently
+// active first, with a preview of the latest message and their unread count.
+func QueryConversationThreads(userID int64, start int, count int) ([]ConversationThread, int, error) {
+	if start < 0 || count <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid pagination params")
+	}
+
+	query := `SELECT c.id, COALESCE(c.title, ''), c.project_id, cp.role,
+		COALESCE(su.username, ''), COALESCE(lm.content, ''), COALESCE(lm.media, '[]'), lm.creation_date,
+		(SELECT COUNT(*) FROM conversationmessages unread
+		 WHERE unread.conversation_id = c.id AND unread.id > cp.last_read_message_id
+		   AND unread.sender_id <> $1 AND unread.deleted_at IS NULL)
+	FROM conversationparticipants cp
+	JOIN conversations c ON c.id = cp.conversation_id
+	LEFT JOIN conversationmessages lm ON lm.id = (
+		SELECT MAX(latest.id) FROM conversationmessages latest WHERE latest.conversation_id = c.id
+	)
+	LEFT JOIN users su ON su.id = lm.sender_id
+	WHERE cp.user_id = $1
+	ORDER BY COALESCE(lm.creation_date, c.created_at) DESC, c.id DESC
+	LIMIT $2 OFFSET $3;`
+
+	rows, err := DB.Query(query, userID, count, start)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	threads := make([]ConversationThread, 0)
+	for rows.Next() {
+		var thread ConversationThread
+		var projectID sql.NullInt64
+		var mediaJSON string
+		var lastAt sql.NullTime
+		if err := rows.Scan(
+			&thread.ConversationID,
+			&thread.Title,
+			&projectID,
+			&thread.Role,
+			&thread.LastSender,
+			&thread.LastContent,
+			&mediaJSON,
+			&lastAt,
+			&thread.UnreadCount,
+		); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		if err := UnmarshalFromJSON(mediaJSON, &thread.LastMedia); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to decode conversation media: %w", err)
+		}
+		thread.ProjectID = nullInt64Pointer(projectID)
+		thread.LastAt = nullTimePointer(lastAt)
+		threads = append(threads, thread)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("conversation rows error: %w", err)
+	}
+	return threads, http.StatusOK, nil
+}
+
+// QueryConversationUnreadTotal counts unread group messages across all of the
+// user's conversations.
+func QueryConversationUnreadTotal(userID int64) (int, error) {
+	query := `SELECT COUNT(*)
+	FROM conversationmessages m
+	JOIN conversationparticipants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = $1
+	WHERE m.id > cp.last_read_message_id AND m.sender_id <> $1 AND m.deleted_at IS NULL;`
+
+	var count int
+	if err := DB.QueryRow(query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count unread conversation messages: %w", err)
+	}
+	return count, nil
+}
+
+// QueryConversationMessageParticipants returns the conversation and sender of
+// a group message, for private media access checks.
+func QueryConversationMessageParticipants(messageID int64) (int64, int64, bool, error) {
+	var conversationID, senderID int64
+	err := DB.QueryRow(
+		`SELECT conversation_id, sender_id FROM conversationmessages WHERE id = $1;`,
+		messageID,
+	).Scan(&conversationID, &senderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, fmt.Errorf("failed to fetch conversation message: %w", err)
+	}
+	return conversationID, senderID, true, nil
+}
@@ -13,7 +13,9 @@ CREATE TABLE IF NOT EXISTS users (
     bio TEXT,
     links JSON,
     settings JSON,
-    creation_date TIMESTAMP NOT NULL
+    creation_date TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP,
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 -- Projects Table
@@ -149,8 +151,11 @@ CREATE TABLE IF NOT EXISTS directmessages (
     sender_id INTEGER NOT NULL,
     recipient_id INTEGER NOT NULL,
     content TEXT NOT NULL,
+    media JSON,
     creation_date TIMESTAMP NOT NULL,
     read_at TIMESTAMP,
+    edited_at TIMESTAMP,
+    deleted_at TIMESTAMP,
     FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (recipient_id) REFERENCES users(id) ON DELETE CASCADE
 );
@@ -166,6 +171,8 @@ CREATE TABLE IF NOT EXISTS notifications (
     comment_id INTEGER,
     created_at TIMESTAMP NOT NULL,
     read_at TIMESTAMP,
+    group_id INTEGER,
+    conversation_id INTEGER,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
@@ -205,6 +212,305 @@ CREATE TABLE IF NOT EXISTS userbans (
     FOREIGN KEY (banned_by) REFERENCES users(id) ON DELETE SET NULL
 );
 
+-- Managed Uploads (per-user storage accounting)
+CREATE TABLE IF NOT EXISTS mediauploads (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    filename TEXT UNIQUE NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Per-user storage limit overrides (set by admins)
+CREATE TABLE IF NOT EXISTS userstoragelimits (
+    user_id INTEGER PRIMARY KEY,
+    quota_bytes BIGINT,
+    uploads_per_hour INTEGER,
+    updated_at TIMESTAMP NOT NULL,
+    updated_by INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (updated_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Resumable Upload Sessions
+CREATE TABLE IF NOT EXISTS uploadsessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    filename TEXT NOT NULL,
+    content_type TEXT,
+    total_bytes BIGINT NOT NULL,
+    offset_bytes BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Private Media (served only through signed URLs)
+CREATE TABLE IF NOT EXISTS privatemedia (
+    filename TEXT PRIMARY KEY,
+    owner_id INTEGER NOT NULL,
+    resource_type VARCHAR(32) NOT NULL,
+    resource_id INTEGER NOT NULL,
+    content_type TEXT,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Group Conversations
+CREATE TABLE IF NOT EXISTS conversations (
+    id SERIAL PRIMARY KEY,
+    title TEXT,
+    project_id INTEGER UNIQUE,
+    created_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS conversationparticipants (
+    conversation_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'member',
+    joined_at TIMESTAMP NOT NULL,
+    last_read_message_id INTEGER NOT NULL DEFAULT 0,
+    last_read_at TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id),
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS conversationmessages (
+    id SERIAL PRIMARY KEY,
+    conversation_id INTEGER NOT NULL,
+    sender_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    media JSON,
+    creation_date TIMESTAMP NOT NULL,
+    edited_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS realtimepayloads (
+    id SERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS userpresence (
+    node_id VARCHAR(32) NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    seen_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (node_id, username)
+);
+
+CREATE TABLE IF NOT EXISTS userblocks (
+    blocker_id INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS usermutes (
+    muter_id INTEGER NOT NULL,
+    muted_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (muter_id, muted_id),
+    FOREIGN KEY (muter_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (muted_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notificationpreferences (
+    user_id INTEGER NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    in_app BOOLEAN NOT NULL DEFAULT TRUE,
+    push BOOLEAN NOT NULL DEFAULT TRUE,
+    email BOOLEAN NOT NULL DEFAULT TRUE,
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notificationquiethours (
+    user_id INTEGER PRIMARY KEY,
+    start_time VARCHAR(5) NOT NULL,
+    end_time VARCHAR(5) NOT NULL,
+    time_zone TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS scheduledpushes (
+    id SERIAL PRIMARY KEY,
+    notification_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    deliver_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (notification_id) REFERENCES notifications(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notificationgrouppushes (
+    group_id INTEGER PRIMARY KEY,
+    pushed_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS mentions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    post_id INTEGER,
+    project_id INTEGER,
+    comment_id INTEGER,
+    span_start INTEGER NOT NULL,
+    span_length INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS pushqueue (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token TEXT NOT NULL,
+    platform TEXT NOT NULL,
+    message TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT,
+    receipt_id TEXT,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS emaildigests (
+    user_id INTEGER PRIMARY KEY,
+    email TEXT,
+    pending_email TEXT,
+    frequency VARCHAR(16) NOT NULL DEFAULT 'off',
+    last_sent_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS projectwebhooks (
+    id SERIAL PRIMARY KEY,
+    project_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events JSON NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMP,
+    created_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhookdeliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    response_code INTEGER,
+    response_body TEXT,
+    last_error TEXT,
+    duration_ms INTEGER,
+    redelivery_of INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP,
+    FOREIGN KEY (webhook_id) REFERENCES projectwebhooks(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS projectbots (
+    project_id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL UNIQUE,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS inboundwebhooks (
+    id SERIAL PRIMARY KEY,
+    project_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    hook_key VARCHAR(64) UNIQUE NOT NULL,
+    secret TEXT NOT NULL,
+    templates JSON,
+    posts_per_hour INTEGER NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    last_received_at TIMESTAMP,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS inboundwebhookevents (
+    id SERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    source VARCHAR(16) NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    post_id INTEGER,
+    detail TEXT,
+    received_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (webhook_id) REFERENCES inboundwebhooks(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS inboundwebhookdeliveries (
+    webhook_id INTEGER NOT NULL,
+    delivery_id VARCHAR(100) NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (webhook_id, delivery_id),
+    FOREIGN KEY (webhook_id) REFERENCES inboundwebhooks(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS bots (
+    user_id INTEGER PRIMARY KEY,
+    owner_user_id INTEGER,
+    owner_project_id INTEGER,
+    created_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (owner_user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (owner_project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS bottokens (
+    id SERIAL PRIMARY KEY,
+    bot_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    token_prefix VARCHAR(16) NOT NULL,
+    scopes JSON NOT NULL,
+    created_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    FOREIGN KEY (bot_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS botprojects (
+    bot_id INTEGER NOT NULL,
+    project_id INTEGER NOT NULL,
+    granted_by INTEGER,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (bot_id, project_id),
+    FOREIGN KEY (bot_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
 -- Indexes for performance
 CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
 CREATE INDEX IF NOT EXISTS idx_projects_owner ON projects(owner);
@@ -233,3 +539,27 @@ CREATE INDEX IF NOT EXISTS idx_userpushtokens_user_id ON userpushtokens(user_id)
 CREATE INDEX IF NOT EXISTS idx_adminusers_user_id ON adminusers(user_id);
 CREATE INDEX IF NOT EXISTS idx_userbans_user_id ON userbans(user_id);
 CREATE INDEX IF NOT EXISTS idx_userbans_user_active ON userbans(user_id, lifted_at, banned_until);
+CREATE INDEX IF NOT EXISTS idx_mediauploads_user_created ON mediauploads(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_uploadsessions_expires_at ON uploadsessions(expires_at);
+CREATE INDEX IF NOT EXISTS idx_privatemedia_resource ON privatemedia(resource_type, resource_id);
+CREATE INDEX IF NOT EXISTS idx_conversationparticipants_user ON conversationparticipants(user_id);
+CREATE INDEX IF NOT EXISTS idx_conversationmessages_conversation ON conversationmessages(conversation_id, id);
+CREATE INDEX IF NOT EXISTS idx_realtimepayloads_created_at ON realtimepayloads(created_at);
+CREATE INDEX IF NOT EXISTS idx_userpresence_username ON userpresence(username, seen_at);
+CREATE INDEX IF NOT EXISTS idx_userblocks_blocked ON userblocks(blocked_id);
+CREATE INDEX IF NOT EXISTS idx_scheduledpushes_deliver_at ON scheduledpushes(deliver_at);
+CREATE INDEX IF NOT EXISTS idx_mentions_post ON mentions(post_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_project ON mentions(project_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_comment ON mentions(comment_id);
+CREATE INDEX IF NOT EXISTS idx_pushqueue_due ON pushqueue(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_pushqueue_receipts ON pushqueue(receipt_id, sent_at);
+CREATE INDEX IF NOT EXISTS idx_emaildigests_due ON emaildigests(frequency, last_sent_at);
+CREATE INDEX IF NOT EXISTS idx_projectwebhooks_project ON projectwebhooks(project_id);
+CREATE INDEX IF NOT EXISTS idx_webhookdeliveries_due ON webhookdeliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhookdeliveries_webhook ON webhookdeliveries(webhook_id, id);
+CREATE INDEX IF NOT EXISTS idx_inboundwebhooks_project ON inboundwebhooks(project_id);
+CREATE INDEX IF NOT EXISTS idx_inboundwebhookevents_webhook ON inboundwebhookevents(webhook_id, status, received_at);
+CREATE INDEX IF NOT EXISTS idx_bots_owner_user ON bots(owner_user_id);
+CREATE INDEX IF NOT EXISTS idx_bots_owner_project ON bots(owner_project_id);
+CREATE INDEX IF NOT EXISTS idx_bottokens_bot ON bottokens(bot_id);
+CREATE INDEX IF NOT EXISTS idx_botprojects_project ON botprojects(project_id);
@@ -18,6 +18,16 @@ var DB *sql.DB // Global database instance
 // driverName stores the active database driver ("postgres" or "sqlite").
 var driverName string
 
+// connectionDSN is the DSN Connect opened, kept for clients that need their
+// own connection, such as LISTEN/NOTIFY listeners.
+var connectionDSN string
+
+// PostgresDSN returns the connection string in use when the active driver is
+// postgres.
+func PostgresDSN() (string, bool) {
+	return connectionDSN, driverName == "postgres"
+}
+
 func resolveSqlitePath() string {
 	candidates := []string{
 		filepath.Join(".", "api", "internal", "database", "dev.sqlite3"),
@@ -76,10 +86,14 @@ func Connect() {
 		if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
 			log.Fatalf("Failed to create sqlite directory: %v", err)
 		}
-		dsn = dbPath
+		// PRAGMAs run through DB.Exec only reach one pooled connection; the
+		// busy timeout must hold on all of them, as background jobs write
+		// alongside requests.
+		dsn = dbPath + "?_pragma=busy_timeout(5000)"
 	}
 
 	DB, err = sql.Open(driverName, dsn)
+	connectionDSN = dsn
 	if err != nil {
 		log.Fatalf("Failed to open database connection: %v", err)
 	}
@@ -131,13 +145,41 @@ func Connect() {
 	log.Printf("Database connected successfully using %s driver", driverName)
 }
 
+// addedColumns lists columns introduced after their table was first created.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so these are added
+// on startup when missing.
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"directmessages", "media", "JSON"},
+	{"users", "last_seen_at", "TIMESTAMP"},
+	{"directmessages", "edited_at", "TIMESTAMP"},
+	{"directmessages", "deleted_at", "TIMESTAMP"},
+	{"notifications", "group_id", "INTEGER"},
+	{"users", "is_bot", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"conversationparticipants", "last_read_at", "TIMESTAMP"},
+	{"notifications", "conversation_id", "INTEGER"},
+	{"emaildigests", "pending_email", "TEXT"},
+}
+
 func ensurePostgresSchema() error {
 	if err := execSqlFile("create_tables.sql"); err != nil {
 		return err
 	}
+	for _, added := range addedColumns {
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;", added.table, added.column, added.definition)
+		if _, err := DB.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", added.table, added.column, err)
+		}
+	}
 	if err := ensureDirectMessageIntegrityForPostgres(); err != nil {
 		return err
 	}
+	if err := ensureProjectBotAccounts(); err != nil {
+		return err
+	}
 	log.Println("PostgreSQL schema ensured successfully.")
 	return nil
 }
@@ -148,6 +190,38 @@ func ensureSqliteSchema() error {
 	if err := execSqlFile("create_tables.sql"); err != nil {
 		return err
 	}
+	for _, added := range addedColumns {
+		var exists int
+		if err := DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2;`, added.table, added.column).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to inspect column %s.%s: %w", added.table, added.column, err)
+		}
+		if exists > 0 {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", added.table, added.column, added.definition)
+		if _, err := DB.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", added.table, added.column, err)
+		}
+	}
+	return ensureProjectBotAccounts()
+}
+
+// ensureProjectBotAccounts turns project bots made before bot accounts
+// existed, which were plain users, into bot accounts owned by their project.
+func ensureProjectBotAccounts() error {
+	_, err := DB.Exec(
+		`INSERT INTO bots (user_id, owner_project_id, created_at)
+		SELECT pb.user_id, pb.project_id, $1 FROM projectbots pb
+		WHERE NOT EXISTS (SELECT 1 FROM bots b WHERE b.user_id = pb.user_id);`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to migrate project bots: %w", err)
+	}
+	_, err = DB.Exec(`UPDATE users SET is_bot = TRUE WHERE is_bot = FALSE AND id IN (SELECT user_id FROM projectbots);`)
+	if err != nil {
+		return fmt.Errorf("failed to migrate project bots: %w", err)
+	}
 	return nil
 }
 
@@ -8,29 +8,96 @@ import (
 )
 
 type DirectMessage struct {
-	ID            int64     `json:"id"`
-	SenderID      int64     `json:"sender_id"`
-	RecipientID   int64     `json:"recipient_id"`
-	SenderName    string    `json:"sender_name"`
-	RecipientName string    `json:"recipient_name"`
-	Content       string    `json:"content"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int64      `json:"id"`
+	SenderID      int64      `json:"sender_id"`
+	RecipientID   int64      `json:"recipient_id"`
+	SenderName    string     `json:"sender_name"`
+	RecipientName string     `json:"recipient_name"`
+	Content       string     `json:"content"`
+	Media         []string   `json:"media"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ReadAt        *time.Time `json:"read_at"`
+	EditedAt      *time.Time `json:"edited_at"`
+	DeletedAt     *time.Time `json:"deleted_at"`
+}
+
+// directMessageColumns is the select list read by scanDirectMessage. It
+// expects the message as dm and its participants as sender and recipient.
+const directMessageColumns = `dm.id,
+		dm.sender_id,
+		dm.recipient_id,
+		sender.username,
+		recipient.username,
+		dm.content,
+		COALESCE(dm.media, '[]'),
+		dm.creation_date,
+		dm.read_at,
+		dm.edited_at,
+		dm.deleted_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDirectMessage(row rowScanner) (*DirectMessage, error) {
+	var message DirectMessage
+	var mediaJSON string
+	var readAt, editedAt, deletedAt sql.NullTime
+	if err := row.Scan(
+		&message.ID,
+		&message.SenderID,
+		&message.RecipientID,
+		&message.SenderName,
+		&message.RecipientName,
+		&message.Content,
+		&mediaJSON,
+		&message.CreatedAt,
+		&readAt,
+		&editedAt,
+		&deletedAt,
+	); err != nil {
+		return nil, err
+	}
+	if err := UnmarshalFromJSON(mediaJSON, &message.Media); err != nil {
+		return nil, fmt.Errorf("failed to decode direct message media: %w", err)
+	}
+	message.ReadAt = nullTimePointer(readAt)
+	message.EditedAt = nullTimePointer(editedAt)
+	message.DeletedAt = nullTimePointer(deletedAt)
+	return &message, nil
+}
+
+func nullTimePointer(value sql.NullTime) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	result := value.Time
+	return &result
 }
 
 type DirectMessageThread struct {
 	PeerUsername string    `json:"peer_username"`
 	PeerPicture  string    `json:"peer_picture"`
 	LastContent  string    `json:"last_content"`
+	LastMedia    []string  `json:"last_media"`
 	LastAt       time.Time `json:"last_at"`
+	UnreadCount  int       `json:"unread_count"`
 }
 
-func QueryCreateDirectMessage(senderUsername string, recipientUsername string, content string) (*DirectMessage, int, error) {
+func QueryCreateDirectMessage(senderUsername string, recipientUsername string, content string, media []string, privateMedia []string) (*DirectMessage, int, error) {
 	if senderUsername == "" || recipientUsername == "" {
 		return nil, http.StatusBadRequest, fmt.Errorf("sender and recipient are required")
 	}
-	if content == "" {
+	if content == "" && len(media) == 0 {
 		return nil, http.StatusBadRequest, fmt.Errorf("message content is required")
 	}
+	if media == nil {
+		media = []string{}
+	}
+	mediaJSON, err := MarshalToJSON(media)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to encode message media: %w", err)
+	}
 
 	senderID, err := GetUserIdByUsername(senderUsername)
 	if err != nil {
@@ -41,18 +108,31 @@ func QueryCreateDirectMessage(senderUsername string, recipientUsername string, c
 		return nil, http.StatusNotFound, fmt.Errorf("recipient '%s' not found", recipientUsername)
 	}
 
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	createdAt := time.Now().UTC()
 	var messageID int64
-	err = DB.QueryRow(
-		`INSERT INTO directmessages (sender_id, recipient_id, content, creation_date) VALUES ($1, $2, $3, $4) RETURNING id;`,
+	err = tx.QueryRow(
+		`INSERT INTO directmessages (sender_id, recipient_id, content, media, creation_date) VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
 		senderID,
 		recipientID,
 		content,
+		mediaJSON,
 		createdAt,
 	).Scan(&messageID)
 	if err != nil {
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to insert direct message: %w", err)
 	}
+	if err := attachPrivateMedia(tx, privateMedia, int64(senderID), "direct_message", messageID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to commit direct message: %w", err)
+	}
 
 	resolvedSender, senderErr := GetUserById(senderID)
 	if senderErr != nil || resolvedSender == nil {
@@ -70,6 +150,7 @@ func QueryCreateDirectMessage(senderUsername string, recipientUsername string, c
 		SenderName:    resolvedSender.Username,
 		RecipientName: resolvedRecipient.Username,
 		Content:       content,
+		Media:         media,
 		CreatedAt:     createdAt,
 	}
 	return message, http.StatusCreated, nil
@@ -93,13 +174,7 @@ func QueryDirectMessages(username string, otherUsername string, start int, count
 	}
 
 	query := `SELECT
-		dm.id,
-		dm.sender_id,
-		dm.recipient_id,
-		sender.username,
-		recipient.username,
-		dm.content,
-		dm.creation_date
+		` + directMessageColumns + `
 	FROM directmessages dm
 	JOIN users sender ON sender.id = dm.sender_id
 	JOIN users recipient ON recipient.id = dm.recipient_id
@@ -116,19 +191,11 @@ func QueryDirectMessages(username string, otherUsername string, start int, count
 
 	messages := make([]DirectMessage, 0)
 	for rows.Next() {
-		var message DirectMessage
-		if err := rows.Scan(
-			&message.ID,
-			&message.SenderID,
-			&message.RecipientID,
-			&message.SenderName,
-			&message.RecipientName,
-			&message.Content,
-			&message.CreatedAt,
-		); err != nil {
+		message, err := scanDirectMessage(rows)
+		if err != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to scan direct message: %w", err)
 		}
-		messages = append(messages, message)
+		messages = append(messages, *message)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, http.StatusInternalServerError, fmt.Errorf("direct message rows error: %w", err)
@@ -137,7 +204,14 @@ func QueryDirectMessages(username string, otherUsername string, start int, count
 	return messages, http.StatusOK, nil
 }
 
-func QueryDirectChatPeers(username string) ([]string, int, error) {
+// DirectChatPeer is someone the user has exchanged messages with. LastSeenAt
+// is when the peer was last connected to the message stream.
+type DirectChatPeer struct {
+	Username   string     `json:"username"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+func QueryDirectChatPeers(username string) ([]DirectChatPeer, int, error) {
 	if username == "" {
 		return nil, http.StatusBadRequest, fmt.Errorf("username is required")
 	}
@@ -147,7 +221,7 @@ func QueryDirectChatPeers(username string) ([]string, int, error) {
 		return nil, http.StatusNotFound, fmt.Errorf("user '%s' not found", username)
 	}
 
-	query := `SELECT DISTINCT u.username
+	query := `SELECT DISTINCT u.username, u.last_seen_at
 	FROM directmessages dm
 	JOIN users u ON u.id = CASE
 		WHEN dm.sender_id = $1 THEN dm.recipient_id
@@ -162,14 +236,20 @@ func QueryDirectChatPeers(username string) ([]string, int, error) {
 	}
 	defer rows.Close()
 
-	peers := make([]string, 0)
+	peers := make([]DirectChatPeer, 0)
 	for rows.Next() {
 		var peer sql.NullString
-		if err := rows.Scan(&peer); err != nil {
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&peer, &lastSeen); err != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to scan chat peer: %w", err)
 		}
 		if peer.Valid && peer.String != "" {
-			peers = append(peers, peer.String)
+			entry := DirectChatPeer{Username: peer.String}
+			if lastSeen.Valid {
+				value := lastSeen.Time
+				entry.LastSeenAt = &value
+			}
+			peers = append(peers, entry)
 		}
 	}
 	if err := rows.Err(); err != nil {
@@ -179,6 +259,92 @@ func QueryDirectChatPeers(username string) ([]string, int, error) {
 	return peers, http.StatusOK, nil
 }
 
+// SharesConversation reports whether the two users have exchanged direct
+// messages or are both in some group conversation.
+func SharesConversation(userID int64, otherID int64) (bool, error) {
+	var shared bool
+	err := DB.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM directmessages
+			WHERE (sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1)
+		) OR EXISTS (
+			SELECT 1 FROM conversationparticipants mine
+			JOIN conversationparticipants theirs ON theirs.conversation_id = mine.conversation_id
+			WHERE mine.user_id = $1 AND theirs.user_id = $2
+		);`,
+		userID,
+		otherID,
+	).Scan(&shared)
+	if err != nil {
+		return false, fmt.Errorf("failed to check shared conversations: %w", err)
+	}
+	return shared, nil
+}
+
+// UpdateUserLastSeen records when the user was last connected.
+func UpdateUserLastSeen(username string, seenAt time.Time) error {
+	if _, err := DB.Exec(`UPDATE users SET last_seen_at = $1 WHERE username = $2;`, seenAt.UTC(), username); err != nil {
+		return fmt.Errorf("failed to update last seen: %w", err)
+	}
+	return nil
+}
+
+// SetUserPresence records that username has a connection open on nodeID.
+func SetUserPresence(nodeID string, username string, seenAt time.Time) error {
+	_, err := DB.Exec(`
+		INSERT INTO userpresence (node_id, username, seen_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (node_id, username) DO UPDATE SET seen_at = EXCLUDED.seen_at;`,
+		nodeID, username, seenAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record presence: %w", err)
+	}
+	return nil
+}
+
+// ClearUserPresence records that username has no connections left on nodeID.
+func ClearUserPresence(nodeID string, username string) error {
+	if _, err := DB.Exec(`DELETE FROM userpresence WHERE node_id = $1 AND username = $2;`, nodeID, username); err != nil {
+		return fmt.Errorf("failed to clear presence: %w", err)
+	}
+	return nil
+}
+
+// ClearNodePresence forgets every connection recorded by nodeID.
+func ClearNodePresence(nodeID string) error {
+	if _, err := DB.Exec(`DELETE FROM userpresence WHERE node_id = $1;`, nodeID); err != nil {
+		return fmt.Errorf("failed to clear node presence: %w", err)
+	}
+	return nil
+}
+
+// IsUserOnlineElsewhere reports whether a node other than nodeID has seen
+// username connected since the given time.
+func IsUserOnlineElsewhere(nodeID string, username string, since time.Time) (bool, error) {
+	var online bool
+	err := DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM userpresence
+			WHERE username = $1 AND node_id <> $2 AND seen_at >= $3
+		);`,
+		username, nodeID, since.UTC(),
+	).Scan(&online)
+	if err != nil {
+		return false, fmt.Errorf("failed to check presence: %w", err)
+	}
+	return online, nil
+}
+
+// PruneUserPresence drops presence rows not refreshed since before, left
+// behind by nodes that stopped without cleaning up.
+func PruneUserPresence(before time.Time) error {
+	if _, err := DB.Exec(`DELETE FROM userpresence WHERE seen_at < $1;`, before.UTC()); err != nil {
+		return fmt.Errorf("failed to prune presence: %w", err)
+	}
+	return nil
+}
+
 func QueryDirectMessageThreads(username string, start int, count int) ([]DirectMessageThread, int, error) {
 	if username == "" {
 		return nil, http.StatusBadRequest, fmt.Errorf("username is required")
@@ -199,6 +365,7 @@ func QueryDirectMessageThreads(username string, start int, count int) ([]DirectM
 				ELSE dm.sender_id
 			END AS peer_id,
 			dm.content,
+			COALESCE(dm.media, '[]') AS media,
 			dm.creation_date,
 			ROW_NUMBER() OVER (
 				PARTITION BY CASE
@@ -210,7 +377,10 @@ func QueryDirectMessageThreads(username string, start int, count int) ([]DirectM
 		FROM directmessages dm
 		WHERE dm.sender_id = $1 OR dm.recipient_id = $1
 	)
-	SELECT u.username, COALESCE(u.picture, ''), rt.content, rt.creation_date
+	SELECT u.username, COALESCE(u.picture, ''), rt.content, rt.media, rt.creation_date,
+		(SELECT COUNT(*) FROM directmessages unread
+		 WHERE unread.sender_id = rt.peer_id AND unread.recipient_id = $1
+		   AND unread.read_at IS NULL AND unread.deleted_at IS NULL)
 	FROM ranked_threads rt
 	JOIN users u ON u.id = rt.peer_id
 	WHERE rt.rank_in_thread = 1
@@ -226,9 +396,13 @@ func QueryDirectMessageThreads(username string, start int, count int) ([]DirectM
 	threads := make([]DirectMessageThread, 0)
 	for rows.Next() {
 		var thread DirectMessageThread
-		if err := rows.Scan(&thread.PeerUsername, &thread.PeerPicture, &thread.LastContent, &thread.LastAt); err != nil {
+		var mediaJSON string
+		if err := rows.Scan(&thread.PeerUsername, &thread.PeerPicture, &thread.LastContent, &mediaJSON, &thread.LastAt, &thread.UnreadCount); err != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("failed to scan direct message thread: %w", err)
 		}
+		if err := UnmarshalFromJSON(mediaJSON, &thread.LastMedia); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to decode direct message thread media: %w", err)
+		}
 		threads = append(threads, thread)
 	}
 	if err := rows.Err(); err != nil {
@@ -237,3 +411,340 @@ func QueryDirectMessageThreads(username string, start int, count int) ([]DirectM
 
 	return threads, http.StatusOK, nil
 }
+
+// QueryDirectMessageParticipants returns the sender and recipient of a direct
+// message. found is false when the message does not exist.
+func QueryDirectMessageParticipants(messageID int64) (senderID int64, recipientID int64, found bool, err error) {
+	err = DB.QueryRow(`SELECT sender_id, recipient_id FROM directmessages WHERE id = $1;`, messageID).Scan(&senderID, &recipientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, fmt.Errorf("failed to fetch direct message participants: %w", err)
+	}
+	return senderID, recipientID, true, nil
+}
+
+// QueryDirectMessagePrivateMedia lists private media attached to any direct
+// message the user sent or received.
+func QueryDirectMessagePrivateMedia(userID int64) ([]string, error) {
+	query := `SELECT pm.filename
+	FROM privatemedia pm
+	JOIN directmessages dm ON dm.id = pm.resource_id
+	WHERE pm.resource_type = 'direct_message'
+	  AND (dm.sender_id = $1 OR dm.recipient_id = $2);`
+
+	rows, err := DB.Query(query, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct message media: %w", err)
+	}
+	defer rows.Close()
+
+	filenames := make([]string, 0)
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, fmt.Errorf("failed to scan direct message media: %w", err)
+		}
+		filenames = append(filenames, filename)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("direct message media rows error: %w", err)
+	}
+	return filenames, nil
+}
+
+// QueryMarkDirectMessagesRead marks messages from otherUsername to
+// readerUsername as read, up to and including upToID (0 marks everything).
+// It returns how many messages changed, the highest id among them and the
+// read timestamp applied.
+func QueryMarkDirectMessagesRead(readerUsername string, otherUsername string, upToID int64) (int64, int64, time.Time, int, error) {
+	readAt := time.Now().UTC()
+	if readerUsername == "" || otherUsername == "" {
+		return 0, 0, readAt, http.StatusBadRequest, fmt.Errorf("username and other username are required")
+	}
+	if upToID < 0 {
+		return 0, 0, readAt, http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	readerID, err := GetUserIdByUsername(readerUsername)
+	if err != nil {
+		return 0, 0, readAt, http.StatusNotFound, fmt.Errorf("user '%s' not found", readerUsername)
+	}
+	otherID, err := GetUserIdByUsername(otherUsername)
+	if err != nil {
+		return 0, 0, readAt, http.StatusNotFound, fmt.Errorf("user '%s' not found", otherUsername)
+	}
+
+	query := `UPDATE directmessages SET read_at = $1
+	WHERE recipient_id = $2 AND sender_id = $3 AND read_at IS NULL`
+	args := []interface{}{readAt, readerID, otherID}
+	if upToID > 0 {
+		query += ` AND id <= $4`
+		args = append(args, upToID)
+	}
+
+	rows, err := DB.Query(query+" RETURNING id;", args...)
+	if err != nil {
+		return 0, 0, readAt, http.StatusInternalServerError, fmt.Errorf("failed to mark direct messages read: %w", err)
+	}
+	defer rows.Close()
+
+	var updated, lastID int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, 0, readAt, http.StatusInternalServerError, fmt.Errorf("failed to scan read direct message: %w", err)
+		}
+		updated++
+		lastID = max(lastID, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, readAt, http.StatusInternalServerError, fmt.Errorf("failed to mark direct messages read: %w", err)
+	}
+	return updated, lastID, readAt, http.StatusOK, nil
+}
+
+// QueryUnreadDirectMessageCount returns how many received messages the user
+// has not read yet, across all conversations.
+func QueryUnreadDirectMessageCount(username string) (int, int, error) {
+	if username == "" {
+		return 0, http.StatusBadRequest, fmt.Errorf("username is required")
+	}
+
+	userID, err := GetUserIdByUsername(username)
+	if err != nil {
+		return 0, http.StatusNotFound, fmt.Errorf("user '%s' not found", username)
+	}
+
+	var count int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM directmessages WHERE recipient_id = $1 AND read_at IS NULL AND deleted_at IS NULL;`, userID).Scan(&count); err != nil {
+		return 0, http.StatusInternalServerError, fmt.Errorf("failed to count unread direct messages: %w", err)
+	}
+	return count, http.StatusOK, nil
+}
+
+// QueryDirectMessageByID returns a single direct message, or nil if none exists.
+func QueryDirectMessageByID(messageID int64) (*DirectMessage, error) {
+	query := `SELECT
+		` + directMessageColumns + `
+	FROM directmessages dm
+	JOIN users sender ON sender.id = dm.sender_id
+	JOIN users recipient ON recipient.id = dm.recipient_id
+	WHERE dm.id = $1;`
+
+	message, err := scanDirectMessage(DB.QueryRow(query, messageID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch direct message: %w", err)
+	}
+	return message, nil
+}
+
+// QueryDirectMessagesSince returns up to limit messages sent or received by
+// userID with an id above afterID, oldest first. It is used to replay what a
+// client missed while disconnected.
+func QueryDirectMessagesSince(userID int64, afterID int64, limit int) ([]DirectMessage, error) {
+	query := `SELECT
+		` + directMessageColumns + `
+	FROM directmessages dm
+	JOIN users sender ON sender.id = dm.sender_id
+	JOIN users recipient ON recipient.id = dm.recipient_id
+	WHERE dm.id > $1 AND (dm.sender_id = $2 OR dm.recipient_id = $2)
+	ORDER BY dm.id ASC
+	LIMIT $3;`
+
+	rows, err := DB.Query(query, afterID, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query missed direct messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]DirectMessage, 0)
+	for rows.Next() {
+		message, err := scanDirectMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan direct message: %w", err)
+		}
+		messages = append(messages, *message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("direct message rows error: %w", err)
+	}
+	return messages, nil
+}
+
+// QueryDirectMessageChangesSince returns up to limit messages with an id up
+// to throughID that userID sent or received and that were edited or deleted
+// after since, in the order the changes happened.
+func QueryDirectMessageChangesSince(userID int64, throughID int64, since time.Time, limit int) ([]DirectMessage, error) {
+	query := `SELECT
+		` + directMessageColumns + `
+	FROM directmessages dm
+	JOIN users sender ON sender.id = dm.sender_id
+	JOIN users recipient ON recipient.id = dm.recipient_id
+	WHERE dm.id <= $1 AND (dm.sender_id = $2 OR dm.recipient_id = $2)
+	  AND (dm.edited_at > $3 OR dm.deleted_at > $3)
+	ORDER BY COALESCE(dm.deleted_at, dm.edited_at) ASC, dm.id ASC
+	LIMIT $4;`
+
+	rows, err := DB.Query(query, throughID, userID, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query changed direct messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]DirectMessage, 0)
+	for rows.Next() {
+		message, err := scanDirectMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan direct message: %w", err)
+		}
+		messages = append(messages, *message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("direct message rows error: %w", err)
+	}
+	return messages, nil
+}
+
+// DirectMessageReadBatch is one mark-as-read: Reader read Count messages
+// from Peer, up to UpToID.
+type DirectMessageReadBatch struct {
+	Reader string
+	Peer   string
+	UpToID int64
+	ReadAt time.Time
+	Count  int64
+}
+
+// QueryDirectMessageReadsSince returns up to limit read batches after since
+// in userID's direct conversations, oldest first.
+func QueryDirectMessageReadsSince(userID int64, since time.Time, limit int) ([]DirectMessageReadBatch, error) {
+	query := `SELECT recipient.username, sender.username, MAX(dm.id), dm.read_at, COUNT(*)
+	FROM directmessages dm
+	JOIN users sender ON sender.id = dm.sender_id
+	JOIN users recipient ON recipient.id = dm.recipient_id
+	WHERE (dm.sender_id = $1 OR dm.recipient_id = $1) AND dm.read_at > $2
+	GROUP BY recipient.username, sender.username, dm.read_at
+	ORDER BY dm.read_at ASC
+	LIMIT $3;`
+
+	rows, err := DB.Query(query, userID, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct message reads: %w", err)
+	}
+	defer rows.Close()
+
+	batches := make([]DirectMessageReadBatch, 0)
+	for rows.Next() {
+		var batch DirectMessageReadBatch
+		if err := rows.Scan(&batch.Reader, &batch.Peer, &batch.UpToID, &batch.ReadAt, &batch.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan direct message read: %w", err)
+		}
+		batches = append(batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("direct message read rows error: %w", err)
+	}
+	return batches, nil
+}
+
+// StreamPosition is how far a realtime stream has got: the newest direct and
+// group message it delivered, and the time of the newest edit, deletion or
+// read receipt.
+type StreamPosition struct {
+	DirectMessageID       int64
+	ConversationMessageID int64
+	ChangedAt             time.Time
+}
+
+// QueryStreamHead returns userID's position as of now.
+func QueryStreamHead(userID int64) (StreamPosition, error) {
+	position := StreamPosition{ChangedAt: time.Now().UTC()}
+	if err := DB.QueryRow(
+		`SELECT COALESCE(MAX(id), 0) FROM directmessages WHERE sender_id = $1 OR recipient_id = $1;`,
+		userID,
+	).Scan(&position.DirectMessageID); err != nil {
+		return position, fmt.Errorf("failed to find latest direct message: %w", err)
+	}
+	if err := DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM conversationmessages;`).Scan(&position.ConversationMessageID); err != nil {
+		return position, fmt.Errorf("failed to find latest conversation message: %w", err)
+	}
+	return position, nil
+}
+
+// QueryStreamPositionAt returns the position of a stream that had seen
+// everything up to direct message messageID, going by when it was sent.
+func QueryStreamPositionAt(messageID int64) (StreamPosition, error) {
+	position := StreamPosition{DirectMessageID: messageID}
+	var sentAt time.Time
+	err := DB.QueryRow(`SELECT creation_date FROM directmessages WHERE id = $1;`, messageID).Scan(&sentAt)
+	if err == sql.ErrNoRows {
+		return position, nil
+	}
+	if err != nil {
+		return position, fmt.Errorf("failed to find direct message: %w", err)
+	}
+	position.ChangedAt = sentAt
+	if err := DB.QueryRow(
+		`SELECT COALESCE(MAX(id), 0) FROM conversationmessages WHERE creation_date <= $1;`,
+		sentAt,
+	).Scan(&position.ConversationMessageID); err != nil {
+		return position, fmt.Errorf("failed to find conversation message: %w", err)
+	}
+	return position, nil
+}
+
+// QueryEditDirectMessage replaces the content of a message that has not been
+// deleted.
+func QueryEditDirectMessage(messageID int64, content string, editedAt time.Time) (bool, error) {
+	updated, err := ExecUpdate(
+		`UPDATE directmessages SET content = $1, edited_at = $2 WHERE id = $3 AND deleted_at IS NULL;`,
+		content,
+		editedAt.UTC(),
+		messageID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to edit direct message: %w", err)
+	}
+	return updated > 0, nil
+}
+
+// QueryDeleteDirectMessage turns a message into a tombstone: the row stays so
+// the conversation keeps its shape, but content and media are cleared.
+func QueryDeleteDirectMessage(messageID int64, deletedAt time.Time) (bool, error) {
+	updated, err := ExecUpdate(
+		`UPDATE directmessages SET content = '', media = '[]', deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL;`,
+		deletedAt.UTC(),
+		messageID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete direct message: %w", err)
+	}
+	return updated > 0, nil
+}
+
+// QueryPrivateMediaForDirectMessage lists private media attached to a message.
+func QueryPrivateMediaForDirectMessage(messageID int64) ([]string, error) {
+	rows, err := DB.Query(`SELECT filename FROM privatemedia WHERE resource_type = 'direct_message' AND resource_id = $1;`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct message media: %w", err)
+	}
+	defer rows.Close()
+
+	filenames := make([]string, 0)
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, fmt.Errorf("failed to scan direct message media: %w", err)
+		}
+		filenames = append(filenames, filename)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("direct message media rows error: %w", err)
+	}
+	return filenames, nil
+}
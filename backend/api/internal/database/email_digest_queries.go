@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Digest frequencies.
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestSettings says whether, how often, and where a user gets an email
+// digest of what they missed. Digests only go to Email, which the user has
+// confirmed; PendingEmail waits for its confirmation link to be followed.
+type DigestSettings struct {
+	Frequency    string  `json:"frequency"`
+	Email        *string `json:"email"`
+	PendingEmail *string `json:"pending_email"`
+}
+
+// DigestRecipient is a user whose digest may be due.
+type DigestRecipient struct {
+	UserID     int64
+	Username   string
+	Email      string
+	Frequency  string
+	LastSentAt *time.Time
+}
+
+// DigestThread summarizes the unread messages from one sender.
+type DigestThread struct {
+	SenderName string
+	Count      int
+	Latest     string
+}
+
+// GetDigestSettings returns userID's digest settings, which are off until set.
+func GetDigestSettings(userID int64) (DigestSettings, error) {
+	settings := DigestSettings{Frequency: DigestOff}
+	var email, pendingEmail sql.NullString
+	err := DB.QueryRow(
+		`SELECT frequency, email, pending_email FROM emaildigests WHERE user_id = $1;`,
+		userID,
+	).Scan(&settings.Frequency, &email, &pendingEmail)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("failed to get digest settings: %w", err)
+	}
+	if email.Valid {
+		settings.Email = &email.String
+	}
+	if pendingEmail.Valid {
+		settings.PendingEmail = &pendingEmail.String
+	}
+	return settings, nil
+}
+
+// SetDigestSettings stores userID's digest settings. The last send is kept,
+// so turning a digest off and on again does not repeat it.
+func SetDigestSettings(userID int64, settings DigestSettings) error {
+	_, err := DB.Exec(
+		`INSERT INTO emaildigests (user_id, email, pending_email, frequency) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET email = excluded.email, pending_email = excluded.pending_email,
+			frequency = excluded.frequency;`,
+		userID,
+		settings.Email,
+		settings.PendingEmail,
+		settings.Frequency,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set digest settings: %w", err)
+	}
+	return nil
+}
+
+// ConfirmDigestEmail makes email userID's digest address if it is the one
+// waiting for confirmation, and reports whether it was.
+func ConfirmDigestEmail(userID int64, email string) (bool, error) {
+	confirmed, err := ExecUpdate(
+		`UPDATE emaildigests SET email = pending_email, pending_email = NULL
+		WHERE user_id = $1 AND pending_email = $2;`,
+		userID,
+		email,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to confirm digest email: %w", err)
+	}
+	return confirmed > 0, nil
+}
+
+// DisableDigest turns userID's digest off and reports whether it was on.
+func DisableDigest(userID int64) (bool, error) {
+	disabled, err := ExecUpdate(
+		`UPDATE emaildigests SET frequency = $1 WHERE user_id = $2 AND frequency <> $1;`,
+		DigestOff,
+		userID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to disable digest: %w", err)
+	}
+	return disabled > 0, nil
+}
+
+// QueryDueDigests returns up to limit users after afterUserID, in id order,
+// whose daily digest was last sent before dailyBefore or weekly digest before
+// weeklyBefore. Digests never sent are due.
+func QueryDueDigests(dailyBefore time.Time, weeklyBefore time.Time, afterUserID int64, limit int) ([]DigestRecipient, error) {
+	rows, err := DB.Query(
+		`SELECT d.user_id, u.username, d.email, d.frequency, d.last_sent_at
+		FROM emaildigests d
+		JOIN users u ON u.id = d.user_id
+		WHERE d.email IS NOT NULL AND d.user_id > $1 AND (
+			(d.frequency = $2 AND (d.last_sent_at IS NULL OR d.last_sent_at <= $3))
+			OR (d.frequency = $4 AND (d.last_sent_at IS NULL OR d.last_sent_at <= $5)))
+		ORDER BY d.user_id
+		LIMIT $6;`,
+		afterUserID,
+		DigestDaily,
+		dailyBefore.UTC(),
+		DigestWeekly,
+		weeklyBefore.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due digests: %w", err)
+	}
+	defer rows.Close()
+
+	recipients := make([]DigestRecipient, 0)
+	for rows.Next() {
+		var recipient DigestRecipient
+		var lastSentAt sql.NullTime
+		if err := rows.Scan(&recipient.UserID, &recipient.Username, &recipient.Email, &recipient.Frequency, &lastSentAt); err != nil {
+			return nil, fmt.Errorf("failed to scan due digest: %w", err)
+		}
+		recipient.LastSentAt = nullTimePointer(lastSentAt)
+		recipients = append(recipients, recipient)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("due digest rows error: %w", err)
+	}
+	return recipients, nil
+}
+
+// ClaimDigest records a digest for userID sent at now, unless another worker
+// already sent one after dueBefore. It reports whether the caller may send.
+func ClaimDigest(userID int64, dueBefore time.Time, now time.Time) (bool, error) {
+	claimed, err := ExecUpdate(
+		`UPDATE emaildigests SET last_sent_at = $1
+		WHERE user_id = $2 AND (last_sent_at IS NULL OR last_sent_at <= $3);`,
+		now.UTC(),
+		userID,
+		dueBefore.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim digest: %w", err)
+	}
+	return claimed > 0, nil
+}
+
+// ReleaseDigest undoes a claim whose email could not be sent, so the digest
+// is tried again on the next run.
+func ReleaseDigest(userID int64, lastSentAt *time.Time) error {
+	var previous interface{}
+	if lastSentAt != nil {
+		previous = lastSentAt.UTC()
+	}
+	if _, err := DB.Exec(`UPDATE emaildigests SET last_sent_at = $1 WHERE user_id = $2;`, previous, userID); err != nil {
+		return fmt.Errorf("failed to release digest: %w", err)
+	}
+	return nil
+}
+
+// QueryDigestNotifications returns up to limit of userID's unread notification
+// groups with activity after since, leaving out messages, which digests list
+// separately, and types the user turned email off for.
+func QueryDigestNotifications(userID int64, since time.Time, limit int) ([]Notification, error) {
+	return queryNotificationGroups(
+		`WHERE n.user_id = $1 AND n.read_at IS NULL AND n.created_at > $2
+			AND n.type NOT IN ('direct_message', 'conversation_message')
+			AND n.type NOT IN (SELECT type FROM notificationpreferences WHERE user_id = $1 AND email = FALSE)`,
+		`LIMIT $3`,
+		userID, since.UTC(), limit,
+	)
+}
+
+// QueryDigestDirectMessages summarizes userID's unread direct messages sent
+// after since, by sender, most recent first.
+func QueryDigestDirectMessages(userID int64, since time.Time, limit int) ([]DigestThread, error) {
+	rows, err := DB.Query(
+		`SELECT sender.username, COUNT(*), MAX(dm.id)
+		FROM directmessages dm
+		JOIN users sender ON sender.id = dm.sender_id
+		WHERE dm.recipient_id = $1 AND dm.read_at IS NULL AND dm.deleted_at IS NULL AND dm.creation_date > $2
+		GROUP BY sender.username
+		ORDER BY MAX(dm.id) DESC
+		LIMIT $3;`,
+		userID,
+		since.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query digest messages: %w", err)
+	}
+
+	threads := make([]DigestThread, 0)
+	latestIDs := make([]int64, 0)
+	for rows.Next() {
+		var thread DigestThread
+		var latestID int64
+		if err := rows.Scan(&thread.SenderName, &thread.Count, &latestID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan digest messages: %w", err)
+		}
+		threads = append(threads, thread)
+		latestIDs = append(latestIDs, latestID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("digest message rows error: %w", err)
+	}
+
+	for index, messageID := range latestIDs {
+		message, err := QueryDirectMessageByID(messageID)
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			threads[index].Latest = message.Content
+		}
+	}
+	return threads, nil
+}
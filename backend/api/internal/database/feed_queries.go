@@ -62,16 +62,27 @@ func projectOrderBy(sort string, alias string) string {
 	}
 }
 
-func getPostsFeedSorted(start int, count int, sort string) ([]Post, int, error) {
+// feedWhere turns an optional hiddenAuthorsFilter into a WHERE clause and
+// appends the viewer to args when it is used.
+func feedWhere(filter string, viewerID int64, args []interface{}) (string, []interface{}) {
+	if filter == "" {
+		return "", args
+	}
+	return "WHERE " + filter, append(args, viewerID)
+}
+
+func getPostsFeedSorted(start int, count int, sort string, viewerID int64) ([]Post, int, error) {
+	where, args := feedWhere(hiddenAuthorsFilter("posts.user_id", 3, viewerID, true), viewerID, []interface{}{count, start})
 	query := fmt.Sprintf(`SELECT id, user_id, project_id, content, COALESCE(media, '[]'),
 			  COALESCE((SELECT COUNT(*) FROM postlikes pl WHERE pl.post_id = posts.id), 0),
 			  COALESCE((SELECT COUNT(*) FROM postsaves ps WHERE ps.post_id = posts.id), 0),
 			  creation_date
 			  FROM posts
 			  %s
-			  LIMIT $1 OFFSET $2;`, postOrderBy(sort, "posts"))
+			  %s
+			  LIMIT $1 OFFSET $2;`, where, postOrderBy(sort, "posts"))
 
-	rows, err := DB.Query(query, count, start)
+	rows, err := DB.Query(query, args...)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -104,18 +115,23 @@ func getPostsFeedSorted(start int, count int, sort string) ([]Post, int, error)
 		posts = append(posts, post)
 	}
 
+	if err := attachPostMentions(posts); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return posts, http.StatusOK, nil
 }
 
-func getProjectsFeedSorted(start int, count int, sort string) ([]Project, int, error) {
+func getProjectsFeedSorted(start int, count int, sort string, viewerID int64) ([]Project, int, error) {
+	where, args := feedWhere(hiddenAuthorsFilter("projects.owner", 3, viewerID, true), viewerID, []interface{}{count, start})
 	query := fmt.Sprintf(`SELECT id, name, description, COALESCE(about_md, ''), status, likes,
               COALESCE((SELECT COUNT(*) FROM projectfollows pf WHERE pf.project_id = projects.id), 0),
 	          COALESCE(links, '[]'), COALESCE(tags, '[]'), COALESCE(media, '[]'), owner, creation_date
 	          FROM projects
               %s
-              LIMIT $1 OFFSET $2;`, projectOrderBy(sort, "projects"))
+              %s
+              LIMIT $1 OFFSET $2;`, where, projectOrderBy(sort, "projects"))
 
-	rows, err := DB.Query(query, count, start)
+	rows, err := DB.Query(query, args...)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -159,6 +175,9 @@ func getProjectsFeedSorted(start int, count int, sort string) ([]Project, int, e
 		projects = append(projects, project)
 	}
 
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return projects, http.StatusOK, nil
 }
 
@@ -174,7 +193,7 @@ func getProjectsFeedSorted(start int, count int, sort string) ([]Project, int, e
 //   - int: http status code
 //   - error: An error if the function fails, nil otherwise
 func GetPostByTimeFeed(start int, count int) ([]Post, int, error) {
-	return getPostsFeedSorted(start, count, "recent")
+	return getPostsFeedSorted(start, count, "recent", 0)
 }
 
 // GetPostByLikesFeed retrieves a set of posts for the feed given a type
@@ -189,7 +208,7 @@ func GetPostByTimeFeed(start int, count int) ([]Post, int, error) {
 //   - int: http status code
 //   - error: An error if the function fails, nil otherwise
 func GetPostByLikesFeed(start int, count int) ([]Post, int, error) {
-	return getPostsFeedSorted(start, count, "popular")
+	return getPostsFeedSorted(start, count, "popular", 0)
 }
 
 // GetProjectByTimeFeed retrieves a set of projects for the feed given a type
@@ -204,7 +223,7 @@ func GetPostByLikesFeed(start int, count int) ([]Post, int, error) {
 //   - int: http status code
 //   - error: An error if the function fails, nil otherwise
 func GetProjectByTimeFeed(start int, count int) ([]Project, int, error) {
-	return getProjectsFeedSorted(start, count, "recent")
+	return getProjectsFeedSorted(start, count, "recent", 0)
 }
 
 // GetProjectByLikesFeed retrieves a set of projects for the feed given a type
@@ -219,15 +238,18 @@ func GetProjectByTimeFeed(start int, count int) ([]Project, int, error) {
 //   - int: http status code
 //   - error: An error if the function fails, nil otherwise
 func GetProjectByLikesFeed(start int, count int) ([]Project, int, error) {
-	return getProjectsFeedSorted(start, count, "popular")
+	return getProjectsFeedSorted(start, count, "popular", 0)
 }
 
-func GetPostFeedBySort(start int, count int, sort string) ([]Post, int, error) {
-	return getPostsFeedSorted(start, count, sort)
+// GetPostFeedBySort returns the public post feed. For a signed-in viewer,
+// posts by users they blocked, were blocked by or muted are left out.
+func GetPostFeedBySort(start int, count int, sort string, viewerID int64) ([]Post, int, error) {
+	return getPostsFeedSorted(start, count, sort, viewerID)
 }
 
-func GetProjectFeedBySort(start int, count int, sort string) ([]Project, int, error) {
-	return getProjectsFeedSorted(start, count, sort)
+// GetProjectFeedBySort is the project counterpart of GetPostFeedBySort.
+func GetProjectFeedBySort(start int, count int, sort string, viewerID int64) ([]Project, int, error) {
+	return getProjectsFeedSorted(start, count, sort, viewerID)
 }
 
 func GetPostByFollowingFeed(username string, start int, count int, sort string) ([]Post, int, error) {
@@ -236,6 +258,7 @@ func GetPostByFollowingFeed(username string, start int, count int, sort string)
 		return nil, http.StatusNotFound, err
 	}
 
+	hiddenFilter := "AND " + hiddenAuthorsFilter("p.user_id", 4, int64(userID), true)
 	query := fmt.Sprintf(`SELECT p.id, p.user_id, p.project_id, p.content, COALESCE(p.media, '[]'),
 			  COALESCE((SELECT COUNT(*) FROM postlikes pl WHERE pl.post_id = p.id), 0),
 			  COALESCE((SELECT COUNT(*) FROM postsaves ps WHERE ps.post_id = p.id), 0),
@@ -244,9 +267,10 @@ func GetPostByFollowingFeed(username string, start int, count int, sort string)
 			  JOIN userfollows uf ON uf.followed_id = p.user_id
 			  WHERE uf.follower_id = $1
 			  %s
-			  LIMIT $2 OFFSET $3;`, postOrderBy(sort, "p"))
+			  %s
+			  LIMIT $2 OFFSET $3;`, hiddenFilter, postOrderBy(sort, "p"))
 
-	rows, err := DB.Query(query, userID, count, start)
+	rows, err := DB.Query(query, userID, count, start, userID)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -278,6 +302,9 @@ func GetPostByFollowingFeed(username string, start int, count int, sort string)
 		posts = append(posts, post)
 	}
 
+	if err := attachPostMentions(posts); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return posts, http.StatusOK, nil
 }
 
@@ -287,6 +314,7 @@ func GetPostBySavedFeed(username string, start int, count int, sort string) ([]P
 		return nil, http.StatusNotFound, err
 	}
 
+	hiddenFilter := "AND " + hiddenAuthorsFilter("p.user_id", 4, int64(userID), false)
 	query := fmt.Sprintf(`SELECT p.id, p.user_id, p.project_id, p.content, COALESCE(p.media, '[]'),
 			  COALESCE((SELECT COUNT(*) FROM postlikes pl WHERE pl.post_id = p.id), 0),
 			  COALESCE((SELECT COUNT(*) FROM postsaves ps2 WHERE ps2.post_id = p.id), 0),
@@ -295,9 +323,10 @@ func GetPostBySavedFeed(username string, start int, count int, sort string) ([]P
 			  JOIN postsaves ps ON ps.post_id = p.id
 			  WHERE ps.user_id = $1
 			  %s
-			  LIMIT $2 OFFSET $3;`, postOrderBy(sort, "p"))
+			  %s
+			  LIMIT $2 OFFSET $3;`, hiddenFilter, postOrderBy(sort, "p"))
 
-	rows, err := DB.Query(query, userID, count, start)
+	rows, err := DB.Query(query, userID, count, start, userID)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -329,6 +358,9 @@ func GetPostBySavedFeed(username string, start int, count int, sort string) ([]P
 		posts = append(posts, post)
 	}
 
+	if err := attachPostMentions(posts); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return posts, http.StatusOK, nil
 }
 
@@ -338,6 +370,7 @@ func GetProjectByFollowingFeed(username string, start int, count int, sort strin
 		return nil, http.StatusNotFound, err
 	}
 
+	hiddenFilter := "AND " + hiddenAuthorsFilter("p.owner", 4, int64(userID), true)
 	query := fmt.Sprintf(`SELECT p.id, p.name, p.description, COALESCE(p.about_md, ''), p.status, p.likes,
 			  COALESCE((SELECT COUNT(*) FROM projectfollows pf2 WHERE pf2.project_id = p.id), 0),
 			  COALESCE(p.links, '[]'), COALESCE(p.tags, '[]'), COALESCE(p.media, '[]'), p.owner, p.creation_date
@@ -345,9 +378,10 @@ func GetProjectByFollowingFeed(username string, start int, count int, sort strin
 			  JOIN projectfollows pf ON pf.project_id = p.id
 			  WHERE pf.user_id = $1
 			  %s
-			  LIMIT $2 OFFSET $3;`, projectOrderBy(sort, "p"))
+			  %s
+			  LIMIT $2 OFFSET $3;`, hiddenFilter, projectOrderBy(sort, "p"))
 
-	rows, err := DB.Query(query, userID, count, start)
+	rows, err := DB.Query(query, userID, count, start, userID)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -391,6 +425,9 @@ func GetProjectByFollowingFeed(username string, start int, count int, sort strin
 		projects = append(projects, project)
 	}
 
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return projects, http.StatusOK, nil
 }
 
@@ -400,6 +437,7 @@ func GetProjectBySavedFeed(username string, start int, count int, sort string) (
 		return nil, http.StatusNotFound, err
 	}
 
+	hiddenFilter := "AND " + hiddenAuthorsFilter("p.owner", 4, int64(userID), false)
 	query := fmt.Sprintf(`SELECT p.id, p.name, p.description, COALESCE(p.about_md, ''), p.status, p.likes,
 			  COALESCE((SELECT COUNT(*) FROM projectfollows pf2 WHERE pf2.project_id = p.id), 0),
 			  COALESCE(p.links, '[]'), COALESCE(p.tags, '[]'), COALESCE(p.media, '[]'), p.owner, p.creation_date
@@ -407,9 +445,10 @@ func GetProjectBySavedFeed(username string, start int, count int, sort string) (
 			  JOIN projectfollows pf ON pf.project_id = p.id
 			  WHERE pf.user_id = $1
 			  %s
-			  LIMIT $2 OFFSET $3;`, projectOrderBy(sort, "p"))
+			  %s
+			  LIMIT $2 OFFSET $3;`, hiddenFilter, projectOrderBy(sort, "p"))
 
-	rows, err := DB.Query(query, userID, count, start)
+	rows, err := DB.Query(query, userID, count, start, userID)
 	if err != nil {
 		return nil, http.StatusNotFound, err
 	}
@@ -453,5 +492,8 @@ func GetProjectBySavedFeed(username string, start int, count int, sort string) (
 		projects = append(projects, project)
 	}
 
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return projects, http.StatusOK, nil
 }
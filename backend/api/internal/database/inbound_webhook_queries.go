@@ -0,0 +1,444 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Outcomes of an inbound webhook call, as kept in its event log.
+const (
+	InboundPosted   = "posted"
+	InboundIgnored  = "ignored"
+	InboundRejected = "rejected"
+)
+
+// InboundWebhook is a URL that CI systems and git hosts call to post into a
+// project as the project's bot.
+type InboundWebhook struct {
+	ID             int64             `json:"id"`
+	ProjectID      int64             `json:"project_id"`
+	Name           string            `json:"name"`
+	Key            string            `json:"-"`
+	Secret         string            `json:"-"`
+	Templates      map[string]string `json:"templates"`
+	PostsPerHour   int               `json:"posts_per_hour"`
+	Active         bool              `json:"active"`
+	CreatedBy      *int64            `json:"created_by"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LastReceivedAt *time.Time        `json:"last_received_at"`
+}
+
+// InboundWebhookEvent is one call to an inbound webhook that got past its
+// signature check.
+type InboundWebhookEvent struct {
+	ID         int64     `json:"id"`
+	WebhookID  int64     `json:"webhook_id"`
+	Source     string    `json:"source"`
+	Event      string    `json:"event"`
+	Status     string    `json:"status"`
+	PostID     *int64    `json:"post_id"`
+	Detail     *string   `json:"detail"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// GetProjectBot returns the id of the user that posts on projectID's behalf,
+// or zero if it has none yet.
+func GetProjectBot(projectID int64) (int64, error) {
+	var userID int64
+	err := DB.QueryRow(`SELECT user_id FROM projectbots WHERE project_id = $1;`, projectID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get project bot: %w", err)
+	}
+	return userID, nil
+}
+
+// SetProjectBot makes userID projectID's bot unless it already has one, and
+// reports whether it did.
+func SetProjectBot(projectID int64, userID int64) (bool, error) {
+	set, err := ExecUpdate(
+		`INSERT INTO projectbots (project_id, user_id) VALUES ($1, $2) ON CONFLICT (project_id) DO NOTHING;`,
+		projectID,
+		userID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to set project bot: %w", err)
+	}
+	return set > 0, nil
+}
+
+const inboundWebhookColumns = `id, project_id, name, hook_key, secret, COALESCE(templates, '{}'), posts_per_hour,
+	active, created_by, created_at, last_received_at`
+
+func scanInboundWebhook(row rowScanner) (*InboundWebhook, error) {
+	var webhook InboundWebhook
+	var templatesJSON string
+	var createdBy sql.NullInt64
+	var lastReceivedAt sql.NullTime
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.ProjectID,
+		&webhook.Name,
+		&webhook.Key,
+		&webhook.Secret,
+		&templatesJSON,
+		&webhook.PostsPerHour,
+		&webhook.Active,
+		&createdBy,
+		&webhook.CreatedAt,
+		&lastReceivedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Templates = map[string]string{}
+	if err := UnmarshalFromJSON(templatesJSON, &webhook.Templates); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook templates: %w", err)
+	}
+	webhook.CreatedBy = nullInt64Pointer(createdBy)
+	webhook.LastReceivedAt = nullTimePointer(lastReceivedAt)
+	return &webhook, nil
+}
+
+// CreateInboundWebhook stores a new inbound webhook and returns its id.
+func CreateInboundWebhook(webhook InboundWebhook, now time.Time) (int64, error) {
+	templatesJSON, err := MarshalToJSON(webhook.Templates)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode webhook templates: %w", err)
+	}
+	var id int64
+	err = DB.QueryRow(
+		`INSERT INTO inboundwebhooks (project_id, name, hook_key, secret, templates, posts_per_hour, active, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;`,
+		webhook.ProjectID,
+		webhook.Name,
+		webhook.Key,
+		webhook.Secret,
+		templatesJSON,
+		webhook.PostsPerHour,
+		webhook.Active,
+		webhook.CreatedBy,
+		now.UTC(),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create inbound webhook: %w", err)
+	}
+	return id, nil
+}
+
+// QueryInboundWebhooks returns projectID's inbound webhooks, oldest first.
+func QueryInboundWebhooks(projectID int64) ([]InboundWebhook, error) {
+	rows, err := DB.Query(
+		`SELECT `+inboundWebhookColumns+` FROM inboundwebhooks WHERE project_id = $1 ORDER BY id;`,
+		projectID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query inbound webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]InboundWebhook, 0)
+	for rows.Next() {
+		webhook, err := scanInboundWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan inbound webhook: %w", err)
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("inbound webhook rows error: %w", err)
+	}
+	return webhooks, nil
+}
+
+// QueryInboundWebhook returns webhookID if it belongs to projectID.
+func QueryInboundWebhook(projectID int64, webhookID int64) (*InboundWebhook, error) {
+	webhook, err := scanInboundWebhook(DB.QueryRow(
+		`SELECT `+inboundWebhookColumns+` FROM inboundwebhooks WHERE id = $1 AND project_id = $2;`,
+		webhookID,
+		projectID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbound webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// GetInboundWebhookByKey returns the inbound webhook whose URL ends in key.
+func GetInboundWebhookByKey(key string) (*InboundWebhook, error) {
+	webhook, err := scanInboundWebhook(DB.QueryRow(
+		`SELECT `+inboundWebhookColumns+` FROM inboundwebhooks WHERE hook_key = $1;`,
+		key,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbound webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// UpdateInboundWebhook stores an inbound webhook's name, secret, templates,
+// rate limit and whether it is active.
+func UpdateInboundWebhook(webhook InboundWebhook) error {
+	templatesJSON, err := MarshalToJSON(webhook.Templates)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook templates: %w", err)
+	}
+	_, err = DB.Exec(
+		`UPDATE inboundwebhooks SET name = $1, secret = $2, templates = $3, posts_per_hour = $4, active = $5
+		WHERE id = $6;`,
+		webhook.Name,
+		webhook.Secret,
+		templatesJSON,
+		webhook.PostsPerHour,
+		webhook.Active,
+		webhook.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update inbound webhook: %w", err)
+	}
+	return nil
+}
+
+// DeleteInboundWebhook deletes webhookID and its event log, and reports
+// whether it belonged to projectID. Posts it made are kept.
+func DeleteInboundWebhook(projectID int64, webhookID int64) (bool, error) {
+	deleted, err := ExecUpdate(`DELETE FROM inboundwebhooks WHERE id = $1 AND project_id = $2;`, webhookID, projectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete inbound webhook: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// RecordInboundWebhookEvent adds a call to webhookID's event log.
+func RecordInboundWebhookEvent(event InboundWebhookEvent) error {
+	var detail interface{}
+	if event.Detail != nil {
+		detail = *event.Detail
+	}
+	_, err := DB.Exec(
+		`INSERT INTO inboundwebhookevents (webhook_id, source, event, status, post_id, detail, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		event.WebhookID,
+		event.Source,
+		event.Event,
+		event.Status,
+		event.PostID,
+		detail,
+		event.ReceivedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record inbound webhook event: %w", err)
+	}
+	_, err = DB.Exec(
+		`UPDATE inboundwebhooks SET last_received_at = $1 WHERE id = $2;`,
+		event.ReceivedAt.UTC(),
+		event.WebhookID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record inbound webhook event: %w", err)
+	}
+	return nil
+}
+
+// InboundReservation is what ReserveInboundWebhookPost decided.
+type InboundReservation struct {
+	// EventID is the posted event holding the reserved post.
+	EventID int64
+	// Duplicate is set when the delivery was received before.
+	Duplicate bool
+	// Limited is set when the webhook has made all its posts for the hour;
+	// Earliest is when the first of them was made.
+	Limited  bool
+	Earliest *time.Time
+}
+
+// ReserveInboundWebhookPost claims one of event's webhook's posts for the
+// hour before event.ReceivedAt and logs event as posted. It holds the
+// webhook's row while it counts, so concurrent calls cannot exceed limit. A
+// deliveryID, if given, is remembered, and a delivery seen before is reported
+// as a duplicate instead of being posted twice.
+func ReserveInboundWebhookPost(event InboundWebhookEvent, deliveryID string, limit int) (*InboundReservation, error) {
+	receivedAt := event.ReceivedAt.UTC()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start inbound webhook transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Writing the webhook's row first locks it in Postgres and takes the
+	// write lock in SQLite, so reservations for one webhook take turns.
+	if _, err := tx.Exec(`UPDATE inboundwebhooks SET last_received_at = $1 WHERE id = $2;`, receivedAt, event.WebhookID); err != nil {
+		return nil, fmt.Errorf("failed to lock inbound webhook: %w", err)
+	}
+
+	if deliveryID != "" {
+		result, err := tx.Exec(
+			`INSERT INTO inboundwebhookdeliveries (webhook_id, delivery_id, received_at) VALUES ($1, $2, $3)
+			ON CONFLICT (webhook_id, delivery_id) DO NOTHING;`,
+			event.WebhookID,
+			deliveryID,
+			receivedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record inbound webhook delivery: %w", err)
+		}
+		if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+			return &InboundReservation{Duplicate: true}, err
+		}
+	}
+
+	posted, earliest, err := countInboundWebhookPosts(tx, event.WebhookID, receivedAt.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if posted >= limit {
+		return &InboundReservation{Limited: true, Earliest: earliest}, nil
+	}
+
+	var eventID int64
+	err = tx.QueryRow(
+		`INSERT INTO inboundwebhookevents (webhook_id, source, event, status, received_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		event.WebhookID,
+		event.Source,
+		event.Event,
+		InboundPosted,
+		receivedAt,
+	).Scan(&eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record inbound webhook event: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit inbound webhook reservation: %w", err)
+	}
+	return &InboundReservation{EventID: eventID}, nil
+}
+
+// AttachInboundWebhookPost records the post a reserved event made.
+func AttachInboundWebhookPost(eventID int64, postID int64) error {
+	if _, err := DB.Exec(`UPDATE inboundwebhookevents SET post_id = $1 WHERE id = $2;`, postID, eventID); err != nil {
+		return fmt.Errorf("failed to attach inbound webhook post: %w", err)
+	}
+	return nil
+}
+
+// ReleaseInboundWebhookPost gives back a reservation that did not become a
+// post: the event is logged as rejected with detail, and the delivery may be
+// sent again.
+func ReleaseInboundWebhookPost(eventID int64, webhookID int64, deliveryID string, detail string) error {
+	_, err := DB.Exec(
+		`UPDATE inboundwebhookevents SET status = $1, detail = $2 WHERE id = $3;`,
+		InboundRejected,
+		detail,
+		eventID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release inbound webhook post: %w", err)
+	}
+	if deliveryID == "" {
+		return nil
+	}
+	_, err = DB.Exec(
+		`DELETE FROM inboundwebhookdeliveries WHERE webhook_id = $1 AND delivery_id = $2;`,
+		webhookID,
+		deliveryID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release inbound webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// countInboundWebhookPosts returns how many posts webhookID made after since
+// and when the earliest of them was made.
+func countInboundWebhookPosts(db userInserter, webhookID int64, since time.Time) (int, *time.Time, error) {
+	var count int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM inboundwebhookevents WHERE webhook_id = $1 AND status = $2 AND received_at > $3;`,
+		webhookID,
+		InboundPosted,
+		since.UTC(),
+	).Scan(&count)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to count inbound webhook posts: %w", err)
+	}
+	if count == 0 {
+		return 0, nil, nil
+	}
+
+	// MIN() over a timestamp comes back as text from SQLite, so read the
+	// earliest row itself.
+	var earliest time.Time
+	err = db.QueryRow(
+		`SELECT received_at FROM inboundwebhookevents
+		WHERE webhook_id = $1 AND status = $2 AND received_at > $3
+		ORDER BY received_at LIMIT 1;`,
+		webhookID,
+		InboundPosted,
+		since.UTC(),
+	).Scan(&earliest)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to count inbound webhook posts: %w", err)
+	}
+	return count, &earliest, nil
+}
+
+// QueryInboundWebhookEvents returns count of webhookID's events from start,
+// newest first.
+func QueryInboundWebhookEvents(webhookID int64, start int, count int) ([]InboundWebhookEvent, error) {
+	rows, err := DB.Query(
+		`SELECT id, webhook_id, source, event, status, post_id, detail, received_at
+		FROM inboundwebhookevents
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`,
+		webhookID,
+		count,
+		start,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query inbound webhook events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]InboundWebhookEvent, 0)
+	for rows.Next() {
+		var event InboundWebhookEvent
+		var postID sql.NullInt64
+		var detail sql.NullString
+		if err := rows.Scan(&event.ID, &event.WebhookID, &event.Source, &event.Event, &event.Status, &postID, &detail, &event.ReceivedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan inbound webhook event: %w", err)
+		}
+		event.PostID = nullInt64Pointer(postID)
+		if detail.Valid {
+			event.Detail = &detail.String
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("inbound webhook event rows error: %w", err)
+	}
+	return events, nil
+}
+
+// PruneInboundWebhookEvents deletes events, and the delivery ids kept to
+// spot repeats, received before before.
+func PruneInboundWebhookEvents(before time.Time) error {
+	if _, err := DB.Exec(`DELETE FROM inboundwebhookevents WHERE received_at < $1;`, before.UTC()); err != nil {
+		return fmt.Errorf("failed to prune inbound webhook events: %w", err)
+	}
+	if _, err := DB.Exec(`DELETE FROM inboundwebhookdeliveries WHERE received_at < $1;`, before.UTC()); err != nil {
+		return fmt.Errorf("failed to prune inbound webhook deliveries: %w", err)
+	}
+	return nil
+}
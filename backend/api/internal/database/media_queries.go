@@ -0,0 +1,390 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StorageLimitOverride holds admin-assigned upload limits for a single user.
+// A nil field means the server-wide default applies.
+type StorageLimitOverride struct {
+	UserID         int64     `json:"user_id"`
+	QuotaBytes     *int64    `json:"quota_bytes"`
+	UploadsPerHour *int      `json:"uploads_per_hour"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Reasons ReserveMediaUpload turns an upload away.
+var (
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	ErrUploadRateLimited    = errors.New("upload rate limit exceeded")
+)
+
+// ReserveMediaUpload registers a file against its owner so it counts toward
+// the owner's storage quota and hourly upload limit, but only while the owner
+// stays within quotaBytes and has made fewer than uploadsPerHour uploads after
+// since. The owner's row is
+// locked for the check, so concurrent uploads cannot both slip under a limit.
+func ReserveMediaUpload(userID int64, filename string, sizeBytes int64, quotaBytes int64, uploadsPerHour int, since time.Time) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A no-op write takes the row lock on Postgres and the write lock on
+	// SQLite, which a SELECT would not.
+	if _, err := tx.Exec(`UPDATE users SET id = id WHERE id = $1;`, userID); err != nil {
+		return fmt.Errorf("failed to lock uploader: %w", err)
+	}
+
+	var used sql.NullInt64
+	var recent int
+	query := `SELECT
+			(SELECT SUM(size_bytes) FROM mediauploads WHERE user_id = $1 AND deleted_at IS NULL),
+			(SELECT COUNT(*) FROM mediauploads WHERE user_id = $1 AND created_at > $2);`
+	if err := tx.QueryRow(query, userID, since.UTC()).Scan(&used, &recent); err != nil {
+		return fmt.Errorf("failed to fetch storage usage: %w", err)
+	}
+	if recent >= uploadsPerHour {
+		return ErrUploadRateLimited
+	}
+	if used.Int64+sizeBytes > quotaBytes {
+		return ErrStorageQuotaExceeded
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO mediauploads (user_id, filename, size_bytes, created_at) VALUES ($1, $2, $3, $4);`,
+		userID, filename, sizeBytes, time.Now().UTC(),
+	); err != nil {
+		return fmt.Errorf("failed to record media upload: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit media upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteMediaUpload forgets a reservation for a file that was never stored,
+// so it counts toward neither limit.
+func DeleteMediaUpload(filename string) error {
+	if _, err := DB.Exec(`DELETE FROM mediauploads WHERE filename = $1;`, filename); err != nil {
+		return fmt.Errorf("failed to delete media upload: %w", err)
+	}
+	return nil
+}
+
+// MarkMediaUploadsDeleted releases the storage held by the given filenames.
+// Rows are kept so deleted files still count toward the hourly upload limit.
+func MarkMediaUploadsDeleted(filenames []string) error {
+	if len(filenames) == 0 {
+		return nil
+	}
+
+	deletedAt := time.Now().UTC()
+	for _, filename := range filenames {
+		if _, err := DB.Exec(`UPDATE mediauploads SET deleted_at = $1 WHERE filename = $2 AND deleted_at IS NULL;`, deletedAt, filename); err != nil {
+			return fmt.Errorf("failed to release media upload: %w", err)
+		}
+	}
+	return nil
+}
+
+// QueryUnreferencedUploads returns the filenames ownerID still holds storage
+// for that no picture, post, project, comment or message refers to any more.
+func QueryUnreferencedUploads(ownerID int64, filenames []string) ([]string, error) {
+	query := `SELECT COUNT(*) FROM mediauploads m
+		WHERE m.filename = $1 AND m.user_id = $2 AND m.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM users WHERE picture LIKE $3)
+		AND NOT EXISTS (SELECT 1 FROM posts WHERE CAST(media AS TEXT) LIKE $3)
+		AND NOT EXISTS (SELECT 1 FROM projects WHERE CAST(media AS TEXT) LIKE $3)
+		AND NOT EXISTS (SELECT 1 FROM comments WHERE CAST(media AS TEXT) LIKE $3)
+		AND NOT EXISTS (SELECT 1 FROM directmessages WHERE CAST(media AS TEXT) LIKE $3)
+		AND NOT EXISTS (SELECT 1 FROM conversationmessages WHERE CAST(media AS TEXT) LIKE $3);`
+
+	unreferenced := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		var count int
+		if err := DB.QueryRow(query, filename, ownerID, "%"+filename+"%").Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to check media references: %w", err)
+		}
+		if count > 0 {
+			unreferenced = append(unreferenced, filename)
+		}
+	}
+	return unreferenced, nil
+}
+
+// GetUserStorageUsage returns the number of bytes currently stored by a user.
+func GetUserStorageUsage(userID int64) (int64, int, error) {
+	var used sql.NullInt64
+	query := `SELECT SUM(size_bytes) FROM mediauploads WHERE user_id = $1 AND deleted_at IS NULL;`
+	if err := DB.QueryRow(query, userID).Scan(&used); err != nil {
+		return 0, http.StatusInternalServerError, fmt.Errorf("failed to fetch storage usage: %w", err)
+	}
+	return used.Int64, http.StatusOK, nil
+}
+
+// CountUserUploadsSince returns how many uploads a user has made after `since`,
+// including uploads that were later deleted.
+func CountUserUploadsSince(userID int64, since time.Time) (int, int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM mediauploads WHERE user_id = $1 AND created_at > $2;`
+	if err := DB.QueryRow(query, userID, since.UTC()).Scan(&count); err != nil {
+		return 0, http.StatusInternalServerError, fmt.Errorf("failed to count recent uploads: %w", err)
+	}
+	return count, http.StatusOK, nil
+}
+
+// GetStorageLimitOverride returns the admin override for a user, or nil when
+// the user is on the default limits.
+func GetStorageLimitOverride(userID int64) (*StorageLimitOverride, error) {
+	query := `SELECT user_id, quota_bytes, uploads_per_hour, updated_at FROM userstoragelimits WHERE user_id = $1;`
+
+	var quotaBytes sql.NullInt64
+	var uploadsPerHour sql.NullInt64
+	override := &StorageLimitOverride{}
+	err := DB.QueryRow(query, userID).Scan(&override.UserID, &quotaBytes, &uploadsPerHour, &override.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch storage limits: %w", err)
+	}
+
+	if quotaBytes.Valid {
+		value := quotaBytes.Int64
+		override.QuotaBytes = &value
+	}
+	if uploadsPerHour.Valid {
+		value := int(uploadsPerHour.Int64)
+		override.UploadsPerHour = &value
+	}
+	return override, nil
+}
+
+// SetStorageLimitOverride stores admin-assigned limits for a user. Passing nil
+// for both limits removes the override.
+func SetStorageLimitOverride(userID int64, quotaBytes *int64, uploadsPerHour *int, updatedBy *int64) error {
+	if quotaBytes == nil && uploadsPerHour == nil {
+		if _, err := DB.Exec(`DELETE FROM userstoragelimits WHERE user_id = $1;`, userID); err != nil {
+			return fmt.Errorf("failed to clear storage limits: %w", err)
+		}
+		return nil
+	}
+
+	query := `INSERT INTO userstoragelimits (user_id, quota_bytes, uploads_per_hour, updated_at, updated_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			quota_bytes = EXCLUDED.quota_bytes,
+			uploads_per_hour = EXCLUDED.uploads_per_hour,
+			updated_at = EXCLUDED.updated_at,
+			updated_by = EXCLUDED.updated_by;`
+	if _, err := DB.Exec(query, userID, quotaBytes, uploadsPerHour, time.Now().UTC(), updatedBy); err != nil {
+		return fmt.Errorf("failed to store storage limits: %w", err)
+	}
+	return nil
+}
+
+// UploadSession tracks a resumable upload that is still receiving chunks.
+type UploadSession struct {
+	ID          string    `json:"id"`
+	UserID      int64     `json:"user_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	TotalBytes  int64     `json:"total_bytes"`
+	OffsetBytes int64     `json:"offset_bytes"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func CreateUploadSession(session *UploadSession) error {
+	query := `INSERT INTO uploadsessions (id, user_id, filename, content_type, total_bytes, offset_bytes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	_, err := DB.Exec(
+		query,
+		session.ID,
+		session.UserID,
+		session.Filename,
+		session.ContentType,
+		session.TotalBytes,
+		session.OffsetBytes,
+		session.CreatedAt.UTC(),
+		session.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+	return nil
+}
+
+// GetUploadSession returns the session with the given id, or nil if none exists.
+func GetUploadSession(id string) (*UploadSession, error) {
+	query := `SELECT id, user_id, filename, COALESCE(content_type, ''), total_bytes, offset_bytes, created_at, expires_at
+		FROM uploadsessions WHERE id = $1;`
+
+	session := &UploadSession{}
+	err := DB.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Filename,
+		&session.ContentType,
+		&session.TotalBytes,
+		&session.OffsetBytes,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch upload session: %w", err)
+	}
+	return session, nil
+}
+
+// AdvanceUploadSession moves the session offset forward, but only if it is
+// still at `fromOffset`. Returns false when another writer got there first.
+func AdvanceUploadSession(id string, fromOffset int64, toOffset int64) (bool, error) {
+	rowsAffected, err := ExecUpdate(
+		`UPDATE uploadsessions SET offset_bytes = $1 WHERE id = $2 AND offset_bytes = $3;`,
+		toOffset,
+		id,
+		fromOffset,
+	)
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// ClaimUploadSession deletes a finished session for the caller completing it.
+// Returns false when another caller claimed it first.
+func ClaimUploadSession(id string) (bool, error) {
+	rowsAffected, err := ExecUpdate(`DELETE FROM uploadsessions WHERE id = $1 AND offset_bytes = total_bytes;`, id)
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func DeleteUploadSession(id string) error {
+	if _, err := DB.Exec(`DELETE FROM uploadsessions WHERE id = $1;`, id); err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredUploadSessions removes every session that expired before `now`
+// and returns their ids so the caller can clean up partial files.
+func DeleteExpiredUploadSessions(now time.Time) ([]string, error) {
+	rows, err := DB.Query(`SELECT id FROM uploadsessions WHERE expires_at < $1;`, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired upload sessions: %w", err)
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan expired upload session: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("expired upload session rows error: %w", err)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := DeleteUploadSession(id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// PrivateMedia is an upload that is only reachable through signed URLs. Access
+// follows the resource it is attached to.
+type PrivateMedia struct {
+	Filename     string    `json:"filename"`
+	OwnerID      int64     `json:"owner_id"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   int64     `json:"resource_id"`
+	ContentType  string    `json:"content_type"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func CreatePrivateMedia(media *PrivateMedia) error {
+	query := `INSERT INTO privatemedia (filename, owner_id, resource_type, resource_id, content_type, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6);`
+	_, err := DB.Exec(
+		query,
+		media.Filename,
+		media.OwnerID,
+		media.ResourceType,
+		media.ResourceID,
+		media.ContentType,
+		media.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create private media: %w", err)
+	}
+	return nil
+}
+
+// GetPrivateMedia returns the private media entry for filename, or nil if none exists.
+func GetPrivateMedia(filename string) (*PrivateMedia, error) {
+	query := `SELECT filename, owner_id, resource_type, resource_id, COALESCE(content_type, ''), created_at
+		FROM privatemedia WHERE filename = $1;`
+
+	media := &PrivateMedia{}
+	err := DB.QueryRow(query, filename).Scan(
+		&media.Filename,
+		&media.OwnerID,
+		&media.ResourceType,
+		&media.ResourceID,
+		&media.ContentType,
+		&media.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch private media: %w", err)
+	}
+	return media, nil
+}
+
+// ErrPrivateMediaUnavailable means media named for attachment is missing,
+// belongs to someone else or is already attached elsewhere.
+var ErrPrivateMediaUnavailable = errors.New("private media not found")
+
+// attachPrivateMedia moves the owner's unattached media onto a resource
+// within tx, failing with ErrPrivateMediaUnavailable if any file cannot move.
+func attachPrivateMedia(tx *sql.Tx, filenames []string, ownerID int64, resourceType string, resourceID int64) error {
+	query := `UPDATE privatemedia SET resource_type = $1, resource_id = $2
+		WHERE filename = $3 AND owner_id = $4 AND resource_type = 'user';`
+	for _, filename := range filenames {
+		result, err := tx.Exec(query, resourceType, resourceID, filename, ownerID)
+		if err != nil {
+			return fmt.Errorf("failed to attach private media: %w", err)
+		}
+		if attached, err := result.RowsAffected(); err != nil || attached != 1 {
+			return ErrPrivateMediaUnavailable
+		}
+	}
+	return nil
+}
+
+func DeletePrivateMedia(filename string) error {
+	if _, err := DB.Exec(`DELETE FROM privatemedia WHERE filename = $1;`, filename); err != nil {
+		return fmt.Errorf("failed to delete private media: %w", err)
+	}
+	return nil
+}
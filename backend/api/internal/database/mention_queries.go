@@ -0,0 +1,299 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Mention is an @username span in a post, comment or project description.
+// Offset and Length count UTF-16 code units, matching string indexing in
+// the clients.
+type Mention struct {
+	Offset int   `json:"offset"`
+	Length int   `json:"length"`
+	UserID int64 `json:"user_id"`
+}
+
+// MentionSource names the kind of content a mention appears in. Its value is
+// the mentions column referencing that content.
+type MentionSource string
+
+const (
+	MentionInPost    MentionSource = "post_id"
+	MentionInProject MentionSource = "project_id"
+	MentionInComment MentionSource = "comment_id"
+)
+
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_][A-Za-z0-9_.-]*)`)
+
+type mentionCandidate struct {
+	username string
+	start    int
+	end      int
+}
+
+// findMentionCandidates returns the @username spans in text as byte ranges.
+// An @ inside a word, as in an email address, does not start a mention, and
+// trailing dots and dashes are taken as punctuation.
+func findMentionCandidates(text string) []mentionCandidate {
+	candidates := make([]mentionCandidate, 0)
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		start := match[0]
+		if start > 0 {
+			previous, _ := utf8.DecodeLastRuneInString(text[:start])
+			if previous == '@' || previous == '_' || unicode.IsLetter(previous) || unicode.IsDigit(previous) {
+				continue
+			}
+		}
+		username := strings.TrimRight(text[match[2]:match[3]], ".-")
+		if username == "" {
+			continue
+		}
+		candidates = append(candidates, mentionCandidate{
+			username: username,
+			start:    start,
+			end:      match[2] + len(username),
+		})
+	}
+	return candidates
+}
+
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// ResolveMentions finds the mentions in text written by authorID. Names that
+// match no user, the author's own name, and users blocked either way with the
+// author are left as plain text.
+func ResolveMentions(text string, authorID int64) ([]Mention, error) {
+	candidates := findMentionCandidates(text)
+	if len(candidates) == 0 {
+		return []Mention{}, nil
+	}
+
+	names := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		names = append(names, strings.ToLower(candidate.username))
+	}
+	userIDs, err := queryUserIDsByUsernames(names)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := make(map[int64]bool)
+	for _, userID := range userIDs {
+		if _, checked := blocked[userID]; checked || userID == authorID {
+			continue
+		}
+		isBlocked, err := IsBlockedBetween(authorID, userID)
+		if err != nil {
+			return nil, err
+		}
+		blocked[userID] = isBlocked
+	}
+
+	mentions := make([]Mention, 0, len(candidates))
+	for _, candidate := range candidates {
+		userID, ok := userIDs[strings.ToLower(candidate.username)]
+		if !ok || userID == authorID || blocked[userID] {
+			continue
+		}
+		mentions = append(mentions, Mention{
+			Offset: utf16Length(text[:candidate.start]),
+			Length: utf16Length(text[candidate.start:candidate.end]),
+			UserID: userID,
+		})
+	}
+	return mentions, nil
+}
+
+// queryUserIDsByUsernames maps lowercased usernames to user ids. Lookups are
+// case-insensitive, as in GetUserIdByUsername.
+func queryUserIDsByUsernames(names []string) (map[string]int64, error) {
+	placeholders := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for index, name := range names {
+		placeholders[index] = fmt.Sprintf("$%d", index+1)
+		args[index] = name
+	}
+	rows, err := DB.Query(
+		`SELECT id, LOWER(username) FROM users
+		WHERE LOWER(username) IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY id DESC;`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up mentioned users: %w", err)
+	}
+	defer rows.Close()
+
+	userIDs := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan mentioned user: %w", err)
+		}
+		// Rows arrive newest first, so the oldest account wins a case clash.
+		userIDs[name] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mentioned user rows error: %w", err)
+	}
+	return userIDs, nil
+}
+
+// ReplaceMentions stores mentions as the full set for one post, project or
+// comment. It returns the users mentioned now who were not mentioned before,
+// in order of first appearance.
+func ReplaceMentions(source MentionSource, sourceID int64, mentions []Mention) ([]int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mentions transaction: %w", err)
+	}
+
+	rollback := func(original error) error {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", original, rollbackErr)
+		}
+		return original
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT user_id FROM mentions WHERE `+string(source)+` = $1;`, sourceID)
+	if err != nil {
+		return nil, rollback(fmt.Errorf("failed to query mentions: %w", err))
+	}
+	previous := make(map[int64]bool)
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, rollback(fmt.Errorf("failed to scan mention: %w", err))
+		}
+		previous[userID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, rollback(fmt.Errorf("mention rows error: %w", err))
+	}
+
+	if _, err := tx.Exec(`DELETE FROM mentions WHERE `+string(source)+` = $1;`, sourceID); err != nil {
+		return nil, rollback(fmt.Errorf("failed to clear mentions: %w", err))
+	}
+
+	added := make([]int64, 0)
+	for _, mention := range mentions {
+		if _, err := tx.Exec(
+			`INSERT INTO mentions (user_id, `+string(source)+`, span_start, span_length) VALUES ($1, $2, $3, $4);`,
+			mention.UserID,
+			sourceID,
+			mention.Offset,
+			mention.Length,
+		); err != nil {
+			return nil, rollback(fmt.Errorf("failed to store mention: %w", err))
+		}
+		if !previous[mention.UserID] {
+			previous[mention.UserID] = true
+			added = append(added, mention.UserID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit mentions: %w", err)
+	}
+	return added, nil
+}
+
+// queryMentions loads the mentions of each listed source id, in text order.
+func queryMentions(source MentionSource, sourceIDs []int64) (map[int64][]Mention, error) {
+	mentions := make(map[int64][]Mention)
+	if len(sourceIDs) == 0 {
+		return mentions, nil
+	}
+
+	placeholders := make([]string, len(sourceIDs))
+	args := make([]interface{}, len(sourceIDs))
+	for index, sourceID := range sourceIDs {
+		placeholders[index] = fmt.Sprintf("$%d", index+1)
+		args[index] = sourceID
+	}
+	rows, err := DB.Query(
+		`SELECT `+string(source)+`, user_id, span_start, span_length FROM mentions
+		WHERE `+string(source)+` IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY span_start;`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sourceID int64
+		var mention Mention
+		if err := rows.Scan(&sourceID, &mention.UserID, &mention.Offset, &mention.Length); err != nil {
+			return nil, fmt.Errorf("failed to scan mention: %w", err)
+		}
+		mentions[sourceID] = append(mentions[sourceID], mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mention rows error: %w", err)
+	}
+	return mentions, nil
+}
+
+func attachPostMentions(posts []Post) error {
+	ids := make([]int64, len(posts))
+	for index := range posts {
+		ids[index] = posts[index].ID
+	}
+	mentions, err := queryMentions(MentionInPost, ids)
+	if err != nil {
+		return err
+	}
+	for index := range posts {
+		posts[index].Mentions = mentions[posts[index].ID]
+	}
+	return nil
+}
+
+func attachProjectMentions(projects []Project) error {
+	ids := make([]int64, len(projects))
+	for index := range projects {
+		ids[index] = projects[index].ID
+	}
+	mentions, err := queryMentions(MentionInProject, ids)
+	if err != nil {
+		return err
+	}
+	for index := range projects {
+		projects[index].Mentions = mentions[projects[index].ID]
+	}
+	return nil
+}
+
+func attachCommentMentions(comments []Comment) error {
+	ids := make([]int64, len(comments))
+	for index := range comments {
+		ids[index] = comments[index].ID
+	}
+	mentions, err := queryMentions(MentionInComment, ids)
+	if err != nil {
+		return err
+	}
+	for index := range comments {
+		comments[index].Mentions = mentions[comments[index].ID]
+	}
+	return nil
+}
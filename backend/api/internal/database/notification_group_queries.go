@@ -0,0 +1,215 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxSampleActors bounds how many actors a notification group lists.
+const maxSampleActors = 3
+
+func int64OrZero(value *int64) int64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// findNotificationGroup returns the unread group a new notification should
+// join, or nil to start a new one. Groups share a type and a target: the post
+// or project the notification is about, or failing those the comment. So
+// comments on one post group together, as do replies to one comment. Group
+// chat messages also share their conversation, and with GroupByActor the
+// group has a single actor.
+func findNotificationGroup(input NotificationInsert, now time.Time) (*int64, error) {
+	if input.GroupWindow <= 0 {
+		return nil, nil
+	}
+
+	var commentTarget int64
+	if input.PostID == nil && input.ProjectID == nil {
+		commentTarget = int64OrZero(input.CommentID)
+	}
+
+	var actorTarget int64
+	if input.GroupByActor {
+		actorTarget = input.ActorID
+	}
+
+	var groupID int64
+	err := DB.QueryRow(
+		`SELECT COALESCE(group_id, id) FROM notifications
+		WHERE user_id = $1 AND type = $2
+			AND COALESCE(post_id, 0) = $3 AND COALESCE(project_id, 0) = $4
+			AND (post_id IS NOT NULL OR project_id IS NOT NULL OR COALESCE(comment_id, 0) = $5)
+			AND COALESCE(conversation_id, 0) = $6
+			AND ($7 = 0 OR actor_id = $7)
+			AND read_at IS NULL AND created_at >= $8
+		ORDER BY id DESC
+		LIMIT 1;`,
+		input.UserID,
+		input.Type,
+		int64OrZero(input.PostID),
+		int64OrZero(input.ProjectID),
+		commentTarget,
+		int64OrZero(input.ConversationID),
+		actorTarget,
+		now.Add(-input.GroupWindow),
+	).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &groupID, nil
+}
+
+type notificationGroupSummary struct {
+	actorCount int
+	unread     int
+}
+
+// queryNotificationGroups summarizes the groups matching where (over
+// notifications n, with $1 the user id), then loads their members in one
+// query to fill in the newest notification and sample actors.
+func queryNotificationGroups(where string, paging string, args ...interface{}) ([]Notification, error) {
+	rows, err := DB.Query(
+		`SELECT COALESCE(n.group_id, n.id), COUNT(DISTINCT n.actor_id),
+			SUM(CASE WHEN n.read_at IS NULL THEN 1 ELSE 0 END)
+		FROM notifications n
+		`+where+`
+		GROUP BY COALESCE(n.group_id, n.id)
+		ORDER BY MAX(n.created_at) DESC, MAX(n.id) DESC
+		`+paging+`;`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification groups: %w", err)
+	}
+
+	order := make([]int64, 0)
+	summaries := make(map[int64]notificationGroupSummary)
+	for rows.Next() {
+		var groupID int64
+		var summary notificationGroupSummary
+		if err := rows.Scan(&groupID, &summary.actorCount, &summary.unread); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan notification group: %w", err)
+		}
+		order = append(order, groupID)
+		summaries[groupID] = summary
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification group rows error: %w", err)
+	}
+
+	groups := []Notification{}
+	if len(order) == 0 {
+		return groups, nil
+	}
+
+	placeholders := make([]string, len(order))
+	memberArgs := []interface{}{args[0]}
+	for index, groupID := range order {
+		placeholders[index] = fmt.Sprintf("$%d", index+2)
+		memberArgs = append(memberArgs, groupID)
+	}
+	memberRows, err := DB.Query(
+		`SELECT `+notificationColumns+`
+		FROM notifications n
+		JOIN users u ON u.id = n.actor_id
+		WHERE n.user_id = $1 AND COALESCE(n.group_id, n.id) IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY n.created_at DESC, n.id DESC;`,
+		memberArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification group members: %w", err)
+	}
+	defer memberRows.Close()
+
+	built := make(map[int64]*Notification, len(order))
+	seenActors := make(map[int64]map[int64]struct{}, len(order))
+	for memberRows.Next() {
+		member, err := scanNotification(memberRows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		summary := summaries[member.GroupID]
+
+		group, ok := built[member.GroupID]
+		if !ok {
+			// Members arrive newest first; the first one describes the group.
+			group = member
+			group.ActorCount = summary.actorCount
+			group.Actors = []NotificationActor{}
+			if summary.unread > 0 {
+				group.ReadAt = nil
+			}
+			built[member.GroupID] = group
+			seenActors[member.GroupID] = make(map[int64]struct{})
+		}
+
+		if _, seen := seenActors[member.GroupID][member.ActorID]; seen || len(group.Actors) >= maxSampleActors {
+			continue
+		}
+		seenActors[member.GroupID][member.ActorID] = struct{}{}
+		group.Actors = append(group.Actors, NotificationActor{
+			ID:      member.ActorID,
+			Name:    member.ActorName,
+			Picture: member.ActorPicture,
+		})
+	}
+	if err := memberRows.Err(); err != nil {
+		return nil, fmt.Errorf("notification rows error: %w", err)
+	}
+
+	for _, groupID := range order {
+		if group, ok := built[groupID]; ok {
+			groups = append(groups, *group)
+		}
+	}
+	return groups, nil
+}
+
+// GetNotificationGroup returns the grouped view of one group, or nil if it
+// no longer exists.
+func GetNotificationGroup(userID int64, groupID int64) (*Notification, error) {
+	groups, err := queryNotificationGroups(`WHERE n.user_id = $1 AND COALESCE(n.group_id, n.id) = $2`, ``, userID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	return &groups[0], nil
+}
+
+// ClaimNotificationGroupPush records a push for groupID unless one went out
+// within throttle. It reports whether the caller may send.
+func ClaimNotificationGroupPush(groupID int64, now time.Time, throttle time.Duration) (bool, error) {
+	claimed, err := ExecUpdate(
+		`INSERT INTO notificationgrouppushes (group_id, pushed_at) VALUES ($1, $2)
+		ON CONFLICT (group_id) DO UPDATE SET pushed_at = excluded.pushed_at
+		WHERE notificationgrouppushes.pushed_at <= $3;`,
+		groupID,
+		now.UTC(),
+		now.Add(-throttle).UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim group push: %w", err)
+	}
+	return claimed > 0, nil
+}
+
+// PruneNotificationGroupPushes forgets push claims older than before, which
+// can no longer throttle anything.
+func PruneNotificationGroupPushes(before time.Time) error {
+	if _, err := DB.Exec(`DELETE FROM notificationgrouppushes WHERE pushed_at < $1;`, before.UTC()); err != nil {
+		return fmt.Errorf("failed to prune group pushes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// NotificationChannels says where notifications of one type are delivered.
+type NotificationChannels struct {
+	InApp bool `json:"in_app"`
+	Push  bool `json:"push"`
+	Email bool `json:"email"`
+}
+
+// DefaultNotificationChannels applies to every type a user has not changed.
+var DefaultNotificationChannels = NotificationChannels{InApp: true, Push: true, Email: true}
+
+// QuietHours is a daily window, in the user's time zone, during which pushes
+// are held back. Times are "HH:MM"; a window may wrap past midnight.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	TimeZone string `json:"time_zone"`
+}
+
+// ScheduledPush is a push held back by quiet hours or a group's throttle.
+// Text is the notification's action; the body is rendered from the group as
+// it stands when the push is sent.
+type ScheduledPush struct {
+	NotificationID int64
+	Text           string
+}
+
+// QueryNotificationPreferences returns the channels a user has set, keyed by
+// notification type. Types missing from the map use the defaults.
+func QueryNotificationPreferences(userID int64) (map[string]NotificationChannels, error) {
+	rows, err := DB.Query(
+		`SELECT type, in_app, push, email FROM notificationpreferences WHERE user_id = $1;`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification preferences: %w", err)
+	}
+	defer rows.Close()
+
+	preferences := make(map[string]NotificationChannels)
+	for rows.Next() {
+		var nType string
+		var channels NotificationChannels
+		if err := rows.Scan(&nType, &channels.InApp, &channels.Push, &channels.Email); err != nil {
+			return nil, fmt.Errorf("failed to scan notification preference: %w", err)
+		}
+		preferences[nType] = channels
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification preference rows error: %w", err)
+	}
+	return preferences, nil
+}
+
+// GetNotificationChannels returns where userID wants nType delivered.
+func GetNotificationChannels(userID int64, nType string) (NotificationChannels, error) {
+	channels := DefaultNotificationChannels
+	err := DB.QueryRow(
+		`SELECT in_app, push, email FROM notificationpreferences WHERE user_id = $1 AND type = $2;`,
+		userID,
+		nType,
+	).Scan(&channels.InApp, &channels.Push, &channels.Email)
+	if err == sql.ErrNoRows {
+		return DefaultNotificationChannels, nil
+	}
+	if err != nil {
+		return DefaultNotificationChannels, fmt.Errorf("failed to get notification preference: %w", err)
+	}
+	return channels, nil
+}
+
+// UpsertNotificationPreferences stores the channels for each listed type.
+func UpsertNotificationPreferences(userID int64, preferences map[string]NotificationChannels) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start preferences transaction: %w", err)
+	}
+
+	rollback := func(original error) error {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", original, rollbackErr)
+		}
+		return original
+	}
+
+	for nType, channels := range preferences {
+		if _, err := tx.Exec(
+			`INSERT INTO notificationpreferences (user_id, type, in_app, push, email) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, type) DO UPDATE SET in_app = excluded.in_app, push = excluded.push, email = excluded.email;`,
+			userID,
+			nType,
+			channels.InApp,
+			channels.Push,
+			channels.Email,
+		); err != nil {
+			return rollback(fmt.Errorf("failed to store notification preference: %w", err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit notification preferences: %w", err)
+	}
+	return nil
+}
+
+// GetQuietHours returns the user's quiet hours, or nil when none are set.
+func GetQuietHours(userID int64) (*QuietHours, error) {
+	var quiet QuietHours
+	err := DB.QueryRow(
+		`SELECT start_time, end_time, time_zone FROM notificationquiethours WHERE user_id = $1;`,
+		userID,
+	).Scan(&quiet.Start, &quiet.End, &quiet.TimeZone)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quiet hours: %w", err)
+	}
+	return &quiet, nil
+}
+
+func SetQuietHours(userID int64, quiet QuietHours) error {
+	_, err := DB.Exec(
+		`INSERT INTO notificationquiethours (user_id, start_time, end_time, time_zone) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET start_time = excluded.start_time, end_time = excluded.end_time, time_zone = excluded.time_zone;`,
+		userID,
+		quiet.Start,
+		quiet.End,
+		quiet.TimeZone,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set quiet hours: %w", err)
+	}
+	return nil
+}
+
+func DeleteQuietHours(userID int64) error {
+	if _, err := DB.Exec(`DELETE FROM notificationquiethours WHERE user_id = $1;`, userID); err != nil {
+		return fmt.Errorf("failed to clear quiet hours: %w", err)
+	}
+	return nil
+}
+
+// SchedulePush holds a notification's push until deliverAt. Deleting the
+// notification drops the push with it.
+func SchedulePush(notificationID int64, text string, deliverAt time.Time) error {
+	_, err := DB.Exec(
+		`INSERT INTO scheduledpushes (notification_id, body, deliver_at) VALUES ($1, $2, $3);`,
+		notificationID,
+		text,
+		deliverAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to schedule push: %w", err)
+	}
+	return nil
+}
+
+// ClaimDuePushes removes and returns pushes due by now. Removal and read are
+// one statement, so each push is claimed by a single API instance.
+func ClaimDuePushes(now time.Time) ([]ScheduledPush, error) {
+	rows, err := DB.Query(
+		`DELETE FROM scheduledpushes WHERE deliver_at <= $1 RETURNING notification_id, body;`,
+		now.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim scheduled pushes: %w", err)
+	}
+	defer rows.Close()
+
+	pushes := make([]ScheduledPush, 0)
+	for rows.Next() {
+		var push ScheduledPush
+		if err := rows.Scan(&push.NotificationID, &push.Text); err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled push: %w", err)
+		}
+		pushes = append(pushes, push)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scheduled push rows error: %w", err)
+	}
+	return pushes, nil
+}
+
+// hiddenNotificationTypesFilter excludes the types the user (bound as $N)
+// turned off in-app. Those rows are still stored for the other channels.
+func hiddenNotificationTypesFilter(column string, userParam int) string {
+	return fmt.Sprintf(`%s NOT IN (
+		SELECT type FROM notificationpreferences WHERE user_id = $%d AND in_app = FALSE)`, column, userParam)
+}
@@ -9,17 +9,31 @@ import (
 )
 
 type Notification struct {
-	ID           int64      `json:"id"`
-	UserID       int64      `json:"user_id"`
-	ActorID      int64      `json:"actor_id"`
-	ActorName    string     `json:"actor_name"`
-	ActorPicture string     `json:"actor_picture"`
-	Type         string     `json:"type"`
-	PostID       *int64     `json:"post_id"`
-	ProjectID    *int64     `json:"project_id"`
-	CommentID    *int64     `json:"comment_id"`
-	CreatedAt    time.Time  `json:"created_at"`
-	ReadAt       *time.Time `json:"read_at"`
+	ID             int64      `json:"id"`
+	UserID         int64      `json:"user_id"`
+	ActorID        int64      `json:"actor_id"`
+	ActorName      string     `json:"actor_name"`
+	ActorPicture   string     `json:"actor_picture"`
+	Type           string     `json:"type"`
+	PostID         *int64     `json:"post_id"`
+	ProjectID      *int64     `json:"project_id"`
+	CommentID      *int64     `json:"comment_id"`
+	ConversationID *int64     `json:"conversation_id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReadAt         *time.Time `json:"read_at"`
+	// GroupID ties together notifications of one type about one target. In
+	// grouped listings the fields above describe the newest member, ReadAt
+	// is nil while any member is unread, and Actors holds a few of the most
+	// recent distinct actors.
+	GroupID    int64               `json:"group_id"`
+	ActorCount int                 `json:"actor_count"`
+	Actors     []NotificationActor `json:"actors"`
+}
+
+type NotificationActor struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Picture string `json:"picture"`
 }
 
 type PushToken struct {
@@ -37,6 +51,14 @@ type NotificationInsert struct {
 	PostID    *int64
 	ProjectID *int64
 	CommentID *int64
+	// ConversationID is the group chat the notification is about.
+	ConversationID *int64
+	// GroupWindow joins the notification to an unread group with the same
+	// type and target that was active this recently. Zero never groups.
+	GroupWindow time.Duration
+	// GroupByActor keeps groups to a single actor, for types such as direct
+	// messages whose only target is the actor.
+	GroupByActor bool
 }
 
 func CreateNotification(input NotificationInsert) (*Notification, int, error) {
@@ -45,13 +67,18 @@ func CreateNotification(input NotificationInsert) (*Notification, int, error) {
 	}
 
 	createdAt := time.Now().UTC()
+	groupID, err := findNotificationGroup(input, createdAt)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to group notification: %v", err)
+	}
+
 	query := `INSERT INTO notifications
-		(user_id, actor_id, type, post_id, project_id, comment_id, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		(user_id, actor_id, type, post_id, project_id, comment_id, conversation_id, created_at, group_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id;`
 
 	var id int64
-	err := DB.QueryRow(
+	err = DB.QueryRow(
 		query,
 		input.UserID,
 		input.ActorID,
@@ -59,7 +86,9 @@ func CreateNotification(input NotificationInsert) (*Notification, int, error) {
 		input.PostID,
 		input.ProjectID,
 		input.CommentID,
+		input.ConversationID,
 		createdAt,
+		groupID,
 	).Scan(&id)
 	if err != nil {
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to create notification: %v", err)
@@ -71,100 +100,181 @@ func CreateNotification(input NotificationInsert) (*Notification, int, error) {
 	}
 
 	notification := &Notification{
-		ID:           id,
-		UserID:       input.UserID,
-		ActorID:      input.ActorID,
-		ActorName:    actor.Username,
-		ActorPicture: actor.Picture,
-		Type:         input.Type,
-		PostID:       input.PostID,
-		ProjectID:    input.ProjectID,
-		CommentID:    input.CommentID,
-		CreatedAt:    createdAt,
-		ReadAt:       nil,
+		ID:             id,
+		UserID:         input.UserID,
+		ActorID:        input.ActorID,
+		ActorName:      actor.Username,
+		ActorPicture:   actor.Picture,
+		Type:           input.Type,
+		PostID:         input.PostID,
+		ProjectID:      input.ProjectID,
+		CommentID:      input.CommentID,
+		ConversationID: input.ConversationID,
+		CreatedAt:      createdAt,
+		ReadAt:         nil,
+		GroupID:        id,
+	}
+	if groupID != nil {
+		notification.GroupID = *groupID
 	}
 
 	return notification, http.StatusCreated, nil
 }
 
-func QueryNotificationsByUser(userID int64, start int, count int) ([]Notification, int, error) {
-	query := `SELECT n.id, n.user_id, n.actor_id, u.username, u.picture, n.type,
-		 n.post_id, n.project_id, n.comment_id, n.created_at, n.read_at
-		FROM notifications n
-		JOIN users u ON u.id = n.actor_id
-		WHERE n.user_id = $1
-		ORDER BY n.created_at DESC
-		LIMIT $2 OFFSET $3;`
+// NotificationFilter narrows a notification listing. The zero value lists
+// everything.
+type NotificationFilter struct {
+	// UnreadOnly keeps groups with at least one unread member.
+	UnreadOnly bool
+	Types      []string
+	// ProjectID keeps notifications about the project or its posts.
+	ProjectID *int64
+}
 
-	rows, err := DB.Query(query, userID, count, start)
+// where renders the filter as conditions on notifications n, numbering its
+// parameters after the args already bound.
+func (filter NotificationFilter) where(args []interface{}) (string, []interface{}) {
+	var conditions strings.Builder
+	next := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.UnreadOnly {
+		conditions.WriteString(` AND COALESCE(n.group_id, n.id) IN (
+			SELECT COALESCE(group_id, id) FROM notifications WHERE user_id = $1 AND read_at IS NULL)`)
+	}
+	if len(filter.Types) > 0 {
+		placeholders := make([]string, len(filter.Types))
+		for index, nType := range filter.Types {
+			placeholders[index] = next(nType)
+		}
+		conditions.WriteString(` AND n.type IN (` + strings.Join(placeholders, ", ") + `)`)
+	}
+	if filter.ProjectID != nil {
+		project := next(*filter.ProjectID)
+		conditions.WriteString(` AND (n.project_id = ` + project + ` OR n.post_id IN (
+			SELECT id FROM posts WHERE project_id = ` + project + `))`)
+	}
+	return conditions.String(), args
+}
+
+// QueryNotificationsByUser returns the user's notification groups matching
+// filter, newest activity first.
+func QueryNotificationsByUser(userID int64, filter NotificationFilter, start int, count int) ([]Notification, int, error) {
+	conditions, args := filter.where([]interface{}{userID})
+	args = append(args, count, start)
+	groups, err := queryNotificationGroups(
+		`WHERE n.user_id = $1 AND `+hiddenNotificationTypesFilter("n.type", 1)+conditions,
+		fmt.Sprintf(`LIMIT $%d OFFSET $%d`, len(args)-1, len(args)),
+		args...,
+	)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
-	defer rows.Close()
+	return groups, http.StatusOK, nil
+}
 
-	list := []Notification{}
-	for rows.Next() {
-		var item Notification
-		var postID sql.NullInt64
-		var projectID sql.NullInt64
-		var commentID sql.NullInt64
-		var readAt sql.NullTime
-		if err := rows.Scan(
-			&item.ID,
-			&item.UserID,
-			&item.ActorID,
-			&item.ActorName,
-			&item.ActorPicture,
-			&item.Type,
-			&postID,
-			&projectID,
-			&commentID,
-			&item.CreatedAt,
-			&readAt,
-		); err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-		if postID.Valid {
-			value := postID.Int64
-			item.PostID = &value
-		}
-		if projectID.Valid {
-			value := projectID.Int64
-			item.ProjectID = &value
-		}
-		if commentID.Valid {
-			value := commentID.Int64
-			item.CommentID = &value
-		}
-		if readAt.Valid {
-			value := readAt.Time
-			item.ReadAt = &value
-		}
-		list = append(list, item)
+const notificationColumns = `n.id, n.user_id, n.actor_id, u.username, u.picture, n.type,
+		 n.post_id, n.project_id, n.comment_id, n.conversation_id, n.created_at, n.read_at, COALESCE(n.group_id, n.id)`
+
+func scanNotification(row rowScanner) (*Notification, error) {
+	var item Notification
+	var postID sql.NullInt64
+	var projectID sql.NullInt64
+	var commentID sql.NullInt64
+	var conversationID sql.NullInt64
+	var readAt sql.NullTime
+	if err := row.Scan(
+		&item.ID,
+		&item.UserID,
+		&item.ActorID,
+		&item.ActorName,
+		&item.ActorPicture,
+		&item.Type,
+		&postID,
+		&projectID,
+		&commentID,
+		&conversationID,
+		&item.CreatedAt,
+		&readAt,
+		&item.GroupID,
+	); err != nil {
+		return nil, err
+	}
+	if postID.Valid {
+		value := postID.Int64
+		item.PostID = &value
+	}
+	if projectID.Valid {
+		value := projectID.Int64
+		item.ProjectID = &value
+	}
+	if commentID.Valid {
+		value := commentID.Int64
+		item.CommentID = &value
 	}
+	if conversationID.Valid {
+		value := conversationID.Int64
+		item.ConversationID = &value
+	}
+	if readAt.Valid {
+		value := readAt.Time
+		item.ReadAt = &value
+	}
+	return &item, nil
+}
 
-	return list, http.StatusOK, nil
+// GetNotification returns a notification by id, or nil if it is gone.
+func GetNotification(notificationID int64) (*Notification, error) {
+	row := DB.QueryRow(`SELECT `+notificationColumns+`
+		FROM notifications n
+		JOIN users u ON u.id = n.actor_id
+		WHERE n.id = $1;`, notificationID)
+	item, err := scanNotification(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notification: %w", err)
+	}
+	return item, nil
 }
 
+// MarkNotificationRead marks the group notificationID belongs to as read.
 func MarkNotificationRead(userID int64, notificationID int64) (int, error) {
-	query := `UPDATE notifications SET read_at = $1 WHERE id = $2 AND user_id = $3;`
-	rowsAffected, err := ExecUpdate(query, time.Now().UTC(), notificationID, userID)
-	if err != nil {
-		return http.StatusInternalServerError, err
+	if status, err := requireNotification(userID, notificationID); err != nil {
+		return status, err
 	}
-	if rowsAffected == 0 {
-		return http.StatusNotFound, fmt.Errorf("notification not found")
+	query := `UPDATE notifications SET read_at = $1
+		WHERE user_id = $3 AND read_at IS NULL AND COALESCE(group_id, id) IN (
+			SELECT COALESCE(group_id, id) FROM notifications WHERE id = $2 AND user_id = $3);`
+	if _, err := ExecUpdate(query, time.Now().UTC(), notificationID, userID); err != nil {
+		return http.StatusInternalServerError, err
 	}
 	return http.StatusOK, nil
 }
 
+// DeleteNotification deletes the group notificationID belongs to.
 func DeleteNotification(userID int64, notificationID int64) (int, error) {
-	query := `DELETE FROM notifications WHERE id = $1 AND user_id = $2;`
-	rowsAffected, err := ExecUpdate(query, notificationID, userID)
+	if status, err := requireNotification(userID, notificationID); err != nil {
+		return status, err
+	}
+	query := `DELETE FROM notifications
+		WHERE user_id = $2 AND COALESCE(group_id, id) IN (
+			SELECT COALESCE(group_id, id) FROM notifications WHERE id = $1 AND user_id = $2);`
+	if _, err := ExecUpdate(query, notificationID, userID); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+func requireNotification(userID int64, notificationID int64) (int, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE id = $1 AND user_id = $2;`, notificationID, userID).Scan(&count)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	if rowsAffected == 0 {
+	if count == 0 {
 		return http.StatusNotFound, fmt.Errorf("notification not found")
 	}
 	return http.StatusOK, nil
@@ -179,19 +289,89 @@ func ClearNotifications(userID int64) (int, error) {
 	return http.StatusOK, nil
 }
 
+// MarkAllNotificationsRead marks the user's unread notifications read,
+// optionally only those created at or before before, or of the listed types.
+// It returns how many were marked.
+func MarkAllNotificationsRead(userID int64, before *time.Time, types []string) (int64, error) {
+	args := []interface{}{userID, time.Now().UTC()}
+	query := `UPDATE notifications SET read_at = $2 WHERE user_id = $1 AND read_at IS NULL`
+	if before != nil {
+		args = append(args, before.UTC())
+		query += fmt.Sprintf(` AND created_at <= $%d`, len(args))
+	}
+	if len(types) > 0 {
+		placeholders := make([]string, len(types))
+		for index, nType := range types {
+			args = append(args, nType)
+			placeholders[index] = fmt.Sprintf("$%d", len(args))
+		}
+		query += ` AND type IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+	marked, err := ExecUpdate(query+`;`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+	return marked, nil
+}
+
+// groupsOfNotifications selects the groups the listed notifications of user
+// $1 belong to, binding the ids after args.
+func groupsOfNotifications(ids []int64, args []interface{}) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	for index, id := range ids {
+		args = append(args, id)
+		placeholders[index] = fmt.Sprintf("$%d", len(args))
+	}
+	return `COALESCE(group_id, id) IN (
+		SELECT COALESCE(group_id, id) FROM notifications
+		WHERE user_id = $1 AND id IN (` + strings.Join(placeholders, ", ") + `))`, args
+}
+
+// MarkNotificationsRead marks the groups of the listed notifications read,
+// ignoring ids that are not the user's, and returns how many notifications
+// changed.
+func MarkNotificationsRead(userID int64, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	groups, args := groupsOfNotifications(ids, []interface{}{userID, time.Now().UTC()})
+	marked, err := ExecUpdate(`UPDATE notifications SET read_at = $2
+		WHERE user_id = $1 AND read_at IS NULL AND `+groups+`;`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+	return marked, nil
+}
+
+// DeleteNotifications deletes the groups of the listed notifications,
+// ignoring ids that are not the user's, and returns how many notifications
+// were deleted.
+func DeleteNotifications(userID int64, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	groups, args := groupsOfNotifications(ids, []interface{}{userID})
+	deleted, err := ExecUpdate(`DELETE FROM notifications WHERE user_id = $1 AND `+groups+`;`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete notifications: %w", err)
+	}
+	return deleted, nil
+}
+
 func DeleteNotificationByReference(userID int64, actorID int64, nType string, postID *int64, projectID *int64) (int, error) {
 	query := `DELETE FROM notifications WHERE user_id = $1 AND actor_id = $2 AND type = $3
-		AND (($4::bigint IS NULL AND post_id IS NULL) OR post_id = $4)
-		AND (($5::bigint IS NULL AND project_id IS NULL) OR project_id = $5);`
-	_, err := DB.Exec(query, userID, actorID, nType, postID, projectID)
+		AND COALESCE(post_id, 0) = $4 AND COALESCE(project_id, 0) = $5;`
+	_, err := DB.Exec(query, userID, actorID, nType, int64OrZero(postID), int64OrZero(projectID))
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 	return http.StatusOK, nil
 }
 
+// GetUnreadNotificationCount counts unread notification groups.
 func GetUnreadNotificationCount(userID int64) (int64, int, error) {
-	query := `SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL;`
+	query := `SELECT COUNT(DISTINCT COALESCE(n.group_id, n.id)) FROM notifications n
+		WHERE n.user_id = $1 AND n.read_at IS NULL AND ` + hiddenNotificationTypesFilter("n.type", 1) + `;`
 	row := DB.QueryRow(query, userID)
 	var count int64
 	if err := row.Scan(&count); err != nil {
@@ -48,6 +48,12 @@ func QueryPost(id int) (*Post, error) {
 		return nil, err
 	}
 
+	mentions, err := queryMentions(MentionInPost, []int64{post.ID})
+	if err != nil {
+		return nil, err
+	}
+	post.Mentions = mentions[post.ID]
+
 	return &post, nil
 }
 
@@ -170,6 +176,9 @@ func QueryPostsByUserId(userId int) ([]Post, int, error) {
 		posts = append(posts, post)
 	}
 
+	if err := attachPostMentions(posts); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return posts, http.StatusOK, nil
 }
 
@@ -207,6 +216,9 @@ func QueryPostsByProjectId(projectId int) ([]Post, int, error) {
 		posts = append(posts, post)
 	}
 
+	if err := attachPostMentions(posts); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return posts, http.StatusOK, nil
 }
 
@@ -259,6 +271,9 @@ func QueryPostsByFilter(filter string) ([]Post, error) {
 		}
 		posts = append(posts, post)
 	}
+	if err := attachPostMentions(posts); err != nil {
+		return nil, err
+	}
 	return posts, nil
 }
 
@@ -57,6 +57,12 @@ func QueryProject(id int) (*Project, error) {
 		return nil, err
 	}
 
+	mentions, err := queryMentions(MentionInProject, []int64{project.ID})
+	if err != nil {
+		return nil, err
+	}
+	project.Mentions = mentions[project.ID]
+
 	return &project, nil
 }
 
@@ -117,6 +123,9 @@ func QueryProjectsByUserId(userId int) ([]Project, int, error) {
 		projects = append(projects, project)
 	}
 
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return projects, http.StatusOK, nil
 }
 
@@ -192,6 +201,10 @@ func QueryDeleteProject(id int) (int16, error) {
 		return rollback(fmt.Errorf("Failed to delete project comments for `%v`: %v", id, err))
 	}
 
+	if err := deleteOwnedBots(tx, `SELECT user_id FROM bots WHERE owner_project_id = $1`, id); err != nil {
+		return rollback(err)
+	}
+
 	_, err = tx.Exec(`DELETE FROM posts WHERE project_id = $1;`, id)
 	if err != nil {
 		return rollback(fmt.Errorf("Failed to delete project posts for `%v`: %v", id, err))
@@ -392,6 +405,9 @@ func QueryProjectsByBuilderId(userId int) ([]Project, int, error) {
 		projects = append(projects, project)
 	}
 
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	return projects, http.StatusOK, nil
 }
 
@@ -422,6 +438,43 @@ func QueryProjectBuilders(projectId int) ([]string, int, error) {
 	return builders, http.StatusOK, nil
 }
 
+// QueryProjectBuilderIDs retrieves the user ids of project builders.
+func QueryProjectBuilderIDs(projectId int) ([]int64, error) {
+	return queryUserIDs(`SELECT user_id FROM projectbuilders WHERE project_id = $1 ORDER BY user_id;`, projectId)
+}
+
+// QueryProjectFollowerIDsAfter pages through a project's followers in id
+// order, returning up to limit ids greater than afterID.
+func QueryProjectFollowerIDsAfter(projectId int, afterID int64, limit int) ([]int64, error) {
+	return queryUserIDs(
+		`SELECT user_id FROM projectfollows WHERE project_id = $1 AND user_id > $2 ORDER BY user_id LIMIT $3;`,
+		projectId,
+		afterID,
+		limit,
+	)
+}
+
+func queryUserIDs(query string, args ...interface{}) ([]int64, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user ids: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan user id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("user id rows error: %w", err)
+	}
+	return ids, nil
+}
+
 // QueryIsProjectBuilder checks if a user is a builder for the project.
 func QueryIsProjectBuilder(projectId int, userId int64) (bool, error) {
 	query := `SELECT 1 FROM projectbuilders WHERE project_id = $1 AND user_id = $2 LIMIT 1;`
@@ -877,5 +930,8 @@ func QueryProjectsByFilter(filter string) ([]Project, error) {
 		}
 		projects = append(projects, project)
 	}
+	if err := attachProjectMentions(projects); err != nil {
+		return nil, err
+	}
 	return projects, nil
 }
@@ -0,0 +1,305 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Push queue statuses. A claimed push is "sending" until its outcome is
+// recorded; if the worker dies first, the claim lapses and it is sent again.
+const (
+	PushPending = "pending"
+	PushSending = "sending"
+	PushSent    = "sent"
+	PushFailed  = "failed"
+)
+
+// QueuedPush is one message waiting for, or being sent to, one device.
+type QueuedPush struct {
+	ID        int64
+	Token     string
+	Platform  string
+	Message   string
+	Attempts  int
+	ReceiptID string
+}
+
+type PushPlatformStats struct {
+	Pending int64 `json:"pending"`
+	Sending int64 `json:"sending"`
+	Sent    int64 `json:"sent"`
+	Failed  int64 `json:"failed"`
+}
+
+// PushQueueStats summarizes the retained push queue for admins.
+type PushQueueStats struct {
+	PushPlatformStats
+	// Retrying counts pending pushes that have failed at least once.
+	Retrying        int64                        `json:"retrying"`
+	AwaitingReceipt int64                        `json:"awaiting_receipt"`
+	OldestPendingAt *time.Time                   `json:"oldest_pending_at"`
+	Platforms       map[string]PushPlatformStats `json:"platforms"`
+}
+
+// EnqueuePushes queues message for every device userID registered and
+// returns how many were queued.
+func EnqueuePushes(userID int64, message string, now time.Time) (int64, error) {
+	queued, err := ExecUpdate(
+		`INSERT INTO pushqueue (user_id, token, platform, message, status, attempts, next_attempt_at, created_at)
+		SELECT user_id, token, COALESCE(platform, ''), $2, $3, 0, $4, $4 FROM userpushtokens WHERE user_id = $1;`,
+		userID,
+		message,
+		PushPending,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue pushes: %w", err)
+	}
+	return queued, nil
+}
+
+// ClaimQueuedPushes marks up to limit due pushes as sending until lease and
+// returns them. Only one caller can claim a push, so several API instances
+// can drain the queue together.
+func ClaimQueuedPushes(now time.Time, lease time.Time, limit int) ([]QueuedPush, error) {
+	rows, err := DB.Query(
+		`UPDATE pushqueue SET status = $1, attempts = attempts + 1, next_attempt_at = $2
+		WHERE status IN ($3, $1) AND next_attempt_at <= $4 AND id IN (
+			SELECT id FROM pushqueue WHERE status IN ($3, $1) AND next_attempt_at <= $4 ORDER BY id LIMIT $5)
+		RETURNING id, token, platform, message, attempts;`,
+		PushSending,
+		lease.UTC(),
+		PushPending,
+		now.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pushes: %w", err)
+	}
+	defer rows.Close()
+
+	pushes := make([]QueuedPush, 0)
+	for rows.Next() {
+		var push QueuedPush
+		if err := rows.Scan(&push.ID, &push.Token, &push.Platform, &push.Message, &push.Attempts); err != nil {
+			return nil, fmt.Errorf("failed to scan claimed push: %w", err)
+		}
+		pushes = append(pushes, push)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claimed push rows error: %w", err)
+	}
+	return pushes, nil
+}
+
+// MarkPushSent records a delivered push. receiptID, when set, is checked
+// later with the provider.
+func MarkPushSent(id int64, receiptID string, now time.Time) error {
+	var receipt interface{}
+	if receiptID != "" {
+		receipt = receiptID
+	}
+	_, err := DB.Exec(
+		`UPDATE pushqueue SET status = $1, receipt_id = $2, sent_at = $3, last_error = NULL WHERE id = $4;`,
+		PushSent,
+		receipt,
+		now.UTC(),
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark push sent: %w", err)
+	}
+	return nil
+}
+
+// RetryPush puts a push back in the queue until at. A retry that should not
+// count against the attempt limit, such as one the provider asked for with a
+// 429, passes countAttempt false.
+func RetryPush(id int64, at time.Time, reason string, countAttempt bool) error {
+	refund := 1
+	if countAttempt {
+		refund = 0
+	}
+	_, err := DB.Exec(
+		`UPDATE pushqueue SET status = $1, next_attempt_at = $2, last_error = $3, attempts = attempts - $4 WHERE id = $5;`,
+		PushPending,
+		at.UTC(),
+		reason,
+		refund,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule push: %w", err)
+	}
+	return nil
+}
+
+// MarkPushFailed gives up on a push.
+func MarkPushFailed(id int64, reason string) error {
+	_, err := DB.Exec(
+		`UPDATE pushqueue SET status = $1, last_error = $2, receipt_id = NULL WHERE id = $3;`,
+		PushFailed,
+		reason,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark push failed: %w", err)
+	}
+	return nil
+}
+
+// PrunePushToken forgets a token the provider no longer knows and fails the
+// pushes still queued for it.
+func PrunePushToken(token string, reason string) error {
+	if _, err := DeletePushToken(token); err != nil {
+		return fmt.Errorf("failed to delete push token: %w", err)
+	}
+	_, err := DB.Exec(
+		`UPDATE pushqueue SET status = $1, last_error = $2 WHERE token = $3 AND status IN ($4, $5);`,
+		PushFailed,
+		reason,
+		token,
+		PushPending,
+		PushSending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to drop pushes for token: %w", err)
+	}
+	return nil
+}
+
+// QueryPendingReceipts returns up to limit sent pushes whose receipts are due,
+// that is, pushes sent at or before sentBefore.
+func QueryPendingReceipts(sentBefore time.Time, limit int) ([]QueuedPush, error) {
+	rows, err := DB.Query(
+		`SELECT id, token, platform, receipt_id FROM pushqueue
+		WHERE status = $1 AND receipt_id IS NOT NULL AND sent_at <= $2
+		ORDER BY id
+		LIMIT $3;`,
+		PushSent,
+		sentBefore.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query push receipts: %w", err)
+	}
+	defer rows.Close()
+
+	pushes := make([]QueuedPush, 0)
+	for rows.Next() {
+		var push QueuedPush
+		if err := rows.Scan(&push.ID, &push.Token, &push.Platform, &push.ReceiptID); err != nil {
+			return nil, fmt.Errorf("failed to scan push receipt: %w", err)
+		}
+		pushes = append(pushes, push)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("push receipt rows error: %w", err)
+	}
+	return pushes, nil
+}
+
+// ClearPushReceipts stops checking the receipts of the listed pushes.
+func ClearPushReceipts(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for index, id := range ids {
+		placeholders[index] = fmt.Sprintf("$%d", index+1)
+		args[index] = id
+	}
+	_, err := DB.Exec(`UPDATE pushqueue SET receipt_id = NULL WHERE id IN (`+strings.Join(placeholders, ", ")+`);`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to clear push receipts: %w", err)
+	}
+	return nil
+}
+
+// ExpirePushReceipts stops checking receipts for pushes sent before before,
+// which providers no longer keep.
+func ExpirePushReceipts(before time.Time) error {
+	_, err := DB.Exec(
+		`UPDATE pushqueue SET receipt_id = NULL WHERE receipt_id IS NOT NULL AND sent_at < $1;`,
+		before.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to expire push receipts: %w", err)
+	}
+	return nil
+}
+
+// PrunePushQueue deletes finished pushes created before before.
+func PrunePushQueue(before time.Time) error {
+	_, err := DB.Exec(
+		`DELETE FROM pushqueue WHERE status IN ($1, $2) AND receipt_id IS NULL AND created_at < $3;`,
+		PushSent,
+		PushFailed,
+		before.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune push queue: %w", err)
+	}
+	return nil
+}
+
+func GetPushQueueStats() (*PushQueueStats, error) {
+	rows, err := DB.Query(
+		`SELECT platform, status, COUNT(*),
+			SUM(CASE WHEN attempts > 0 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN receipt_id IS NOT NULL THEN 1 ELSE 0 END)
+		FROM pushqueue
+		GROUP BY platform, status;`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query push stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := &PushQueueStats{Platforms: make(map[string]PushPlatformStats)}
+	for rows.Next() {
+		var platform, status string
+		var count, attempted, awaiting int64
+		if err := rows.Scan(&platform, &status, &count, &attempted, &awaiting); err != nil {
+			return nil, fmt.Errorf("failed to scan push stats: %w", err)
+		}
+		platformStats := stats.Platforms[platform]
+		switch status {
+		case PushPending:
+			platformStats.Pending += count
+			stats.Pending += count
+			stats.Retrying += attempted
+		case PushSending:
+			platformStats.Sending += count
+			stats.Sending += count
+		case PushSent:
+			platformStats.Sent += count
+			stats.Sent += count
+			stats.AwaitingReceipt += awaiting
+		case PushFailed:
+			platformStats.Failed += count
+			stats.Failed += count
+		}
+		stats.Platforms[platform] = platformStats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("push stats rows error: %w", err)
+	}
+
+	var oldest time.Time
+	err = DB.QueryRow(
+		`SELECT created_at FROM pushqueue WHERE status IN ($1, $2) ORDER BY created_at LIMIT 1;`,
+		PushPending,
+		PushSending,
+	).Scan(&oldest)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query oldest pending push: %w", err)
+	}
+	if err == nil {
+		stats.OldestPendingAt = &oldest
+	}
+	return stats, nil
+}
@@ -13,6 +13,7 @@ type Post struct {
 	Content      string    `json:"content" binding:"required"`
 	Media        []string  `json:"media"`
 	CreationDate time.Time `json:"created_on"`
+	Mentions     []Mention `json:"mentions,omitempty"`
 }
 
 type Project struct {
@@ -28,4 +29,5 @@ type Project struct {
 	Links        []string  `json:"links"`
 	Media        []string  `json:"media"`
 	CreationDate time.Time `json:"creation_date"`
+	Mentions     []Mention `json:"mentions,omitempty"`
 }
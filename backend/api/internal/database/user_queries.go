@@ -17,6 +17,10 @@ type ApiUser struct {
 	Links        []string               `json:"links"`
 	Settings     map[string]interface{} `json:"settings"`
 	CreationDate string                 `json:"creation_date"`
+	IsBot        bool                   `json:"is_bot,omitempty"`
+	// BotOwner says who runs a bot. It is only filled in when looking up a
+	// single user.
+	BotOwner *BotOwner `json:"bot_owner,omitempty"`
 }
 
 type UserLoginInfo struct {
@@ -32,6 +36,7 @@ func scanApiUserRow(rows *sql.Rows) (*ApiUser, error) {
 	var links []byte
 	var settings []byte
 	var creationDate sql.NullString
+	var isBot bool
 
 	if err := rows.Scan(
 		&id,
@@ -41,6 +46,7 @@ func scanApiUserRow(rows *sql.Rows) (*ApiUser, error) {
 		&links,
 		&settings,
 		&creationDate,
+		&isBot,
 	); err != nil {
 		return nil, err
 	}
@@ -56,6 +62,7 @@ func scanApiUserRow(rows *sql.Rows) (*ApiUser, error) {
 		Picture:      picture.String,
 		Bio:          bio.String,
 		CreationDate: creationDate.String,
+		IsBot:        isBot,
 		Links:        []string{},
 		Settings:     map[string]interface{}{},
 	}
@@ -76,6 +83,15 @@ func scanApiUserRow(rows *sql.Rows) (*ApiUser, error) {
 
 // CreateUser inserts a new user into the database
 func CreateUser(user *ApiUser) (int, error) {
+	return insertUser(DB, user)
+}
+
+// userInserter is a *sql.DB or *sql.Tx.
+type userInserter interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func insertUser(db userInserter, user *ApiUser) (int, error) {
 	linksJson, err := json.Marshal(user.Links)
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal links: %w", err)
@@ -87,12 +103,12 @@ func CreateUser(user *ApiUser) (int, error) {
 
 	// Use $1, $2, etc. for parameter placeholders in PostgreSQL
 	query := `
-		INSERT INTO users (username, picture, bio, links, settings, creation_date)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (username, picture, bio, links, settings, creation_date, is_bot)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id;
 	`
 	var newId int
-	err = DB.QueryRow(
+	err = db.QueryRow(
 		query,
 		user.Username,
 		user.Picture,
@@ -100,6 +116,7 @@ func CreateUser(user *ApiUser) (int, error) {
 		linksJson,
 		settingsJson,
 		time.Now().UTC().Format("2006-01-02 15:04:05"),
+		user.IsBot,
 	).Scan(&newId)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert user: %w", err)
@@ -110,7 +127,7 @@ func CreateUser(user *ApiUser) (int, error) {
 // GetUserByUsername retrieves a user by their username
 func GetUserByUsername(username string) (*ApiUser, error) {
 	query := `
-		SELECT id, username, picture, bio, links, settings, creation_date
+		SELECT id, username, picture, bio, links, settings, creation_date, is_bot
 		FROM users
 		WHERE LOWER(username) = LOWER($1)
 		ORDER BY CASE WHEN username = $1 THEN 0 ELSE 1 END, id ASC
@@ -126,6 +143,7 @@ func GetUserByUsername(username string) (*ApiUser, error) {
 		&links,
 		&settings,
 		&user.CreationDate,
+		&user.IsBot,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -141,13 +159,19 @@ func GetUserByUsername(username string) (*ApiUser, error) {
 		log.Printf("WARN: could not unmarshal user settings: %v", err)
 	}
 
+	if user.IsBot {
+		if user.BotOwner, err = GetBotOwner(int64(user.Id)); err != nil {
+			return nil, err
+		}
+	}
+
 	return user, nil
 }
 
 // GetUserById retrieves a user by their ID
 func GetUserById(id int) (*ApiUser, error) {
 	query := `
-		SELECT id, username, picture, bio, links, settings, creation_date
+		SELECT id, username, picture, bio, links, settings, creation_date, is_bot
 		FROM users
 		WHERE id = $1;
 	`
@@ -161,6 +185,7 @@ func GetUserById(id int) (*ApiUser, error) {
 		&links,
 		&settings,
 		&user.CreationDate,
+		&user.IsBot,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -176,6 +201,12 @@ func GetUserById(id int) (*ApiUser, error) {
 		log.Printf("WARN: could not unmarshal user settings: %v", err)
 	}
 
+	if user.IsBot {
+		if user.BotOwner, err = GetBotOwner(int64(user.Id)); err != nil {
+			return nil, err
+		}
+	}
+
 	return user, nil
 }
 
@@ -251,6 +282,15 @@ func DeleteUser(username string) error {
 		return rollback(fmt.Errorf("failed to delete comments linked to user-owned content: %w", err))
 	}
 
+	err = deleteOwnedBots(
+		tx,
+		`SELECT user_id FROM bots WHERE owner_user_id = $1 OR owner_project_id IN (SELECT id FROM projects WHERE owner = $1)`,
+		userID,
+	)
+	if err != nil {
+		return rollback(err)
+	}
+
 	if _, err := tx.Exec("DELETE FROM userlogininfo WHERE username = $1", username); err != nil {
 		return rollback(fmt.Errorf("failed to delete user login info: %w", err))
 	}
@@ -280,15 +320,22 @@ func DeleteUser(username string) error {
 }
 
 // SearchUsers retrieves users whose username starts with the given prefix (case-insensitive), limited to the specified limit.
-func SearchUsers(prefix string, limit int) ([]*ApiUser, error) {
-	query := `
-		SELECT id, username, picture, bio, links, settings, creation_date
+// Users viewerID blocked or was blocked by are left out; pass 0 for anonymous searches.
+func SearchUsers(prefix string, limit int, viewerID int64) ([]*ApiUser, error) {
+	args := []interface{}{prefix + "%", limit}
+	hidden := ""
+	if filter := hiddenAuthorsFilter("id", 3, viewerID, false); filter != "" {
+		hidden = "AND " + filter
+		args = append(args, viewerID)
+	}
+	query := fmt.Sprintf(`
+		SELECT id, username, picture, bio, links, settings, creation_date, is_bot
 		FROM users
-		WHERE LOWER(username) LIKE LOWER($1) AND id > 0
+		WHERE LOWER(username) LIKE LOWER($1) AND id > 0 %s
 		ORDER BY username ASC
 		LIMIT $2;
-	`
-	rows, err := DB.Query(query, prefix+"%", limit)
+	`, hidden)
+	rows, err := DB.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search users: %w", err)
 	}
@@ -306,6 +353,7 @@ func SearchUsers(prefix string, limit int) ([]*ApiUser, error) {
 			&links,
 			&settings,
 			&user.CreationDate,
+			&user.IsBot,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan user row: %w", err)
 		}
@@ -327,7 +375,7 @@ func SearchUsers(prefix string, limit int) ([]*ApiUser, error) {
 // GetUsers retrieves a list of all users
 func GetUsers() ([]*ApiUser, error) {
 	query := `
-		SELECT id, username, picture, bio, links, settings, creation_date
+		SELECT id, username, picture, bio, links, settings, creation_date, is_bot
 		FROM users;
 	`
 	rows, err := DB.Query(query)
@@ -356,7 +404,7 @@ func GetUsers() ([]*ApiUser, error) {
 func QueryUsersByFilter(filter string) ([]*ApiUser, error) {
 	like := "%" + strings.ToLower(strings.TrimSpace(filter)) + "%"
 	query := `
-		SELECT id, username, picture, bio, links, settings, creation_date
+		SELECT id, username, picture, bio, links, settings, creation_date, is_bot
 		FROM users
 		WHERE LOWER(username) LIKE $1
 		ORDER BY id
@@ -446,7 +494,7 @@ func GetUserFollowers(username string) ([]*ApiUser, error) {
 	}
 
 	query := `
-		SELECT u.id, u.username, u.picture, u.bio, u.links, u.settings, u.creation_date
+		SELECT u.id, u.username, u.picture, u.bio, u.links, u.settings, u.creation_date, u.is_bot
 		FROM users u
 		JOIN userfollows f ON u.id = f.follower_id
 		WHERE f.followed_id = $1
@@ -470,6 +518,7 @@ func GetUserFollowers(username string) ([]*ApiUser, error) {
 			&links,
 			&settings,
 			&follower.CreationDate,
+			&follower.IsBot,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan follower row: %w", err)
 		}
@@ -497,7 +546,7 @@ func GetUserFollowing(username string) ([]*ApiUser, error) {
 	}
 
 	query := `
-		SELECT u.id, u.username, u.picture, u.bio, u.links, u.settings, u.creation_date
+		SELECT u.id, u.username, u.picture, u.bio, u.links, u.settings, u.creation_date, u.is_bot
 		FROM users u
 		JOIN userfollows f ON u.id = f.followed_id
 		WHERE f.follower_id = $1
@@ -521,6 +570,7 @@ func GetUserFollowing(username string) ([]*ApiUser, error) {
 			&links,
 			&settings,
 			&followed.CreationDate,
+			&followed.IsBot,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan followed row: %w", err)
 		}
@@ -0,0 +1,478 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Webhook delivery statuses. Like the push queue, a claimed delivery is
+// "sending" until its outcome is recorded, and is sent again if the claim
+// lapses first.
+const (
+	WebhookPending   = "pending"
+	WebhookSending   = "sending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// ProjectWebhook is an endpoint outside DevBits that hears about activity in
+// a project.
+type ProjectWebhook struct {
+	ID                  int64      `json:"id"`
+	ProjectID           int64      `json:"project_id"`
+	URL                 string     `json:"url"`
+	Secret              string     `json:"-"`
+	Events              []string   `json:"events"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	CreatedBy           *int64     `json:"created_by"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to one webhook, with the
+// outcome of its latest attempt.
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+	ResponseCode  *int64          `json:"response_code"`
+	ResponseBody  *string         `json:"response_body"`
+	Error         *string         `json:"error"`
+	DurationMS    *int64          `json:"duration_ms"`
+	RedeliveryOf  *int64          `json:"redelivery_of"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+}
+
+// WebhookAttempt is what happened when a delivery was sent. ResponseCode is
+// zero when no response came back.
+type WebhookAttempt struct {
+	ResponseCode int
+	ResponseBody string
+	Error        string
+	Duration     time.Duration
+}
+
+const projectWebhookColumns = `id, project_id, url, secret, COALESCE(events, '[]'), active,
+	consecutive_failures, disabled_at, created_by, created_at`
+
+func scanProjectWebhook(row rowScanner) (*ProjectWebhook, error) {
+	var webhook ProjectWebhook
+	var eventsJSON string
+	var disabledAt sql.NullTime
+	var createdBy sql.NullInt64
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.ProjectID,
+		&webhook.URL,
+		&webhook.Secret,
+		&eventsJSON,
+		&webhook.Active,
+		&webhook.ConsecutiveFailures,
+		&disabledAt,
+		&createdBy,
+		&webhook.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := UnmarshalFromJSON(eventsJSON, &webhook.Events); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook events: %w", err)
+	}
+	webhook.DisabledAt = nullTimePointer(disabledAt)
+	webhook.CreatedBy = nullInt64Pointer(createdBy)
+	return &webhook, nil
+}
+
+// CreateProjectWebhook stores a new webhook and returns its id.
+func CreateProjectWebhook(webhook ProjectWebhook, now time.Time) (int64, error) {
+	eventsJSON, err := MarshalToJSON(webhook.Events)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode webhook events: %w", err)
+	}
+	var id int64
+	err = DB.QueryRow(
+		`INSERT INTO projectwebhooks (project_id, url, secret, events, active, consecutive_failures, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, 0, $6, $7) RETURNING id;`,
+		webhook.ProjectID,
+		webhook.URL,
+		webhook.Secret,
+		eventsJSON,
+		webhook.Active,
+		webhook.CreatedBy,
+		now.UTC(),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	return id, nil
+}
+
+// QueryProjectWebhooks returns projectID's webhooks, oldest first.
+func QueryProjectWebhooks(projectID int64) ([]ProjectWebhook, error) {
+	rows, err := DB.Query(
+		`SELECT `+projectWebhookColumns+` FROM projectwebhooks WHERE project_id = $1 ORDER BY id;`,
+		projectID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]ProjectWebhook, 0)
+	for rows.Next() {
+		webhook, err := scanProjectWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("webhook rows error: %w", err)
+	}
+	return webhooks, nil
+}
+
+// QueryProjectWebhook returns webhookID if it belongs to projectID.
+func QueryProjectWebhook(projectID int64, webhookID int64) (*ProjectWebhook, error) {
+	webhook, err := scanProjectWebhook(DB.QueryRow(
+		`SELECT `+projectWebhookColumns+` FROM projectwebhooks WHERE id = $1 AND project_id = $2;`,
+		webhookID,
+		projectID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// GetProjectWebhook returns a webhook by id alone, for the delivery worker.
+func GetProjectWebhook(webhookID int64) (*ProjectWebhook, error) {
+	webhook, err := scanProjectWebhook(DB.QueryRow(
+		`SELECT `+projectWebhookColumns+` FROM projectwebhooks WHERE id = $1;`,
+		webhookID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook: %w", err)
+	}
+	return webhook, nil
+}
+
+// UpdateProjectWebhook stores a webhook's url, secret, events and whether it
+// is active. Turning a webhook on clears its failure streak.
+func UpdateProjectWebhook(webhook ProjectWebhook) error {
+	eventsJSON, err := MarshalToJSON(webhook.Events)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook events: %w", err)
+	}
+	_, err = DB.Exec(
+		`UPDATE projectwebhooks SET url = $1, secret = $2, events = $3, active = $4,
+			consecutive_failures = CASE WHEN $4 AND NOT active THEN 0 ELSE consecutive_failures END,
+			disabled_at = CASE WHEN $4 THEN NULL ELSE disabled_at END
+		WHERE id = $5;`,
+		webhook.URL,
+		webhook.Secret,
+		eventsJSON,
+		webhook.Active,
+		webhook.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	return nil
+}
+
+// DeleteProjectWebhook deletes webhookID and its delivery log, and reports
+// whether it belonged to projectID.
+func DeleteProjectWebhook(projectID int64, webhookID int64) (bool, error) {
+	deleted, err := ExecUpdate(`DELETE FROM projectwebhooks WHERE id = $1 AND project_id = $2;`, webhookID, projectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// QueryActiveProjectWebhooks returns the webhooks that should hear about
+// projectID's activity.
+func QueryActiveProjectWebhooks(projectID int64) ([]ProjectWebhook, error) {
+	rows, err := DB.Query(
+		`SELECT `+projectWebhookColumns+` FROM projectwebhooks WHERE project_id = $1 AND active = $2 ORDER BY id;`,
+		projectID,
+		true,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]ProjectWebhook, 0)
+	for rows.Next() {
+		webhook, err := scanProjectWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("webhook rows error: %w", err)
+	}
+	return webhooks, nil
+}
+
+// EnqueueWebhookDelivery queues payload for webhookID and returns the new
+// delivery's id. redeliveryOf names the delivery being sent again, if any.
+func EnqueueWebhookDelivery(webhookID int64, event string, payload string, redeliveryOf *int64, now time.Time) (int64, error) {
+	var id int64
+	err := DB.QueryRow(
+		`INSERT INTO webhookdeliveries (webhook_id, event, payload, status, attempts, next_attempt_at, redelivery_of, created_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $6, $5) RETURNING id;`,
+		webhookID,
+		event,
+		payload,
+		WebhookPending,
+		now.UTC(),
+		redeliveryOf,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue webhook delivery: %w", err)
+	}
+	return id, nil
+}
+
+// ClaimWebhookDeliveries marks up to limit due deliveries to active webhooks
+// as sending until lease and returns them, without their outcomes.
+func ClaimWebhookDeliveries(now time.Time, lease time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := DB.Query(
+		`UPDATE webhookdeliveries SET status = $1, attempts = attempts + 1, next_attempt_at = $2
+		WHERE id IN (
+			SELECT d.id FROM webhookdeliveries d
+			JOIN projectwebhooks w ON w.id = d.webhook_id
+			WHERE d.status IN ($3, $1) AND d.next_attempt_at <= $4 AND w.active = $5
+			ORDER BY d.id LIMIT $6)
+		RETURNING id, webhook_id, event, payload, attempts, created_at;`,
+		WebhookSending,
+		lease.UTC(),
+		WebhookPending,
+		now.UTC(),
+		true,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Attempts, &delivery.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan claimed webhook delivery: %w", err)
+		}
+		delivery.Payload = json.RawMessage(payload)
+		delivery.Status = WebhookSending
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claimed webhook delivery rows error: %w", err)
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of a delivery's latest attempt and
+// moves it to status. A pending delivery is tried again at nextAttemptAt.
+func RecordWebhookAttempt(id int64, status string, attempt WebhookAttempt, nextAttemptAt time.Time, now time.Time) error {
+	var responseCode, responseBody, lastError, deliveredAt interface{}
+	if attempt.ResponseCode != 0 {
+		responseCode = attempt.ResponseCode
+		responseBody = attempt.ResponseBody
+	}
+	if attempt.Error != "" {
+		lastError = attempt.Error
+	}
+	if status == WebhookDelivered {
+		deliveredAt = now.UTC()
+	}
+	_, err := DB.Exec(
+		`UPDATE webhookdeliveries SET status = $1, next_attempt_at = $2, response_code = $3, response_body = $4,
+			last_error = $5, duration_ms = $6, delivered_at = $7
+		WHERE id = $8;`,
+		status,
+		nextAttemptAt.UTC(),
+		responseCode,
+		responseBody,
+		lastError,
+		attempt.Duration.Milliseconds(),
+		deliveredAt,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %w", err)
+	}
+	return nil
+}
+
+// ResetWebhookFailures ends webhookID's failure streak after a delivery got
+// through.
+func ResetWebhookFailures(webhookID int64) error {
+	if _, err := DB.Exec(`UPDATE projectwebhooks SET consecutive_failures = 0 WHERE id = $1;`, webhookID); err != nil {
+		return fmt.Errorf("failed to reset webhook failures: %w", err)
+	}
+	return nil
+}
+
+// RecordWebhookFailure adds a failed attempt to webhookID's streak. Once the
+// streak reaches disableAfter the webhook is turned off and its queued
+// deliveries fail; the result reports whether this call turned it off.
+func RecordWebhookFailure(webhookID int64, disableAfter int, now time.Time) (bool, error) {
+	if _, err := DB.Exec(`UPDATE projectwebhooks SET consecutive_failures = consecutive_failures + 1 WHERE id = $1;`, webhookID); err != nil {
+		return false, fmt.Errorf("failed to record webhook failure: %w", err)
+	}
+	disabled, err := ExecUpdate(
+		`UPDATE projectwebhooks SET active = $1, disabled_at = $2
+		WHERE id = $3 AND active = $4 AND consecutive_failures >= $5;`,
+		false,
+		now.UTC(),
+		webhookID,
+		true,
+		disableAfter,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to disable webhook: %w", err)
+	}
+	if disabled == 0 {
+		return false, nil
+	}
+	_, err = DB.Exec(
+		`UPDATE webhookdeliveries SET status = $1, last_error = COALESCE(last_error, $2)
+		WHERE webhook_id = $3 AND status IN ($4, $5);`,
+		WebhookFailed,
+		"webhook disabled",
+		webhookID,
+		WebhookPending,
+		WebhookSending,
+	)
+	if err != nil {
+		return true, fmt.Errorf("failed to drop deliveries for disabled webhook: %w", err)
+	}
+	return true, nil
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at, response_code,
+	response_body, last_error, duration_ms, redelivery_of, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	var responseCode, durationMS, redeliveryOf sql.NullInt64
+	var responseBody, lastError sql.NullString
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&nextAttemptAt,
+		&responseCode,
+		&responseBody,
+		&lastError,
+		&durationMS,
+		&redeliveryOf,
+		&delivery.CreatedAt,
+		&deliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	if delivery.Status == WebhookPending {
+		delivery.NextAttemptAt = nullTimePointer(nextAttemptAt)
+	}
+	delivery.ResponseCode = nullInt64Pointer(responseCode)
+	if responseBody.Valid {
+		delivery.ResponseBody = &responseBody.String
+	}
+	if lastError.Valid {
+		delivery.Error = &lastError.String
+	}
+	delivery.DurationMS = nullInt64Pointer(durationMS)
+	delivery.RedeliveryOf = nullInt64Pointer(redeliveryOf)
+	delivery.DeliveredAt = nullTimePointer(deliveredAt)
+	return &delivery, nil
+}
+
+// QueryWebhookDeliveries returns count of webhookID's deliveries from start,
+// newest first.
+func QueryWebhookDeliveries(webhookID int64, start int, count int) ([]WebhookDelivery, error) {
+	rows, err := DB.Query(
+		`SELECT `+webhookDeliveryColumns+` FROM webhookdeliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`,
+		webhookID,
+		count,
+		start,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("webhook delivery rows error: %w", err)
+	}
+	return deliveries, nil
+}
+
+// QueryWebhookDelivery returns deliveryID if it was made to webhookID.
+func QueryWebhookDelivery(webhookID int64, deliveryID int64) (*WebhookDelivery, error) {
+	delivery, err := scanWebhookDelivery(DB.QueryRow(
+		`SELECT `+webhookDeliveryColumns+` FROM webhookdeliveries WHERE id = $1 AND webhook_id = $2;`,
+		deliveryID,
+		webhookID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook delivery: %w", err)
+	}
+	return delivery, nil
+}
+
+// PruneWebhookDeliveries deletes finished deliveries created before before.
+func PruneWebhookDeliveries(before time.Time) error {
+	_, err := DB.Exec(
+		`DELETE FROM webhookdeliveries WHERE status IN ($1, $2) AND created_at < $3;`,
+		WebhookDelivered,
+		WebhookFailed,
+		before.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune webhook deliveries: %w", err)
+	}
+	return nil
+}
@@ -14,6 +14,7 @@ import (
 
 const authUserIDKey = "authUserID"
 const authUsernameKey = "authUsername"
+const authBotKey = "authBot"
 
 func RequireAuth() gin.HandlerFunc {
 	return func(context *gin.Context) {
@@ -25,6 +26,14 @@ func RequireAuth() gin.HandlerFunc {
 		}
 
 		token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		if auth.IsBotToken(token) {
+			if !authenticateBot(context, token) {
+				context.Abort()
+				return
+			}
+			context.Next()
+			return
+		}
 		claims, err := auth.ParseToken(token)
 		if err != nil {
 			RespondWithError(context, http.StatusUnauthorized, "Invalid auth token")
@@ -38,6 +47,26 @@ func RequireAuth() gin.HandlerFunc {
 	}
 }
 
+// OptionalAuth identifies the caller when a valid token is sent, so public
+// routes can tailor results to them, and lets anonymous requests through.
+func OptionalAuth() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		authorization := context.GetHeader("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+			if auth.IsBotToken(token) {
+				if botToken, err := lookupBotToken(token); err == nil && botToken != nil {
+					setBotIdentity(context, botToken)
+				}
+			} else if claims, err := auth.ParseToken(token); err == nil {
+				context.Set(authUserIDKey, claims.UserID)
+				context.Set(authUsernameKey, claims.Username)
+			}
+		}
+		context.Next()
+	}
+}
+
 func RequireAdmin() gin.HandlerFunc {
 	return func(context *gin.Context) {
 		adminKey := os.Getenv("DEVBITS_ADMIN_KEY")
@@ -68,7 +68,7 @@ func Register(context *gin.Context) {
 	}
 
 	if strings.TrimSpace(newUser.Picture) != "" {
-		storedPicture, err := materializeMediaReference(newUser.Picture)
+		storedPicture, err := materializeMediaReference(0, newUser.Picture)
 		if err != nil {
 			RespondWithError(context, http.StatusBadRequest, "Invalid picture media reference")
 			return
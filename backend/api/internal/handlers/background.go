@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Work that outlives the request which started it (presence updates,
+// notification fan-outs, queue runs, periodic workers and open streams) is
+// tracked here, so shutdown can stop it and wait for it before the database
+// goes away.
+var background = newBackgroundWork()
+
+type backgroundWork struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping bool
+}
+
+func newBackgroundWork() *backgroundWork {
+	work := &backgroundWork{}
+	work.ctx, work.cancel = context.WithCancel(context.Background())
+	return work
+}
+
+// track registers one unit of work and returns the context it should stop on
+// and the callback to run when it is done. It reports false once shutdown
+// has begun, in which case the work must not start.
+func (w *backgroundWork) track() (context.Context, func(), bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping {
+		return nil, nil, false
+	}
+	w.wg.Add(1)
+	return w.ctx, w.wg.Done, true
+}
+
+// goBackground runs fn in a tracked goroutine. fn should return soon after
+// its context ends. It reports whether fn was started.
+func goBackground(fn func(ctx context.Context)) bool {
+	ctx, done, ok := background.track()
+	if !ok {
+		return false
+	}
+	go func() {
+		defer done()
+		fn(ctx)
+	}()
+	return true
+}
+
+// runEvery calls fn now and then every interval until shutdown.
+func runEvery(interval time.Duration, fn func()) {
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			fn()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// StopBackgroundWork cancels tracked work, waits for it to return and then
+// accepts new work again. It gives up waiting after timeout and reports
+// whether everything finished.
+func StopBackgroundWork(timeout time.Duration) bool {
+	background.mu.Lock()
+	background.stopping = true
+	background.cancel()
+	background.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		background.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		return false
+	}
+
+	background.mu.Lock()
+	background.ctx, background.cancel = context.WithCancel(context.Background())
+	background.stopping = false
+	background.mu.Unlock()
+	return true
+}
+
+// queueRunner runs a queue drain in the background on demand. Kicks that
+// arrive while it is running collapse into one more run, and nothing is left
+// running once the queue is idle.
+type queueRunner struct {
+	mu      sync.Mutex
+	running bool
+	pending bool
+	run     func()
+}
+
+func (q *queueRunner) kick() {
+	q.mu.Lock()
+	if q.running {
+		q.pending = true
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	q.mu.Unlock()
+
+	started := goBackground(func(ctx context.Context) {
+		for {
+			q.run()
+			q.mu.Lock()
+			if !q.pending || ctx.Err() != nil {
+				q.running = false
+				q.pending = false
+				q.mu.Unlock()
+				return
+			}
+			q.pending = false
+			q.mu.Unlock()
+		}
+	})
+	if !started {
+		q.mu.Lock()
+		q.running = false
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"backend/api/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isBlockedBetweenUsernames reports whether either user blocked the other.
+// Unknown usernames are not blocked; the caller's own lookup reports them.
+func isBlockedBetweenUsernames(username string, other string) (bool, error) {
+	user, err := database.GetUserByUsername(username)
+	if err != nil || user == nil {
+		return false, err
+	}
+	otherUser, err := database.GetUserByUsername(other)
+	if err != nil || otherUser == nil {
+		return false, err
+	}
+	return database.IsBlockedBetween(int64(user.Id), int64(otherUser.Id))
+}
+
+// resolveRelationTarget loads the :username caller and :target user for the
+// block and mute routes. It writes the error response itself.
+func resolveRelationTarget(context *gin.Context) (int64, int64, string, bool) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return 0, 0, "", false
+	}
+
+	target, err := database.GetUserByUsername(strings.TrimSpace(context.Param("target")))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch user: %v", err))
+		return 0, 0, "", false
+	}
+	if target == nil {
+		RespondWithError(context, http.StatusNotFound, "User not found")
+		return 0, 0, "", false
+	}
+	if int64(target.Id) == userID {
+		RespondWithError(context, http.StatusBadRequest, "You cannot do that to yourself")
+		return 0, 0, "", false
+	}
+	return userID, int64(target.Id), target.Username, true
+}
+
+// GetBlockedUsers handles GET /users/:username/blocks.
+func GetBlockedUsers(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	users, err := database.QueryBlockedUsers(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch blocked users: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got blocked users", "blocks": users})
+}
+
+// BlockUser handles POST /users/:username/blocks/:target. Blocking removes
+// follows both ways and stops messages, follows, comments and notifications
+// between the two users.
+func BlockUser(context *gin.Context) {
+	userID, targetID, targetName, ok := resolveRelationTarget(context)
+	if !ok {
+		return
+	}
+
+	if _, err := database.BlockUser(userID, targetID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to block user: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Blocked %v", targetName)})
+}
+
+// UnblockUser handles DELETE /users/:username/blocks/:target.
+func UnblockUser(context *gin.Context) {
+	userID, targetID, targetName, ok := resolveRelationTarget(context)
+	if !ok {
+		return
+	}
+
+	removed, err := database.UnblockUser(userID, targetID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to unblock user: %v", err))
+		return
+	}
+	if !removed {
+		RespondWithError(context, http.StatusNotFound, fmt.Sprintf("%v is not blocked", targetName))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Unblocked %v", targetName)})
+}
+
+// GetMutedUsers handles GET /users/:username/mutes.
+func GetMutedUsers(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	users, err := database.QueryMutedUsers(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch muted users: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got muted users", "mutes": users})
+}
+
+// MuteUser handles POST /users/:username/mutes/:target. Muting only hides
+// the target's posts and projects from the caller's feeds.
+func MuteUser(context *gin.Context) {
+	userID, targetID, targetName, ok := resolveRelationTarget(context)
+	if !ok {
+		return
+	}
+
+	if _, err := database.MuteUser(userID, targetID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to mute user: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Muted %v", targetName)})
+}
+
+// UnmuteUser handles DELETE /users/:username/mutes/:target.
+func UnmuteUser(context *gin.Context) {
+	userID, targetID, targetName, ok := resolveRelationTarget(context)
+	if !ok {
+		return
+	}
+
+	removed, err := database.UnmuteUser(userID, targetID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to unmute user: %v", err))
+		return
+	}
+	if !removed {
+		RespondWithError(context, http.StatusNotFound, fmt.Sprintf("%v is not muted", targetName))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Unmuted %v", targetName)})
+}
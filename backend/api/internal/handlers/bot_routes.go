@@ -0,0 +1,487 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxBotsPerOwner      = 10
+	maxBotTokens         = 10
+	maxBotTokenName      = 100
+	maxBotTokenLifetime  = 365
+	botManagedContextKey = "managedBot"
+)
+
+// Scopes a bot token can carry.
+const (
+	botScopePostsWrite    = "posts:write"
+	botScopeCommentsWrite = "comments:write"
+)
+
+var botScopes = []string{botScopePostsWrite, botScopeCommentsWrite}
+
+// botRouteScopes lists the routes bot tokens may call, keyed by method and
+// route, with the scope each needs. Every other route is closed to bots; an
+// empty scope needs only a valid token.
+var botRouteScopes = map[string]string{
+	"GET /auth/me":                           "",
+	"POST /posts":                            botScopePostsWrite,
+	"PUT /posts/:post_id":                    botScopePostsWrite,
+	"DELETE /posts/:post_id":                 botScopePostsWrite,
+	"POST /comments/for-post/:post_id":       botScopeCommentsWrite,
+	"POST /comments/for-project/:project_id": botScopeCommentsWrite,
+	"PUT /comments/:comment_id":              botScopeCommentsWrite,
+	"DELETE /comments/:comment_id":           botScopeCommentsWrite,
+}
+
+var botUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,50}$`)
+
+// botRequest is the body of POST /users/:username/bots and
+// POST /projects/:project_id/bots.
+type botRequest struct {
+	Username string   `json:"username"`
+	Bio      string   `json:"bio"`
+	Picture  string   `json:"picture"`
+	Links    []string `json:"links"`
+}
+
+// botTokenRequest is the body of POST /bots/:username/tokens. Tokens without
+// expires_in_days last until revoked.
+type botTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// isBotRequest reports whether the caller signed in with a bot token.
+func isBotRequest(context *gin.Context) bool {
+	return context.GetBool(authBotKey)
+}
+
+// authenticateBot signs the request in as the bot holding token, if the
+// token is valid and carries the scope the route needs. It writes the error
+// response.
+func authenticateBot(context *gin.Context, raw string) bool {
+	token, err := lookupBotToken(raw)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to verify auth token")
+		return false
+	}
+	if token == nil {
+		RespondWithError(context, http.StatusUnauthorized, "Invalid auth token")
+		return false
+	}
+	scope, allowed := botRouteScopes[context.Request.Method+" "+context.FullPath()]
+	if !allowed {
+		RespondWithError(context, http.StatusForbidden, "Bot tokens cannot use this endpoint")
+		return false
+	}
+	if scope != "" && !slices.Contains(token.Scopes, scope) {
+		RespondWithError(context, http.StatusForbidden, fmt.Sprintf("Token is missing the '%s' scope", scope))
+		return false
+	}
+	setBotIdentity(context, token)
+	return true
+}
+
+// lookupBotToken returns the live token matching raw, or nil if there is
+// none.
+func lookupBotToken(raw string) (*database.BotToken, error) {
+	token, err := database.GetBotTokenByHash(auth.HashBotToken(raw))
+	if err != nil || token == nil {
+		return nil, err
+	}
+	now := time.Now()
+	if token.ExpiresAt != nil && !now.Before(*token.ExpiresAt) {
+		return nil, nil
+	}
+	if err := database.TouchBotToken(token.ID, now); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func setBotIdentity(context *gin.Context, token *database.BotToken) {
+	context.Set(authUserIDKey, token.BotID)
+	context.Set(authUsernameKey, token.BotUsername)
+	context.Set(authBotKey, true)
+}
+
+// checkBotProjectAccess stops bots from acting in projects that neither own
+// nor granted them. People always pass. It writes the error response.
+func checkBotProjectAccess(context *gin.Context, projectID int64) bool {
+	if !isBotRequest(context) {
+		return true
+	}
+	botID, _ := GetAuthUserID(context)
+	allowed, err := database.IsBotAllowedInProject(botID, projectID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check bot access: %v", err))
+		return false
+	}
+	if !allowed {
+		RespondWithError(context, http.StatusForbidden, "This bot has not been granted access to this stream")
+		return false
+	}
+	return true
+}
+
+// loadBot loads the bot named in the path, responding with 404 if there is
+// no such bot.
+func loadBot(context *gin.Context) (*database.ApiUser, bool) {
+	bot, err := database.GetUserByUsername(context.Param("username"))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load bot: %v", err))
+		return nil, false
+	}
+	if bot == nil || !bot.IsBot {
+		RespondWithError(context, http.StatusNotFound, "Bot not found")
+		return nil, false
+	}
+	return bot, true
+}
+
+// RequireBotManager lets through people who own the bot named in the path,
+// or own the project that does. It must follow RequireAuth.
+func RequireBotManager() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		bot, ok := loadBot(context)
+		if !ok {
+			context.Abort()
+			return
+		}
+		authUserID, _ := GetAuthUserID(context)
+		canManage, err := database.CanManageBot(int64(bot.Id), authUserID)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check bot owner: %v", err))
+			context.Abort()
+			return
+		}
+		if !canManage {
+			RespondWithError(context, http.StatusForbidden, "Only the bot's owner can manage it")
+			context.Abort()
+			return
+		}
+		context.Set(botManagedContextKey, bot)
+		context.Next()
+	}
+}
+
+func managedBot(context *gin.Context) *database.ApiUser {
+	bot, _ := context.MustGet(botManagedContextKey).(*database.ApiUser)
+	return bot
+}
+
+// createBot makes a bot owned by owner from the request body.
+func createBot(context *gin.Context, owner database.BotOwner) {
+	var request botRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if !botUsernamePattern.MatchString(request.Username) {
+		RespondWithError(context, http.StatusBadRequest, "Bot usernames must be 3 to 50 letters, digits or underscores")
+		return
+	}
+
+	owned, err := database.QueryOwnedBots(owner)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch bots: %v", err))
+		return
+	}
+	if len(owned) >= maxBotsPerOwner {
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("An owner can have at most %d bots", maxBotsPerOwner))
+		return
+	}
+	existing, err := database.GetUserByUsername(request.Username)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to check user")
+		return
+	}
+	if existing != nil {
+		RespondWithError(context, http.StatusConflict, "Username already taken")
+		return
+	}
+
+	authUserID, _ := GetAuthUserID(context)
+	bot := &database.ApiUser{
+		Username: request.Username,
+		Bio:      request.Bio,
+		Links:    []string{},
+		Settings: map[string]interface{}{},
+	}
+	if request.Links != nil {
+		bot.Links = request.Links
+	}
+	if strings.TrimSpace(request.Picture) != "" {
+		picture, err := materializeMediaReference(authUserID, request.Picture)
+		if err != nil {
+			respondWithMediaIngestError(context, err, "Invalid picture media reference")
+			return
+		}
+		bot.Picture = picture
+	}
+
+	id, err := database.CreateBot(bot, owner, &authUserID, time.Now())
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create bot: %v", err))
+		return
+	}
+	created, err := database.GetUserById(int(id))
+	if err != nil || created == nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to load created bot")
+		return
+	}
+	context.JSON(http.StatusCreated, gin.H{"message": "Bot created", "bot": created})
+}
+
+// GetUserBots handles GET /users/:username/bots.
+func GetUserBots(context *gin.Context) {
+	user, err := database.GetUserByUsername(context.Param("username"))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to get user: %v", err))
+		return
+	}
+	if user == nil {
+		RespondWithError(context, http.StatusNotFound, "User not found")
+		return
+	}
+	bots, err := database.QueryOwnedBots(database.BotOwner{UserID: int64(user.Id)})
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch bots: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"bots": bots})
+}
+
+// CreateUserBot handles POST /users/:username/bots.
+func CreateUserBot(context *gin.Context) {
+	authUserID, _ := GetAuthUserID(context)
+	createBot(context, database.BotOwner{UserID: authUserID})
+}
+
+// GetProjectBots handles GET /projects/:project_id/bots, the bots the project
+// owns.
+func GetProjectBots(context *gin.Context) {
+	projectID, err := strconv.Atoi(context.Param("project_id"))
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse project_id: %v", err))
+		return
+	}
+	project, err := database.QueryProject(projectID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load project: %v", err))
+		return
+	}
+	if project == nil {
+		RespondWithError(context, http.StatusNotFound, "Project not found")
+		return
+	}
+	bots, err := database.QueryOwnedBots(database.BotOwner{ProjectID: project.ID})
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch bots: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"bots": bots})
+}
+
+// CreateProjectBot handles POST /projects/:project_id/bots. The bot may post
+// to the project without a grant.
+func CreateProjectBot(context *gin.Context) {
+	project, ok := loadProjectOwnedBy(context, "Only the owner can manage bots")
+	if !ok {
+		return
+	}
+	createBot(context, database.BotOwner{ProjectID: project.ID})
+}
+
+// GetBot handles GET /bots/:username: the bot, who owns it and the projects
+// it was granted.
+func GetBot(context *gin.Context) {
+	bot, ok := loadBot(context)
+	if !ok {
+		return
+	}
+	grants, err := database.QueryBotProjects(int64(bot.Id))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch bot projects: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"bot": bot, "projects": grants})
+}
+
+// GetBotTokens handles GET /bots/:username/tokens. Tokens themselves are
+// only shown when created.
+func GetBotTokens(context *gin.Context) {
+	tokens, err := database.QueryBotTokens(int64(managedBot(context).Id))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch tokens: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"tokens": tokens, "scopes": botScopes})
+}
+
+// CreateBotToken handles POST /bots/:username/tokens. The response carries
+// the token, which cannot be shown again.
+func CreateBotToken(context *gin.Context) {
+	bot := managedBot(context)
+	var request botTokenRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > maxBotTokenName {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d characters", maxBotTokenName))
+		return
+	}
+	if len(request.Scopes) == 0 {
+		RespondWithError(context, http.StatusBadRequest, "scopes must list at least one scope")
+		return
+	}
+	scopes := make([]string, 0, len(request.Scopes))
+	for _, scope := range request.Scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(botScopes, scope) {
+			RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Unknown token scope '%s'", scope))
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > maxBotTokenLifetime {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("expires_in_days must be between 1 and %d, or 0 to never expire", maxBotTokenLifetime))
+		return
+	}
+
+	existing, err := database.QueryBotTokens(int64(bot.Id))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch tokens: %v", err))
+		return
+	}
+	if len(existing) >= maxBotTokens {
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("A bot can have at most %d tokens", maxBotTokens))
+		return
+	}
+
+	raw, prefix, err := auth.NewBotToken()
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	now := time.Now()
+	authUserID, _ := GetAuthUserID(context)
+	token := database.BotToken{
+		BotID:     int64(bot.Id),
+		Name:      request.Name,
+		Prefix:    prefix,
+		Scopes:    scopes,
+		CreatedBy: &authUserID,
+	}
+	if request.ExpiresInDays > 0 {
+		expiresAt := now.Add(time.Duration(request.ExpiresInDays) * 24 * time.Hour).UTC()
+		token.ExpiresAt = &expiresAt
+	}
+	id, err := database.CreateBotToken(token, auth.HashBotToken(raw), now)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create token: %v", err))
+		return
+	}
+	token.ID = id
+	token.CreatedAt = now.UTC()
+	context.JSON(http.StatusCreated, gin.H{"message": "Token created", "token": token, "secret": raw})
+}
+
+// DeleteBotToken handles DELETE /bots/:username/tokens/:token_id, revoking
+// the token at once.
+func DeleteBotToken(context *gin.Context) {
+	tokenID, err := strconv.ParseInt(context.Param("token_id"), 10, 64)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse token_id: %v", err))
+		return
+	}
+	deleted, err := database.DeleteBotToken(int64(managedBot(context).Id), tokenID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete token: %v", err))
+		return
+	}
+	if !deleted {
+		RespondWithError(context, http.StatusNotFound, "Token not found")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
+
+// GrantBotProject handles PUT /bots/:username/projects/:project_id. Only the
+// project's owner can let a bot post to it.
+func GrantBotProject(context *gin.Context) {
+	project, ok := loadProjectOwnedBy(context, "Only the owner can grant bots access")
+	if !ok {
+		return
+	}
+	bot, ok := loadBot(context)
+	if !ok {
+		return
+	}
+	authUserID, _ := GetAuthUserID(context)
+	if _, err := database.GrantBotProject(int64(bot.Id), project.ID, authUserID, time.Now()); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to grant access: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%s can now post to %s", bot.Username, project.Name)})
+}
+
+// RevokeBotProject handles DELETE /bots/:username/projects/:project_id. The
+// project's owner and the bot's owner can both revoke.
+func RevokeBotProject(context *gin.Context) {
+	projectID, err := strconv.ParseInt(context.Param("project_id"), 10, 64)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse project_id: %v", err))
+		return
+	}
+	bot, ok := loadBot(context)
+	if !ok {
+		return
+	}
+	authUserID, _ := GetAuthUserID(context)
+	project, err := database.QueryProject(int(projectID))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load project: %v", err))
+		return
+	}
+	allowed := project != nil && project.Owner == authUserID
+	if !allowed {
+		if allowed, err = database.CanManageBot(int64(bot.Id), authUserID); err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check bot owner: %v", err))
+			return
+		}
+	}
+	if !allowed {
+		RespondWithError(context, http.StatusForbidden, "Only the project or bot owner can revoke access")
+		return
+	}
+
+	revoked, err := database.RevokeBotProject(int64(bot.Id), projectID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to revoke access: %v", err))
+		return
+	}
+	if !revoked {
+		RespondWithError(context, http.StatusNotFound, "Bot has no access to this project")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
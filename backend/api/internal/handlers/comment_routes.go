@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"backend/api/internal/database"
+	"backend/api/internal/webhooks"
 
 	"github.com/gin-gonic/gin"
 )
@@ -148,9 +149,9 @@ func CreateCommentOnPost(context *gin.Context) {
 	}
 
 	if len(newComment.Media) > 0 {
-		normalizedMedia, mediaErr := materializeMediaList(newComment.Media)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, newComment.Media)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		newComment.Media = normalizedMedia
@@ -187,6 +188,10 @@ func CreateCommentOnPost(context *gin.Context) {
 		return
 	}
 
+	if !checkBotProjectAccess(context, post.Project) || !checkCommentAllowed(context, newComment.User, int64(post.User)) {
+		return
+	}
+
 	// Create the comment
 	id, err := database.QueryCreateCommentOnPost(newComment, postId)
 	if err != nil {
@@ -194,21 +199,27 @@ func CreateCommentOnPost(context *gin.Context) {
 		return
 	}
 
+	syncMentions(hubFor(context), database.MentionInComment, id, newComment.User, newComment.Content)
+
 	if post.User != newComment.User {
 		postID64 := int64(post.ID)
 		commentID64 := int64(id)
-		actor, _ := database.GetUserById(int(newComment.User))
 		createAndPushNotification(
+			hubFor(context),
 			int64(post.User),
 			int64(newComment.User),
 			"comment_post",
 			&postID64,
 			nil,
 			&commentID64,
-			notificationBody(actor.Username, "commented on your byte"),
+			"commented on your byte",
 		)
 	}
 
+	if created, err := database.QueryComment(int(id)); err == nil && created != nil {
+		emitProjectEventByID(post.Project, webhooks.EventCommentCreated, newComment.User, gin.H{"comment": created, "post_id": post.ID})
+	}
+
 	context.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Comment created successfully with id %v", id)})
 }
 
@@ -234,9 +245,9 @@ func CreateCommentOnProject(context *gin.Context) {
 	}
 
 	if len(newComment.Media) > 0 {
-		normalizedMedia, mediaErr := materializeMediaList(newComment.Media)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, newComment.Media)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		newComment.Media = normalizedMedia
@@ -273,6 +284,10 @@ func CreateCommentOnProject(context *gin.Context) {
 		return
 	}
 
+	if !checkBotProjectAccess(context, project.ID) || !checkCommentAllowed(context, newComment.User, int64(project.Owner)) {
+		return
+	}
+
 	// Create the comment
 	id, err := database.QueryCreateCommentOnProject(newComment, projId)
 	if err != nil {
@@ -280,6 +295,14 @@ func CreateCommentOnProject(context *gin.Context) {
 		return
 	}
 
+	syncMentions(hubFor(context), database.MentionInComment, id, newComment.User, newComment.Content)
+
+	commentID64 := id
+	notifyProjectTeam(hubFor(context), project, newComment.User, "comment_project", nil, &commentID64, "commented on your stream")
+	if created, err := database.QueryComment(int(id)); err == nil && created != nil {
+		emitProjectEvent(project, webhooks.EventCommentCreated, newComment.User, gin.H{"comment": created})
+	}
+
 	context.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Comment created successfully with id %v", id)})
 }
 
@@ -305,9 +328,9 @@ func CreateCommentOnComment(context *gin.Context) {
 	}
 
 	if len(newComment.Media) > 0 {
-		normalizedMedia, mediaErr := materializeMediaList(newComment.Media)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, newComment.Media)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		newComment.Media = normalizedMedia
@@ -344,6 +367,10 @@ func CreateCommentOnComment(context *gin.Context) {
 		return
 	}
 
+	if !checkCommentAllowed(context, newComment.User, int64(parentComment.User)) {
+		return
+	}
+
 	// Create the reply (comment)
 	id, err := database.QueryCreateCommentOnComment(newComment, commId)
 	if err != nil {
@@ -351,6 +378,22 @@ func CreateCommentOnComment(context *gin.Context) {
 		return
 	}
 
+	syncMentions(hubFor(context), database.MentionInComment, id, newComment.User, newComment.Content)
+
+	// The reply notification points at the parent comment, so replies to one
+	// comment group together.
+	parentID64 := int64(parentComment.ID)
+	createAndPushNotification(
+		hubFor(context),
+		int64(parentComment.User),
+		newComment.User,
+		"comment_reply",
+		nil,
+		nil,
+		&parentID64,
+		"replied to your comment",
+	)
+
 	context.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Reply created successfully with id %v", id)})
 }
 
@@ -444,9 +487,9 @@ func UpdateCommentContent(context *gin.Context) {
 		"content": requestData.Content,
 	}
 	if requestData.Media != nil {
-		normalizedMedia, mediaErr := materializeMediaList(requestData.Media)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, requestData.Media)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		updatedData["media"] = normalizedMedia
@@ -458,22 +501,29 @@ func UpdateCommentContent(context *gin.Context) {
 		return
 	}
 
+	syncMentions(hubFor(context), database.MentionInComment, existingComment.ID, existingComment.User, requestData.Content)
+
 	updatedComment, err := database.QueryComment(id)
 	if err != nil {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Error validating updated comment: %v", err))
 		return
 	}
 
+	comment := gin.H{
+		"id":             updatedComment.ID,
+		"user":           updatedComment.User,
+		"likes":          updatedComment.Likes,
+		"parent_comment": updatedComment.ParentComment,
+		"content":        updatedComment.Content,
+		"media":          updatedComment.Media,
+	}
+	if len(updatedComment.Mentions) > 0 {
+		comment["mentions"] = updatedComment.Mentions
+	}
+
 	context.JSON(http.StatusOK, gin.H{
 		"message": "Comment updated successfully",
-		"comment": gin.H{
-			"id":             updatedComment.ID,
-			"user":           updatedComment.User,
-			"likes":          updatedComment.Likes,
-			"parent_comment": updatedComment.ParentComment,
-			"content":        updatedComment.Content,
-			"media":          updatedComment.Media,
-		},
+		"comment": comment,
 	})
 }
 
@@ -491,6 +541,25 @@ func LikeComment(context *gin.Context) {
 		RespondWithError(context, httpcode, fmt.Sprintf("Failed to like comment: %v", err))
 		return
 	}
+
+	if httpcode == http.StatusCreated {
+		commentInt, _ := strconv.Atoi(commentId)
+		comment, _ := database.QueryComment(commentInt)
+		actorID, _ := database.GetUserIdByUsername(username)
+		if comment != nil {
+			commentID64 := int64(comment.ID)
+			createAndPushNotification(
+				hubFor(context),
+				int64(comment.User),
+				int64(actorID),
+				"like_comment",
+				nil,
+				nil,
+				&commentID64,
+				"liked your comment",
+			)
+		}
+	}
 	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%v likes comment %v", username, commentId)})
 }
 
@@ -543,3 +612,21 @@ func IsCommentEditable(context *gin.Context) {
 	}
 	context.JSON(httpcode, gin.H{"status": exists})
 }
+
+// checkCommentAllowed stops users from commenting on content owned by
+// someone they blocked or were blocked by. It writes the error response.
+func checkCommentAllowed(context *gin.Context, commenterID int64, ownerID int64) bool {
+	if commenterID == ownerID {
+		return true
+	}
+	blocked, err := database.IsBlockedBetween(commenterID, ownerID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to verify comment permissions: %v", err))
+		return false
+	}
+	if blocked {
+		RespondWithError(context, http.StatusForbidden, "You cannot comment on this user's content")
+		return false
+	}
+	return true
+}
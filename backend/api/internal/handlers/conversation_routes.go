@@ -0,0 +1,836 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxConversationParticipants bounds group size so websocket fan-out stays
+// cheap.
+var maxConversationParticipants = int(readPositiveIntEnv("DEVBITS_CONVERSATION_MAX_PARTICIPANTS", 50))
+
+const maxConversationTitleLength = 100
+
+type ConversationCreateRequest struct {
+	Title        string   `json:"title"`
+	Participants []string `json:"participants"`
+}
+
+type ConversationUpdateRequest struct {
+	Title string `json:"title"`
+}
+
+type ConversationParticipantRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// conversationReadReceipt tells participants how far Reader has read.
+type conversationReadReceipt struct {
+	ConversationID int64     `json:"conversation_id"`
+	Reader         string    `json:"reader"`
+	UpToID         int64     `json:"up_to_id"`
+	ReadAt         time.Time `json:"read_at"`
+}
+
+func isConversationManager(participant *database.ConversationParticipant) bool {
+	return participant.Role == database.ConversationRoleOwner || participant.Role == database.ConversationRoleAdmin
+}
+
+// publishConversationEvent sends event to every participant of conversation.
+func (h *RealtimeHub) publishConversationEvent(conversation *database.Conversation, event directMessageStreamEvent) {
+	for _, participant := range conversation.Participants {
+		h.publishToUser(participant.Username, event)
+	}
+}
+
+// publishConversationMessage sends a group message to each participant with
+// private media links signed for them.
+func (h *RealtimeHub) publishConversationMessage(conversation *database.Conversation, message database.ConversationMessage) {
+	for _, participant := range conversation.Participants {
+		forParticipant := presentConversationMessage(message, participant.UserID)
+		h.publishToUser(participant.Username, directMessageStreamEvent{
+			Type:                "conversation_message",
+			ConversationMessage: &forParticipant,
+		})
+	}
+}
+
+// publishConversationUpdate announces a title or membership change. Users who
+// were just removed are told too, so their clients can drop the thread.
+func (h *RealtimeHub) publishConversationUpdate(conversation *database.Conversation, removed ...string) {
+	event := directMessageStreamEvent{
+		Type:         "conversation_updated",
+		Conversation: conversation,
+	}
+	h.publishConversationEvent(conversation, event)
+	for _, username := range removed {
+		h.publishToUser(username, event)
+	}
+}
+
+func presentConversationMessage(message database.ConversationMessage, viewerID int64) database.ConversationMessage {
+	message.Media = signPrivateMediaReferences(message.Media, viewerID)
+	return message
+}
+
+// loadConversation resolves :conversation_id and the caller's membership.
+// Non-participants get a 404 so conversation ids are not probeable, except
+// for project chats which the project's team may see and join. It writes the
+// error response itself; the returned participant may be nil.
+func loadConversation(context *gin.Context) (*database.Conversation, *database.ConversationParticipant, bool) {
+	conversationID, err := strconv.ParseInt(context.Param("conversation_id"), 10, 64)
+	if err != nil || conversationID <= 0 {
+		RespondWithError(context, http.StatusBadRequest, "Invalid conversation id")
+		return nil, nil, false
+	}
+
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return nil, nil, false
+	}
+
+	conversation, err := database.GetConversation(conversationID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch conversation: %v", err))
+		return nil, nil, false
+	}
+	if conversation == nil {
+		RespondWithError(context, http.StatusNotFound, "Conversation not found")
+		return nil, nil, false
+	}
+
+	for index := range conversation.Participants {
+		if conversation.Participants[index].UserID == userID {
+			return conversation, &conversation.Participants[index], true
+		}
+	}
+
+	if conversation.ProjectID != nil {
+		member, err := isProjectTeamMember(*conversation.ProjectID, userID)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch conversation: %v", err))
+			return nil, nil, false
+		}
+		if member {
+			return conversation, nil, true
+		}
+	}
+
+	RespondWithError(context, http.StatusNotFound, "Conversation not found")
+	return nil, nil, false
+}
+
+// requireConversationParticipant is loadConversation for routes that need the
+// caller to have joined.
+func requireConversationParticipant(context *gin.Context) (*database.Conversation, *database.ConversationParticipant, bool) {
+	conversation, participant, ok := loadConversation(context)
+	if !ok {
+		return nil, nil, false
+	}
+	if participant == nil {
+		RespondWithError(context, http.StatusForbidden, "Join the conversation first")
+		return nil, nil, false
+	}
+	return conversation, participant, true
+}
+
+func isProjectTeamMember(projectID int64, userID int64) (bool, error) {
+	project, err := database.QueryProject(int(projectID))
+	if err != nil || project == nil {
+		return false, err
+	}
+	if project.Owner == userID {
+		return true, nil
+	}
+	return database.QueryIsProjectBuilder(int(projectID), userID)
+}
+
+func parseConversationPaging(context *gin.Context, defaultCount int) (int, int) {
+	start := 0
+	count := defaultCount
+	if raw := context.Query("start"); raw != "" {
+		if value, err := strconv.Atoi(raw); err == nil && value >= 0 {
+			start = value
+		}
+	}
+	if raw := context.Query("count"); raw != "" {
+		if value, err := strconv.Atoi(raw); err == nil && value > 0 {
+			if value > 200 {
+				value = 200
+			}
+			count = value
+		}
+	}
+	return start, count
+}
+
+// CreateConversation handles POST /conversations. The caller becomes the
+// owner; participants are listed by username.
+func CreateConversation(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request ConversationCreateRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	title := strings.TrimSpace(request.Title)
+	if len(title) > maxConversationTitleLength {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Title must be at most %d characters", maxConversationTitleLength))
+		return
+	}
+
+	memberIDs := make([]int64, 0, len(request.Participants))
+	seen := map[int64]struct{}{userID: {}}
+	for _, raw := range request.Participants {
+		username := normalizeUsername(raw)
+		if username == "" {
+			continue
+		}
+		user, err := database.GetUserByUsername(username)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to resolve participant: %v", err))
+			return
+		}
+		if user == nil {
+			RespondWithError(context, http.StatusNotFound, fmt.Sprintf("User '%s' not found", username))
+			return
+		}
+		memberID := int64(user.Id)
+		if _, dup := seen[memberID]; dup {
+			continue
+		}
+		blocked, err := database.IsBlockedBetween(userID, memberID)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to resolve participant: %v", err))
+			return
+		}
+		if blocked {
+			RespondWithError(context, http.StatusForbidden, fmt.Sprintf("You cannot add '%s' to a conversation", username))
+			return
+		}
+		seen[memberID] = struct{}{}
+		memberIDs = append(memberIDs, memberID)
+	}
+
+	if len(memberIDs) == 0 {
+		RespondWithError(context, http.StatusBadRequest, "A conversation needs at least one other participant")
+		return
+	}
+	if len(memberIDs)+1 > maxConversationParticipants {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("A conversation can have at most %d participants", maxConversationParticipants))
+		return
+	}
+
+	conversation, err := database.CreateConversation(title, nil, userID, memberIDs)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create conversation: %v", err))
+		return
+	}
+
+	hubFor(context).publishConversationUpdate(conversation)
+
+	context.JSON(http.StatusCreated, gin.H{"message": "Conversation created", "conversation": conversation})
+}
+
+// GetConversations handles GET /conversations, the caller's group inbox.
+func GetConversations(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	start, count := parseConversationPaging(context, 50)
+	threads, status, err := database.QueryConversationThreads(userID, start, count)
+	if err != nil {
+		RespondWithError(context, status, fmt.Sprintf("Failed to fetch conversations: %v", err))
+		return
+	}
+
+	for index := range threads {
+		threads[index].LastMedia = signPrivateMediaReferences(threads[index].LastMedia, userID)
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got conversations", "conversations": threads})
+}
+
+// GetConversationUnreadCount handles GET /conversations/unread-count, the
+// group counterpart of /messages/:username/unread-count.
+func GetConversationUnreadCount(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	count, err := database.QueryConversationUnreadTotal(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to count unread messages: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"unread_count": count})
+}
+
+func GetConversation(context *gin.Context) {
+	conversation, _, ok := loadConversation(context)
+	if !ok {
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got conversation", "conversation": conversation})
+}
+
+// UpdateConversation handles PUT /conversations/:conversation_id. Owners and
+// admins may rename the conversation.
+func UpdateConversation(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+	if !isConversationManager(participant) {
+		RespondWithError(context, http.StatusForbidden, "Only conversation admins can change the title")
+		return
+	}
+
+	var request ConversationUpdateRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	title := strings.TrimSpace(request.Title)
+	if len(title) > maxConversationTitleLength {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Title must be at most %d characters", maxConversationTitleLength))
+		return
+	}
+
+	if err := database.UpdateConversationTitle(conversation.ID, title); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update conversation: %v", err))
+		return
+	}
+	conversation.Title = title
+
+	hubFor(context).publishConversationUpdate(conversation)
+
+	context.JSON(http.StatusOK, gin.H{"message": "Conversation updated", "conversation": conversation})
+}
+
+func GetConversationMessages(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+
+	start, count := parseConversationPaging(context, 100)
+	messages, status, err := database.QueryConversationMessages(conversation.ID, start, count)
+	if err != nil {
+		RespondWithError(context, status, fmt.Sprintf("Failed to fetch conversation messages: %v", err))
+		return
+	}
+
+	for index := range messages {
+		messages[index] = presentConversationMessage(messages[index], participant.UserID)
+	}
+
+	context.JSON(http.StatusOK, messages)
+}
+
+func CreateConversationMessage(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+
+	var request DirectMessageCreateRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	media, privateMedia, err := resolveMessageMedia(participant.UserID, request.Media)
+	if err != nil {
+		respondWithMediaIngestError(context, err, "Invalid media reference")
+		return
+	}
+
+	content := strings.TrimSpace(request.Content)
+	if content == "" && len(media) == 0 {
+		RespondWithError(context, http.StatusBadRequest, "Message content cannot be empty")
+		return
+	}
+
+	message, err := database.CreateConversationMessage(conversation.ID, participant.UserID, content, media, privateMedia)
+	if errors.Is(err, database.ErrPrivateMediaUnavailable) {
+		RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+		return
+	}
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create conversation message: %v", err))
+		return
+	}
+
+	// Sending implies having read everything before it.
+	if _, _, err := database.MarkConversationRead(conversation.ID, participant.UserID, message.ID); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"conversation_id": conversation.ID,
+			"err":             err.Error(),
+		}).Warn("Failed to advance sender read pointer")
+	}
+
+	hub := hubFor(context)
+	hub.publishConversationMessage(conversation, *message)
+
+	// Participants with the app open get the websocket event; everyone else is
+	// notified.
+	for _, other := range conversation.Participants {
+		if other.UserID == participant.UserID || hub.isOnline(other.Username) {
+			continue
+		}
+		pushNotification(hub, database.NotificationInsert{
+			UserID:         other.UserID,
+			ActorID:        participant.UserID,
+			Type:           "conversation_message",
+			ProjectID:      conversation.ProjectID,
+			ConversationID: &conversation.ID,
+		}, "sent a message to a group")
+	}
+
+	context.JSON(http.StatusCreated, gin.H{"message": "Message sent", "conversation_message": presentConversationMessage(*message, participant.UserID)})
+}
+
+// MarkConversationRead handles POST /conversations/:conversation_id/read. It
+// moves the caller's read pointer to `up_to_id`, or to the latest message
+// when the body is empty.
+func MarkConversationRead(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+
+	var request DirectMessageReadRequest
+	if context.Request.ContentLength != 0 {
+		if err := context.ShouldBindJSON(&request); err != nil {
+			RespondWithError(context, http.StatusBadRequest, "Invalid request")
+			return
+		}
+	}
+	if request.UpToID < 0 {
+		RespondWithError(context, http.StatusBadRequest, "up_to_id must be >= 0")
+		return
+	}
+
+	lastRead, readAt, err := database.MarkConversationRead(conversation.ID, participant.UserID, request.UpToID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to mark conversation read: %v", err))
+		return
+	}
+
+	if readAt != nil {
+		hubFor(context).publishConversationEvent(conversation, directMessageStreamEvent{
+			Type: "conversation_read",
+			ConversationRead: &conversationReadReceipt{
+				ConversationID: conversation.ID,
+				Reader:         participant.Username,
+				UpToID:         lastRead,
+				ReadAt:         *readAt,
+			},
+		})
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Conversation marked read", "last_read_message_id": lastRead})
+}
+
+// AddConversationParticipant handles POST /conversations/:conversation_id/participants.
+// Owners and admins may add members; only the owner may add admins.
+func AddConversationParticipant(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+	if !isConversationManager(participant) {
+		RespondWithError(context, http.StatusForbidden, "Only conversation admins can add participants")
+		return
+	}
+
+	var request ConversationParticipantRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	role := request.Role
+	if role == "" {
+		role = database.ConversationRoleMember
+	}
+	if role != database.ConversationRoleMember && role != database.ConversationRoleAdmin {
+		RespondWithError(context, http.StatusBadRequest, "Role must be 'member' or 'admin'")
+		return
+	}
+	if role == database.ConversationRoleAdmin && participant.Role != database.ConversationRoleOwner {
+		RespondWithError(context, http.StatusForbidden, "Only the conversation owner can add admins")
+		return
+	}
+
+	user, err := database.GetUserByUsername(normalizeUsername(request.Username))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to resolve participant: %v", err))
+		return
+	}
+	if user == nil {
+		RespondWithError(context, http.StatusNotFound, "User not found")
+		return
+	}
+	blocked, err := database.IsBlockedBetween(participant.UserID, int64(user.Id))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to add participant: %v", err))
+		return
+	}
+	if blocked {
+		RespondWithError(context, http.StatusForbidden, fmt.Sprintf("You cannot add '%s' to a conversation", user.Username))
+		return
+	}
+	if conversation.ProjectID != nil {
+		member, err := isProjectTeamMember(*conversation.ProjectID, int64(user.Id))
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to add participant: %v", err))
+			return
+		}
+		if !member {
+			RespondWithError(context, http.StatusForbidden, "Project chats are limited to the project's builders")
+			return
+		}
+	}
+	if len(conversation.Participants) >= maxConversationParticipants {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("A conversation can have at most %d participants", maxConversationParticipants))
+		return
+	}
+
+	added, err := database.AddConversationParticipant(conversation.ID, int64(user.Id), role)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to add participant: %v", err))
+		return
+	}
+	if !added {
+		RespondWithError(context, http.StatusConflict, "User is already a participant")
+		return
+	}
+
+	respondWithConversationChange(context, conversation.ID, "Participant added")
+}
+
+// UpdateConversationParticipant handles PUT
+// /conversations/:conversation_id/participants/:username. Only the owner may
+// promote or demote admins.
+func UpdateConversationParticipant(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+	if participant.Role != database.ConversationRoleOwner {
+		RespondWithError(context, http.StatusForbidden, "Only the conversation owner can change roles")
+		return
+	}
+
+	var request ConversationParticipantRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if request.Role != database.ConversationRoleMember && request.Role != database.ConversationRoleAdmin {
+		RespondWithError(context, http.StatusBadRequest, "Role must be 'member' or 'admin'")
+		return
+	}
+
+	target := findConversationParticipant(conversation, context.Param("username"))
+	if target == nil {
+		RespondWithError(context, http.StatusNotFound, "Participant not found")
+		return
+	}
+	if target.UserID == participant.UserID {
+		RespondWithError(context, http.StatusBadRequest, "The owner's role cannot be changed")
+		return
+	}
+
+	if err := database.SetConversationParticipantRole(conversation.ID, target.UserID, request.Role); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update participant: %v", err))
+		return
+	}
+
+	respondWithConversationChange(context, conversation.ID, "Participant updated")
+}
+
+// RemoveConversationParticipant handles DELETE
+// /conversations/:conversation_id/participants/:username. Admins may remove
+// members; only the owner may remove admins, and the owner cannot be removed.
+func RemoveConversationParticipant(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+
+	target := findConversationParticipant(conversation, context.Param("username"))
+	if target == nil {
+		RespondWithError(context, http.StatusNotFound, "Participant not found")
+		return
+	}
+	if target.UserID == participant.UserID {
+		RespondWithError(context, http.StatusBadRequest, "Use /leave to leave a conversation")
+		return
+	}
+
+	switch {
+	case target.Role == database.ConversationRoleOwner:
+		RespondWithError(context, http.StatusForbidden, "The conversation owner cannot be removed")
+		return
+	case target.Role == database.ConversationRoleAdmin && participant.Role != database.ConversationRoleOwner:
+		RespondWithError(context, http.StatusForbidden, "Only the conversation owner can remove admins")
+		return
+	case !isConversationManager(participant):
+		RespondWithError(context, http.StatusForbidden, "Only conversation admins can remove participants")
+		return
+	}
+
+	if _, err := database.RemoveConversationParticipant(conversation.ID, target.UserID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to remove participant: %v", err))
+		return
+	}
+
+	respondWithConversationChange(context, conversation.ID, "Participant removed", target.Username)
+}
+
+// JoinConversation handles POST /conversations/:conversation_id/join. Only
+// project chats can be joined, by the project's owner and builders; other
+// conversations are invite-only.
+func JoinConversation(context *gin.Context) {
+	conversation, participant, ok := loadConversation(context)
+	if !ok {
+		return
+	}
+	if participant != nil {
+		RespondWithError(context, http.StatusConflict, "Already a participant")
+		return
+	}
+
+	userID, _ := GetAuthUserID(context)
+	if len(conversation.Participants) >= maxConversationParticipants {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("A conversation can have at most %d participants", maxConversationParticipants))
+		return
+	}
+	if _, err := database.AddConversationParticipant(conversation.ID, userID, database.ConversationRoleMember); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to join conversation: %v", err))
+		return
+	}
+
+	respondWithConversationChange(context, conversation.ID, "Joined conversation")
+}
+
+// LeaveConversation handles POST /conversations/:conversation_id/leave. When
+// the owner leaves, the longest-standing participant takes over; a
+// conversation nobody is left in is deleted, and a project chat starts afresh
+// the next time the team opens it.
+func LeaveConversation(context *gin.Context) {
+	conversation, participant, ok := requireConversationParticipant(context)
+	if !ok {
+		return
+	}
+
+	if err := departConversation(hubFor(context), conversation, participant); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to leave conversation: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Left conversation"})
+}
+
+// departConversation takes participant out of conversation, handing
+// ownership to the longest-standing participant left or deleting the
+// conversation when nobody is, and tells the others.
+func departConversation(hub *RealtimeHub, conversation *database.Conversation, participant *database.ConversationParticipant) error {
+	if _, err := database.RemoveConversationParticipant(conversation.ID, participant.UserID); err != nil {
+		return err
+	}
+
+	var successor *database.ConversationParticipant
+	for index := range conversation.Participants {
+		if conversation.Participants[index].UserID != participant.UserID {
+			successor = &conversation.Participants[index]
+			break
+		}
+	}
+	if successor == nil {
+		return database.DeleteConversation(conversation.ID)
+	}
+
+	if participant.Role == database.ConversationRoleOwner {
+		if err := database.SetConversationParticipantRole(conversation.ID, successor.UserID, database.ConversationRoleOwner); err != nil {
+			return fmt.Errorf("failed to transfer ownership: %w", err)
+		}
+	}
+
+	updated, err := database.GetConversation(conversation.ID)
+	if err != nil {
+		return err
+	}
+	if updated != nil {
+		hub.publishConversationUpdate(updated, participant.Username)
+	}
+	return nil
+}
+
+// removeFromProjectConversation takes someone who left a project's team out
+// of the project's chat, if they were in it.
+func removeFromProjectConversation(hub *RealtimeHub, projectID int64, userID int64) error {
+	conversationID, err := database.GetConversationIDForProject(projectID)
+	if err != nil || conversationID == 0 {
+		return err
+	}
+	conversation, err := database.GetConversation(conversationID)
+	if err != nil || conversation == nil {
+		return err
+	}
+	for index := range conversation.Participants {
+		if conversation.Participants[index].UserID == userID {
+			return departConversation(hub, conversation, &conversation.Participants[index])
+		}
+	}
+	return nil
+}
+
+// GetProjectConversation handles GET /projects/:project_id/conversation. The
+// project's chat is created on first use with the owner and every builder,
+// and the caller is joined if they are not in it yet.
+func GetProjectConversation(context *gin.Context) {
+	projectID, err := strconv.ParseInt(context.Param("project_id"), 10, 64)
+	if err != nil || projectID <= 0 {
+		RespondWithError(context, http.StatusBadRequest, "Invalid project id")
+		return
+	}
+
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	project, err := database.QueryProject(int(projectID))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch project: %v", err))
+		return
+	}
+	if project == nil {
+		RespondWithError(context, http.StatusNotFound, "Project not found")
+		return
+	}
+
+	member, err := isProjectTeamMember(projectID, userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch project conversation: %v", err))
+		return
+	}
+	if !member {
+		RespondWithError(context, http.StatusForbidden, "Only the project's builders can use its chat")
+		return
+	}
+
+	conversationID, err := database.GetConversationIDForProject(projectID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch project conversation: %v", err))
+		return
+	}
+
+	if conversationID == 0 {
+		conversation, err := createProjectConversation(hubFor(context), project)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create project conversation: %v", err))
+			return
+		}
+		conversationID = conversation.ID
+	}
+
+	if _, err := database.AddConversationParticipant(conversationID, userID, database.ConversationRoleMember); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to join project conversation: %v", err))
+		return
+	}
+
+	conversation, err := database.GetConversation(conversationID)
+	if err != nil || conversation == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch project conversation: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got project conversation", "conversation": conversation})
+}
+
+// createProjectConversation starts a project's chat owned by the project
+// owner. If another request created it first, that one is returned.
+func createProjectConversation(hub *RealtimeHub, project *database.Project) (*database.Conversation, error) {
+	builders, _, err := database.QueryProjectBuilders(int(project.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	memberIDs := make([]int64, 0, len(builders))
+	for _, username := range builders {
+		user, err := database.GetUserByUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && int64(user.Id) != project.Owner && len(memberIDs)+1 < maxConversationParticipants {
+			memberIDs = append(memberIDs, int64(user.Id))
+		}
+	}
+
+	projectID := project.ID
+	conversation, err := database.CreateConversation(project.Name, &projectID, project.Owner, memberIDs)
+	if err == nil {
+		hub.publishConversationUpdate(conversation)
+		return conversation, nil
+	}
+
+	existingID, lookupErr := database.GetConversationIDForProject(projectID)
+	if lookupErr != nil || existingID == 0 {
+		return nil, err
+	}
+	return database.GetConversation(existingID)
+}
+
+func findConversationParticipant(conversation *database.Conversation, username string) *database.ConversationParticipant {
+	normalized := normalizeUsername(username)
+	for index := range conversation.Participants {
+		if normalizeUsername(conversation.Participants[index].Username) == normalized {
+			return &conversation.Participants[index]
+		}
+	}
+	return nil
+}
+
+// respondWithConversationChange reloads the conversation after a membership
+// change, broadcasts it, and writes it as the response.
+func respondWithConversationChange(context *gin.Context, conversationID int64, message string, removed ...string) {
+	conversation, err := database.GetConversation(conversationID)
+	if err != nil || conversation == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch conversation: %v", err))
+		return
+	}
+
+	hubFor(context).publishConversationUpdate(conversation, removed...)
+
+	context.JSON(http.StatusOK, gin.H{"message": message, "conversation": conversation})
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"backend/api/internal/database"
+	"backend/api/internal/realtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// realtimeBackendEnvKey selects how hub events reach other API instances:
+// "memory" (default, single instance) or "postgres" (LISTEN/NOTIFY on the
+// main database). Presence is shared through the database either way.
+const realtimeBackendEnvKey = "DEVBITS_REALTIME_BACKEND"
+
+const realtimeHubKey = "realtimeHub"
+
+// RealtimeBrokerFromEnv opens the broker named by DEVBITS_REALTIME_BACKEND.
+// It must run after database.Connect.
+func RealtimeBrokerFromEnv() (realtime.Broker, error) {
+	backend := strings.ToLower(strings.TrimSpace(os.Getenv(realtimeBackendEnvKey)))
+	switch backend {
+	case "", "memory":
+		return realtime.NewMemoryBroker(), nil
+	case "postgres":
+		dsn, ok := database.PostgresDSN()
+		if !ok {
+			return nil, fmt.Errorf("%s=postgres requires a postgres database", realtimeBackendEnvKey)
+		}
+		return realtime.NewPostgresBroker(database.DB, dsn)
+	default:
+		return nil, fmt.Errorf("unknown %s %q", realtimeBackendEnvKey, backend)
+	}
+}
+
+// WithRealtimeHub makes hub the one handlers publish through and stream from.
+func WithRealtimeHub(hub *RealtimeHub) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Set(realtimeHubKey, hub)
+		context.Next()
+	}
+}
+
+func hubFor(context *gin.Context) *RealtimeHub {
+	return context.MustGet(realtimeHubKey).(*RealtimeHub)
+}
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+)
+
+// Clients may send small JSON frames over the direct message websocket:
+//
+//	{"type": "typing_start", "peer": "alice"}
+//	{"type": "typing_stop", "peer": "alice"}
+//	{"type": "heartbeat"}
+//
+// Typing frames are forwarded to the peer as "typing" events, but only to
+// peers the user shares a conversation with and neither has blocked.
+// Heartbeats keep the connection (and the user's presence) alive for clients
+// that cannot answer protocol-level pings. Unknown frames are ignored.
+type directMessageClientFrame struct {
+	Type string `json:"type"`
+	Peer string `json:"peer"`
+}
+
+type directMessageTyping struct {
+	Username string `json:"username"`
+	Peer     string `json:"peer"`
+	Typing   bool   `json:"typing"`
+}
+
+type directMessagePresence struct {
+	Username   string     `json:"username"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+type userPresence struct {
+	connections int
+	lastSeen    time.Time
+}
+
+// Each node records the users connected to it in userpresence and refreshes
+// those rows every presenceRefreshInterval. A row older than presenceTTL
+// belongs to a node that went away without clearing it.
+const (
+	presenceRefreshInterval = 30 * time.Second
+	presenceTTL             = 3 * presenceRefreshInterval
+)
+
+// markOnline registers a new connection for username and reports whether the
+// user just came online on any node.
+func (h *RealtimeHub) markOnline(username string) bool {
+	normalized := normalizeUsername(username)
+	now := time.Now().UTC()
+
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	h.mu.Lock()
+	entry, ok := h.presence[normalized]
+	if !ok {
+		entry = &userPresence{}
+		h.presence[normalized] = entry
+	}
+	entry.connections++
+	entry.lastSeen = now
+	first := entry.connections == 1
+	h.mu.Unlock()
+
+	if !first {
+		return false
+	}
+	elsewhere, err := database.IsUserOnlineElsewhere(h.nodeID, normalized, now.Add(-presenceTTL))
+	if err != nil {
+		logPresenceError(username, err)
+	}
+	if err := database.SetUserPresence(h.nodeID, normalized, now); err != nil {
+		logPresenceError(username, err)
+	}
+	return !elsewhere
+}
+
+// markOffline drops a connection for username and reports whether the user
+// has no connections left on any node.
+func (h *RealtimeHub) markOffline(username string) (bool, time.Time) {
+	normalized := normalizeUsername(username)
+	now := time.Now().UTC()
+
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	h.mu.Lock()
+	entry, ok := h.presence[normalized]
+	if !ok {
+		h.mu.Unlock()
+		return false, now
+	}
+	entry.connections--
+	entry.lastSeen = now
+	if entry.connections > 0 {
+		h.mu.Unlock()
+		return false, now
+	}
+	delete(h.presence, normalized)
+	h.mu.Unlock()
+
+	if err := database.ClearUserPresence(h.nodeID, normalized); err != nil {
+		logPresenceError(username, err)
+	}
+	elsewhere, err := database.IsUserOnlineElsewhere(h.nodeID, normalized, now.Add(-presenceTTL))
+	if err != nil {
+		logPresenceError(username, err)
+	}
+	return !elsewhere, now
+}
+
+func (h *RealtimeHub) touch(username string) {
+	normalized := normalizeUsername(username)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if entry, ok := h.presence[normalized]; ok {
+		entry.lastSeen = time.Now().UTC()
+	}
+}
+
+// isOnline reports whether username is connected to this node or, going by
+// the shared presence rows, to any other.
+func (h *RealtimeHub) isOnline(username string) bool {
+	normalized := normalizeUsername(username)
+
+	h.mu.RLock()
+	entry, ok := h.presence[normalized]
+	local := ok && entry.connections > 0
+	h.mu.RUnlock()
+	if local {
+		return true
+	}
+
+	online, err := database.IsUserOnlineElsewhere(h.nodeID, normalized, time.Now().UTC().Add(-presenceTTL))
+	if err != nil {
+		logPresenceError(username, err)
+		return false
+	}
+	return online
+}
+
+// startPresenceRefresh keeps this node's presence rows fresh until the hub
+// closes or the server shuts down.
+func (h *RealtimeHub) startPresenceRefresh() {
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(presenceRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.refreshPresence()
+			case <-h.stopRefresh:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+func (h *RealtimeHub) refreshPresence() {
+	now := time.Now().UTC()
+
+	h.mu.RLock()
+	usernames := make([]string, 0, len(h.presence))
+	for username := range h.presence {
+		usernames = append(usernames, username)
+	}
+	h.mu.RUnlock()
+
+	for _, username := range usernames {
+		if err := database.SetUserPresence(h.nodeID, username, now); err != nil {
+			logPresenceError(username, err)
+		}
+	}
+	if err := database.PruneUserPresence(now.Add(-presenceTTL)); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"err": err.Error(),
+		}).Warn("Failed to prune stale presence")
+	}
+}
+
+func logPresenceError(username string, err error) {
+	logger.Log.WithFields(map[string]interface{}{
+		"username": username,
+		"err":      err.Error(),
+	}).Warn("Failed to update shared presence")
+}
+
+// publishPresence tells everyone username has a conversation with that they
+// came online or went offline.
+func (h *RealtimeHub) publishPresence(username string, online bool, lastSeen time.Time) {
+	peers, _, err := database.QueryDirectChatPeers(username)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": username,
+			"err":      err.Error(),
+		}).Warn("Failed to resolve chat peers for presence update")
+		return
+	}
+
+	event := directMessageStreamEvent{
+		Type: "presence",
+		Presence: &directMessagePresence{
+			Username:   username,
+			Online:     online,
+			LastSeenAt: &lastSeen,
+		},
+	}
+	for _, peer := range peers {
+		h.publishToUser(peer.Username, event)
+	}
+}
+
+func (h *RealtimeHub) publishTyping(username string, peer string, typing bool) {
+	h.publishToUser(peer, directMessageStreamEvent{
+		Type: "typing",
+		Typing: &directMessageTyping{
+			Username: username,
+			Peer:     peer,
+			Typing:   typing,
+		},
+	})
+}
+
+// typingCheckInterval is how long a connection trusts its last answer to
+// whether it may show a peer typing indicators.
+const typingCheckInterval = 5 * time.Second
+
+type typingCheck struct {
+	allowed   bool
+	checkedAt time.Time
+}
+
+// directMessageConnection holds per-socket state for the client protocol.
+type directMessageConnection struct {
+	hub         *RealtimeHub
+	userID      int64
+	username    string
+	typingTo    map[string]struct{}
+	typingCheck map[string]typingCheck
+}
+
+func newDirectMessageConnection(hub *RealtimeHub, userID int64, username string) *directMessageConnection {
+	return &directMessageConnection{
+		hub:         hub,
+		userID:      userID,
+		username:    username,
+		typingTo:    make(map[string]struct{}),
+		typingCheck: make(map[string]typingCheck),
+	}
+}
+
+// canSignalTyping reports whether the user may show peer a typing indicator.
+// The answer is reused for typingCheckInterval so a client toggling typing
+// in a loop does not query the database on every frame.
+func (c *directMessageConnection) canSignalTyping(peer string) bool {
+	now := time.Now()
+	if check, ok := c.typingCheck[peer]; ok && now.Sub(check.checkedAt) < typingCheckInterval {
+		return check.allowed
+	}
+	allowed := c.lookupTypingPermission(peer)
+	c.typingCheck[peer] = typingCheck{allowed: allowed, checkedAt: now}
+	return allowed
+}
+
+func (c *directMessageConnection) lookupTypingPermission(peer string) bool {
+	peerID, err := database.GetUserIdByUsername(peer)
+	if err != nil {
+		return false
+	}
+	blocked, err := database.IsBlockedBetween(c.userID, int64(peerID))
+	if err != nil || blocked {
+		return false
+	}
+	shared, err := database.SharesConversation(c.userID, int64(peerID))
+	return err == nil && shared
+}
+
+func (c *directMessageConnection) handleFrame(payload []byte) {
+	var frame directMessageClientFrame
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		return
+	}
+
+	peer := normalizeUsername(frame.Peer)
+	switch frame.Type {
+	case "typing_start":
+		if peer == "" || peer == normalizeUsername(c.username) {
+			return
+		}
+		// The peer already sees the indicator.
+		if _, ok := c.typingTo[peer]; ok {
+			return
+		}
+		if !c.canSignalTyping(peer) {
+			return
+		}
+		c.typingTo[peer] = struct{}{}
+		c.hub.publishTyping(c.username, peer, true)
+	case "typing_stop":
+		if _, ok := c.typingTo[peer]; !ok {
+			return
+		}
+		delete(c.typingTo, peer)
+		c.hub.publishTyping(c.username, peer, false)
+	case "heartbeat":
+		c.hub.touch(c.username)
+	}
+}
+
+// close stops any typing indicators this connection left running.
+func (c *directMessageConnection) close() {
+	for peer := range c.typingTo {
+		c.hub.publishTyping(c.username, peer, false)
+	}
+	c.typingTo = map[string]struct{}{}
+}
+
+// connectPresence marks the user online and returns the matching disconnect
+// callback, which also persists their last-seen time. Both run in the stream
+// handler, so nothing outlives the connection.
+func connectPresence(hub *RealtimeHub, username string) func() {
+	if hub.markOnline(username) {
+		hub.publishPresence(username, true, time.Now().UTC())
+	}
+
+	return func() {
+		offline, lastSeen := hub.markOffline(username)
+		if !offline {
+			return
+		}
+		if err := database.UpdateUserLastSeen(username, lastSeen); err != nil {
+			logger.Log.WithFields(map[string]interface{}{
+				"username": username,
+				"err":      err.Error(),
+			}).Warn("Failed to persist last seen")
+		}
+		hub.publishPresence(username, false, lastSeen)
+	}
+}
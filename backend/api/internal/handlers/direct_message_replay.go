@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+)
+
+// streamBufferSize is how many events a stream may fall behind before it is
+// cut off with a resync event.
+var streamBufferSize = int(readPositiveIntEnv("DEVBITS_STREAM_BUFFER_SIZE", 64))
+
+// directMessageReplayLimit caps how many missed events are replayed on
+// reconnect. Clients further behind are told to resync.
+var directMessageReplayLimit = int(readPositiveIntEnv("DEVBITS_STREAM_REPLAY_LIMIT", 500))
+
+// Reasons carried by a resync event.
+const (
+	resyncSlowConsumer = "slow_consumer"
+	resyncReplayLimit  = "replay_limit"
+)
+
+// directMessageResync tells the client its live view is incomplete. It should
+// refetch its threads, then reconnect with ?since=Cursor. LastMessageID is
+// the newest direct message it was sent.
+type directMessageResync struct {
+	Reason        string `json:"reason"`
+	LastMessageID int64  `json:"last_message_id"`
+	Cursor        string `json:"cursor"`
+}
+
+// A stream cursor is written "<direct message id>.<conversation message
+// id>.<change time in unix nanoseconds>". A bare direct message id is also
+// accepted and resumes from when that message was sent.
+func formatStreamCursor(position database.StreamPosition) string {
+	var changedAt int64
+	if !position.ChangedAt.IsZero() {
+		changedAt = position.ChangedAt.UnixNano()
+	}
+	return fmt.Sprintf("%d.%d.%d", position.DirectMessageID, position.ConversationMessageID, changedAt)
+}
+
+// parseStreamSince reads the ?since=<cursor> resume point. It returns nil
+// when the client did not ask for a replay.
+func parseStreamSince(raw string) (*database.StreamPosition, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 1 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid since")
+	}
+	values := make([]int64, len(parts))
+	for index, part := range parts {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid since")
+		}
+		values[index] = value
+	}
+
+	if len(values) == 1 {
+		position, err := database.QueryStreamPositionAt(values[0])
+		if err != nil {
+			logger.Log.WithFields(map[string]interface{}{
+				"since": raw,
+				"err":   err.Error(),
+			}).Warn("Failed to resolve stream position")
+		}
+		return &position, nil
+	}
+	position := database.StreamPosition{
+		DirectMessageID:       values[0],
+		ConversationMessageID: values[1],
+	}
+	if values[2] > 0 {
+		position.ChangedAt = time.Unix(0, values[2]).UTC()
+	}
+	return &position, nil
+}
+
+// missedStreamEvents loads what userID missed after since as stream events:
+// new direct and group messages, then edits, deletions and read receipts in
+// the order they happened. When there are more than the replay limit, the
+// last event is a resync instead.
+func missedStreamEvents(userID int64, since database.StreamPosition) ([]directMessageStreamEvent, error) {
+	fetch := directMessageReplayLimit + 1
+
+	messages, err := database.QueryDirectMessagesSince(userID, since.DirectMessageID, fetch)
+	if err != nil {
+		return nil, err
+	}
+	groupMessages, err := database.QueryConversationMessagesSince(userID, since.ConversationMessageID, fetch)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := database.QueryDirectMessageChangesSince(userID, since.DirectMessageID, since.ChangedAt, fetch)
+	if err != nil {
+		return nil, err
+	}
+	reads, err := database.QueryDirectMessageReadsSince(userID, since.ChangedAt, fetch)
+	if err != nil {
+		return nil, err
+	}
+	groupReads, err := database.QueryConversationReadsSince(userID, since.ChangedAt, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]directMessageStreamEvent, 0, len(messages)+len(groupMessages))
+	for _, message := range messages {
+		eventType := "direct_message"
+		if message.DeletedAt != nil {
+			eventType = "direct_message_deleted"
+		}
+		presented := presentDirectMessage(message, userID)
+		events = append(events, directMessageStreamEvent{
+			Type:          eventType,
+			DirectMessage: &presented,
+		})
+	}
+	for _, message := range groupMessages {
+		presented := presentConversationMessage(message, userID)
+		events = append(events, directMessageStreamEvent{
+			Type:                "conversation_message",
+			ConversationMessage: &presented,
+		})
+	}
+
+	changes := make([]directMessageStreamEvent, 0, len(changed)+len(reads)+len(groupReads))
+	for _, message := range changed {
+		eventType := "direct_message_updated"
+		if message.DeletedAt != nil {
+			eventType = "direct_message_deleted"
+		}
+		presented := presentDirectMessage(message, userID)
+		changes = append(changes, directMessageStreamEvent{
+			Type:          eventType,
+			DirectMessage: &presented,
+		})
+	}
+	for _, read := range reads {
+		changes = append(changes, directMessageStreamEvent{
+			Type: "read_receipt",
+			ReadReceipt: &directMessageReadReceipt{
+				Reader: read.Reader,
+				Peer:   read.Peer,
+				UpToID: read.UpToID,
+				ReadAt: read.ReadAt,
+				Count:  read.Count,
+			},
+		})
+	}
+	for _, read := range groupReads {
+		changes = append(changes, directMessageStreamEvent{
+			Type: "conversation_read",
+			ConversationRead: &conversationReadReceipt{
+				ConversationID: read.ConversationID,
+				Reader:         read.Username,
+				UpToID:         read.LastReadMessageID,
+				ReadAt:         read.LastReadAt,
+			},
+		})
+	}
+	slices.SortStableFunc(changes, func(a, b directMessageStreamEvent) int {
+		return changedAt(a).Compare(changedAt(b))
+	})
+	events = append(events, changes...)
+
+	if len(events) <= directMessageReplayLimit {
+		return events, nil
+	}
+
+	// Resume after the last replayed event. Messages and changes are each in
+	// order, and only the changes that made it in move the change time on.
+	messageCount := len(events) - len(changes)
+	events = events[:directMessageReplayLimit]
+	position := since
+	for index, event := range events {
+		switch {
+		case index >= messageCount:
+			position.ChangedAt = changedAt(event)
+		case event.DirectMessage != nil:
+			position.DirectMessageID = event.DirectMessage.ID
+		case event.ConversationMessage != nil:
+			position.ConversationMessageID = event.ConversationMessage.ID
+		}
+	}
+	cursor := &streamCursor{position: position}
+	return append(events, cursor.resync(resyncReplayLimit)), nil
+}
+
+// changedAt is when an edit, deletion or read receipt event happened, or the
+// zero time for other events.
+func changedAt(event directMessageStreamEvent) time.Time {
+	switch {
+	case event.ReadReceipt != nil:
+		return event.ReadReceipt.ReadAt
+	case event.ConversationRead != nil:
+		return event.ConversationRead.ReadAt
+	case event.DirectMessage != nil && event.DirectMessage.DeletedAt != nil:
+		return *event.DirectMessage.DeletedAt
+	case event.DirectMessage != nil && event.DirectMessage.EditedAt != nil && event.Type == "direct_message_updated":
+		return *event.DirectMessage.EditedAt
+	}
+	return time.Time{}
+}
+
+// replayStream writes what the client missed after since, if it asked, and
+// primes cursor so live copies are skipped. Streams that did not ask start
+// from the current head, so a later resync still points somewhere useful.
+// It only fails if write does.
+func replayStream(claims *auth.Claims, since *database.StreamPosition, cursor *streamCursor, write func(directMessageStreamEvent) error) error {
+	if since == nil {
+		head, err := database.QueryStreamHead(claims.UserID)
+		if err != nil {
+			logger.Log.WithFields(map[string]interface{}{
+				"username": claims.Username,
+				"err":      err.Error(),
+			}).Warn("Failed to load stream position")
+		}
+		cursor.position = head
+		return nil
+	}
+	cursor.position = *since
+
+	missed, err := missedStreamEvents(claims.UserID, *since)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": claims.Username,
+			"since":    formatStreamCursor(*since),
+			"err":      err.Error(),
+		}).Warn("Failed to replay missed stream events")
+		missed = []directMessageStreamEvent{cursor.resync(resyncReplayLimit)}
+	}
+	for _, event := range missed {
+		cursor.admit(&event)
+		if err := write(event); err != nil {
+			return err
+		}
+	}
+	cursor.finishReplay()
+	return nil
+}
+
+// streamCursor tracks how far a stream has got. Messages covered by the
+// replay are skipped if they also arrive live.
+type streamCursor struct {
+	replayedThrough             int64
+	replayedConversationThrough int64
+	position                    database.StreamPosition
+}
+
+// admit reports whether event should be written and advances the cursor.
+// Edits, deletions and read receipts always pass. Message and change events
+// are stamped with the cursor to resume after them.
+func (c *streamCursor) admit(event *directMessageStreamEvent) bool {
+	at := changedAt(*event)
+	if at.After(c.position.ChangedAt) {
+		c.position.ChangedAt = at
+	}
+	switch {
+	case event.DirectMessage != nil:
+		if event.Type == "direct_message" && event.DirectMessage.ID <= c.replayedThrough {
+			return false
+		}
+		if event.DirectMessage.ID > c.position.DirectMessageID {
+			c.position.DirectMessageID = event.DirectMessage.ID
+		}
+	case event.ConversationMessage != nil:
+		if event.Type == "conversation_message" && event.ConversationMessage.ID <= c.replayedConversationThrough {
+			return false
+		}
+		if event.ConversationMessage.ID > c.position.ConversationMessageID {
+			c.position.ConversationMessageID = event.ConversationMessage.ID
+		}
+	case at.IsZero():
+		return true
+	}
+	event.Cursor = formatStreamCursor(c.position)
+	return true
+}
+
+// finishReplay marks everything delivered so far as replayed.
+func (c *streamCursor) finishReplay() {
+	c.replayedThrough = c.position.DirectMessageID
+	c.replayedConversationThrough = c.position.ConversationMessageID
+}
+
+func (c *streamCursor) resync(reason string) directMessageStreamEvent {
+	return directMessageStreamEvent{
+		Type: "resync",
+		Resync: &directMessageResync{
+			Reason:        reason,
+			LastMessageID: c.position.DirectMessageID,
+			Cursor:        formatStreamCursor(c.position),
+		},
+	}
+}
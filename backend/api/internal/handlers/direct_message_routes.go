@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,42 +14,121 @@ import (
 	"backend/api/internal/auth"
 	"backend/api/internal/database"
 	"backend/api/internal/logger"
+	"backend/api/internal/realtime"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 type directMessageStreamEvent struct {
-	Type          string                `json:"type"`
-	DirectMessage database.DirectMessage `json:"direct_message"`
+	Type                string                        `json:"type"`
+	DirectMessage       *database.DirectMessage       `json:"direct_message,omitempty"`
+	ReadReceipt         *directMessageReadReceipt     `json:"read_receipt,omitempty"`
+	Typing              *directMessageTyping          `json:"typing,omitempty"`
+	Presence            *directMessagePresence        `json:"presence,omitempty"`
+	Conversation        *database.Conversation        `json:"conversation,omitempty"`
+	ConversationMessage *database.ConversationMessage `json:"conversation_message,omitempty"`
+	ConversationRead    *conversationReadReceipt      `json:"conversation_read,omitempty"`
+	Notification        *database.Notification        `json:"notification,omitempty"`
+	NotificationCount   *notificationCount            `json:"notification_count,omitempty"`
+	Resync              *directMessageResync          `json:"resync,omitempty"`
+	// Cursor is set per stream on message and change events; reconnecting
+	// with ?since=<cursor> resumes after the event.
+	Cursor string `json:"cursor,omitempty"`
 }
 
-type directMessageHub struct {
+// directMessageReadReceipt tells both participants that Reader has read
+// everything Peer sent them up to UpToID.
+type directMessageReadReceipt struct {
+	Reader string    `json:"reader"`
+	Peer   string    `json:"peer"`
+	UpToID int64     `json:"up_to_id"`
+	ReadAt time.Time `json:"read_at"`
+	Count  int64     `json:"count"`
+}
+
+// hubSubscriber is one open stream. When its buffer fills up the hub stops
+// delivering to it and closes overflowed, so the stream can tell the client to
+// resync instead of silently missing events.
+type hubSubscriber struct {
+	events     chan directMessageStreamEvent
+	overflowed chan struct{}
+	overflow   sync.Once
+}
+
+// RealtimeHub delivers stream events to the sockets connected to one API
+// server. Everything it publishes goes through its broker, which hands events
+// back to the hubs of every server sharing it, this one included.
+type RealtimeHub struct {
 	mu          sync.RWMutex
-	subscribers map[string]map[chan directMessageStreamEvent]struct{}
+	subscribers map[string]map[*hubSubscriber]struct{}
+	presence    map[string]*userPresence
+
+	// presenceMu orders each user's online/offline transitions on this node
+	// with the shared presence rows they write.
+	presenceMu sync.Mutex
+	nodeID     string
+
+	broker            realtime.Broker
+	unsubscribeBroker func()
+	stopRefresh       chan struct{}
+	closeOnce         sync.Once
 }
 
-func newDirectMessageHub() *directMessageHub {
-	return &directMessageHub{
-		subscribers: make(map[string]map[chan directMessageStreamEvent]struct{}),
+// NewRealtimeHub subscribes a new hub to broker. The caller still owns the
+// broker and closes it after closing the hub.
+func NewRealtimeHub(broker realtime.Broker) (*RealtimeHub, error) {
+	nodeID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	hub := &RealtimeHub{
+		subscribers: make(map[string]map[*hubSubscriber]struct{}),
+		presence:    make(map[string]*userPresence),
+		nodeID:      nodeID,
+		broker:      broker,
+		stopRefresh: make(chan struct{}),
 	}
+	unsubscribe, err := broker.Subscribe(hub.deliverLocal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to realtime broker: %w", err)
+	}
+	hub.unsubscribeBroker = unsubscribe
+	hub.startPresenceRefresh()
+	return hub, nil
+}
+
+// Close stops delivery to this hub and forgets the presence it recorded.
+func (h *RealtimeHub) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		close(h.stopRefresh)
+		h.unsubscribeBroker()
+		err = database.ClearNodePresence(h.nodeID)
+	})
+	return err
 }
 
-func (h *directMessageHub) subscribe(username string) chan directMessageStreamEvent {
-	channel := make(chan directMessageStreamEvent, 32)
+func (h *RealtimeHub) subscribe(username string) *hubSubscriber {
+	subscriber := &hubSubscriber{
+		events:     make(chan directMessageStreamEvent, streamBufferSize),
+		overflowed: make(chan struct{}),
+	}
 	normalized := normalizeUsername(username)
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if _, ok := h.subscribers[normalized]; !ok {
-		h.subscribers[normalized] = make(map[chan directMessageStreamEvent]struct{})
+		h.subscribers[normalized] = make(map[*hubSubscriber]struct{})
 	}
-	h.subscribers[normalized][channel] = struct{}{}
-	return channel
+	h.subscribers[normalized][subscriber] = struct{}{}
+	return subscriber
 }
 
-func (h *directMessageHub) unsubscribe(username string, channel chan directMessageStreamEvent) {
+// unsubscribe stops delivery to subscriber. Its channel is left open since a
+// delivery may still be in flight.
+func (h *RealtimeHub) unsubscribe(username string, subscriber *hubSubscriber) {
 	normalized := normalizeUsername(username)
 
 	h.mu.Lock()
@@ -58,47 +139,92 @@ func (h *directMessageHub) unsubscribe(username string, channel chan directMessa
 		return
 	}
 
-	if _, exists := listeners[channel]; exists {
-		delete(listeners, channel)
-		close(channel)
-	}
-
+	delete(listeners, subscriber)
 	if len(listeners) == 0 {
 		delete(h.subscribers, normalized)
 	}
 }
 
-func (h *directMessageHub) publish(message database.DirectMessage) {
+func (h *RealtimeHub) publish(message database.DirectMessage) {
+	h.publishMessageEvent("direct_message", message)
+}
+
+// publishMessageEvent sends a message event to both participants, each with
+// private media links signed for them.
+func (h *RealtimeHub) publishMessageEvent(eventType string, message database.DirectMessage) {
+	forSender := presentDirectMessage(message, message.SenderID)
+	forRecipient := presentDirectMessage(message, message.RecipientID)
+	h.publishToUser(message.SenderName, directMessageStreamEvent{
+		Type:          eventType,
+		DirectMessage: &forSender,
+	})
+	h.publishToUser(message.RecipientName, directMessageStreamEvent{
+		Type:          eventType,
+		DirectMessage: &forRecipient,
+	})
+}
+
+func (h *RealtimeHub) publishReadReceipt(receipt directMessageReadReceipt) {
 	event := directMessageStreamEvent{
-		Type:          "direct_message",
-		DirectMessage: message,
+		Type:        "read_receipt",
+		ReadReceipt: &receipt,
 	}
+	h.publishToUser(receipt.Peer, event)
+	h.publishToUser(receipt.Reader, event)
+}
 
-	targets := []string{message.SenderName, message.RecipientName}
-	for _, target := range targets {
-		h.publishToUser(target, event)
+// publishToUser hands event to the broker, which delivers it to username's
+// sockets on every node, this one included.
+func (h *RealtimeHub) publishToUser(username string, event directMessageStreamEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": username,
+			"type":     event.Type,
+			"err":      err.Error(),
+		}).Warn("Failed to encode realtime event")
+		return
 	}
-}
 
-func (h *directMessageHub) publishToUser(username string, event directMessageStreamEvent) {
-	normalized := normalizeUsername(username)
+	if err := h.broker.Publish(normalizeUsername(username), payload); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": username,
+			"type":     event.Type,
+			"err":      err.Error(),
+		}).Warn("Failed to publish realtime event")
+	}
+}
 
+// deliverLocal writes a brokered event to the sockets connected to this node.
+func (h *RealtimeHub) deliverLocal(normalized string, payload []byte) {
 	h.mu.RLock()
 	listeners, ok := h.subscribers[normalized]
 	if !ok || len(listeners) == 0 {
 		h.mu.RUnlock()
 		return
 	}
-	channels := make([]chan directMessageStreamEvent, 0, len(listeners))
-	for channel := range listeners {
-		channels = append(channels, channel)
+	subscribers := make([]*hubSubscriber, 0, len(listeners))
+	for subscriber := range listeners {
+		subscribers = append(subscribers, subscriber)
 	}
 	h.mu.RUnlock()
 
-	for _, channel := range channels {
+	var event directMessageStreamEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": normalized,
+			"err":      err.Error(),
+		}).Warn("Failed to decode realtime event")
+		return
+	}
+
+	for _, subscriber := range subscribers {
 		select {
-		case channel <- event:
+		case subscriber.events <- event:
 		default:
+			subscriber.overflow.Do(func() {
+				close(subscriber.overflowed)
+			})
 		}
 	}
 }
@@ -139,12 +265,74 @@ var wsUpgrader = websocket.Upgrader{
 	},
 }
 
-var dmHub = newDirectMessageHub()
+// directMessageEditWindow is how long after sending a message its sender may
+// still edit it. Deleting is always allowed.
+var directMessageEditWindow = time.Duration(readPositiveIntEnv("DEVBITS_DM_EDIT_WINDOW_MINUTES", 15)) * time.Minute
 
-type DirectMessageCreateRequest struct {
+type DirectMessageEditRequest struct {
 	Content string `json:"content"`
 }
 
+type DirectMessageReadRequest struct {
+	UpToID int64 `json:"up_to_id"`
+}
+
+type DirectMessageCreateRequest struct {
+	Content string   `json:"content"`
+	Media   []string `json:"media"`
+}
+
+// presentDirectMessage prepares a message for viewerID, signing any private
+// media links for them.
+func presentDirectMessage(message database.DirectMessage, viewerID int64) database.DirectMessage {
+	message.Media = signPrivateMediaReferences(message.Media, viewerID)
+	return message
+}
+
+// resolveMessageMedia stores the media attached to a new direct or group
+// message. Private media uploaded by the sender is kept private and returned
+// separately so it can be attached to the message once it exists; every other
+// reference is materialized as a managed upload.
+func resolveMessageMedia(senderID int64, values []string) ([]string, []string, error) {
+	resolved := make([]string, 0, len(values))
+	private := make([]string, 0)
+	public := make([]string, 0)
+	publicIndexes := make([]int, 0)
+
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if filename, ok := extractPrivateMediaFilename(value); ok {
+			media, err := database.GetPrivateMedia(filename)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Only the sender's own, not yet attached media may be used.
+			if media == nil || media.OwnerID != senderID || media.ResourceType != "user" {
+				return nil, nil, fmt.Errorf("private media not found")
+			}
+			resolved = append(resolved, privateMediaReference(filename))
+			if !slices.Contains(private, filename) {
+				private = append(private, filename)
+			}
+			continue
+		}
+		publicIndexes = append(publicIndexes, len(resolved))
+		resolved = append(resolved, "")
+		public = append(public, value)
+	}
+
+	materialized, err := materializeMediaList(senderID, public)
+	if err != nil {
+		return nil, nil, err
+	}
+	for index, stored := range materialized {
+		resolved[publicIndexes[index]] = stored
+	}
+	return resolved, private, nil
+}
+
 func GetDirectMessages(context *gin.Context) {
 	username := context.Param("username")
 	other := context.Param("other")
@@ -171,6 +359,11 @@ func GetDirectMessages(context *gin.Context) {
 		return
 	}
 
+	viewerID, _ := GetAuthUserID(context)
+	for index := range items {
+		items[index] = presentDirectMessage(items[index], viewerID)
+	}
+
 	context.JSON(http.StatusOK, items)
 }
 
@@ -184,47 +377,103 @@ func CreateDirectMessage(context *gin.Context) {
 		return
 	}
 
+	senderID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	blocked, err := isBlockedBetweenUsernames(username, other)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create direct message: %v", err))
+		return
+	}
+	if blocked {
+		RespondWithError(context, http.StatusForbidden, "You cannot message this user")
+		return
+	}
+
+	media, privateMedia, err := resolveMessageMedia(senderID, request.Media)
+	if err != nil {
+		respondWithMediaIngestError(context, err, "Invalid media reference")
+		return
+	}
+
 	content := strings.TrimSpace(request.Content)
-	if content == "" {
+	if content == "" && len(media) == 0 {
 		RespondWithError(context, http.StatusBadRequest, "Message content cannot be empty")
 		return
 	}
 
-	message, status, err := database.QueryCreateDirectMessage(username, other, content)
+	message, status, err := database.QueryCreateDirectMessage(username, other, content, media, privateMedia)
+	if errors.Is(err, database.ErrPrivateMediaUnavailable) {
+		RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+		return
+	}
 	if err != nil {
 		RespondWithError(context, status, fmt.Sprintf("Failed to create direct message: %v", err))
 		return
 	}
 
-	dmHub.publish(*message)
+	hub := hubFor(context)
+	hub.publish(*message)
 
-	createAndPushNotification(
-		message.RecipientID,
-		message.SenderID,
-		"direct_message",
-		nil,
-		nil,
-		nil,
-		notificationBody(message.SenderName, "sent you a message"),
-	)
+	// Messages from different people are told apart, not grouped.
+	pushNotification(hub, database.NotificationInsert{
+		UserID:       message.RecipientID,
+		ActorID:      message.SenderID,
+		Type:         "direct_message",
+		GroupByActor: true,
+	}, "sent you a message")
 
-	context.JSON(http.StatusCreated, gin.H{"message": "Message sent", "direct_message": message})
+	context.JSON(http.StatusCreated, gin.H{"message": "Message sent", "direct_message": presentDirectMessage(*message, senderID)})
 }
 
-func StreamDirectMessages(context *gin.Context) {
+// authorizeStream checks the token for a :username stream and parses its
+// resume point. It writes the error response itself.
+func authorizeStream(context *gin.Context, rawSince string) (*auth.Claims, string, *database.StreamPosition, bool) {
 	username := normalizeUsername(context.Param("username"))
 	if username == "" {
 		RespondWithError(context, http.StatusBadRequest, "Username required")
-		return
+		return nil, "", nil, false
 	}
 
 	claims, ok := parseTokenClaims(context)
 	if !ok {
-		return
+		return nil, "", nil, false
 	}
 
 	if normalizeUsername(claims.Username) != username {
 		RespondWithError(context, http.StatusForbidden, "Forbidden")
+		return nil, "", nil, false
+	}
+
+	since, err := parseStreamSince(rawSince)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, "since must be a stream cursor or message id")
+		return nil, "", nil, false
+	}
+	return claims, username, since, true
+}
+
+// trackStream registers an open stream as background work, so shutdown can
+// end it. The returned channel closes when the stream should hang up, and
+// release must be called once it has. It responds 503 during shutdown.
+func trackStream(context *gin.Context) (<-chan struct{}, func(), bool) {
+	ctx, release, ok := background.track()
+	if !ok {
+		RespondWithError(context, http.StatusServiceUnavailable, "Server is shutting down")
+		return nil, nil, false
+	}
+	return ctx.Done(), release, true
+}
+
+// StreamDirectMessages upgrades GET /messages/:username/stream to a websocket
+// carrying all of the user's realtime events: direct and group messages,
+// presence, typing and notifications.
+func StreamDirectMessages(context *gin.Context) {
+	claims, username, since, ok := authorizeStream(context, context.Query("since"))
+	if !ok {
 		return
 	}
 
@@ -239,6 +488,12 @@ func StreamDirectMessages(context *gin.Context) {
 		return
 	}
 
+	shutdown, release, ok := trackStream(context)
+	if !ok {
+		return
+	}
+	defer release()
+
 	connection, err := wsUpgrader.Upgrade(context.Writer, context.Request, nil)
 	if err != nil {
 		logger.Log.WithFields(map[string]interface{}{
@@ -255,8 +510,14 @@ func StreamDirectMessages(context *gin.Context) {
 	}
 	defer connection.Close()
 
-	stream := dmHub.subscribe(username)
-	defer dmHub.unsubscribe(username, stream)
+	// Subscribe before loading the replay so nothing falls in between; the
+	// cursor drops live copies of replayed messages.
+	hub := hubFor(context)
+	stream := hub.subscribe(username)
+	defer hub.unsubscribe(username, stream)
+
+	disconnectPresence := connectPresence(hub, claims.Username)
+	defer disconnectPresence()
 
 	_ = connection.SetReadDeadline(time.Now().Add(30 * time.Second))
 	connection.SetPongHandler(func(_ string) error {
@@ -264,40 +525,87 @@ func StreamDirectMessages(context *gin.Context) {
 		return nil
 	})
 
+	clientState := newDirectMessageConnection(hub, claims.UserID, claims.Username)
+	readerDone := make(chan struct{})
 	go func() {
+		defer close(readerDone)
+		defer clientState.close()
 		for {
-			if _, _, readErr := connection.ReadMessage(); readErr != nil {
+			messageType, payload, readErr := connection.ReadMessage()
+			if readErr != nil {
 				_ = connection.Close()
 				return
 			}
+			_ = connection.SetReadDeadline(time.Now().Add(30 * time.Second))
+			if messageType == websocket.TextMessage {
+				clientState.handleFrame(payload)
+			}
 		}
 	}()
+	defer func() {
+		_ = connection.Close()
+		<-readerDone
+	}()
+
+	cursor := &streamCursor{}
+	err = replayStream(claims, since, cursor, func(event directMessageStreamEvent) error {
+		return writeStreamEvent(connection, event)
+	})
+	if err != nil {
+		return
+	}
 
 	pingTicker := time.NewTicker(20 * time.Second)
 	defer pingTicker.Stop()
 
 	for {
 		select {
-		case event := <-stream:
-			payload, marshalErr := json.Marshal(event)
-			if marshalErr != nil {
+		case event := <-stream.events:
+			if !cursor.admit(&event) {
 				continue
 			}
-			_ = connection.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := connection.WriteMessage(websocket.TextMessage, payload); err != nil {
+			if err := writeStreamEvent(connection, event); err != nil {
 				return
 			}
+		case <-stream.overflowed:
+			// The client fell too far behind to catch up live. Tell it where
+			// to resume from and hang up.
+			_ = writeStreamEvent(connection, cursor.resync(resyncSlowConsumer))
+			_ = connection.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, resyncSlowConsumer),
+				time.Now().Add(time.Second),
+			)
+			return
 		case <-pingTicker.C:
 			_ = connection.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := connection.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
 				return
 			}
+		case <-readerDone:
+			return
 		case <-context.Request.Context().Done():
 			return
+		case <-shutdown:
+			_ = connection.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second),
+			)
+			return
 		}
 	}
 }
 
+func writeStreamEvent(connection *websocket.Conn, event directMessageStreamEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_ = connection.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return connection.WriteMessage(websocket.TextMessage, payload)
+}
+
 func GetDirectChatPeers(context *gin.Context) {
 	username := context.Param("username")
 
@@ -307,7 +615,19 @@ func GetDirectChatPeers(context *gin.Context) {
 		return
 	}
 
-	context.JSON(http.StatusOK, gin.H{"message": "Successfully got chat peers", "peers": peers})
+	hub := hubFor(context)
+	usernames := make([]string, 0, len(peers))
+	presence := make([]directMessagePresence, 0, len(peers))
+	for _, peer := range peers {
+		usernames = append(usernames, peer.Username)
+		presence = append(presence, directMessagePresence{
+			Username:   peer.Username,
+			Online:     hub.isOnline(peer.Username),
+			LastSeenAt: peer.LastSeenAt,
+		})
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Successfully got chat peers", "peers": usernames, "presence": presence})
 }
 
 func GetDirectMessageThreads(context *gin.Context) {
@@ -335,5 +655,185 @@ func GetDirectMessageThreads(context *gin.Context) {
 		return
 	}
 
+	viewerID, _ := GetAuthUserID(context)
+	for index := range threads {
+		threads[index].LastMedia = signPrivateMediaReferences(threads[index].LastMedia, viewerID)
+	}
+
 	context.JSON(http.StatusOK, gin.H{"message": "Successfully got message threads", "threads": threads})
 }
+
+// MarkDirectMessagesRead handles POST /messages/:username/with/:other/read.
+// It marks messages from :other as read up to `up_to_id`, or all of them when
+// the body is empty, and sends a read_receipt event to both participants.
+func MarkDirectMessagesRead(context *gin.Context) {
+	username := context.Param("username")
+	other := context.Param("other")
+
+	var request DirectMessageReadRequest
+	if context.Request.ContentLength != 0 {
+		if err := context.ShouldBindJSON(&request); err != nil {
+			RespondWithError(context, http.StatusBadRequest, "Invalid request")
+			return
+		}
+	}
+	if request.UpToID < 0 {
+		RespondWithError(context, http.StatusBadRequest, "up_to_id must be >= 0")
+		return
+	}
+
+	updated, upToID, readAt, status, err := database.QueryMarkDirectMessagesRead(username, other, request.UpToID)
+	if err != nil {
+		RespondWithError(context, status, fmt.Sprintf("Failed to mark messages read: %v", err))
+		return
+	}
+
+	if updated > 0 {
+		hubFor(context).publishReadReceipt(directMessageReadReceipt{
+			Reader: username,
+			Peer:   other,
+			UpToID: upToID,
+			ReadAt: readAt,
+			Count:  updated,
+		})
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Messages marked read", "updated": updated})
+}
+
+// GetUnreadDirectMessageCount handles GET /messages/:username/unread-count,
+// the total used for the DM badge.
+func GetUnreadDirectMessageCount(context *gin.Context) {
+	username := context.Param("username")
+
+	count, status, err := database.QueryUnreadDirectMessageCount(username)
+	if err != nil {
+		RespondWithError(context, status, fmt.Sprintf("Failed to count unread messages: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"unread_count": count})
+}
+
+// loadSentDirectMessage resolves :message_id within the :username/:other
+// conversation and checks that the caller sent it. It writes the error
+// response itself.
+func loadSentDirectMessage(context *gin.Context) (*database.DirectMessage, bool) {
+	messageID, err := strconv.ParseInt(context.Param("message_id"), 10, 64)
+	if err != nil || messageID <= 0 {
+		RespondWithError(context, http.StatusBadRequest, "Invalid message id")
+		return nil, false
+	}
+
+	message, err := database.QueryDirectMessageByID(messageID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch direct message: %v", err))
+		return nil, false
+	}
+
+	username := normalizeUsername(context.Param("username"))
+	other := normalizeUsername(context.Param("other"))
+	if message == nil {
+		RespondWithError(context, http.StatusNotFound, "Direct message not found")
+		return nil, false
+	}
+	sender := normalizeUsername(message.SenderName)
+	recipient := normalizeUsername(message.RecipientName)
+	if !(sender == username && recipient == other) && !(sender == other && recipient == username) {
+		RespondWithError(context, http.StatusNotFound, "Direct message not found")
+		return nil, false
+	}
+	if sender != username {
+		RespondWithError(context, http.StatusForbidden, "Only the sender can change this message")
+		return nil, false
+	}
+	if message.DeletedAt != nil {
+		RespondWithError(context, http.StatusGone, "Direct message was deleted")
+		return nil, false
+	}
+	return message, true
+}
+
+// UpdateDirectMessage handles PUT /messages/:username/with/:other/:message_id.
+// The sender may change the text while the edit window is open.
+func UpdateDirectMessage(context *gin.Context) {
+	message, ok := loadSentDirectMessage(context)
+	if !ok {
+		return
+	}
+
+	var request DirectMessageEditRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	content := strings.TrimSpace(request.Content)
+	if content == "" && len(message.Media) == 0 {
+		RespondWithError(context, http.StatusBadRequest, "Message content cannot be empty")
+		return
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(message.CreatedAt) > directMessageEditWindow {
+		RespondWithError(context, http.StatusForbidden, "The edit window for this message has passed")
+		return
+	}
+
+	updated, err := database.QueryEditDirectMessage(message.ID, content, now)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to edit direct message: %v", err))
+		return
+	}
+	if !updated {
+		RespondWithError(context, http.StatusGone, "Direct message was deleted")
+		return
+	}
+
+	message.Content = content
+	message.EditedAt = &now
+	hubFor(context).publishMessageEvent("direct_message_updated", *message)
+
+	context.JSON(http.StatusOK, gin.H{"message": "Message updated", "direct_message": presentDirectMessage(*message, message.SenderID)})
+}
+
+// DeleteDirectMessage handles DELETE /messages/:username/with/:other/:message_id.
+// The message is removed for both participants and replaced by a tombstone.
+func DeleteDirectMessage(context *gin.Context) {
+	message, ok := loadSentDirectMessage(context)
+	if !ok {
+		return
+	}
+
+	privateMedia, err := database.QueryPrivateMediaForDirectMessage(message.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete direct message: %v", err))
+		return
+	}
+
+	now := time.Now().UTC()
+	deleted, err := database.QueryDeleteDirectMessage(message.ID, now)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete direct message: %v", err))
+		return
+	}
+	if !deleted {
+		RespondWithError(context, http.StatusGone, "Direct message was deleted")
+		return
+	}
+
+	if _, err := purgePrivateMedia(privateMedia); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"message_id": message.ID,
+			"err":        err.Error(),
+		}).Warn("Failed to remove media from deleted direct message")
+	}
+	releaseMessageUploads(message.SenderID, message.Media)
+
+	message.Content = ""
+	message.Media = []string{}
+	message.DeletedAt = &now
+	hubFor(context).publishMessageEvent("direct_message_deleted", *message)
+
+	context.JSON(http.StatusOK, gin.H{"message": "Message deleted", "direct_message": message})
+}
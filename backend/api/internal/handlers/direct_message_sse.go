@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeSSEEvent writes event in text/event-stream framing. Message and change
+// events carry the stream cursor as their id, so a reconnecting EventSource
+// sends it back as Last-Event-ID and resumes from there.
+func writeSSEEvent(writer io.Writer, event directMessageStreamEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var frame strings.Builder
+	fmt.Fprintf(&frame, "event: %s\n", event.Type)
+	if event.Cursor != "" {
+		fmt.Fprintf(&frame, "id: %s\n", event.Cursor)
+	}
+	fmt.Fprintf(&frame, "data: %s\n\n", payload)
+
+	_, err = io.WriteString(writer, frame.String())
+	return err
+}
+
+// StreamDirectMessageEvents handles GET /messages/:username/events, a
+// Server-Sent Events fallback for clients whose network breaks websocket
+// upgrades. It carries the same events as StreamDirectMessages and resumes
+// from the Last-Event-ID header or ?since=. The stream is one-way, so typing
+// indicators can only be received here.
+func StreamDirectMessageEvents(context *gin.Context) {
+	rawSince := strings.TrimSpace(context.GetHeader("Last-Event-ID"))
+	if rawSince == "" {
+		rawSince = context.Query("since")
+	}
+	claims, username, since, ok := authorizeStream(context, rawSince)
+	if !ok {
+		return
+	}
+
+	flusher, ok := context.Writer.(http.Flusher)
+	if !ok {
+		RespondWithError(context, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	shutdown, release, ok := trackStream(context)
+	if !ok {
+		return
+	}
+	defer release()
+
+	hub := hubFor(context)
+	stream := hub.subscribe(username)
+	defer hub.unsubscribe(username, stream)
+
+	disconnectPresence := connectPresence(hub, claims.Username)
+	defer disconnectPresence()
+
+	header := context.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Connection", "keep-alive")
+	// Stop nginx and similar proxies from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	context.Status(http.StatusOK)
+
+	writer := context.Writer
+	if _, err := fmt.Fprintf(writer, "retry: %d\n\n", (3 * time.Second).Milliseconds()); err != nil {
+		return
+	}
+
+	cursor := &streamCursor{}
+	err := replayStream(claims, since, cursor, func(event directMessageStreamEvent) error {
+		return writeSSEEvent(writer, event)
+	})
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// Heartbeats keep proxies from closing an idle stream.
+	heartbeatInterval := time.Duration(readPositiveIntEnv("DEVBITS_SSE_HEARTBEAT_SECONDS", 15)) * time.Second
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-stream.events:
+			if !cursor.admit(&event) {
+				continue
+			}
+			if err := writeSSEEvent(writer, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-stream.overflowed:
+			_ = writeSSEEvent(writer, cursor.resync(resyncSlowConsumer))
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			hub.touch(claims.Username)
+			if _, err := io.WriteString(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-context.Request.Context().Done():
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
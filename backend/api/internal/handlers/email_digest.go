@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+	"backend/api/internal/mail"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	digestBatch          = 100
+	digestMaxItems       = 20
+	digestMaxThreads     = 10
+	digestSnippetLength  = 140
+	defaultPublicBaseURL = "https://devbits.app"
+)
+
+//go:embed templates/digest.html templates/digest.txt templates/unsubscribe.html
+//go:embed templates/digest_email.html templates/digest_email.txt templates/confirm_email.html
+var digestTemplateFiles embed.FS
+
+var (
+	digestHTMLTemplate       = htmltemplate.Must(htmltemplate.ParseFS(digestTemplateFiles, "templates/digest.html"))
+	digestTextTemplate       = texttemplate.Must(texttemplate.ParseFS(digestTemplateFiles, "templates/digest.txt"))
+	unsubscribePageTemplate  = htmltemplate.Must(htmltemplate.ParseFS(digestTemplateFiles, "templates/unsubscribe.html"))
+	digestEmailHTMLTemplate  = htmltemplate.Must(htmltemplate.ParseFS(digestTemplateFiles, "templates/digest_email.html"))
+	digestEmailTextTemplate  = texttemplate.Must(texttemplate.ParseFS(digestTemplateFiles, "templates/digest_email.txt"))
+	confirmEmailPageTemplate = htmltemplate.Must(htmltemplate.ParseFS(digestTemplateFiles, "templates/confirm_email.html"))
+)
+
+// notificationActions is how a digest describes each notification type,
+// matching the text of its push.
+var notificationActions = map[string]string{
+	"builder_added":   "added you as a builder",
+	"comment_post":    "commented on your byte",
+	"comment_project": "commented on your stream",
+	"comment_reply":   "replied to your comment",
+	"follow_user":     "followed you",
+	"like_comment":    "liked your comment",
+	"like_post":       "liked your byte",
+	"like_project":    "liked your stream",
+	"mention":         "mentioned you",
+	"project_post":    "posted in a stream you follow",
+	"save_post":       "saved your byte",
+	"save_project":    "saved your stream",
+}
+
+type digestItem struct {
+	Text string
+	URL  string
+}
+
+type digestThread struct {
+	database.DigestThread
+	URL string
+}
+
+type digestView struct {
+	Username         string
+	Frequency        string
+	Period           string
+	Notifications    []digestItem
+	Threads          []digestThread
+	NotificationsURL string
+	UnsubscribeURL   string
+}
+
+// publicBaseURL is where links in emails point, DEVBITS_PUBLIC_URL or the
+// production site.
+func publicBaseURL() string {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("DEVBITS_PUBLIC_URL")), "/")
+	if base == "" {
+		return defaultPublicBaseURL
+	}
+	return base
+}
+
+// digestUnsubscribeURL is the signed link that turns userID's digest off.
+func digestUnsubscribeURL(userID int64) string {
+	query := url.Values{}
+	query.Set("user", strconv.FormatInt(userID, 10))
+	query.Set("signature", auth.SignDigestUnsubscribe(userID))
+	return publicBaseURL() + "/notifications/digest/unsubscribe?" + query.Encode()
+}
+
+// digestEmailURL is the signed link that confirms email as userID's digest
+// address.
+func digestEmailURL(userID int64, email string) string {
+	query := url.Values{}
+	query.Set("user", strconv.FormatInt(userID, 10))
+	query.Set("email", email)
+	query.Set("signature", auth.SignDigestEmail(userID, email))
+	return publicBaseURL() + "/notifications/digest/confirm?" + query.Encode()
+}
+
+type digestEmailView struct {
+	Email      string
+	ConfirmURL string
+}
+
+// sendDigestEmailConfirmation mails email the link that confirms it as
+// userID's digest address. Until it is followed no digest goes there.
+func sendDigestEmailConfirmation(userID int64, email string) {
+	sender := currentMailer()
+	if sender == nil {
+		return
+	}
+
+	view := digestEmailView{Email: email, ConfirmURL: digestEmailURL(userID, email)}
+	var text, html bytes.Buffer
+	err := digestEmailTextTemplate.Execute(&text, view)
+	if err == nil {
+		err = digestEmailHTMLTemplate.Execute(&html, view)
+	}
+	if err == nil {
+		err = sender.Send(mail.Message{
+			To:      email,
+			Subject: "Confirm your DevBits digest address",
+			Text:    text.String(),
+			HTML:    html.String(),
+		})
+	}
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": userID,
+			"err":     err.Error(),
+		}).Warn("Failed to send digest email confirmation")
+	}
+}
+
+func digestPeriod(frequency string) time.Duration {
+	if frequency == database.DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// StartEmailDigestWorker sends due digests every interval.
+func StartEmailDigestWorker(interval time.Duration) {
+	runEvery(interval, func() { SendEmailDigests(time.Now()) })
+}
+
+// SendEmailDigests emails every user whose digest is due at now a summary of
+// the unread notifications and messages since their last digest. Users with
+// nothing new get no email. Nothing is sent while no mailer is configured.
+func SendEmailDigests(now time.Time) {
+	sender := currentMailer()
+	if sender == nil {
+		return
+	}
+
+	dailyBefore := now.Add(-digestPeriod(database.DigestDaily))
+	weeklyBefore := now.Add(-digestPeriod(database.DigestWeekly))
+	var afterUserID int64
+	for {
+		recipients, err := database.QueryDueDigests(dailyBefore, weeklyBefore, afterUserID, digestBatch)
+		if err != nil {
+			logger.Log.Warnf("failed to query due digests: %v", err)
+			return
+		}
+		for _, recipient := range recipients {
+			sendEmailDigest(sender, recipient, now)
+		}
+		if len(recipients) < digestBatch {
+			return
+		}
+		afterUserID = recipients[len(recipients)-1].UserID
+	}
+}
+
+func sendEmailDigest(sender mail.Mailer, recipient database.DigestRecipient, now time.Time) {
+	period := digestPeriod(recipient.Frequency)
+	claimed, err := database.ClaimDigest(recipient.UserID, now.Add(-period), now)
+	if err != nil || !claimed {
+		return
+	}
+
+	since := now.Add(-period)
+	if recipient.LastSentAt != nil {
+		since = *recipient.LastSentAt
+	}
+	message, err := buildEmailDigest(recipient, since)
+	if err == nil && message == nil {
+		return
+	}
+	if err == nil {
+		err = sender.Send(*message)
+	}
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": recipient.UserID,
+			"err":     err.Error(),
+		}).Warn("Failed to send email digest")
+		if err := database.ReleaseDigest(recipient.UserID, recipient.LastSentAt); err != nil {
+			logger.Log.Warnf("failed to release digest: %v", err)
+		}
+	}
+}
+
+// buildEmailDigest renders recipient's digest of activity after since, or
+// returns nil if there is nothing to tell them.
+func buildEmailDigest(recipient database.DigestRecipient, since time.Time) (*mail.Message, error) {
+	base := publicBaseURL()
+	view := digestView{
+		Username:         recipient.Username,
+		Frequency:        recipient.Frequency,
+		Period:           "this week",
+		NotificationsURL: base + "/notifications",
+		UnsubscribeURL:   digestUnsubscribeURL(recipient.UserID),
+	}
+	if recipient.Frequency == database.DigestDaily {
+		view.Period = "today"
+	}
+
+	groups, err := database.QueryDigestNotifications(recipient.UserID, since, digestMaxItems)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		action, ok := notificationActions[group.Type]
+		if !ok {
+			continue
+		}
+		view.Notifications = append(view.Notifications, digestItem{
+			Text: groupedNotificationBody(&group, action),
+			URL:  notificationLink(base, group),
+		})
+	}
+
+	channels, err := database.GetNotificationChannels(recipient.UserID, "direct_message")
+	if err != nil {
+		return nil, err
+	}
+	if channels.Email {
+		threads, err := database.QueryDigestDirectMessages(recipient.UserID, since, digestMaxThreads)
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			if runes := []rune(thread.Latest); len(runes) > digestSnippetLength {
+				thread.Latest = strings.TrimSpace(string(runes[:digestSnippetLength])) + "…"
+			}
+			view.Threads = append(view.Threads, digestThread{
+				DigestThread: thread,
+				URL:          base + "/conversation/" + url.PathEscape(thread.SenderName),
+			})
+		}
+	}
+
+	if len(view.Notifications) == 0 && len(view.Threads) == 0 {
+		return nil, nil
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, view); err != nil {
+		return nil, fmt.Errorf("failed to render digest: %w", err)
+	}
+	if err := digestHTMLTemplate.Execute(&html, view); err != nil {
+		return nil, fmt.Errorf("failed to render digest: %w", err)
+	}
+
+	return &mail.Message{
+		To:      recipient.Email,
+		Subject: fmt.Sprintf("Your DevBits %s digest", recipient.Frequency),
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + view.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}, nil
+}
+
+// notificationLink points at what a notification is about.
+func notificationLink(base string, notification database.Notification) string {
+	switch {
+	case notification.PostID != nil:
+		return fmt.Sprintf("%s/post/%d", base, *notification.PostID)
+	case notification.ProjectID != nil:
+		return fmt.Sprintf("%s/stream/%d", base, *notification.ProjectID)
+	case notification.Type == "follow_user":
+		return base + "/user/" + url.PathEscape(notification.ActorName)
+	}
+	return base + "/notifications"
+}
+
+// digestUnsubscriber reads the user a signed unsubscribe link is for, or
+// responds 403 if the signature does not match.
+func digestUnsubscriber(context *gin.Context) (int64, bool) {
+	userID, err := strconv.ParseInt(context.Query("user"), 10, 64)
+	if err != nil || !auth.VerifyDigestUnsubscribe(userID, context.Query("signature")) {
+		RespondWithError(context, http.StatusForbidden, "Invalid unsubscribe link")
+		return 0, false
+	}
+	return userID, true
+}
+
+// ConfirmEmailDigestUnsubscribe handles GET /notifications/digest/unsubscribe,
+// the signed link in every digest. It only shows a page asking to confirm,
+// since mail scanners and link previews follow links on their own.
+func ConfirmEmailDigestUnsubscribe(context *gin.Context) {
+	userID, ok := digestUnsubscriber(context)
+	if !ok {
+		return
+	}
+
+	var page bytes.Buffer
+	if err := unsubscribePageTemplate.Execute(&page, struct{ UnsubscribeURL string }{digestUnsubscribeURL(userID)}); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to render page: %v", err))
+		return
+	}
+	context.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// UnsubscribeEmailDigest handles POST /notifications/digest/unsubscribe, sent
+// by the confirmation page and by mail clients as a one-click unsubscribe
+// (RFC 8058).
+func UnsubscribeEmailDigest(context *gin.Context) {
+	userID, ok := digestUnsubscriber(context)
+	if !ok {
+		return
+	}
+
+	if _, err := database.DisableDigest(userID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to unsubscribe: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Unsubscribed from email digests"})
+}
+
+// digestEmailConfirmation reads the user and address a signed confirmation
+// link is for, or responds 403 if the signature does not match.
+func digestEmailConfirmation(context *gin.Context) (int64, string, bool) {
+	userID, err := strconv.ParseInt(context.Query("user"), 10, 64)
+	email := context.Query("email")
+	if err != nil || !auth.VerifyDigestEmail(userID, email, context.Query("signature")) {
+		RespondWithError(context, http.StatusForbidden, "Invalid confirmation link")
+		return 0, "", false
+	}
+	return userID, email, true
+}
+
+// ShowDigestEmailConfirmation handles GET /notifications/digest/confirm, the
+// signed link mailed to a new digest address. Like unsubscribing, it only
+// shows a page asking to confirm, so a mail scanner cannot confirm for the
+// address's owner.
+func ShowDigestEmailConfirmation(context *gin.Context) {
+	userID, email, ok := digestEmailConfirmation(context)
+	if !ok {
+		return
+	}
+
+	var page bytes.Buffer
+	view := digestEmailView{Email: email, ConfirmURL: digestEmailURL(userID, email)}
+	if err := confirmEmailPageTemplate.Execute(&page, view); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to render page: %v", err))
+		return
+	}
+	context.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// ConfirmDigestEmail handles POST /notifications/digest/confirm, sent by the
+// confirmation page. Links for an address that is no longer pending, because
+// it was confirmed or replaced, do nothing.
+func ConfirmDigestEmail(context *gin.Context) {
+	userID, email, ok := digestEmailConfirmation(context)
+	if !ok {
+		return
+	}
+
+	confirmed, err := database.ConfirmDigestEmail(userID, email)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to confirm email: %v", err))
+		return
+	}
+	if !confirmed {
+		RespondWithError(context, http.StatusNotFound, "No digest address is waiting for this confirmation")
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Digest email address confirmed"})
+}
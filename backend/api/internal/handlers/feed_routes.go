@@ -76,7 +76,8 @@ func GetPostsFeed(context *gin.Context) {
 	}
 	var posts []database.Post = []database.Post{}
 	var code int
-	posts, code, err = database.GetPostFeedBySort(start, count, feedSort)
+	viewerID, _ := GetAuthUserID(context)
+	posts, code, err = database.GetPostFeedBySort(start, count, feedSort, viewerID)
 	if err != nil {
 		RespondWithError(context, code, fmt.Sprintf("An error occurred getting feed: %v", err))
 		return
@@ -137,7 +138,8 @@ func GetProjectsFeed(context *gin.Context) {
 	}
 	var projects []database.Project = []database.Project{}
 	var code int
-	projects, code, err = database.GetProjectFeedBySort(start, count, feedSort)
+	viewerID, _ := GetAuthUserID(context)
+	projects, code, err = database.GetProjectFeedBySort(start, count, feedSort, viewerID)
 	if err != nil {
 		RespondWithError(context, code, fmt.Sprintf("An error occurred getting feed: %v", err))
 		return
@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+	"backend/api/internal/webhooks"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxInboundWebhooks = 10
+	// maxInboundBody fits the largest pushes GitHub and GitLab send in
+	// practice; bigger ones are refused rather than read.
+	maxInboundBody         = 5 << 20
+	maxInboundPostLength   = 4000
+	maxInboundTemplate     = 4000
+	maxInboundPostsPerHour = 600
+	maxInboundNameLength   = 100
+)
+
+// inboundWebhookRequest is the body of POST and PUT
+// /projects/:project_id/inbound-webhooks. Fields left out of a PUT keep their
+// values; a template set to "" goes back to the default.
+type inboundWebhookRequest struct {
+	Name         *string           `json:"name"`
+	Templates    map[string]string `json:"templates"`
+	PostsPerHour *int              `json:"posts_per_hour"`
+	Secret       *string           `json:"secret"`
+	Active       *bool             `json:"active"`
+	RotateSecret bool              `json:"rotate_secret"`
+}
+
+// inboundWebhookView adds the URL to call, which is only useful with the
+// secret.
+type inboundWebhookView struct {
+	database.InboundWebhook
+	URL string `json:"url"`
+}
+
+func newInboundWebhookView(hook database.InboundWebhook) inboundWebhookView {
+	return inboundWebhookView{InboundWebhook: hook, URL: publicBaseURL() + "/webhooks/inbound/" + hook.Key}
+}
+
+// defaultInboundPostsPerHour is the rate limit for webhooks that do not set
+// their own.
+func defaultInboundPostsPerHour() int {
+	return int(readPositiveIntEnv("DEVBITS_INBOUND_WEBHOOK_POSTS_PER_HOUR", 30))
+}
+
+// projectBotUsername derives a bot's username from its project's name, such
+// as "docuhelper_bot".
+func projectBotUsername(project *database.Project) string {
+	var slug strings.Builder
+	for _, r := range strings.ToLower(project.Name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			slug.WriteRune(r)
+		case slug.Len() > 0 && !strings.HasSuffix(slug.String(), "_"):
+			slug.WriteByte('_')
+		}
+		if slug.Len() >= 30 {
+			break
+		}
+	}
+	name := strings.Trim(slug.String(), "_")
+	if name == "" {
+		name = "stream"
+	}
+	return name + "_bot"
+}
+
+// ensureProjectBot returns the bot that posts inbound webhook updates on
+// project's behalf, creating it on first use. The project owns the bot.
+func ensureProjectBot(project *database.Project) (int64, error) {
+	botID, err := database.GetProjectBot(project.ID)
+	if err != nil || botID != 0 {
+		return botID, err
+	}
+
+	username := projectBotUsername(project)
+	existing, err := database.GetUserByUsername(username)
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		username = fmt.Sprintf("%s_%d", strings.TrimSuffix(username, "_bot"), project.ID) + "_bot"
+	}
+	id, err := database.CreateBot(&database.ApiUser{
+		Username: username,
+		Bio:      fmt.Sprintf("Posts automated updates to %s.", project.Name),
+		Links:    []string{},
+		Settings: map[string]interface{}{},
+	}, database.BotOwner{ProjectID: project.ID}, nil, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create project bot: %w", err)
+	}
+	set, err := database.SetProjectBot(project.ID, id)
+	if err != nil {
+		return 0, err
+	}
+	if !set {
+		// Another request created the bot first.
+		if err := database.DeleteUser(username); err != nil {
+			logger.Log.Warnf("failed to delete duplicate project bot: %v", err)
+		}
+		return database.GetProjectBot(project.ID)
+	}
+	return id, nil
+}
+
+// loadOwnedInboundWebhook loads the project and inbound webhook named in the
+// path, checking the caller owns the project.
+func loadOwnedInboundWebhook(context *gin.Context) (*database.InboundWebhook, bool) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return nil, false
+	}
+	webhookID, err := strconv.ParseInt(context.Param("webhook_id"), 10, 64)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse webhook_id: %v", err))
+		return nil, false
+	}
+	hook, err := database.QueryInboundWebhook(project.ID, webhookID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return nil, false
+	}
+	if hook == nil {
+		RespondWithError(context, http.StatusNotFound, "Webhook not found")
+		return nil, false
+	}
+	return hook, true
+}
+
+// applyInboundWebhookRequest validates request and copies it onto hook,
+// returning the new secret if one was set.
+func applyInboundWebhookRequest(hook *database.InboundWebhook, request inboundWebhookRequest) (string, string) {
+	if request.Name != nil {
+		name := strings.TrimSpace(*request.Name)
+		if name == "" || len(name) > maxInboundNameLength {
+			return "", fmt.Sprintf("name must be 1 to %d characters", maxInboundNameLength)
+		}
+		hook.Name = name
+	}
+	for kind, text := range request.Templates {
+		known := false
+		for _, candidate := range webhooks.Kinds {
+			known = known || candidate == kind
+		}
+		if !known {
+			return "", fmt.Sprintf("Unknown template kind '%s'", kind)
+		}
+		if strings.TrimSpace(text) == "" {
+			delete(hook.Templates, kind)
+			continue
+		}
+		if len(text) > maxInboundTemplate {
+			return "", fmt.Sprintf("Templates must be at most %d characters", maxInboundTemplate)
+		}
+		if err := webhooks.CheckTemplate(text); err != nil {
+			return "", fmt.Sprintf("Invalid %s template: %v", kind, err)
+		}
+		hook.Templates[kind] = text
+	}
+	if request.PostsPerHour != nil {
+		if *request.PostsPerHour < 1 || *request.PostsPerHour > maxInboundPostsPerHour {
+			return "", fmt.Sprintf("posts_per_hour must be between 1 and %d", maxInboundPostsPerHour)
+		}
+		hook.PostsPerHour = *request.PostsPerHour
+	}
+	if request.Active != nil {
+		hook.Active = *request.Active
+	}
+	if request.Secret != nil && request.RotateSecret {
+		return "", "Set secret or rotate_secret, not both"
+	}
+	if request.Secret != nil {
+		if message := validateWebhookSecret(*request.Secret); message != "" {
+			return "", message
+		}
+		hook.Secret = *request.Secret
+		return hook.Secret, ""
+	}
+	if request.RotateSecret {
+		generated, err := webhooks.NewSecret()
+		if err != nil {
+			return "", err.Error()
+		}
+		hook.Secret = generated
+		return hook.Secret, ""
+	}
+	return "", ""
+}
+
+// GetInboundWebhooks handles GET /projects/:project_id/inbound-webhooks.
+func GetInboundWebhooks(context *gin.Context) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return
+	}
+	hooks, err := database.QueryInboundWebhooks(project.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch webhooks: %v", err))
+		return
+	}
+	views := make([]inboundWebhookView, len(hooks))
+	for index, hook := range hooks {
+		views[index] = newInboundWebhookView(hook)
+	}
+	context.JSON(http.StatusOK, gin.H{"webhooks": views, "default_templates": webhooks.DefaultTemplates})
+}
+
+// CreateInboundWebhook handles POST /projects/:project_id/inbound-webhooks.
+// The project's bot is created along with its first inbound webhook. The
+// secret, generated unless given, is only shown in this response.
+func CreateInboundWebhook(context *gin.Context) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return
+	}
+	var request inboundWebhookRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+	if request.Name == nil {
+		RespondWithError(context, http.StatusBadRequest, "A webhook name is required")
+		return
+	}
+	if request.Secret == nil {
+		request.RotateSecret = true
+	}
+
+	authUserID, _ := GetAuthUserID(context)
+	hook := database.InboundWebhook{
+		ProjectID:    project.ID,
+		Templates:    map[string]string{},
+		PostsPerHour: defaultInboundPostsPerHour(),
+		Active:       true,
+		CreatedBy:    &authUserID,
+	}
+	secret, message := applyInboundWebhookRequest(&hook, request)
+	if message != "" {
+		RespondWithError(context, http.StatusBadRequest, message)
+		return
+	}
+
+	existing, err := database.QueryInboundWebhooks(project.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch webhooks: %v", err))
+		return
+	}
+	if len(existing) >= maxInboundWebhooks {
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("A project can have at most %d inbound webhooks", maxInboundWebhooks))
+		return
+	}
+	if _, err := ensureProjectBot(project); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to set up the project bot: %v", err))
+		return
+	}
+
+	if hook.Key, err = webhooks.NewKey(); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id, err := database.CreateInboundWebhook(hook, time.Now())
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create webhook: %v", err))
+		return
+	}
+	created, err := database.QueryInboundWebhook(project.ID, id)
+	if err != nil || created == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return
+	}
+	context.JSON(http.StatusCreated, gin.H{"message": "Webhook created", "webhook": newInboundWebhookView(*created), "secret": secret})
+}
+
+// UpdateInboundWebhook handles PUT /projects/:project_id/inbound-webhooks/:webhook_id.
+func UpdateInboundWebhook(context *gin.Context) {
+	hook, ok := loadOwnedInboundWebhook(context)
+	if !ok {
+		return
+	}
+	var request inboundWebhookRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+	secret, message := applyInboundWebhookRequest(hook, request)
+	if message != "" {
+		RespondWithError(context, http.StatusBadRequest, message)
+		return
+	}
+	if err := database.UpdateInboundWebhook(*hook); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update webhook: %v", err))
+		return
+	}
+
+	response := gin.H{"message": "Webhook updated", "webhook": newInboundWebhookView(*hook)}
+	if secret != "" {
+		response["secret"] = secret
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// DeleteInboundWebhook handles DELETE /projects/:project_id/inbound-webhooks/:webhook_id.
+func DeleteInboundWebhook(context *gin.Context) {
+	hook, ok := loadOwnedInboundWebhook(context)
+	if !ok {
+		return
+	}
+	if _, err := database.DeleteInboundWebhook(hook.ProjectID, hook.ID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete webhook: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// GetInboundWebhookEvents handles GET /projects/:project_id/inbound-webhooks/:webhook_id/events,
+// the calls the webhook received, newest first, paged with start and count.
+func GetInboundWebhookEvents(context *gin.Context) {
+	hook, ok := loadOwnedInboundWebhook(context)
+	if !ok {
+		return
+	}
+	start, count := parseConversationPaging(context, 50)
+	events, err := database.QueryInboundWebhookEvents(hook.ID, start, count)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch events: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// ReceiveInboundWebhook handles POST /webhooks/inbound/:key, where CI systems
+// and git hosts report pushes, releases and anything else they render into a
+// post. Calls must be signed with the webhook's secret; see
+// webhooks.VerifyInbound.
+func ReceiveInboundWebhook(context *gin.Context) {
+	hook, err := database.GetInboundWebhookByKey(context.Param("key"))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return
+	}
+	if hook == nil {
+		RespondWithError(context, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxInboundBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			RespondWithError(context, http.StatusRequestEntityTooLarge, "Payload too large")
+			return
+		}
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to read payload: %v", err))
+		return
+	}
+	if !webhooks.VerifyInbound(context.Request.Header, body, hook.Secret) {
+		RespondWithError(context, http.StatusUnauthorized, "Invalid webhook signature")
+		return
+	}
+	if !hook.Active {
+		RespondWithError(context, http.StatusForbidden, "Webhook is disabled")
+		return
+	}
+
+	now := time.Now()
+	logEvent := database.InboundWebhookEvent{WebhookID: hook.ID, ReceivedAt: now}
+	record := func(status string, detail string) {
+		logEvent.Status = status
+		if detail != "" {
+			logEvent.Detail = &detail
+		}
+		if err := database.RecordInboundWebhookEvent(logEvent); err != nil {
+			logger.Log.Warnf("failed to record inbound webhook event: %v", err)
+		}
+	}
+
+	event, err := webhooks.ParseInbound(context.Request.Header, body)
+	if err != nil {
+		logEvent.Source, logEvent.Event = webhooks.SourceGeneric, "invalid"
+		record(database.InboundRejected, err.Error())
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Invalid payload: %v", err))
+		return
+	}
+	logEvent.Source = event.Source
+	logEvent.Event = event.Event
+	if len(logEvent.Event) > 50 {
+		logEvent.Event = logEvent.Event[:50]
+	}
+	if event.Kind == "" {
+		record(database.InboundIgnored, event.Ignored)
+		context.JSON(http.StatusAccepted, gin.H{"message": "Event ignored", "reason": event.Ignored})
+		return
+	}
+
+	content, err := webhooks.Render(hook.Templates, event)
+	if err != nil {
+		record(database.InboundRejected, err.Error())
+		RespondWithError(context, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to render post: %v", err))
+		return
+	}
+	if content == "" {
+		record(database.InboundIgnored, "empty post")
+		context.JSON(http.StatusAccepted, gin.H{"message": "Event ignored", "reason": "empty post"})
+		return
+	}
+	if runes := []rune(content); len(runes) > maxInboundPostLength {
+		content = strings.TrimSpace(string(runes[:maxInboundPostLength-1])) + "…"
+	}
+
+	project, err := database.QueryProject(int(hook.ProjectID))
+	if err != nil || project == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load project: %v", err))
+		return
+	}
+	botID, err := ensureProjectBot(project)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load the project bot: %v", err))
+		return
+	}
+
+	// The post is reserved before it is made, so concurrent calls cannot
+	// exceed the rate limit and a redelivered call is not posted twice.
+	reservation, err := database.ReserveInboundWebhookPost(logEvent, event.DeliveryID, hook.PostsPerHour)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if reservation.Duplicate {
+		record(database.InboundIgnored, "duplicate delivery")
+		context.JSON(http.StatusOK, gin.H{"message": "Delivery already received"})
+		return
+	}
+	if reservation.Limited {
+		retryAfter := time.Minute
+		if reservation.Earliest != nil {
+			retryAfter = max(reservation.Earliest.Add(time.Hour).Sub(now), time.Second)
+		}
+		record(database.InboundRejected, "rate limited")
+		context.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		RespondWithError(context, http.StatusTooManyRequests, fmt.Sprintf("Rate limit of %d posts per hour reached", hook.PostsPerHour))
+		return
+	}
+
+	postID, err := database.QueryCreatePost(&database.Post{User: botID, Project: project.ID, Content: content, Media: []string{}})
+	if err != nil {
+		if releaseErr := database.ReleaseInboundWebhookPost(reservation.EventID, hook.ID, event.DeliveryID, err.Error()); releaseErr != nil {
+			logger.Log.Warnf("failed to release inbound webhook post: %v", releaseErr)
+		}
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create post: %v", err))
+		return
+	}
+	if err := database.AttachInboundWebhookPost(reservation.EventID, postID); err != nil {
+		logger.Log.Warnf("failed to record inbound webhook post: %v", err)
+	}
+	publishPost(hubFor(context), project, postID, botID, content)
+
+	context.JSON(http.StatusCreated, gin.H{"message": "Post created", "post_id": postID})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"backend/api/internal/mail"
+)
+
+// defaultMailFrom is the sender when DEVBITS_MAIL_FROM is unset.
+const defaultMailFrom = "DevBits <no-reply@devbits.app>"
+
+var mailer = struct {
+	sync.RWMutex
+	current mail.Mailer
+}{}
+
+// UseMailer sends email through m. A nil mailer turns email off.
+func UseMailer(m mail.Mailer) {
+	mailer.Lock()
+	defer mailer.Unlock()
+	mailer.current = m
+}
+
+func currentMailer() mail.Mailer {
+	mailer.RLock()
+	defer mailer.RUnlock()
+	return mailer.current
+}
+
+// ConfigureMailer sets up email from the environment: DEVBITS_MAILER=smtp
+// sends through DEVBITS_SMTP_ADDR with optional DEVBITS_SMTP_USERNAME and
+// DEVBITS_SMTP_PASSWORD, DEVBITS_MAILER=file writes emails to DEVBITS_MAIL_DIR,
+// and anything else leaves email off.
+func ConfigureMailer() error {
+	from := strings.TrimSpace(os.Getenv("DEVBITS_MAIL_FROM"))
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("DEVBITS_MAILER"))); mode {
+	case "", "off":
+		UseMailer(nil)
+		return nil
+	case "smtp":
+		smtpMailer, err := mail.NewSMTPMailer(
+			strings.TrimSpace(os.Getenv("DEVBITS_SMTP_ADDR")),
+			from,
+			os.Getenv("DEVBITS_SMTP_USERNAME"),
+			os.Getenv("DEVBITS_SMTP_PASSWORD"),
+		)
+		if err != nil {
+			return err
+		}
+		UseMailer(smtpMailer)
+		return nil
+	case "file":
+		dir := strings.TrimSpace(os.Getenv("DEVBITS_MAIL_DIR"))
+		if dir == "" {
+			dir = "mail"
+		}
+		fileMailer, err := mail.NewFileMailer(dir, from)
+		if err != nil {
+			return err
+		}
+		UseMailer(fileMailer)
+		return nil
+	default:
+		return fmt.Errorf("unknown DEVBITS_MAILER %q", mode)
+	}
+}
@@ -39,14 +39,16 @@ func coerceStringSlice(value interface{}) ([]string, bool) {
 	}
 }
 
-func materializeMediaList(values []string) ([]string, error) {
+// materializeMediaList stores every media reference as a managed upload owned
+// by ownerID. Pass 0 when the owner is not known yet (e.g. during register).
+func materializeMediaList(ownerID int64, values []string) ([]string, error) {
 	if len(values) == 0 {
 		return values, nil
 	}
 
 	normalized := make([]string, 0, len(values))
 	for _, value := range values {
-		stored, err := materializeMediaReference(value)
+		stored, err := materializeMediaReference(ownerID, value)
 		if err != nil {
 			return nil, err
 		}
@@ -56,7 +58,7 @@ func materializeMediaList(values []string) ([]string, error) {
 	return normalized, nil
 }
 
-func materializeMediaReference(raw string) (string, error) {
+func materializeMediaReference(ownerID int64, raw string) (string, error) {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
 		return "", nil
@@ -76,7 +78,7 @@ func materializeMediaReference(raw string) (string, error) {
 	}
 
 	if strings.HasPrefix(trimmed, "data:") {
-		return materializeDataURI(trimmed)
+		return materializeDataURI(ownerID, trimmed)
 	}
 
 	parsed, err := url.Parse(trimmed)
@@ -98,13 +100,13 @@ func materializeMediaReference(raw string) (string, error) {
 			// in case this is a legitimate external URL that happens to have
 			// an /uploads/ path.
 		}
-		return materializeRemoteURL(parsed)
+		return materializeRemoteURL(ownerID, parsed)
 	}
 
 	return "", fmt.Errorf("unsupported media reference scheme")
 }
 
-func materializeDataURI(raw string) (string, error) {
+func materializeDataURI(ownerID int64, raw string) (string, error) {
 	commaIndex := strings.Index(raw, ",")
 	if commaIndex <= 0 {
 		return "", fmt.Errorf("invalid data uri")
@@ -146,10 +148,10 @@ func materializeDataURI(raw string) (string, error) {
 	if !isAllowedManagedMedia(ext, mediaType) {
 		return "", fmt.Errorf("unsupported media type")
 	}
-	return saveManagedUpload(body, ext)
+	return saveManagedUpload(ownerID, body, ext)
 }
 
-func materializeRemoteURL(parsed *url.URL) (string, error) {
+func materializeRemoteURL(ownerID int64, parsed *url.URL) (string, error) {
 	request, err := http.NewRequest(http.MethodGet, parsed.String(), nil)
 	if err != nil {
 		return "", fmt.Errorf("invalid media url")
@@ -179,7 +181,7 @@ func materializeRemoteURL(parsed *url.URL) (string, error) {
 	if !isAllowedManagedMedia(ext, contentType) {
 		return "", fmt.Errorf("unsupported media type")
 	}
-	return saveManagedUpload(body, ext)
+	return saveManagedUpload(ownerID, body, ext)
 }
 
 func isAllowedManagedMedia(ext, contentType string) bool {
@@ -240,7 +242,15 @@ func extensionFromContentType(contentType string) string {
 	return strings.ToLower(extensions[0])
 }
 
-func saveManagedUpload(body []byte, ext string) (string, error) {
+func saveManagedUpload(ownerID int64, body []byte, ext string) (string, error) {
+	if ext == ".svg" {
+		sanitized, err := sanitizeSVG(body)
+		if err != nil {
+			return "", err
+		}
+		body = sanitized
+	}
+
 	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		return "", fmt.Errorf("failed to prepare upload directory")
 	}
@@ -251,9 +261,20 @@ func saveManagedUpload(body []byte, ext string) (string, error) {
 	}
 
 	filename := fmt.Sprintf("%s%s", name, ext)
+	if ownerID > 0 {
+		filename = fmt.Sprintf("u%d_%s", ownerID, filename)
+	}
 	path := filepath.Join(uploadDir, filename)
 
+	if ownerID > 0 {
+		if err := reserveManagedUpload(ownerID, filename, int64(len(body))); err != nil {
+			return "", err
+		}
+	}
 	if err := os.WriteFile(path, bytes.Clone(body), 0o644); err != nil {
+		if ownerID > 0 {
+			cancelManagedUpload(filename)
+		}
 		return "", fmt.Errorf("failed to store media")
 	}
 
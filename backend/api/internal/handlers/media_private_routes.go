@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Private media lives outside the public uploads directory and is only served
+// through HMAC-signed URLs minted for a specific viewer. Every file belongs to
+// a resource (its owner, a post, a project, ...) and a viewer may see it only
+// while they may see that resource.
+const privateUploadDir = "private_uploads"
+
+var privateMediaURLTTL = time.Duration(readPositiveIntEnv("DEVBITS_PRIVATE_MEDIA_URL_TTL_MINUTES", 15)) * time.Minute
+
+var privateMediaFilenamePattern = regexp.MustCompile(`^u[0-9]+_[0-9a-f]+\.[a-z0-9]+$`)
+
+// privateMediaResource describes who may attach media to a resource type and
+// who may view media attached to it. The media owner can always view it.
+type privateMediaResource struct {
+	canAttach func(userID int64, resourceID int64) (bool, error)
+	canView   func(viewerID int64, resourceID int64) (bool, error)
+}
+
+var privateMediaResources = map[string]privateMediaResource{
+	"user": {
+		canAttach: func(userID int64, resourceID int64) (bool, error) {
+			return userID == resourceID, nil
+		},
+		canView: func(viewerID int64, resourceID int64) (bool, error) {
+			return viewerID == resourceID, nil
+		},
+	},
+	"post": {
+		canAttach: func(userID int64, resourceID int64) (bool, error) {
+			post, err := database.QueryPost(int(resourceID))
+			if err != nil || post == nil {
+				return false, err
+			}
+			return post.User == userID, nil
+		},
+		canView: func(viewerID int64, resourceID int64) (bool, error) {
+			post, err := database.QueryPost(int(resourceID))
+			if err != nil || post == nil {
+				return false, err
+			}
+			return blockAllowsViewingPost(viewerID, post)
+		},
+	},
+	"project": {
+		canAttach: func(userID int64, resourceID int64) (bool, error) {
+			project, err := database.QueryProject(int(resourceID))
+			if err != nil || project == nil {
+				return false, err
+			}
+			if project.Owner == userID {
+				return true, nil
+			}
+			return database.QueryIsProjectBuilder(int(resourceID), userID)
+		},
+		canView: func(viewerID int64, resourceID int64) (bool, error) {
+			project, err := database.QueryProject(int(resourceID))
+			if err != nil || project == nil {
+				return false, err
+			}
+			return blockAllowsViewingProject(viewerID, project)
+		},
+	},
+	"direct_message": {
+		canAttach: func(userID int64, resourceID int64) (bool, error) {
+			senderID, _, found, err := database.QueryDirectMessageParticipants(resourceID)
+			return found && senderID == userID, err
+		},
+		canView: func(viewerID int64, resourceID int64) (bool, error) {
+			senderID, recipientID, found, err := database.QueryDirectMessageParticipants(resourceID)
+			return found && (viewerID == senderID || viewerID == recipientID), err
+		},
+	},
+	"conversation_message": {
+		canAttach: func(userID int64, resourceID int64) (bool, error) {
+			_, senderID, found, err := database.QueryConversationMessageParticipants(resourceID)
+			return found && senderID == userID, err
+		},
+		canView: func(viewerID int64, resourceID int64) (bool, error) {
+			conversationID, _, found, err := database.QueryConversationMessageParticipants(resourceID)
+			if err != nil || !found {
+				return false, err
+			}
+			participant, err := database.GetConversationParticipant(conversationID, viewerID)
+			return participant != nil, err
+		},
+	},
+}
+
+func canViewPrivateMedia(viewerID int64, media *database.PrivateMedia) (bool, error) {
+	if viewerID == media.OwnerID {
+		return true, nil
+	}
+	resource, ok := privateMediaResources[media.ResourceType]
+	if !ok {
+		return false, nil
+	}
+	return resource.canView(viewerID, media.ResourceID)
+}
+
+// signedPrivateMediaURL returns a relative URL granting viewerID access to
+// filename. Expiry is rounded up to the next minute so repeated requests
+// share a URL and the client cache stays useful.
+func signedPrivateMediaURL(filename string, viewerID int64) (string, time.Time) {
+	expires := time.Now().UTC().Add(privateMediaURLTTL).Truncate(time.Minute).Add(time.Minute)
+	query := url.Values{}
+	query.Set("viewer", strconv.FormatInt(viewerID, 10))
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", auth.SignMediaURL(filename, viewerID, expires))
+	return fmt.Sprintf("/media/private/%s?%s", filename, query.Encode()), expires
+}
+
+// privateMediaReference is the stored, unsigned form of a private media link.
+func privateMediaReference(filename string) string {
+	return fmt.Sprintf("/media/private/%s", filename)
+}
+
+// extractPrivateMediaFilename recognises private media links, signed or not,
+// relative or absolute.
+func extractPrivateMediaFilename(raw string) (string, bool) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", false
+	}
+	filename, found := strings.CutPrefix(parsed.Path, "/media/private/")
+	if !found || !privateMediaFilenamePattern.MatchString(filename) {
+		return "", false
+	}
+	return filename, true
+}
+
+// signPrivateMediaReferences swaps stored private media links for URLs signed
+// for viewerID. Other entries are returned unchanged.
+func signPrivateMediaReferences(media []string, viewerID int64) []string {
+	if len(media) == 0 {
+		return media
+	}
+	signed := make([]string, len(media))
+	for index, item := range media {
+		if filename, ok := extractPrivateMediaFilename(item); ok {
+			signed[index], _ = signedPrivateMediaURL(filename, viewerID)
+			continue
+		}
+		signed[index] = item
+	}
+	return signed
+}
+
+func privateMediaResponse(context *gin.Context, media *database.PrivateMedia, viewerID int64) gin.H {
+	relativeURL, expires := signedPrivateMediaURL(media.Filename, viewerID)
+	return gin.H{
+		"url":           relativeURL,
+		"absolute_url":  requestOrigin(context) + relativeURL,
+		"reference":     privateMediaReference(media.Filename),
+		"expires_at":    expires,
+		"filename":      media.Filename,
+		"contentType":   media.ContentType,
+		"resource_type": media.ResourceType,
+		"resource_id":   media.ResourceID,
+	}
+}
+
+// loadViewablePrivateMedia resolves :filename and checks that viewerID may see
+// it. Missing and forbidden media both return 404 so filenames can't be probed.
+func loadViewablePrivateMedia(context *gin.Context, viewerID int64) (*database.PrivateMedia, bool) {
+	filename := strings.TrimSpace(context.Param("filename"))
+	if !privateMediaFilenamePattern.MatchString(filename) {
+		RespondWithError(context, http.StatusNotFound, "Media not found")
+		return nil, false
+	}
+
+	media, err := database.GetPrivateMedia(filename)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch media: %v", err))
+		return nil, false
+	}
+	if media == nil {
+		RespondWithError(context, http.StatusNotFound, "Media not found")
+		return nil, false
+	}
+
+	allowed, err := canViewPrivateMedia(viewerID, media)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check media access: %v", err))
+		return nil, false
+	}
+	if !allowed {
+		RespondWithError(context, http.StatusNotFound, "Media not found")
+		return nil, false
+	}
+	return media, true
+}
+
+// UploadPrivateMedia handles POST /media/private. It takes the same multipart
+// payload as /media/upload plus optional `resource_type` and `resource_id`
+// fields naming the resource the media belongs to (defaults to the uploader).
+func UploadPrivateMedia(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	file, err := context.FormFile("file")
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Missing file: %v", err))
+		return
+	}
+
+	resourceType := strings.ToLower(strings.TrimSpace(context.PostForm("resource_type")))
+	resourceID := userID
+	if resourceType == "" {
+		resourceType = "user"
+	}
+	if rawID := strings.TrimSpace(context.PostForm("resource_id")); rawID != "" {
+		resourceID, err = strconv.ParseInt(rawID, 10, 64)
+		if err != nil || resourceID <= 0 {
+			RespondWithError(context, http.StatusBadRequest, "Invalid resource_id")
+			return
+		}
+	}
+
+	resource, ok := privateMediaResources[resourceType]
+	if !ok {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Unsupported resource_type '%s'", resourceType))
+		return
+	}
+	allowed, err := resource.canAttach(userID, resourceID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check resource access: %v", err))
+		return
+	}
+	if !allowed {
+		RespondWithError(context, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	ext, mediaKind, err := validateUploadAndResolveExtension(file, true, false)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := os.MkdirAll(privateUploadDir, 0o755); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare upload directory")
+		return
+	}
+
+	name, err := randomHex(12)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to generate filename")
+		return
+	}
+
+	filename := fmt.Sprintf("u%d_%s%s", userID, name, ext)
+	path := filepath.Join(privateUploadDir, filename)
+	if err := reserveManagedUpload(userID, filename, file.Size); err != nil {
+		respondWithUploadLimitError(context, err)
+		return
+	}
+	if err := context.SaveUploadedFile(file, path); err != nil {
+		cancelManagedUpload(filename)
+		RespondWithError(context, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	media := &database.PrivateMedia{
+		Filename:     filename,
+		OwnerID:      userID,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		ContentType:  file.Header.Get("Content-Type"),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := database.CreatePrivateMedia(media); err != nil {
+		_ = os.Remove(path)
+		cancelManagedUpload(filename)
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to store media: %v", err))
+		return
+	}
+
+	response := privateMediaResponse(context, media, userID)
+	response["mediaType"] = mediaKind
+	response["size"] = file.Size
+	context.JSON(http.StatusOK, response)
+}
+
+// GetPrivateMediaURL handles GET /media/private/:filename/url and returns a
+// fresh signed URL for the authenticated viewer.
+func GetPrivateMediaURL(context *gin.Context) {
+	viewerID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	media, ok := loadViewablePrivateMedia(context, viewerID)
+	if !ok {
+		return
+	}
+	context.JSON(http.StatusOK, privateMediaResponse(context, media, viewerID))
+}
+
+// ServePrivateMedia handles GET /media/private/:filename. It needs no bearer
+// token so signed URLs work in <img> and <video> tags; the signature binds the
+// URL to one viewer and the access check is repeated in case it was revoked.
+func ServePrivateMedia(context *gin.Context) {
+	filename := strings.TrimSpace(context.Param("filename"))
+	viewerID, viewerErr := strconv.ParseInt(context.Query("viewer"), 10, 64)
+	expires, expiresErr := strconv.ParseInt(context.Query("expires"), 10, 64)
+	if viewerErr != nil || expiresErr != nil ||
+		!auth.VerifyMediaSignature(filename, viewerID, expires, context.Query("signature")) {
+		RespondWithError(context, http.StatusForbidden, "Invalid or expired media link")
+		return
+	}
+
+	if _, ok := loadViewablePrivateMedia(context, viewerID); !ok {
+		return
+	}
+
+	// Cache for the viewer only, and no longer than the link is valid.
+	maxAge := expires - time.Now().Unix()
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	header := context.Writer.Header()
+	header.Del("Pragma")
+	header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	header.Set("Expires", time.Unix(expires, 0).UTC().Format(http.TimeFormat))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	header.Set("Referrer-Policy", "no-referrer")
+
+	context.File(filepath.Join(privateUploadDir, filename))
+}
+
+// DeletePrivateMedia handles DELETE /media/private/:filename. Only the owner
+// may delete private media.
+func DeletePrivateMedia(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	media, ok := loadViewablePrivateMedia(context, userID)
+	if !ok {
+		return
+	}
+	if media.OwnerID != userID {
+		RespondWithError(context, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if _, err := purgePrivateMedia([]string{media.Filename}); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete media: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Media deleted"})
+}
+
+// purgePrivateMedia deletes private media rows and their files.
+func purgePrivateMedia(filenames []string) (int, error) {
+	for _, filename := range filenames {
+		if err := database.DeletePrivateMedia(filename); err != nil {
+			return 0, err
+		}
+	}
+	return removePrivateMediaFiles(filenames), nil
+}
+
+func removePrivateMediaFiles(filenames []string) int {
+	removed := 0
+	released := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		filePath := filepath.Join(privateUploadDir, filename)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			logger.Log.WithFields(map[string]interface{}{
+				"path": filePath,
+				"err":  err.Error(),
+			}).Warn("Failed to remove private media")
+			continue
+		} else if err == nil {
+			removed += 1
+		}
+		released = append(released, filename)
+	}
+	releaseManagedUploads(released)
+	return removed
+}
+
+// removeOwnerPrivateMediaFiles deletes every private file uploaded by userID.
+// Their database rows go away with the user through ON DELETE CASCADE.
+func removeOwnerPrivateMediaFiles(userID int) int {
+	entries, err := os.ReadDir(privateUploadDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.WithFields(map[string]interface{}{
+				"dir": privateUploadDir,
+				"err": err.Error(),
+			}).Warn("Failed to scan private uploads directory")
+		}
+		return 0
+	}
+
+	prefix := fmt.Sprintf("u%d_", userID)
+	filenames := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			filenames = append(filenames, entry.Name())
+		}
+	}
+	return removePrivateMediaFiles(filenames)
+}
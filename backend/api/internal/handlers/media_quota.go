@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server-wide upload limits, overridable per user by admins. Configure with
+// DEVBITS_UPLOAD_QUOTA_MB and DEVBITS_UPLOADS_PER_HOUR.
+var defaultUploadQuotaBytes = readPositiveIntEnv("DEVBITS_UPLOAD_QUOTA_MB", 1024) << 20
+var defaultUploadsPerHour = int(readPositiveIntEnv("DEVBITS_UPLOADS_PER_HOUR", 60))
+
+var errStorageQuotaExceeded = database.ErrStorageQuotaExceeded
+var errUploadRateLimited = database.ErrUploadRateLimited
+
+type uploadLimits struct {
+	QuotaBytes     int64 `json:"quota_bytes"`
+	UploadsPerHour int   `json:"uploads_per_hour"`
+}
+
+type storageUsage struct {
+	UsedBytes       int64 `json:"used_bytes"`
+	QuotaBytes      int64 `json:"quota_bytes"`
+	UploadsLastHour int   `json:"uploads_last_hour"`
+	UploadsPerHour  int   `json:"uploads_per_hour"`
+}
+
+func readPositiveIntEnv(key string, fallback int64) int64 {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value <= 0 {
+		log.Printf("WARN: ignoring invalid %s=%q", key, raw)
+		return fallback
+	}
+	return value
+}
+
+func resolveUploadLimits(userID int64) (uploadLimits, error) {
+	limits := uploadLimits{
+		QuotaBytes:     defaultUploadQuotaBytes,
+		UploadsPerHour: defaultUploadsPerHour,
+	}
+
+	override, err := database.GetStorageLimitOverride(userID)
+	if err != nil {
+		return limits, err
+	}
+	if override != nil {
+		if override.QuotaBytes != nil {
+			limits.QuotaBytes = *override.QuotaBytes
+		}
+		if override.UploadsPerHour != nil {
+			limits.UploadsPerHour = *override.UploadsPerHour
+		}
+	}
+	return limits, nil
+}
+
+func getStorageUsage(userID int64) (*storageUsage, int, error) {
+	limits, err := resolveUploadLimits(userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	used, status, err := database.GetUserStorageUsage(userID)
+	if err != nil {
+		return nil, status, err
+	}
+
+	recent, status, err := database.CountUserUploadsSince(userID, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		return nil, status, err
+	}
+
+	return &storageUsage{
+		UsedBytes:       used,
+		QuotaBytes:      limits.QuotaBytes,
+		UploadsLastHour: recent,
+		UploadsPerHour:  limits.UploadsPerHour,
+	}, http.StatusOK, nil
+}
+
+// checkUploadAllowance verifies that storing `incomingBytes` more for the user
+// stays within their quota and hourly upload limit.
+func checkUploadAllowance(userID int64, incomingBytes int64) error {
+	usage, _, err := getStorageUsage(userID)
+	if err != nil {
+		return fmt.Errorf("failed to check upload limits: %w", err)
+	}
+	if usage.UploadsLastHour >= usage.UploadsPerHour {
+		return errUploadRateLimited
+	}
+	if usage.UsedBytes+incomingBytes > usage.QuotaBytes {
+		return errStorageQuotaExceeded
+	}
+	return nil
+}
+
+// reserveManagedUpload counts filename toward the user's quota and hourly
+// upload limit before the file is written, failing with
+// errStorageQuotaExceeded or errUploadRateLimited when it does not fit. Call
+// cancelManagedUpload if storing the file then fails.
+func reserveManagedUpload(userID int64, filename string, sizeBytes int64) error {
+	limits, err := resolveUploadLimits(userID)
+	if err != nil {
+		return fmt.Errorf("failed to check upload limits: %w", err)
+	}
+	return database.ReserveMediaUpload(userID, filename, sizeBytes, limits.QuotaBytes, limits.UploadsPerHour, time.Now().UTC().Add(-time.Hour))
+}
+
+// cancelManagedUpload drops the reservation for a file that was never stored.
+func cancelManagedUpload(filename string) {
+	if err := database.DeleteMediaUpload(filename); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"filename": filename,
+			"err":      err.Error(),
+		}).Warn("Failed to cancel managed upload")
+	}
+}
+
+// respondWithUploadLimitError reports a failed reservation, as the limit it
+// hit or as a server error.
+func respondWithUploadLimitError(context *gin.Context, err error) {
+	if status := uploadLimitStatus(err); status != 0 {
+		RespondWithError(context, status, err.Error())
+		return
+	}
+	RespondWithError(context, http.StatusInternalServerError, "Failed to check upload limits")
+}
+
+func releaseManagedUploads(filenames []string) {
+	if err := database.MarkMediaUploadsDeleted(filenames); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"count": len(filenames),
+			"err":   err.Error(),
+		}).Warn("Failed to release managed uploads")
+	}
+}
+
+// uploadLimitStatus maps quota failures to their HTTP status, or 0 when the
+// error is not a limit violation.
+func uploadLimitStatus(err error) int {
+	switch {
+	case errors.Is(err, errStorageQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUploadRateLimited):
+		return http.StatusTooManyRequests
+	default:
+		return 0
+	}
+}
+
+// respondWithMediaIngestError reports quota violations as such and every other
+// ingest failure with the caller's bad-request message.
+func respondWithMediaIngestError(context *gin.Context, err error, message string) {
+	if status := uploadLimitStatus(err); status != 0 {
+		RespondWithError(context, status, err.Error())
+		return
+	}
+	RespondWithError(context, http.StatusBadRequest, message)
+}
+
+type setStorageLimitsRequest struct {
+	QuotaMB        *int64 `json:"quota_mb"`
+	UploadsPerHour *int   `json:"uploads_per_hour"`
+}
+
+// AdminGetUserStorage returns a user's storage usage and effective limits.
+func AdminGetUserStorage(c *gin.Context) {
+	target, err := database.GetUserByUsername(strings.TrimSpace(c.Param("username")))
+	if err != nil || target == nil {
+		RespondWithError(c, http.StatusNotFound, "User not found")
+		return
+	}
+
+	usage, status, err := getStorageUsage(int64(target.Id))
+	if err != nil {
+		RespondWithError(c, status, fmt.Sprintf("Failed to fetch storage usage: %v", err))
+		return
+	}
+
+	override, err := database.GetStorageLimitOverride(int64(target.Id))
+	if err != nil {
+		RespondWithError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch storage limits: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"usage":    usage,
+		"override": override,
+		"defaults": uploadLimits{QuotaBytes: defaultUploadQuotaBytes, UploadsPerHour: defaultUploadsPerHour},
+	})
+}
+
+// AdminSetUserStorage overrides a user's quota and hourly upload limit. Omitted
+// fields fall back to the server defaults; omitting both clears the override.
+func AdminSetUserStorage(c *gin.Context) {
+	target, err := database.GetUserByUsername(strings.TrimSpace(c.Param("username")))
+	if err != nil || target == nil {
+		RespondWithError(c, http.StatusNotFound, "User not found")
+		return
+	}
+
+	var payload setStorageLimitsRequest
+	if err := c.BindJSON(&payload); err != nil {
+		RespondWithError(c, http.StatusBadRequest, fmt.Sprintf("Invalid payload: %v", err))
+		return
+	}
+	if payload.QuotaMB != nil && *payload.QuotaMB < 0 {
+		RespondWithError(c, http.StatusBadRequest, "quota_mb must be >= 0")
+		return
+	}
+	if payload.UploadsPerHour != nil && *payload.UploadsPerHour < 0 {
+		RespondWithError(c, http.StatusBadRequest, "uploads_per_hour must be >= 0")
+		return
+	}
+
+	var quotaBytes *int64
+	if payload.QuotaMB != nil {
+		value := *payload.QuotaMB << 20
+		quotaBytes = &value
+	}
+
+	var updatedBy *int64
+	if authUserID, ok := GetAuthUserID(c); ok {
+		updatedBy = &authUserID
+	}
+
+	if err := database.SetStorageLimitOverride(int64(target.Id), quotaBytes, payload.UploadsPerHour, updatedBy); err != nil {
+		RespondWithError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to update storage limits: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Storage limits updated for %s", target.Username)})
+}
+
+// releaseMessageUploads removes the managed uploads a deleted message carried
+// and gives their storage back to the sender, except for files that something
+// else still shows.
+func releaseMessageUploads(senderID int64, media []string) {
+	filenames := make([]string, 0, len(media))
+	for _, item := range media {
+		if filename, ok := extractManagedUploadFilename(item); ok {
+			filenames = append(filenames, filename)
+		}
+	}
+	if len(filenames) == 0 {
+		return
+	}
+
+	unreferenced, err := database.QueryUnreferencedUploads(senderID, filenames)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": senderID,
+			"err":     err.Error(),
+		}).Warn("Failed to find uploads to release")
+		return
+	}
+	targets := make(map[string]struct{}, len(unreferenced))
+	for _, filename := range unreferenced {
+		targets[filename] = struct{}{}
+	}
+	removeManagedUploadFiles(targets)
+}
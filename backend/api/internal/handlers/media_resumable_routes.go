@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads let clients on flaky networks send large videos in
+// chunks. The protocol mirrors tus.io's core semantics with a JSON API:
+//
+//	POST   /media/uploads                 create a session ({filename, content_type, size})
+//	HEAD   /media/uploads/:upload_id      current offset in the Upload-Offset header
+//	PATCH  /media/uploads/:upload_id      append a chunk at Upload-Offset
+//	POST   /media/uploads/:upload_id/complete  validate and store the finished file
+//	DELETE /media/uploads/:upload_id      abort the session
+//
+// Partial data lives outside the public uploads directory until completion.
+const uploadSessionDir = "upload_sessions"
+
+const uploadSessionTTL = 24 * time.Hour
+
+var maxResumableUploadBytes = readPositiveIntEnv("DEVBITS_RESUMABLE_UPLOAD_MAX_MB", 512) << 20
+
+// uploadSessionLocks serialises chunk writes per session within this process.
+var uploadSessionLocks sync.Map
+
+type createUploadSessionRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+func lockUploadSession(id string) func() {
+	value, _ := uploadSessionLocks.LoadOrStore(id, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func uploadSessionPath(id string) string {
+	return filepath.Join(uploadSessionDir, id+".part")
+}
+
+func setUploadSessionHeaders(context *gin.Context, session *database.UploadSession) {
+	context.Header("Upload-Offset", strconv.FormatInt(session.OffsetBytes, 10))
+	context.Header("Upload-Length", strconv.FormatInt(session.TotalBytes, 10))
+	context.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// loadOwnedUploadSession fetches a session and verifies it belongs to the
+// caller and has not expired. It writes the error response itself.
+func loadOwnedUploadSession(context *gin.Context) (*database.UploadSession, bool) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	id := strings.TrimSpace(context.Param("upload_id"))
+	session, err := database.GetUploadSession(id)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch upload session: %v", err))
+		return nil, false
+	}
+	if session == nil || session.UserID != userID {
+		RespondWithError(context, http.StatusNotFound, "Upload session not found")
+		return nil, false
+	}
+	if time.Now().UTC().After(session.ExpiresAt) {
+		discardUploadSession(session.ID)
+		RespondWithError(context, http.StatusGone, "Upload session expired")
+		return nil, false
+	}
+	return session, true
+}
+
+func discardUploadSession(id string) {
+	if err := database.DeleteUploadSession(id); err != nil {
+		logger.Log.Warnf("failed to delete upload session %s: %v", id, err)
+	}
+	if err := os.Remove(uploadSessionPath(id)); err != nil && !os.IsNotExist(err) {
+		logger.Log.Warnf("failed to remove partial upload %s: %v", id, err)
+	}
+	uploadSessionLocks.Delete(id)
+}
+
+// CreateUploadSession handles POST /media/uploads.
+func CreateUploadSession(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request createUploadSessionRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	request.Filename = filepath.Base(strings.TrimSpace(request.Filename))
+	if request.Filename == "" || request.Filename == "." {
+		RespondWithError(context, http.StatusBadRequest, "Missing filename")
+		return
+	}
+	if request.Size <= 0 {
+		RespondWithError(context, http.StatusBadRequest, "size must be > 0")
+		return
+	}
+	if request.Size > maxResumableUploadBytes {
+		RespondWithError(context, http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+
+	// Reject obviously unsupported types before the client sends any data.
+	// The content itself is checked again on completion.
+	if _, _, err := resolveUploadExtension(request.Filename, request.ContentType, nil, true, false); err != nil {
+		RespondWithError(context, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := checkUploadAllowance(userID, request.Size); err != nil {
+		respondWithUploadLimitError(context, err)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to generate upload id")
+		return
+	}
+
+	if err := os.MkdirAll(uploadSessionDir, 0o755); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare upload directory")
+		return
+	}
+	partial, err := os.OpenFile(uploadSessionPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare upload")
+		return
+	}
+	_ = partial.Close()
+
+	now := time.Now().UTC()
+	session := &database.UploadSession{
+		ID:          id,
+		UserID:      userID,
+		Filename:    request.Filename,
+		ContentType: strings.TrimSpace(request.ContentType),
+		TotalBytes:  request.Size,
+		OffsetBytes: 0,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(uploadSessionTTL),
+	}
+	if err := database.CreateUploadSession(session); err != nil {
+		_ = os.Remove(uploadSessionPath(id))
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create upload session: %v", err))
+		return
+	}
+
+	setUploadSessionHeaders(context, session)
+	context.Header("Location", fmt.Sprintf("/media/uploads/%s", id))
+	context.JSON(http.StatusCreated, gin.H{"message": "Upload session created", "upload": session})
+}
+
+// GetUploadSessionOffset handles HEAD /media/uploads/:upload_id so clients can
+// find where to resume after a dropped connection.
+func GetUploadSessionOffset(context *gin.Context) {
+	session, ok := loadOwnedUploadSession(context)
+	if !ok {
+		return
+	}
+
+	setUploadSessionHeaders(context, session)
+	context.Status(http.StatusOK)
+}
+
+// AppendUploadChunk handles PATCH /media/uploads/:upload_id. The request body
+// is raw bytes that must start exactly at the session's current offset.
+func AppendUploadChunk(context *gin.Context) {
+	session, ok := loadOwnedUploadSession(context)
+	if !ok {
+		return
+	}
+
+	unlock := lockUploadSession(session.ID)
+	defer unlock()
+
+	// Re-read under the lock in case another chunk landed while we waited.
+	session, err := database.GetUploadSession(session.ID)
+	if err != nil || session == nil {
+		RespondWithError(context, http.StatusNotFound, "Upload session not found")
+		return
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(context.GetHeader("Upload-Offset")), 10, 64)
+	if err != nil || offset < 0 {
+		RespondWithError(context, http.StatusBadRequest, "Missing or invalid Upload-Offset header")
+		return
+	}
+	if offset != session.OffsetBytes {
+		setUploadSessionHeaders(context, session)
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, session.OffsetBytes))
+		return
+	}
+
+	partial, err := os.OpenFile(uploadSessionPath(session.ID), os.O_WRONLY, 0o600)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to open partial upload")
+		return
+	}
+	defer partial.Close()
+
+	// Drop any bytes left behind by a write that failed before the offset was saved.
+	if err := partial.Truncate(session.OffsetBytes); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare partial upload")
+		return
+	}
+	if _, err := partial.Seek(session.OffsetBytes, io.SeekStart); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare partial upload")
+		return
+	}
+
+	remaining := session.TotalBytes - session.OffsetBytes
+	written, copyErr := io.Copy(partial, io.LimitReader(context.Request.Body, remaining+1))
+	if written > remaining {
+		_ = partial.Truncate(session.OffsetBytes)
+		RespondWithError(context, http.StatusRequestEntityTooLarge, "Chunk exceeds declared upload size")
+		return
+	}
+
+	// Keep whatever arrived before a dropped connection so the client can resume from it.
+	newOffset := session.OffsetBytes + written
+	advanced, err := database.AdvanceUploadSession(session.ID, session.OffsetBytes, newOffset)
+	if err != nil || !advanced {
+		_ = partial.Truncate(session.OffsetBytes)
+		RespondWithError(context, http.StatusConflict, "Upload session changed concurrently")
+		return
+	}
+	session.OffsetBytes = newOffset
+
+	setUploadSessionHeaders(context, session)
+	if copyErr != nil {
+		RespondWithError(context, http.StatusBadRequest, "Chunk transfer interrupted")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Chunk stored", "upload": session})
+}
+
+// CompleteUploadSession handles POST /media/uploads/:upload_id/complete. The
+// assembled file is validated like a regular upload and moved into the
+// managed uploads directory.
+func CompleteUploadSession(context *gin.Context) {
+	session, ok := loadOwnedUploadSession(context)
+	if !ok {
+		return
+	}
+
+	unlock := lockUploadSession(session.ID)
+	defer unlock()
+
+	// Re-read under the lock: a complete that held it first has already
+	// stored the file and deleted the session.
+	session, err := database.GetUploadSession(session.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch upload session: %v", err))
+		return
+	}
+	if session == nil {
+		RespondWithError(context, http.StatusNotFound, "Upload session not found")
+		return
+	}
+
+	if session.OffsetBytes != session.TotalBytes {
+		setUploadSessionHeaders(context, session)
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("Upload incomplete: %d of %d bytes received", session.OffsetBytes, session.TotalBytes))
+		return
+	}
+
+	partialPath := uploadSessionPath(session.ID)
+	probe, err := readUploadProbe(partialPath)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to read partial upload")
+		return
+	}
+
+	ext, mediaKind, err := resolveUploadExtension(session.Filename, session.ContentType, probe, true, false)
+	if err != nil {
+		discardUploadSession(session.ID)
+		RespondWithError(context, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mediaKind != "video" && session.TotalBytes > maxUploadBytes {
+		discardUploadSession(session.ID)
+		RespondWithError(context, http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to prepare upload directory")
+		return
+	}
+
+	name, err := randomHex(12)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, "Failed to generate filename")
+		return
+	}
+
+	filename := buildManagedUploadFilename(context, name, ext)
+	if err := reserveManagedUpload(session.UserID, filename, session.TotalBytes); err != nil {
+		respondWithUploadLimitError(context, err)
+		return
+	}
+	// The lock only covers this process; claiming the row settles races with
+	// other instances.
+	claimed, err := database.ClaimUploadSession(session.ID)
+	if err != nil || !claimed {
+		cancelManagedUpload(filename)
+		RespondWithError(context, http.StatusNotFound, "Upload session not found")
+		return
+	}
+	if err := moveFile(partialPath, filepath.Join(uploadDir, filename)); err != nil {
+		cancelManagedUpload(filename)
+		discardUploadSession(session.ID)
+		RespondWithError(context, http.StatusInternalServerError, "Failed to store upload")
+		return
+	}
+	discardUploadSession(session.ID)
+
+	context.JSON(http.StatusOK, managedUploadResponse(context, filename, session.ContentType, mediaKind, session.TotalBytes))
+}
+
+// AbortUploadSession handles DELETE /media/uploads/:upload_id.
+func AbortUploadSession(context *gin.Context) {
+	session, ok := loadOwnedUploadSession(context)
+	if !ok {
+		return
+	}
+
+	unlock := lockUploadSession(session.ID)
+	defer unlock()
+
+	discardUploadSession(session.ID)
+	context.JSON(http.StatusOK, gin.H{"message": "Upload session aborted"})
+}
+
+func readUploadProbe(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	probe := make([]byte, 512)
+	readCount, err := file.Read(probe)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return probe[:readCount], nil
+}
+
+// moveFile renames src to dst, falling back to a copy when the two paths are
+// on different filesystems (e.g. a mounted uploads volume).
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// StartUploadSessionJanitor periodically deletes expired upload sessions and
+// their partial files.
+func StartUploadSessionJanitor(interval time.Duration) {
+	runEvery(interval, pruneExpiredUploadSessions)
+}
+
+func pruneExpiredUploadSessions() {
+	ids, err := database.DeleteExpiredUploadSessions(time.Now().UTC())
+	if err != nil {
+		logger.Log.Warnf("failed to prune expired upload sessions: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if err := os.Remove(uploadSessionPath(id)); err != nil && !os.IsNotExist(err) {
+			logger.Log.Warnf("failed to remove expired partial upload %s: %v", id, err)
+		}
+		uploadSessionLocks.Delete(id)
+	}
+	if len(ids) > 0 {
+		logger.Log.Infof("pruned %d expired upload sessions", len(ids))
+	}
+}
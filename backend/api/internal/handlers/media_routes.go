@@ -67,25 +67,35 @@ func validateUploadAndResolveExtension(file *multipart.FileHeader, allowVideos b
 		return "", "", fmt.Errorf("file too large")
 	}
 
-	headerContentType := strings.ToLower(strings.TrimSpace(file.Header.Get("Content-Type")))
-	if idx := strings.Index(headerContentType, ";"); idx >= 0 {
-		headerContentType = strings.TrimSpace(headerContentType[:idx])
-	}
-
-	detectedContentType := ""
+	var probe []byte
 	opened, err := file.Open()
 	if err == nil {
 		defer opened.Close()
-		probe := make([]byte, 512)
-		readCount, readErr := opened.Read(probe)
+		buffer := make([]byte, 512)
+		readCount, readErr := opened.Read(buffer)
 		if readErr != nil && readErr != io.EOF {
 			return "", "", fmt.Errorf("failed to read upload")
 		}
-		if readCount > 0 {
-			detectedContentType = strings.ToLower(http.DetectContentType(probe[:readCount]))
-			if idx := strings.Index(detectedContentType, ";"); idx >= 0 {
-				detectedContentType = strings.TrimSpace(detectedContentType[:idx])
-			}
+		probe = buffer[:readCount]
+	}
+
+	return resolveUploadExtension(file.Filename, file.Header.Get("Content-Type"), probe, allowVideos, allowSVG)
+}
+
+// resolveUploadExtension checks the declared and sniffed content type of an
+// upload against the allowed media formats and returns the extension to store
+// it under along with its media kind ("image" or "video").
+func resolveUploadExtension(filename string, declaredContentType string, probe []byte, allowVideos bool, allowSVG bool) (string, string, error) {
+	headerContentType := strings.ToLower(strings.TrimSpace(declaredContentType))
+	if idx := strings.Index(headerContentType, ";"); idx >= 0 {
+		headerContentType = strings.TrimSpace(headerContentType[:idx])
+	}
+
+	detectedContentType := ""
+	if len(probe) > 0 {
+		detectedContentType = strings.ToLower(http.DetectContentType(probe))
+		if idx := strings.Index(detectedContentType, ";"); idx >= 0 {
+			detectedContentType = strings.TrimSpace(detectedContentType[:idx])
 		}
 	}
 
@@ -94,7 +104,7 @@ func validateUploadAndResolveExtension(file *multipart.FileHeader, allowVideos b
 		return "", "", fmt.Errorf("unsupported file type")
 	}
 
-	ext := strings.ToLower(filepath.Ext(file.Filename))
+	ext := strings.ToLower(filepath.Ext(filename))
 	if ext == "" {
 		if headerContentType != "" {
 			if guessed, guessErr := mime.ExtensionsByType(headerContentType); guessErr == nil && len(guessed) > 0 {
@@ -206,11 +216,70 @@ func UploadMedia(context *gin.Context) {
 
 	filename := buildManagedUploadFilename(context, name, ext)
 	path := filepath.Join(uploadDir, filename)
-	if err := context.SaveUploadedFile(file, path); err != nil {
+	size := file.Size
+	var sanitized []byte
+	if ext == ".svg" {
+		sanitized, err = readSanitizedSVGUpload(file)
+		if err != nil {
+			RespondWithError(context, http.StatusBadRequest, err.Error())
+			return
+		}
+		size = int64(len(sanitized))
+	}
+
+	ownerID, hasOwner := getAuthUserIDFromContext(context)
+	if hasOwner {
+		if err := reserveManagedUpload(int64(ownerID), filename, size); err != nil {
+			respondWithUploadLimitError(context, err)
+			return
+		}
+	}
+	if sanitized != nil {
+		err = os.WriteFile(path, sanitized, 0o644)
+	} else {
+		err = context.SaveUploadedFile(file, path)
+	}
+	if err != nil {
+		if hasOwner {
+			cancelManagedUpload(filename)
+		}
 		RespondWithError(context, http.StatusInternalServerError, "Failed to save file")
 		return
 	}
 
+	context.JSON(http.StatusOK, managedUploadResponse(context, filename, file.Header.Get("Content-Type"), mediaKind, size))
+}
+
+// readSanitizedSVGUpload returns a sanitized copy of an uploaded SVG.
+func readSanitizedSVGUpload(file *multipart.FileHeader) ([]byte, error) {
+	opened, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload")
+	}
+	defer opened.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(opened, maxUploadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload")
+	}
+	return sanitizeSVG(raw)
+}
+
+func managedUploadResponse(context *gin.Context, filename string, contentType string, mediaKind string, size int64) gin.H {
+	relativeURL := fmt.Sprintf("/%s/%s", uploadDir, filename)
+
+	return gin.H{
+		"url":          relativeURL,
+		"absolute_url": requestOrigin(context) + relativeURL,
+		"filename":     filename,
+		"contentType":  contentType,
+		"mediaType":    mediaKind,
+		"size":         size,
+	}
+}
+
+// requestOrigin returns the scheme and host the client used to reach the API.
+func requestOrigin(context *gin.Context) string {
 	scheme := "http"
 	if context.Request.TLS != nil {
 		scheme = "https"
@@ -222,17 +291,7 @@ func UploadMedia(context *gin.Context) {
 			}
 		}
 	}
-	relativeURL := fmt.Sprintf("/%s/%s", uploadDir, filename)
-	absoluteURL := fmt.Sprintf("%s://%s%s", scheme, context.Request.Host, relativeURL)
-
-	context.JSON(http.StatusOK, gin.H{
-		"url":          relativeURL,
-		"absolute_url": absoluteURL,
-		"filename":     filename,
-		"contentType":  file.Header.Get("Content-Type"),
-		"mediaType":    mediaKind,
-		"size":         file.Size,
-	})
+	return fmt.Sprintf("%s://%s", scheme, context.Request.Host)
 }
 
 func logMissingUpload(context *gin.Context, err error) {
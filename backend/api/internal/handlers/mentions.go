@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+)
+
+// syncMentions stores the mentions in text, the current content of a post,
+// project description or comment, and notifies the users it mentions for the
+// first time.
+func syncMentions(hub *RealtimeHub, source database.MentionSource, sourceID int64, authorID int64, text string) {
+	mentions, err := database.ResolveMentions(text, authorID)
+	if err != nil {
+		logMentionError(source, sourceID, err)
+		return
+	}
+	added, err := database.ReplaceMentions(source, sourceID, mentions)
+	if err != nil {
+		logMentionError(source, sourceID, err)
+		return
+	}
+	notifyMentioned(hub, source, sourceID, authorID, added)
+}
+
+func logMentionError(source database.MentionSource, sourceID int64, err error) {
+	logger.Log.WithFields(map[string]interface{}{
+		"source":    string(source),
+		"source_id": sourceID,
+		"err":       err.Error(),
+	}).Warn("Failed to store mentions")
+}
+
+func notifyMentioned(hub *RealtimeHub, source database.MentionSource, sourceID int64, authorID int64, userIDs []int64) {
+	var postID, projectID, commentID *int64
+	var text string
+	switch source {
+	case database.MentionInPost:
+		postID, text = &sourceID, "mentioned you in a byte"
+	case database.MentionInProject:
+		projectID, text = &sourceID, "mentioned you in a stream"
+	case database.MentionInComment:
+		commentID, text = &sourceID, "mentioned you in a comment"
+	}
+	for _, userID := range userIDs {
+		createAndPushNotification(hub, userID, authorID, "mention", postID, projectID, commentID, text)
+	}
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+	// Quiet hours use IANA zones; embed them so hosts without zoneinfo work.
+	_ "time/tzdata"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notificationTypes lists every type createAndPushNotification emits, and so
+// every type a user can set preferences for. Keep it sorted.
+var notificationTypes = []string{
+	"builder_added",
+	"comment_post",
+	"comment_project",
+	"comment_reply",
+	"conversation_message",
+	"direct_message",
+	"follow_user",
+	"like_comment",
+	"like_post",
+	"like_project",
+	"mention",
+	"project_post",
+	"save_post",
+	"save_project",
+}
+
+// NotificationChannelsRequest changes some channels of one type; omitted
+// channels keep their current setting.
+type NotificationChannelsRequest struct {
+	InApp *bool `json:"in_app"`
+	Push  *bool `json:"push"`
+	Email *bool `json:"email"`
+}
+
+// DigestSettingsRequest changes the email digest; omitted fields keep their
+// current setting, and an empty email clears the address. A new address only
+// gets digests once it is confirmed.
+type DigestSettingsRequest struct {
+	Frequency *string `json:"frequency"`
+	Email     *string `json:"email"`
+}
+
+// NotificationPreferencesRequest is the body of PUT /notifications/preferences.
+// quiet_hours may be omitted to keep it, or null to clear it.
+type NotificationPreferencesRequest struct {
+	Types      map[string]NotificationChannelsRequest `json:"types"`
+	QuietHours json.RawMessage                        `json:"quiet_hours"`
+	Digest     *DigestSettingsRequest                 `json:"digest"`
+}
+
+type notificationPreferencesView struct {
+	Types      map[string]database.NotificationChannels `json:"types"`
+	QuietHours *database.QuietHours                     `json:"quiet_hours"`
+	Digest     database.DigestSettings                  `json:"digest"`
+}
+
+func isNotificationType(nType string) bool {
+	index := sort.SearchStrings(notificationTypes, nType)
+	return index < len(notificationTypes) && notificationTypes[index] == nType
+}
+
+func loadNotificationPreferences(userID int64) (*notificationPreferencesView, error) {
+	stored, err := database.QueryNotificationPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	quiet, err := database.GetQuietHours(userID)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := database.GetDigestSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &notificationPreferencesView{
+		Types:      make(map[string]database.NotificationChannels, len(notificationTypes)),
+		QuietHours: quiet,
+		Digest:     digest,
+	}
+	for _, nType := range notificationTypes {
+		channels, ok := stored[nType]
+		if !ok {
+			channels = database.DefaultNotificationChannels
+		}
+		view.Types[nType] = channels
+	}
+	return view, nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(value string) (int, bool) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+// validateQuietHours normalizes quiet and returns a message describing what
+// is wrong with it, or "" when it is valid.
+func validateQuietHours(quiet *database.QuietHours) string {
+	start, ok := parseClock(quiet.Start)
+	if !ok {
+		return "Quiet hours start must be HH:MM"
+	}
+	end, ok := parseClock(quiet.End)
+	if !ok {
+		return "Quiet hours end must be HH:MM"
+	}
+	if start == end {
+		return "Quiet hours start and end must differ"
+	}
+	quiet.TimeZone = strings.TrimSpace(quiet.TimeZone)
+	if quiet.TimeZone == "" {
+		quiet.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(quiet.TimeZone); err != nil {
+		return fmt.Sprintf("Unknown time zone '%s'", quiet.TimeZone)
+	}
+	quiet.Start = fmt.Sprintf("%02d:%02d", start/60, start%60)
+	quiet.End = fmt.Sprintf("%02d:%02d", end/60, end%60)
+	return ""
+}
+
+// applyDigestSettings merges update into digest and returns a message
+// describing what is wrong with the result, or "" when it is valid.
+func applyDigestSettings(digest *database.DigestSettings, update *DigestSettingsRequest) string {
+	if update.Frequency != nil {
+		frequency := strings.ToLower(strings.TrimSpace(*update.Frequency))
+		switch frequency {
+		case database.DigestOff, database.DigestDaily, database.DigestWeekly:
+		default:
+			return "Digest frequency must be off, daily or weekly"
+		}
+		digest.Frequency = frequency
+	}
+	if update.Email != nil {
+		email := strings.TrimSpace(*update.Email)
+		if email == "" {
+			digest.Email = nil
+			digest.PendingEmail = nil
+		} else {
+			address, err := mail.ParseAddress(email)
+			if err != nil || address.Name != "" {
+				return "Invalid digest email address"
+			}
+			if digest.Email != nil && *digest.Email == address.Address {
+				digest.PendingEmail = nil
+			} else {
+				digest.PendingEmail = &address.Address
+			}
+		}
+	}
+	if digest.Frequency != database.DigestOff && digest.Email == nil && digest.PendingEmail == nil {
+		return "An email address is required for digests"
+	}
+	return ""
+}
+
+// quietHoursEnd reports whether now falls inside quiet, and if so when the
+// window closes.
+func quietHoursEnd(quiet *database.QuietHours, now time.Time) (time.Time, bool) {
+	location, err := time.LoadLocation(quiet.TimeZone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, okStart := parseClock(quiet.Start)
+	end, okEnd := parseClock(quiet.End)
+	if !okStart || !okEnd || start == end {
+		return time.Time{}, false
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	inside := minute >= start && minute < end
+	if start > end {
+		inside = minute >= start || minute < end
+	}
+	if !inside {
+		return time.Time{}, false
+	}
+
+	closes := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, location)
+	if !closes.After(local) {
+		closes = time.Date(local.Year(), local.Month(), local.Day()+1, end/60, end%60, 0, 0, location)
+	}
+	return closes.UTC(), true
+}
+
+// deliverPush sends a group's push now, or holds it until the recipient's
+// quiet hours end or the group's push throttle lapses.
+func deliverPush(group *database.Notification, text string) {
+	now := time.Now()
+
+	quiet, err := database.GetQuietHours(group.UserID)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": group.UserID,
+			"err":     err.Error(),
+		}).Warn("Failed to load quiet hours")
+	}
+	if quiet != nil {
+		if closes, inside := quietHoursEnd(quiet, now); inside {
+			holdPush(group, text, closes)
+			return
+		}
+	}
+
+	claimed, err := database.ClaimNotificationGroupPush(group.GroupID, now, pushGroupThrottle)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"group_id": group.GroupID,
+			"err":      err.Error(),
+		}).Warn("Failed to throttle group push")
+		claimed = true
+	}
+	if !claimed {
+		holdPush(group, text, now.Add(pushGroupThrottle))
+		return
+	}
+
+	SendNotificationPush(group.UserID, group, groupedNotificationBody(group, text))
+}
+
+func holdPush(group *database.Notification, text string, until time.Time) {
+	if err := database.SchedulePush(group.ID, text, until); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"notification_id": group.ID,
+			"err":             err.Error(),
+		}).Warn("Failed to hold push")
+	}
+}
+
+// StartScheduledPushDispatcher sends held pushes once they are due. Each
+// sends the group as it is by then, so several held pushes for one group
+// collapse into one; pushes for groups read in the meantime are dropped.
+func StartScheduledPushDispatcher(interval time.Duration) {
+	runEvery(interval, dispatchScheduledPushes)
+}
+
+func dispatchScheduledPushes() {
+	now := time.Now()
+	pushes, err := database.ClaimDuePushes(now)
+	if err != nil {
+		logger.Log.Warnf("failed to claim scheduled pushes: %v", err)
+		return
+	}
+	for _, push := range pushes {
+		notification, err := database.GetNotification(push.NotificationID)
+		if err != nil || notification == nil {
+			continue
+		}
+		group, err := database.GetNotificationGroup(notification.UserID, notification.GroupID)
+		if err != nil || group == nil || group.ReadAt != nil {
+			continue
+		}
+		claimed, err := database.ClaimNotificationGroupPush(group.GroupID, now, pushGroupThrottle)
+		if err != nil || !claimed {
+			continue
+		}
+		SendNotificationPush(group.UserID, group, groupedNotificationBody(group, push.Text))
+	}
+
+	if err := database.PruneNotificationGroupPushes(now.Add(-pushGroupThrottle)); err != nil {
+		logger.Log.Warnf("failed to prune group push claims: %v", err)
+	}
+}
+
+// GetNotificationPreferences handles GET /notifications/preferences.
+func GetNotificationPreferences(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	preferences, err := loadNotificationPreferences(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch preferences: %v", err))
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"preferences": preferences})
+}
+
+// UpdateNotificationPreferences handles PUT /notifications/preferences.
+func UpdateNotificationPreferences(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request NotificationPreferencesRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	current, err := loadNotificationPreferences(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch preferences: %v", err))
+		return
+	}
+
+	changed := make(map[string]database.NotificationChannels, len(request.Types))
+	for nType, update := range request.Types {
+		if !isNotificationType(nType) {
+			RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Unknown notification type '%s'", nType))
+			return
+		}
+		channels := current.Types[nType]
+		if update.InApp != nil {
+			channels.InApp = *update.InApp
+		}
+		if update.Push != nil {
+			channels.Push = *update.Push
+		}
+		if update.Email != nil {
+			channels.Email = *update.Email
+		}
+		changed[nType] = channels
+	}
+
+	var quiet *database.QuietHours
+	quietChanged := len(request.QuietHours) > 0
+	if quietChanged && string(request.QuietHours) != "null" {
+		quiet = &database.QuietHours{}
+		if err := json.Unmarshal(request.QuietHours, quiet); err != nil {
+			RespondWithError(context, http.StatusBadRequest, "Invalid quiet hours")
+			return
+		}
+		if message := validateQuietHours(quiet); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	}
+
+	digest := current.Digest
+	if request.Digest != nil {
+		if message := applyDigestSettings(&digest, request.Digest); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	}
+
+	if err := database.UpsertNotificationPreferences(userID, changed); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update preferences: %v", err))
+		return
+	}
+	if quietChanged {
+		if quiet == nil {
+			err = database.DeleteQuietHours(userID)
+		} else {
+			err = database.SetQuietHours(userID, *quiet)
+		}
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update preferences: %v", err))
+			return
+		}
+	}
+
+	if request.Digest != nil {
+		if err := database.SetDigestSettings(userID, digest); err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update preferences: %v", err))
+			return
+		}
+		if pending := digest.PendingEmail; pending != nil &&
+			(current.Digest.PendingEmail == nil || *current.Digest.PendingEmail != *pending) {
+			sendDigestEmailConfirmation(userID, *pending)
+		}
+	}
+
+	preferences, err := loadNotificationPreferences(userID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch preferences: %v", err))
+		return
+	}
+	hubFor(context).publishNotificationCount(userID)
+
+	context.JSON(http.StatusOK, gin.H{"message": "Notification preferences updated", "preferences": preferences})
+}
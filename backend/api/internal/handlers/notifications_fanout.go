@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+)
+
+// notificationFanOutBatchSize is how many recipients a fan-out loads and
+// notifies at a time.
+var notificationFanOutBatchSize = int(readPositiveIntEnv("DEVBITS_NOTIFICATION_FANOUT_BATCH_SIZE", 200))
+
+// recipientPage returns up to limit recipient ids greater than afterID, in
+// ascending order.
+type recipientPage func(afterID int64, limit int) ([]int64, error)
+
+// fanOutNotification notifies a possibly large audience in the background,
+// one batch of recipients at a time, so the request that caused it returns
+// without waiting. A fan-out under way finishes even during shutdown.
+func fanOutNotification(hub *RealtimeHub, page recipientPage, actorID int64, nType string, postID *int64, projectID *int64, commentID *int64, text string) {
+	goBackground(func(context.Context) {
+		var afterID int64
+		for {
+			recipients, err := page(afterID, notificationFanOutBatchSize)
+			if err != nil {
+				logger.Log.WithFields(map[string]interface{}{
+					"type": nType,
+					"err":  err.Error(),
+				}).Warn("Failed to load notification recipients")
+				return
+			}
+			for _, recipientID := range recipients {
+				createAndPushNotification(hub, recipientID, actorID, nType, postID, projectID, commentID, text)
+			}
+			if len(recipients) < notificationFanOutBatchSize {
+				return
+			}
+			afterID = recipients[len(recipients)-1]
+		}
+	})
+}
+
+// notifyProjectTeam notifies a project's owner and builders.
+func notifyProjectTeam(hub *RealtimeHub, project *database.Project, actorID int64, nType string, postID *int64, commentID *int64, text string) {
+	projectID := project.ID
+	createAndPushNotification(hub, project.Owner, actorID, nType, postID, &projectID, commentID, text)
+
+	builders, err := database.QueryProjectBuilderIDs(int(projectID))
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"project_id": project.ID,
+			"err":        err.Error(),
+		}).Warn("Failed to load project builders for notification")
+		return
+	}
+	for _, builderID := range builders {
+		if builderID != project.Owner {
+			createAndPushNotification(hub, builderID, actorID, nType, postID, &projectID, commentID, text)
+		}
+	}
+}
@@ -1,10 +1,8 @@
 package handlers
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +10,7 @@ import (
 
 	"backend/api/internal/database"
 	"backend/api/internal/logger"
+	"backend/api/internal/push"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,27 +20,6 @@ type RegisterPushTokenRequest struct {
 	Platform string `json:"platform"`
 }
 
-type ExpoPushMessage struct {
-	To    string                 `json:"to"`
-	Title string                 `json:"title"`
-	Body  string                 `json:"body"`
-	Data  map[string]interface{} `json:"data,omitempty"`
-}
-
-type ExpoPushTicketResponse struct {
-	Data struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-		Details struct {
-			Error string `json:"error"`
-		} `json:"details"`
-	} `json:"data"`
-}
-
-const expoPushURL = "https://exp.host/--/api/v2/push/send"
-
-var expoPushHTTPClient = &http.Client{Timeout: 4 * time.Second}
-
 func RegisterPushToken(context *gin.Context) {
 	userID, ok := GetAuthUserID(context)
 	if !ok {
@@ -61,12 +39,18 @@ func RegisterPushToken(context *gin.Context) {
 		RespondWithError(context, http.StatusBadRequest, "Missing token or platform")
 		return
 	}
-	if !isValidExpoPushToken(request.Token) {
-		RespondWithError(context, http.StatusBadRequest, "Invalid Expo push token")
+	provider := pushProviderFor(request.Platform)
+	if provider == nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Push is not available for platform '%s'", request.Platform))
+		return
+	}
+	token, err := provider.Normalize(request.Token)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Invalid push token: %v", err))
 		return
 	}
 
-	status, err := database.UpsertPushToken(userID, request.Token, request.Platform)
+	status, err := database.UpsertPushToken(userID, token, request.Platform)
 	if err != nil {
 		RespondWithError(context, status, fmt.Sprintf("Failed to store token: %v", err))
 		return
@@ -75,6 +59,16 @@ func RegisterPushToken(context *gin.Context) {
 	context.JSON(http.StatusOK, gin.H{"message": "Token registered"})
 }
 
+// GetWebPushKey returns the VAPID public key browsers subscribe with.
+func GetWebPushKey(context *gin.Context) {
+	provider, ok := pushProviderFor(webPushPlatform).(interface{ PublicKey() string })
+	if !ok {
+		RespondWithError(context, http.StatusNotFound, "Web push is not configured")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"public_key": provider.PublicKey()})
+}
+
 func GetNotifications(context *gin.Context) {
 	userID, ok := GetAuthUserID(context)
 	if !ok {
@@ -94,7 +88,13 @@ func GetNotifications(context *gin.Context) {
 		}
 	}
 
-	items, status, err := database.QueryNotificationsByUser(userID, start, count)
+	filter, message := parseNotificationFilter(context)
+	if message != "" {
+		RespondWithError(context, http.StatusBadRequest, message)
+		return
+	}
+
+	items, status, err := database.QueryNotificationsByUser(userID, filter, start, count)
 	if err != nil {
 		RespondWithError(context, status, fmt.Sprintf("Failed to fetch notifications: %v", err))
 		return
@@ -103,6 +103,54 @@ func GetNotifications(context *gin.Context) {
 	context.JSON(http.StatusOK, items)
 }
 
+// parseNotificationFilter reads the listing filters: unread=true, type (a
+// comma-separated list, or repeated) and project_id. It returns a message
+// describing the first invalid one.
+func parseNotificationFilter(context *gin.Context) (database.NotificationFilter, string) {
+	var filter database.NotificationFilter
+	if raw := context.Query("unread"); raw != "" {
+		unread, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filter, "unread must be true or false"
+		}
+		filter.UnreadOnly = unread
+	}
+
+	types, message := parseNotificationTypes(context.QueryArray("type"))
+	if message != "" {
+		return filter, message
+	}
+	filter.Types = types
+
+	if raw := context.Query("project_id"); raw != "" {
+		projectID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || projectID <= 0 {
+			return filter, "Invalid project id"
+		}
+		filter.ProjectID = &projectID
+	}
+	return filter, ""
+}
+
+// parseNotificationTypes flattens comma-separated lists of types and checks
+// each is known.
+func parseNotificationTypes(values []string) ([]string, string) {
+	types := make([]string, 0)
+	for _, value := range values {
+		for _, nType := range strings.Split(value, ",") {
+			nType = strings.TrimSpace(nType)
+			if nType == "" {
+				continue
+			}
+			if !isNotificationType(nType) {
+				return nil, fmt.Sprintf("Unknown notification type '%s'", nType)
+			}
+			types = append(types, nType)
+		}
+	}
+	return types, ""
+}
+
 func GetNotificationCount(context *gin.Context) {
 	userID, ok := GetAuthUserID(context)
 	if !ok {
@@ -138,6 +186,7 @@ func MarkNotificationRead(context *gin.Context) {
 		return
 	}
 
+	hubFor(context).publishNotificationCount(userID)
 	context.JSON(http.StatusOK, gin.H{"message": "Notification marked read"})
 }
 
@@ -160,6 +209,7 @@ func DeleteNotification(context *gin.Context) {
 		return
 	}
 
+	hubFor(context).publishNotificationCount(userID)
 	context.JSON(http.StatusOK, gin.H{"message": "Notification deleted"})
 }
 
@@ -176,116 +226,154 @@ func ClearNotifications(context *gin.Context) {
 		return
 	}
 
+	hubFor(context).publishNotificationCount(userID)
 	context.JSON(http.StatusOK, gin.H{"message": "Notifications cleared"})
 }
 
+// SendNotificationPush queues a push to every device the target registered.
 func SendNotificationPush(targetID int64, notification *database.Notification, body string) {
 	if notification == nil {
 		return
 	}
 
-	tokens, status, err := database.QueryPushTokens(targetID)
-	if err != nil || status != http.StatusOK {
-		return
-	}
-
-	payload := ExpoPushMessage{
+	message, err := json.Marshal(push.Message{
 		Title: "DevBits",
 		Body:  body,
 		Data: map[string]interface{}{
-			"actor_id":   notification.ActorID,
-			"actor_name": notification.ActorName,
-			"type":       notification.Type,
-			"post_id":    notification.PostID,
-			"project_id": notification.ProjectID,
-			"comment_id": notification.CommentID,
+			"actor_id":    notification.ActorID,
+			"actor_name":  notification.ActorName,
+			"type":        notification.Type,
+			"post_id":     notification.PostID,
+			"project_id":  notification.ProjectID,
+			"comment_id":  notification.CommentID,
+			"group_id":    notification.GroupID,
+			"actor_count": notification.ActorCount,
 		},
+	})
+	if err != nil {
+		return
 	}
 
-	const maxWorkers = 6
-	workerCount := len(tokens)
-	if workerCount > maxWorkers {
-		workerCount = maxWorkers
-	}
-	if workerCount < 1 {
+	queued, err := database.EnqueuePushes(targetID, string(message), time.Now())
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": targetID,
+			"err":     err.Error(),
+		}).Warn("Failed to queue push")
 		return
 	}
-
-	tokensCh := make(chan database.PushToken)
-	for i := 0; i < workerCount; i++ {
-		go func() {
-			for token := range tokensCh {
-				sendPushToToken(token.Token, payload)
-			}
-		}()
+	if queued > 0 {
+		kickPushQueue()
 	}
+}
 
-	for _, token := range tokens {
-		tokensCh <- token
-	}
-	close(tokensCh)
+// maxBulkNotificationIDs bounds the ids one bulk request may name.
+const maxBulkNotificationIDs = 500
+
+// MarkAllNotificationsReadRequest is the optional body of
+// POST /notifications/read-all. Before limits it to notifications created at
+// or before a time; Types limits it to some types.
+type MarkAllNotificationsReadRequest struct {
+	Before *time.Time `json:"before"`
+	Types  []string   `json:"types"`
 }
 
-func isValidExpoPushToken(token string) bool {
-	return strings.HasPrefix(token, "ExponentPushToken[") || strings.HasPrefix(token, "ExpoPushToken[")
+// BulkNotificationsRequest names notifications by id. Each id stands for the
+// whole group it belongs to, as with the single-id routes.
+type BulkNotificationsRequest struct {
+	IDs []int64 `json:"ids"`
 }
 
-func sendPushToToken(token string, basePayload ExpoPushMessage) {
-	if token == "" {
+// MarkAllNotificationsRead handles POST /notifications/read-all.
+func MarkAllNotificationsRead(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	payload := basePayload
-	payload.To = token
-
-	bytesBody, err := json.Marshal(payload)
-	if err != nil {
+	var request MarkAllNotificationsReadRequest
+	if context.Request.ContentLength != 0 {
+		if err := context.BindJSON(&request); err != nil {
+			RespondWithError(context, http.StatusBadRequest, "Invalid request")
+			return
+		}
+	}
+	types, message := parseNotificationTypes(request.Types)
+	if message != "" {
+		RespondWithError(context, http.StatusBadRequest, message)
 		return
 	}
 
-	request, err := http.NewRequest("POST", expoPushURL, bytes.NewBuffer(bytesBody))
+	marked, err := database.MarkAllNotificationsRead(userID, request.Before, types)
 	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to mark read: %v", err))
 		return
 	}
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
 
-	response, err := expoPushHTTPClient.Do(request)
-	if err != nil {
-		logger.Log.Warnf("push delivery failed for token: %v", err)
-		return
+	hubFor(context).publishNotificationCount(userID)
+	context.JSON(http.StatusOK, gin.H{"message": "Notifications marked read", "updated": marked})
+}
+
+func bindBulkNotifications(context *gin.Context) ([]int64, bool) {
+	var request BulkNotificationsRequest
+	if err := context.BindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, "Invalid request")
+		return nil, false
+	}
+	if len(request.IDs) == 0 {
+		RespondWithError(context, http.StatusBadRequest, "ids must list at least one notification")
+		return nil, false
 	}
-	defer response.Body.Close()
+	if len(request.IDs) > maxBulkNotificationIDs {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("ids may list at most %d notifications", maxBulkNotificationIDs))
+		return nil, false
+	}
+	return request.IDs, true
+}
 
-	responseBytes, err := io.ReadAll(response.Body)
-	if err != nil {
+// MarkNotificationsRead handles POST /notifications/read. Ids that are not
+// the caller's are ignored.
+func MarkNotificationsRead(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-
-	if response.StatusCode >= http.StatusBadRequest {
-		logger.Log.Warnf("expo push rejected token with status %d", response.StatusCode)
+	ids, ok := bindBulkNotifications(context)
+	if !ok {
+		return
 	}
 
-	if shouldDeleteToken(responseBytes) {
-		_, _ = database.DeletePushToken(token)
+	marked, err := database.MarkNotificationsRead(userID, ids)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to mark read: %v", err))
+		return
 	}
+
+	hubFor(context).publishNotificationCount(userID)
+	context.JSON(http.StatusOK, gin.H{"message": "Notifications marked read", "updated": marked})
 }
 
-func shouldDeleteToken(responseBytes []byte) bool {
-	if len(responseBytes) == 0 {
-		return false
+// DeleteNotifications handles POST /notifications/delete. Ids that are not
+// the caller's are ignored.
+func DeleteNotifications(context *gin.Context) {
+	userID, ok := GetAuthUserID(context)
+	if !ok {
+		RespondWithError(context, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
-
-	var ticket ExpoPushTicketResponse
-	if err := json.Unmarshal(responseBytes, &ticket); err != nil {
-		return false
+	ids, ok := bindBulkNotifications(context)
+	if !ok {
+		return
 	}
 
-	if ticket.Data.Status != "error" {
-		return false
+	deleted, err := database.DeleteNotifications(userID, ids)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete: %v", err))
+		return
 	}
 
-	errorCode := strings.ToLower(strings.TrimSpace(ticket.Data.Details.Error))
-	message := strings.ToLower(strings.TrimSpace(ticket.Data.Message))
-	return errorCode == "devicenotregistered" || strings.Contains(message, "not a registered push notification recipient")
+	hubFor(context).publishNotificationCount(userID)
+	context.JSON(http.StatusOK, gin.H{"message": "Notifications deleted", "deleted": deleted})
 }
@@ -1,23 +1,83 @@
 package handlers
 
 import (
+	"fmt"
+	"time"
+
 	"backend/api/internal/database"
+	"backend/api/internal/logger"
 )
 
-func createAndPushNotification(userID int64, actorID int64, nType string, postID *int64, projectID *int64, commentID *int64, body string) {
-	notification, _, err := database.CreateNotification(database.NotificationInsert{
+// notificationGroupWindow is how long an unread group keeps absorbing new
+// notifications of the same type about the same target.
+var notificationGroupWindow = time.Duration(readPositiveIntEnv("DEVBITS_NOTIFICATION_GROUP_WINDOW_MINUTES", 1440)) * time.Minute
+
+// pushGroupThrottle is the shortest gap between two pushes for one group.
+// Notifications arriving in between are folded into the next push.
+var pushGroupThrottle = time.Duration(readPositiveIntEnv("DEVBITS_PUSH_GROUP_THROTTLE_SECONDS", 300)) * time.Second
+
+// createAndPushNotification records that actorID did something to userID and
+// delivers it on the channels userID wants. text is the action, such as
+// "saved your byte"; pushes prefix it with the group's actors.
+func createAndPushNotification(hub *RealtimeHub, userID int64, actorID int64, nType string, postID *int64, projectID *int64, commentID *int64, text string) {
+	pushNotification(hub, database.NotificationInsert{
 		UserID:    userID,
 		ActorID:   actorID,
 		Type:      nType,
 		PostID:    postID,
 		ProjectID: projectID,
 		CommentID: commentID,
-	})
+	}, text)
+}
+
+// pushNotification is createAndPushNotification for notifications that need
+// more than a post, project or comment to group by.
+func pushNotification(hub *RealtimeHub, input database.NotificationInsert, text string) {
+	userID := input.UserID
+	actorID := input.ActorID
+	nType := input.Type
+
+	// Nobody is notified about their own activity, whichever path got here.
+	if userID == actorID {
+		return
+	}
+
+	// Nothing is delivered between users when either has blocked the other.
+	if blocked, err := database.IsBlockedBetween(userID, actorID); err != nil || blocked {
+		return
+	}
+
+	channels, err := database.GetNotificationChannels(userID, nType)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": userID,
+			"type":    nType,
+			"err":     err.Error(),
+		}).Warn("Failed to load notification preferences")
+	}
+	if !channels.InApp && !channels.Push && !channels.Email {
+		return
+	}
+
+	// The row is kept even when in-app is off, for the push and email
+	// channels; listings and unread counts leave those types out.
+	input.GroupWindow = notificationGroupWindow
+	notification, _, err := database.CreateNotification(input)
 	if err != nil || notification == nil {
 		return
 	}
 
-	go SendNotificationPush(userID, notification, body)
+	group, err := database.GetNotificationGroup(userID, notification.GroupID)
+	if err != nil || group == nil {
+		group = notification
+	}
+
+	if channels.InApp {
+		hub.publishNotification(group)
+	}
+	if channels.Push {
+		deliverPush(group, text)
+	}
 }
 
 func notificationBody(actorName string, text string) string {
@@ -26,3 +86,15 @@ func notificationBody(actorName string, text string) string {
 	}
 	return actorName + " " + text
 }
+
+// groupedNotificationBody renders text for a notification group, as in
+// "alex and 12 others saved your byte".
+func groupedNotificationBody(group *database.Notification, text string) string {
+	switch others := group.ActorCount - 1; {
+	case others == 1:
+		return notificationBody(group.ActorName+" and 1 other", text)
+	case others > 1:
+		return notificationBody(fmt.Sprintf("%s and %d others", group.ActorName, others), text)
+	}
+	return notificationBody(group.ActorName, text)
+}
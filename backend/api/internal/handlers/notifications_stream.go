@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+)
+
+// notificationCount carries a user's unread notification total on the stream.
+type notificationCount struct {
+	Unread int64 `json:"unread"`
+}
+
+// publishNotification sends a new or grown notification group, then the
+// recipient's updated unread count, over the same stream that carries their
+// direct messages. Clients replace any group they hold with the same
+// group_id.
+func (h *RealtimeHub) publishNotification(notification *database.Notification) {
+	user, err := database.GetUserById(int(notification.UserID))
+	if err != nil || user == nil {
+		return
+	}
+
+	h.publishToUser(user.Username, directMessageStreamEvent{
+		Type:         "notification",
+		Notification: notification,
+	})
+	h.publishNotificationCountTo(notification.UserID, user.Username)
+}
+
+// publishNotificationCount tells userID's clients their unread count changed,
+// after a notification was read, deleted or retracted.
+func (h *RealtimeHub) publishNotificationCount(userID int64) {
+	user, err := database.GetUserById(int(userID))
+	if err != nil || user == nil {
+		return
+	}
+	h.publishNotificationCountTo(userID, user.Username)
+}
+
+func (h *RealtimeHub) publishNotificationCountTo(userID int64, username string) {
+	count, _, err := database.GetUnreadNotificationCount(userID)
+	if err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"username": username,
+			"err":      err.Error(),
+		}).Warn("Failed to count unread notifications")
+		return
+	}
+
+	h.publishToUser(username, directMessageStreamEvent{
+		Type:              "notification_count",
+		NotificationCount: &notificationCount{Unread: count},
+	})
+}
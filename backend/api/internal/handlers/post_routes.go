@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"backend/api/internal/database"
+	"backend/api/internal/webhooks"
 
 	"github.com/gin-gonic/gin"
 )
@@ -30,7 +31,16 @@ func GetPostById(context *gin.Context) {
 		return
 	}
 
-	if post == nil {
+	viewerID, _ := GetAuthUserID(context)
+	allowed := post != nil
+	if allowed {
+		allowed, err = blockAllowsViewingPost(viewerID, post)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check post access: %v", err))
+			return
+		}
+	}
+	if !allowed {
 		RespondWithError(context, http.StatusNotFound, fmt.Sprintf("Post with id '%v' not found", strId))
 		return
 	}
@@ -38,6 +48,18 @@ func GetPostById(context *gin.Context) {
 	context.JSON(http.StatusOK, post)
 }
 
+// blockAllowsViewingPost reports whether a block keeps viewerID from seeing
+// post. There is no post visibility setting: every post is public, so this
+// only hides posts between users where either blocked the other. A viewerID
+// of 0 is anonymous and never blocked.
+func blockAllowsViewingPost(viewerID int64, post *database.Post) (bool, error) {
+	if viewerID <= 0 || viewerID == post.User {
+		return true, nil
+	}
+	blocked, err := database.IsBlockedBetween(viewerID, post.User)
+	return !blocked, err
+}
+
 // GetPostByUserId handles GET requests to retrieve project information by its owning user.
 // It expects the `user_id` parameter in the URL and does not require a request body.
 // Returns:
@@ -98,21 +120,21 @@ func CreatePost(context *gin.Context) {
 		return
 	}
 
+	authUserID, ok := GetAuthUserID(context)
+	if ok && authUserID != newPost.User {
+		RespondWithError(context, http.StatusForbidden, "Post user does not match auth user")
+		return
+	}
+
 	if len(newPost.Media) > 0 {
-		normalizedMedia, mediaErr := materializeMediaList(newPost.Media)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, newPost.Media)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		newPost.Media = normalizedMedia
 	}
 
-	authUserID, ok := GetAuthUserID(context)
-	if ok && authUserID != newPost.User {
-		RespondWithError(context, http.StatusForbidden, "Post user does not match auth user")
-		return
-	}
-
 	// verify the owner
 	user, err := database.GetUserById(int(newPost.User))
 	if err != nil {
@@ -137,7 +159,12 @@ func CreatePost(context *gin.Context) {
 		return
 	}
 
-	if ok && project.Owner != authUserID {
+	if isBotRequest(context) {
+		// Bots post where they were granted access, never as builders.
+		if !checkBotProjectAccess(context, project.ID) {
+			return
+		}
+	} else if ok && project.Owner != authUserID {
 		isBuilder, err := database.QueryIsProjectBuilder(int(project.ID), authUserID)
 		if err != nil {
 			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check builder access: %v", err))
@@ -154,9 +181,37 @@ func CreatePost(context *gin.Context) {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create project: %v", err))
 		return
 	}
+
+	publishPost(hubFor(context), project, id, newPost.User, newPost.Content)
 	context.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Post created successfully with id '%v'", id)})
 }
 
+// publishPost announces a new post in project: mentions, followers and
+// webhooks all hear about it.
+func publishPost(hub *RealtimeHub, project *database.Project, id int64, authorID int64, content string) {
+	syncMentions(hub, database.MentionInPost, id, authorID, content)
+
+	// Followers of busy projects can number in the thousands, so they are
+	// notified in the background.
+	postID64 := id
+	projectID64 := project.ID
+	fanOutNotification(
+		hub,
+		func(afterID int64, limit int) ([]int64, error) {
+			return database.QueryProjectFollowerIDsAfter(int(projectID64), afterID, limit)
+		},
+		authorID,
+		"project_post",
+		&postID64,
+		&projectID64,
+		nil,
+		fmt.Sprintf("posted in %s", project.Name),
+	)
+	if created, err := database.QueryPost(int(id)); err == nil && created != nil {
+		emitProjectEvent(project, webhooks.EventPostCreated, authorID, gin.H{"post": created})
+	}
+}
+
 // DeletePost handles DELETE requests to delete a post.
 // It expects the `post_id` parameter in the URL.
 // Returns:
@@ -283,9 +338,9 @@ func UpdatePostInfo(context *gin.Context) {
 			RespondWithError(context, http.StatusBadRequest, "Invalid media format")
 			return
 		}
-		normalizedMedia, mediaErr := materializeMediaList(mediaList)
+		normalizedMedia, mediaErr := materializeMediaList(authUserID, mediaList)
 		if mediaErr != nil {
-			RespondWithError(context, http.StatusBadRequest, "Invalid media reference")
+			respondWithMediaIngestError(context, mediaErr, "Invalid media reference")
 			return
 		}
 		updatedData["media"] = normalizedMedia
@@ -297,6 +352,10 @@ func UpdatePostInfo(context *gin.Context) {
 		return
 	}
 
+	if content, ok := updatedData["content"].(string); ok {
+		syncMentions(hubFor(context), database.MentionInPost, existingPost.ID, existingPost.User, content)
+	}
+
 	updatedPost, err := database.QueryPost(id)
 
 	if err != nil {
@@ -324,6 +383,25 @@ func LikePost(context *gin.Context) {
 		RespondWithError(context, httpcode, fmt.Sprintf("Failed to like post: %v", err))
 		return
 	}
+
+	if httpcode == http.StatusCreated {
+		postInt, _ := strconv.Atoi(postId)
+		post, _ := database.QueryPost(postInt)
+		actorID, _ := database.GetUserIdByUsername(username)
+		if post != nil {
+			postID64 := int64(post.ID)
+			createAndPushNotification(
+				hubFor(context),
+				int64(post.User),
+				int64(actorID),
+				"like_post",
+				&postID64,
+				nil,
+				nil,
+				"liked your byte",
+			)
+		}
+	}
 	context.JSON(httpcode, gin.H{"message": fmt.Sprintf("%v likes post %v", username, postId)})
 }
 
@@ -341,6 +419,21 @@ func UnlikePost(context *gin.Context) {
 		RespondWithError(context, httpcode, fmt.Sprintf("Failed to unlike post: %v", err))
 		return
 	}
+
+	postInt, _ := strconv.Atoi(postId)
+	post, _ := database.QueryPost(postInt)
+	actorID, _ := database.GetUserIdByUsername(username)
+	if post != nil {
+		postID64 := int64(post.ID)
+		_, _ = database.DeleteNotificationByReference(
+			int64(post.User),
+			int64(actorID),
+			"like_post",
+			&postID64,
+			nil,
+		)
+		hubFor(context).publishNotificationCount(int64(post.User))
+	}
 	context.JSON(httpcode, gin.H{"message": fmt.Sprintf("%v unliked post %v", username, postId)})
 }
 
@@ -378,13 +471,14 @@ func SavePost(context *gin.Context) {
 	if post != nil {
 		postID64 := int64(post.ID)
 		createAndPushNotification(
+			hubFor(context),
 			int64(post.User),
 			int64(actorID),
 			"save_post",
 			&postID64,
 			nil,
 			nil,
-			notificationBody(username, "saved your byte"),
+			"saved your byte",
 		)
 	}
 
@@ -414,6 +508,7 @@ func UnsavePost(context *gin.Context) {
 			&postID64,
 			nil,
 		)
+		hubFor(context).publishNotificationCount(int64(post.User))
 	}
 
 	context.JSON(httpcode, gin.H{"message": fmt.Sprintf("%v unsaved post %v", username, postId)})
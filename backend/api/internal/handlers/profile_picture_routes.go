@@ -90,7 +90,12 @@ func UpdateProfilePicture(context *gin.Context) {
 
 	filename := buildManagedUploadFilename(context, randomName, ext)
 	storedPath := filepath.Join(uploadDir, filename)
+	if err := reserveManagedUpload(int64(existingUser.Id), filename, file.Size); err != nil {
+		respondWithUploadLimitError(context, err)
+		return
+	}
 	if err := context.SaveUploadedFile(file, storedPath); err != nil {
+		cancelManagedUpload(filename)
 		RespondWithError(context, http.StatusInternalServerError, "Failed to store profile picture")
 		return
 	}
@@ -98,6 +103,7 @@ func UpdateProfilePicture(context *gin.Context) {
 	existingUser.Picture = fmt.Sprintf("/%s/%s", uploadDir, filename)
 	if err := database.UpdateUser(existingUser); err != nil {
 		_ = os.Remove(storedPath)
+		releaseManagedUploads([]string{filename})
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Error updating user: %v", err))
 		return
 	}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"backend/api/internal/database"
+	"backend/api/internal/webhooks"
 
 	"github.com/gin-gonic/gin"
 )
@@ -29,7 +30,16 @@ func GetProjectById(context *gin.Context) {
 		return
 	}
 
-	if project == nil {
+	viewerID, _ := GetAuthUserID(context)
+	allowed := project != nil
+	if allowed {
+		allowed, err = blockAllowsViewingProject(viewerID, project)
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to check project access: %v", err))
+			return
+		}
+	}
+	if !allowed {
 		RespondWithError(context, http.StatusNotFound, fmt.Sprintf("Project with id '%v' not found", strId))
 		return
 	}
@@ -37,6 +47,18 @@ func GetProjectById(context *gin.Context) {
 	context.JSON(http.StatusOK, project)
 }
 
+// blockAllowsViewingProject reports whether a block keeps viewerID from
+// seeing project. There is no project visibility setting: every project is
+// public, so this only hides projects between their owner and users either
+// of them blocked. A viewerID of 0 is anonymous and never blocked.
+func blockAllowsViewingProject(viewerID int64, project *database.Project) (bool, error) {
+	if viewerID <= 0 || viewerID == project.Owner {
+		return true, nil
+	}
+	blocked, err := database.IsBlockedBetween(viewerID, project.Owner)
+	return !blocked, err
+}
+
 // GetProjectsByUserId handles GET requests to retrieve projects information by its owning user's id.
 // It expects the `user_id` parameter in the URL and does not require a request body.
 // Returns:
@@ -133,6 +155,10 @@ func AddProjectBuilder(context *gin.Context) {
 		RespondWithError(context, http.StatusBadRequest, "Builder user not found")
 		return
 	}
+	if builder.IsBot {
+		RespondWithError(context, http.StatusBadRequest, "Bots cannot be builders. Grant the bot access to the project instead")
+		return
+	}
 
 	builderID64 := int64(builder.Id)
 	if builderID64 == project.Owner {
@@ -147,16 +173,19 @@ func AddProjectBuilder(context *gin.Context) {
 	}
 
 	projectID64 := int64(projectId)
-	owner, _ := database.GetUserById(int(project.Owner))
 	createAndPushNotification(
+		hubFor(context),
 		builderID64,
 		project.Owner,
 		"builder_added",
 		nil,
 		&projectID64,
 		nil,
-		notificationBody(owner.Username, "added you as a builder"),
+		"added you as a builder",
 	)
+	emitProjectEvent(project, webhooks.EventBuilderAdded, authUserID, gin.H{
+		"builder": webhookUser{ID: builderID64, Username: builder.Username},
+	})
 
 	context.JSON(http.StatusOK, gin.H{"message": "Builder added"})
 }
@@ -203,11 +232,20 @@ func RemoveProjectBuilder(context *gin.Context) {
 		return
 	}
 
+	// Leave the project chat first: should removing the builder then fail,
+	// they can still rejoin it.
+	if err := removeFromProjectConversation(hubFor(context), int64(projectId), builderID64); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to remove builder from the project chat: %v", err))
+		return
+	}
 	status, err := database.QueryRemoveProjectBuilder(projectId, builderID64)
 	if err != nil {
 		RespondWithError(context, status, fmt.Sprintf("Failed to remove builder: %v", err))
 		return
 	}
+	emitProjectEvent(project, webhooks.EventBuilderRemoved, authUserID, gin.H{
+		"builder": webhookUser{ID: builderID64, Username: builder.Username},
+	})
 
 	context.JSON(http.StatusOK, gin.H{"message": "Builder removed"})
 }
@@ -251,6 +289,8 @@ func CreateProject(context *gin.Context) {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create project: %v", err))
 		return
 	}
+	syncMentions(hubFor(context), database.MentionInProject, id, newProj.Owner, newProj.AboutMd)
+
 	context.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Project created successfully with id '%v'", id)})
 }
 
@@ -377,6 +417,15 @@ func UpdateProjectInfo(context *gin.Context) {
 		return
 	}
 
+	// Builders may edit the description too; mentions come from whoever saved it.
+	if aboutMd, ok := updatedData["about_md"].(string); ok {
+		editorID := existingProj.Owner
+		if authUserID, ok := GetAuthUserID(context); ok {
+			editorID = authUserID
+		}
+		syncMentions(hubFor(context), database.MentionInProject, existingProj.ID, editorID, aboutMd)
+	}
+
 	updatedProj, err := database.QueryProject(id)
 
 	if err != nil {
@@ -491,14 +540,18 @@ func FollowProject(context *gin.Context) {
 	if project != nil {
 		projectID64 := int64(project.ID)
 		createAndPushNotification(
+			hubFor(context),
 			project.Owner,
 			int64(actor.Id),
 			"save_project",
 			nil,
 			&projectID64,
 			nil,
-			notificationBody(username, "saved your stream"),
+			"saved your stream",
 		)
+		emitProjectEvent(project, webhooks.EventFollowerAdded, int64(actor.Id), gin.H{
+			"follower": webhookUser{ID: int64(actor.Id), Username: actor.Username},
+		})
 	}
 	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%v now follows project %v", username, projectId)})
 }
@@ -530,6 +583,10 @@ func UnfollowProject(context *gin.Context) {
 			nil,
 			&projectID64,
 		)
+		hubFor(context).publishNotificationCount(project.Owner)
+		emitProjectEvent(project, webhooks.EventFollowerRemoved, int64(actor.Id), gin.H{
+			"follower": webhookUser{ID: int64(actor.Id), Username: actor.Username},
+		})
 	}
 	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%v unfollowed project %v", username, projectId)})
 }
@@ -548,6 +605,25 @@ func LikeProject(context *gin.Context) {
 		RespondWithError(context, httpcode, fmt.Sprintf("Failed to like project: %v", err))
 		return
 	}
+
+	if httpcode == http.StatusCreated {
+		projectInt, _ := strconv.Atoi(projectId)
+		project, _ := database.QueryProject(projectInt)
+		actorID, _ := database.GetUserIdByUsername(username)
+		if project != nil {
+			projectID64 := project.ID
+			createAndPushNotification(
+				hubFor(context),
+				project.Owner,
+				int64(actorID),
+				"like_project",
+				nil,
+				&projectID64,
+				nil,
+				"liked your stream",
+			)
+		}
+	}
 	context.JSON(httpcode, gin.H{"message": fmt.Sprintf("%v likes project %v", username, projectId)})
 }
 
@@ -565,6 +641,21 @@ func UnlikeProject(context *gin.Context) {
 		RespondWithError(context, httpcode, fmt.Sprintf("Failed to unlike project: %v", err))
 		return
 	}
+
+	projectInt, _ := strconv.Atoi(projectId)
+	project, _ := database.QueryProject(projectInt)
+	actorID, _ := database.GetUserIdByUsername(username)
+	if project != nil {
+		projectID64 := project.ID
+		_, _ = database.DeleteNotificationByReference(
+			project.Owner,
+			int64(actorID),
+			"like_project",
+			nil,
+			&projectID64,
+		)
+		hubFor(context).publishNotificationCount(project.Owner)
+	}
 	context.JSON(httpcode, gin.H{"message": fmt.Sprintf("%v unliked project %v", username, projectId)})
 }
 
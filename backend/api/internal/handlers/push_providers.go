@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"backend/api/internal/push"
+)
+
+// pushProviders picks a provider by the platform a token was registered for.
+// Platforms without their own provider use the fallback, Expo, which is what
+// the mobile app registers on both iOS and Android.
+var pushProviders = struct {
+	sync.RWMutex
+	byPlatform map[string]push.Provider
+	fallback   push.Provider
+}{
+	byPlatform: map[string]push.Provider{},
+	fallback:   push.NewExpoProvider(push.DefaultExpoURL),
+}
+
+// webPushPlatform is the platform browsers register subscriptions under.
+const webPushPlatform = "web"
+
+// UsePushProvider sends pushes for platform through provider. An empty
+// platform replaces the fallback; a nil provider removes the platform's own.
+func UsePushProvider(platform string, provider push.Provider) {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+
+	pushProviders.Lock()
+	defer pushProviders.Unlock()
+	switch {
+	case platform == "":
+		pushProviders.fallback = provider
+	case provider == nil:
+		delete(pushProviders.byPlatform, platform)
+	default:
+		pushProviders.byPlatform[platform] = provider
+	}
+}
+
+// pushProviderFor returns the provider for platform, or nil if there is none.
+func pushProviderFor(platform string) push.Provider {
+	pushProviders.RLock()
+	defer pushProviders.RUnlock()
+	if provider, ok := pushProviders.byPlatform[platform]; ok {
+		return provider
+	}
+	if platform == webPushPlatform {
+		// Browsers cannot receive Expo pushes.
+		return nil
+	}
+	return pushProviders.fallback
+}
+
+// ConfigurePushProviders sets up providers from the environment:
+// DEVBITS_PUSH_PROVIDER=recording keeps every push in memory instead of
+// sending it, DEVBITS_EXPO_PUSH_URL points Expo delivery at another server,
+// and DEVBITS_VAPID_PRIVATE_KEY with DEVBITS_VAPID_SUBJECT enable Web Push.
+func ConfigurePushProviders() error {
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("DEVBITS_PUSH_PROVIDER"))); mode {
+	case "", "live":
+	case "recording":
+		recorder := push.NewRecordingProvider()
+		UsePushProvider("", recorder)
+		UsePushProvider(webPushPlatform, recorder)
+		return nil
+	default:
+		return fmt.Errorf("unknown DEVBITS_PUSH_PROVIDER %q", mode)
+	}
+
+	UsePushProvider("", push.NewExpoProvider(strings.TrimSpace(os.Getenv("DEVBITS_EXPO_PUSH_URL"))))
+
+	vapidKey := strings.TrimSpace(os.Getenv("DEVBITS_VAPID_PRIVATE_KEY"))
+	if vapidKey == "" {
+		return nil
+	}
+	webPush, err := push.NewWebPushProvider(vapidKey, os.Getenv("DEVBITS_VAPID_SUBJECT"))
+	if err != nil {
+		return err
+	}
+	UsePushProvider(webPushPlatform, webPush)
+	return nil
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+	"backend/api/internal/push"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pushClaimBatch is how many queued pushes a worker takes at a time.
+	pushClaimBatch = 500
+	// pushClaimLease is how long a claimed push may stay unanswered before
+	// another worker sends it again.
+	pushClaimLease = 2 * time.Minute
+	pushRetryBase  = 30 * time.Second
+	pushRetryMax   = time.Hour
+	// pushReceiptBatch matches the most ids Expo accepts per receipt request.
+	pushReceiptBatch = 1000
+	// pushReceiptExpiry is how long providers keep receipts.
+	pushReceiptExpiry = 24 * time.Hour
+	pushSendWorkers   = 6
+)
+
+var pushQueue = &queueRunner{run: func() { ProcessPushQueue(time.Now()) }}
+
+// kickPushQueue asks the queue worker to run soon. Kicks that arrive while
+// it is busy collapse into one more run.
+func kickPushQueue() {
+	pushQueue.kick()
+}
+
+// StartPushQueueWorker drains the push queue every interval, which picks up
+// retries and receipts that nothing else would wake the worker for.
+func StartPushQueueWorker(interval time.Duration) {
+	runEvery(interval, kickPushQueue)
+}
+
+// ProcessPushQueue sends every push due at now, checks the receipts of pushes
+// sent earlier, and prunes finished pushes. A provider rate limiting ends the
+// sending for this run; the rest waits for the next one. It is safe to run
+// from several processes at once.
+func ProcessPushQueue(now time.Time) {
+	maxAttempts := int(readPositiveIntEnv("DEVBITS_PUSH_MAX_ATTEMPTS", 6))
+	var limited atomic.Bool
+	for !limited.Load() {
+		pushes, err := database.ClaimQueuedPushes(now, now.Add(pushClaimLease), pushClaimBatch)
+		if err != nil {
+			logger.Log.Warnf("failed to claim queued pushes: %v", err)
+			break
+		}
+		if len(pushes) == 0 {
+			break
+		}
+
+		byProvider := make(map[push.Provider][]database.QueuedPush)
+		for _, queued := range pushes {
+			provider := pushProviderFor(queued.Platform)
+			if provider == nil {
+				recordPushError(database.MarkPushFailed(queued.ID, fmt.Sprintf("no push provider for platform '%s'", queued.Platform)))
+				continue
+			}
+			byProvider[provider] = append(byProvider[provider], queued)
+		}
+
+		var wg sync.WaitGroup
+		for provider, queued := range byProvider {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if sendQueuedPushes(provider, queued, now, maxAttempts) {
+					limited.Store(true)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	checkPushReceipts(now)
+
+	retention := time.Duration(readPositiveIntEnv("DEVBITS_PUSH_QUEUE_RETENTION_HOURS", 168)) * time.Hour
+	recordPushError(database.PrunePushQueue(now.Add(-retention)))
+}
+
+// sendQueuedPushes sends one provider's share of a claim, in batches when the
+// provider supports them. Once the provider rate limits, the rest of the share
+// waits as long as it asked. It reports whether that happened.
+func sendQueuedPushes(provider push.Provider, queued []database.QueuedPush, now time.Time, maxAttempts int) bool {
+	ready := make([]database.QueuedPush, 0, len(queued))
+	deliveries := make([]push.Delivery, 0, len(queued))
+	for _, item := range queued {
+		var message push.Message
+		if err := json.Unmarshal([]byte(item.Message), &message); err != nil {
+			recordPushError(database.MarkPushFailed(item.ID, fmt.Sprintf("invalid queued message: %v", err)))
+			continue
+		}
+		ready = append(ready, item)
+		deliveries = append(deliveries, push.Delivery{Token: item.Token, Message: message})
+	}
+
+	if batcher, ok := provider.(push.BatchSender); ok {
+		size := batcher.MaxBatch()
+		for start := 0; start < len(ready); start += size {
+			end := min(start+size, len(ready))
+			outcomes, err := batcher.SendBatch(deliveries[start:end])
+			if err != nil {
+				outcomes = make([]push.Outcome, end-start)
+				for index := range outcomes {
+					outcomes[index].Err = err
+				}
+			}
+
+			var limited *push.RateLimitError
+			for index, outcome := range outcomes {
+				if rateLimit := recordPushOutcome(ready[start+index], outcome, now, maxAttempts); rateLimit != nil {
+					limited = rateLimit
+				}
+			}
+			if limited != nil {
+				deferPushes(ready[end:], limited, now)
+				return true
+			}
+		}
+		return false
+	}
+
+	var limited atomic.Pointer[push.RateLimitError]
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for worker := 0; worker < min(pushSendWorkers, len(ready)); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if rateLimit := limited.Load(); rateLimit != nil {
+					deferPushes(ready[index:index+1], rateLimit, now)
+					continue
+				}
+				err := provider.Send(deliveries[index].Token, deliveries[index].Message)
+				if rateLimit := recordPushOutcome(ready[index], push.Outcome{Err: err}, now, maxAttempts); rateLimit != nil {
+					limited.Store(rateLimit)
+				}
+			}
+		}()
+	}
+	for index := range ready {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return limited.Load() != nil
+}
+
+// recordPushOutcome stores what happened to one push and returns the rate
+// limit, if the provider reported one.
+func recordPushOutcome(queued database.QueuedPush, outcome push.Outcome, now time.Time, maxAttempts int) *push.RateLimitError {
+	var rateLimit *push.RateLimitError
+	switch {
+	case outcome.Err == nil:
+		recordPushError(database.MarkPushSent(queued.ID, outcome.ReceiptID, now))
+	case errors.Is(outcome.Err, push.ErrTokenGone):
+		recordPushError(database.PrunePushToken(queued.Token, outcome.Err.Error()))
+	case errors.As(outcome.Err, &rateLimit):
+		recordPushError(database.RetryPush(queued.ID, now.Add(rateLimit.RetryAfter), outcome.Err.Error(), false))
+		return rateLimit
+	case queued.Attempts >= maxAttempts:
+		logger.Log.WithFields(map[string]interface{}{
+			"platform": queued.Platform,
+			"attempts": queued.Attempts,
+			"err":      outcome.Err.Error(),
+		}).Warn("Push delivery failed")
+		recordPushError(database.MarkPushFailed(queued.ID, outcome.Err.Error()))
+	default:
+		recordPushError(database.RetryPush(queued.ID, now.Add(retryDelay(queued.Attempts, pushRetryBase, pushRetryMax)), outcome.Err.Error(), true))
+	}
+	return nil
+}
+
+// deferPushes puts claimed pushes that were never tried back in the queue
+// until the rate limit lapses.
+func deferPushes(queued []database.QueuedPush, rateLimit *push.RateLimitError, now time.Time) {
+	for _, item := range queued {
+		recordPushError(database.RetryPush(item.ID, now.Add(rateLimit.RetryAfter), rateLimit.Error(), false))
+	}
+}
+
+// checkPushReceipts asks providers what became of pushes they accepted a
+// while ago, pruning tokens for uninstalled apps.
+func checkPushReceipts(now time.Time) {
+	delay := time.Duration(readPositiveIntEnv("DEVBITS_PUSH_RECEIPT_DELAY_MINUTES", 15)) * time.Minute
+	pending, err := database.QueryPendingReceipts(now.Add(-delay), pushReceiptBatch)
+	if err != nil {
+		logger.Log.Warnf("failed to query push receipts: %v", err)
+		return
+	}
+
+	byProvider := make(map[push.ReceiptChecker][]database.QueuedPush)
+	unchecked := make([]int64, 0)
+	for _, sent := range pending {
+		checker, ok := pushProviderFor(sent.Platform).(push.ReceiptChecker)
+		if !ok {
+			unchecked = append(unchecked, sent.ID)
+			continue
+		}
+		byProvider[checker] = append(byProvider[checker], sent)
+	}
+	recordPushError(database.ClearPushReceipts(unchecked))
+
+	for checker, sent := range byProvider {
+		ids := make([]string, len(sent))
+		for index, item := range sent {
+			ids[index] = item.ReceiptID
+		}
+		results, err := checker.CheckReceipts(ids)
+		if err != nil {
+			logger.Log.Warnf("failed to check push receipts: %v", err)
+			continue
+		}
+
+		delivered := make([]int64, 0, len(sent))
+		for _, item := range sent {
+			result, ready := results[item.ReceiptID]
+			switch {
+			case !ready:
+			case result == nil:
+				delivered = append(delivered, item.ID)
+			case errors.Is(result, push.ErrTokenGone):
+				recordPushError(database.PrunePushToken(item.Token, result.Error()))
+				recordPushError(database.MarkPushFailed(item.ID, result.Error()))
+			default:
+				recordPushError(database.MarkPushFailed(item.ID, result.Error()))
+			}
+		}
+		recordPushError(database.ClearPushReceipts(delivered))
+	}
+
+	recordPushError(database.ExpirePushReceipts(now.Add(-pushReceiptExpiry)))
+}
+
+func recordPushError(err error) {
+	if err != nil {
+		logger.Log.Warnf("push queue: %v", err)
+	}
+}
+
+// AdminPushStats handles GET /admin/push/stats.
+func AdminPushStats(c *gin.Context) {
+	stats, err := database.GetPushQueueStats()
+	if err != nil {
+		RespondWithError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch push stats: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
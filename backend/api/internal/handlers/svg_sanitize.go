@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SVGs are served from our own origin, so anything that can run script or pull
+// in outside content is stripped before the file is stored. The sanitizer works
+// on the raw token stream and rebuilds the document itself because
+// encoding/xml's encoder rewrites namespace prefixes.
+
+// svgBlockedElements are dropped together with all of their children.
+var svgBlockedElements = map[string]struct{}{
+	"script":        {},
+	"foreignobject": {},
+	"iframe":        {},
+	"embed":         {},
+	"object":        {},
+	"audio":         {},
+	"video":         {},
+	"handler":       {},
+	"listener":      {},
+}
+
+var svgAnimationElements = map[string]struct{}{
+	"set":              {},
+	"animate":          {},
+	"animatemotion":    {},
+	"animatetransform": {},
+}
+
+// svgAllowedDataImages are the only data: URIs an href may point at.
+var svgAllowedDataImages = []string{
+	"data:image/png",
+	"data:image/jpeg",
+	"data:image/jpg",
+	"data:image/gif",
+	"data:image/webp",
+}
+
+var cssURLPattern = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+
+var errInvalidSVG = fmt.Errorf("invalid svg")
+
+// sanitizeSVG removes scripts, event handlers, foreign objects and external
+// references from an SVG document. It fails when the input is not a
+// well-formed SVG.
+func sanitizeSVG(input []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(input))
+	decoder.Strict = true
+
+	var out bytes.Buffer
+	var names []string
+	skipDepth := 0
+	sawRoot := false
+
+	// <style> bodies are buffered so the whole element can be dropped when
+	// the stylesheet turns out to load external resources.
+	inStyle := false
+	var styleOpen string
+	var styleBody strings.Builder
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errInvalidSVG
+		}
+
+		switch value := token.(type) {
+		case xml.StartElement:
+			local := strings.ToLower(value.Name.Local)
+			if !sawRoot {
+				if local != "svg" {
+					return nil, errInvalidSVG
+				}
+				sawRoot = true
+			} else if len(names) == 0 && skipDepth == 0 {
+				// Only a single root element is allowed.
+				return nil, errInvalidSVG
+			}
+			if skipDepth > 0 || inStyle {
+				skipDepth++
+				continue
+			}
+			if _, blocked := svgBlockedElements[local]; blocked || isUnsafeSVGAnimation(local, value.Attr) {
+				skipDepth = 1
+				continue
+			}
+
+			names = append(names, svgQualifiedName(value.Name))
+			open := svgStartTag(value)
+			if local == "style" {
+				inStyle = true
+				styleOpen = open
+				styleBody.Reset()
+				continue
+			}
+			out.WriteString(open)
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if len(names) == 0 {
+				return nil, errInvalidSVG
+			}
+			name := names[len(names)-1]
+			names = names[:len(names)-1]
+			if inStyle {
+				inStyle = false
+				if isSafeSVGStyle(styleBody.String()) {
+					out.WriteString(styleOpen)
+					xml.EscapeText(&out, []byte(styleBody.String()))
+					out.WriteString("</" + name + ">")
+				}
+				continue
+			}
+			out.WriteString("</" + name + ">")
+		case xml.CharData:
+			if skipDepth > 0 || !sawRoot {
+				continue
+			}
+			if inStyle {
+				styleBody.Write(value)
+				continue
+			}
+			xml.EscapeText(&out, value)
+		}
+		// Comments, processing instructions and directives (DOCTYPE and
+		// entity declarations) are dropped.
+	}
+
+	if !sawRoot || len(names) != 0 {
+		return nil, errInvalidSVG
+	}
+	return out.Bytes(), nil
+}
+
+func svgQualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func svgStartTag(element xml.StartElement) string {
+	var builder strings.Builder
+	builder.WriteString("<")
+	builder.WriteString(svgQualifiedName(element.Name))
+	for _, attr := range element.Attr {
+		if !isSafeSVGAttribute(attr) {
+			continue
+		}
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(attr.Value))
+		builder.WriteString(" ")
+		builder.WriteString(svgQualifiedName(attr.Name))
+		builder.WriteString(`="`)
+		builder.Write(escaped.Bytes())
+		builder.WriteString(`"`)
+	}
+	builder.WriteString(">")
+	return builder.String()
+}
+
+func isSafeSVGAttribute(attr xml.Attr) bool {
+	local := strings.ToLower(attr.Name.Local)
+	space := strings.ToLower(attr.Name.Space)
+	value := strings.TrimSpace(attr.Value)
+
+	if space == "xmlns" || (space == "" && local == "xmlns") {
+		return true
+	}
+	if strings.HasPrefix(local, "on") {
+		return false
+	}
+	if space == "xml" && local == "base" {
+		return false
+	}
+	switch local {
+	case "href", "src":
+		return isSafeSVGReference(value)
+	case "style":
+		return isSafeSVGStyle(value)
+	}
+	if strings.Contains(strings.ToLower(value), "url(") {
+		return isSafeSVGStyle(value)
+	}
+	return true
+}
+
+// isSafeSVGReference allows fragment references within the document and
+// inline raster images; everything else could load or navigate elsewhere.
+func isSafeSVGReference(value string) bool {
+	if strings.HasPrefix(value, "#") {
+		return true
+	}
+	lowered := strings.ToLower(value)
+	for _, prefix := range svgAllowedDataImages {
+		if strings.HasPrefix(lowered, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeSVGStyle(css string) bool {
+	lowered := strings.ToLower(css)
+	// CSS escapes could be used to smuggle any of the checks below.
+	if strings.Contains(lowered, `\`) {
+		return false
+	}
+	if strings.Contains(lowered, "@import") || strings.Contains(lowered, "expression(") || strings.Contains(lowered, "javascript:") {
+		return false
+	}
+	for _, match := range cssURLPattern.FindAllStringSubmatch(css, -1) {
+		if !isSafeSVGReference(match[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isUnsafeSVGAnimation reports animation elements that retarget an href or an
+// event handler, which would otherwise reintroduce what the sanitizer removed.
+func isUnsafeSVGAnimation(local string, attrs []xml.Attr) bool {
+	if _, ok := svgAnimationElements[local]; !ok {
+		return false
+	}
+	for _, attr := range attrs {
+		if strings.ToLower(attr.Name.Local) != "attributename" {
+			continue
+		}
+		target := strings.ToLower(strings.TrimSpace(attr.Value))
+		if idx := strings.Index(target, ":"); idx >= 0 {
+			target = target[idx+1:]
+		}
+		if target == "href" || target == "src" || strings.HasPrefix(target, "on") {
+			return true
+		}
+	}
+	return false
+}
@@ -37,7 +37,9 @@ func SearchUsers(context *gin.Context) {
 		}
 	}
 
-	users, err := database.SearchUsers(q, limit)
+	// Users the viewer blocked or was blocked by are left out.
+	viewerID, _ := GetAuthUserID(context)
+	users, err := database.SearchUsers(q, limit, viewerID)
 	if err != nil {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to search users: %v", err))
 		return
@@ -213,6 +215,12 @@ func DeleteUser(context *gin.Context) {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to collect user media before delete: %v", err))
 		return
 	}
+	// Private attachments in conversations go with either participant.
+	directMessageMedia, err := database.QueryDirectMessagePrivateMedia(int64(existingUser.Id))
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to collect user media before delete: %v", err))
+		return
+	}
 
 	err = database.DeleteUser(username)
 	if err != nil {
@@ -221,6 +229,15 @@ func DeleteUser(context *gin.Context) {
 	}
 
 	removedFiles := removeManagedUploadFiles(managedUploads)
+	removedFiles += removeOwnerPrivateMediaFiles(existingUser.Id)
+	if removedPrivate, purgeErr := purgePrivateMedia(directMessageMedia); purgeErr != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"user_id": existingUser.Id,
+			"err":     purgeErr.Error(),
+		}).Warn("Failed to remove direct message media after user delete")
+	} else {
+		removedFiles += removedPrivate
+	}
 	removedOwnedOrphans := removeOwnerPrefixedUploadFiles(existingUser.Id, managedUploads)
 	context.JSON(http.StatusOK, gin.H{
 		"message":                fmt.Sprintf("User '%v' deleted.", username),
@@ -269,8 +286,15 @@ func GetUserManagedMedia(context *gin.Context) {
 		return items[i].Filename < items[j].Filename
 	})
 
+	usage, status, err := getStorageUsage(int64(existingUser.Id))
+	if err != nil {
+		RespondWithError(context, status, fmt.Sprintf("Failed to fetch storage usage: %v", err))
+		return
+	}
+
 	context.JSON(http.StatusOK, gin.H{
 		"items": items,
+		"usage": usage,
 	})
 }
 
@@ -389,6 +413,8 @@ func collectManagedUploadsForUser(userID int) (map[string]struct{}, error) {
 		 	JOIN projects pr ON pr.id = prc.project_id
 		 	WHERE pr.owner = $1
 		 )`,
+		// Attachments in either direction, since both participants govern them.
+		`SELECT COALESCE(media, '[]') FROM directmessages WHERE sender_id = $1 OR recipient_id = $1`,
 	}
 
 	for _, query := range queries {
@@ -417,10 +443,12 @@ func collectManagedUploadsForUser(userID int) (map[string]struct{}, error) {
 
 func removeManagedUploadFiles(uploads map[string]struct{}) int {
 	removed := 0
+	released := make([]string, 0, len(uploads))
 	for filename := range uploads {
 		filePath := filepath.Join(uploadDir, filename)
 		if err := os.Remove(filePath); err != nil {
 			if os.IsNotExist(err) {
+				released = append(released, filename)
 				continue
 			}
 			logger.Log.WithFields(map[string]interface{}{
@@ -429,8 +457,10 @@ func removeManagedUploadFiles(uploads map[string]struct{}) int {
 			}).Warn("Failed to remove managed upload after user delete")
 			continue
 		}
+		released = append(released, filename)
 		removed += 1
 	}
+	releaseManagedUploads(released)
 	return removed
 }
 
@@ -481,6 +511,12 @@ func removeMediaReferencesForUser(userID int, targets map[string]struct{}) error
 	if err := pruneMediaColumnRows("comments", "user_id", userID, targets); err != nil {
 		return err
 	}
+	if err := pruneMediaColumnRows("directmessages", "sender_id", userID, targets); err != nil {
+		return err
+	}
+	if err := pruneMediaColumnRows("directmessages", "recipient_id", userID, targets); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -636,9 +672,9 @@ func UpdateUserInfo(context *gin.Context) {
 		if strings.TrimSpace(pictureStr) == "" {
 			existingUser.Picture = ""
 		} else {
-			storedPicture, ingestErr := materializeMediaReference(pictureStr)
+			storedPicture, ingestErr := materializeMediaReference(int64(existingUser.Id), pictureStr)
 			if ingestErr != nil {
-				RespondWithError(context, http.StatusBadRequest, "Invalid picture media reference")
+				respondWithMediaIngestError(context, ingestErr, "Invalid picture media reference")
 				return
 			}
 			existingUser.Picture = storedPicture
@@ -725,7 +761,9 @@ func cleanupReplacedProfileUpload(previousPicture, nextPicture string) {
 			"path": filePath,
 			"err":  err.Error(),
 		}).Warn("Failed to remove replaced profile image")
+		return
 	}
+	releaseManagedUploads([]string{previousFilename})
 }
 
 func extractManagedUploadFilename(picture string) (string, bool) {
@@ -834,7 +872,17 @@ func FollowUser(context *gin.Context) {
 	username := context.Param("username")
 	newFollow := context.Param("new_follow")
 
-	err := database.FollowUser(username, newFollow)
+	blocked, err := isBlockedBetweenUsernames(username, newFollow)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to add follower: %v", err))
+		return
+	}
+	if blocked {
+		RespondWithError(context, http.StatusForbidden, "You cannot follow this user")
+		return
+	}
+
+	err = database.FollowUser(username, newFollow)
 	if err != nil {
 		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to add follower: %v", err))
 		return
@@ -843,13 +891,14 @@ func FollowUser(context *gin.Context) {
 	actor, _ := database.GetUserByUsername(username)
 	user, _ := database.GetUserByUsername(newFollow)
 	createAndPushNotification(
+		hubFor(context),
 		int64(user.Id),
 		int64(actor.Id),
 		"follow_user",
 		nil,
 		nil,
 		nil,
-		notificationBody(username, "followed you"),
+		"followed you",
 	)
 	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%v now follows %v", username, newFollow)})
 }
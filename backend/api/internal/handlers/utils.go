@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"backend/api/internal/logger"
 
@@ -65,3 +66,12 @@ func GetAuthUserID(context *gin.Context) (int64, bool) {
 	userID, ok := value.(int64)
 	return userID, ok
 }
+
+// retryDelay doubles from base with each attempt, up to max.
+func retryDelay(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for attempt := 1; attempt < attempts && delay < max; attempt++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
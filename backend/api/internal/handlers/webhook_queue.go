@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/logger"
+	"backend/api/internal/webhooks"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// webhookClaimBatch is how many deliveries a worker takes at a time.
+	webhookClaimBatch = 100
+	// webhookClaimLease outlasts the sender's timeout, so a delivery is only
+	// sent again once its attempt has certainly ended.
+	webhookClaimLease  = time.Minute
+	webhookRetryBase   = 30 * time.Second
+	webhookRetryMax    = time.Hour
+	webhookSendWorkers = 6
+)
+
+var (
+	webhookQueue  = &queueRunner{run: func() { ProcessWebhookQueue(time.Now()) }}
+	webhookSender = webhooks.NewSender(allowPrivateWebhooks)
+)
+
+// allowPrivateWebhooks reports whether webhooks may reach loopback and
+// private addresses, which is only meant for local development and tests.
+func allowPrivateWebhooks() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("DEVBITS_WEBHOOK_ALLOW_PRIVATE")), "true")
+}
+
+type webhookUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type webhookProject struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// webhookPayload is the body of every delivery.
+type webhookPayload struct {
+	Event     string         `json:"event"`
+	Project   webhookProject `json:"project"`
+	Actor     *webhookUser   `json:"actor"`
+	Data      gin.H          `json:"data"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// lookupWebhookUser describes userID in a payload, or returns nil if the user
+// is gone.
+func lookupWebhookUser(userID int64) *webhookUser {
+	user, err := database.GetUserById(int(userID))
+	if err != nil || user == nil {
+		return nil
+	}
+	return &webhookUser{ID: int64(user.Id), Username: user.Username}
+}
+
+// emitProjectEvent queues event for every active webhook on project that
+// subscribed to it. Failing to queue is logged, never returned: webhooks
+// must not break the request that caused the event.
+func emitProjectEvent(project *database.Project, event string, actorID int64, data gin.H) {
+	hooks, err := database.QueryActiveProjectWebhooks(project.ID)
+	if err != nil {
+		logger.Log.Warnf("failed to load webhooks: %v", err)
+		return
+	}
+	subscribed := make([]database.ProjectWebhook, 0, len(hooks))
+	for _, hook := range hooks {
+		if webhooks.Subscribed(hook.Events, event) {
+			subscribed = append(subscribed, hook)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(webhookPayload{
+		Event:     event,
+		Project:   webhookProject{ID: project.ID, Name: project.Name},
+		Actor:     lookupWebhookUser(actorID),
+		Data:      data,
+		CreatedAt: now.UTC(),
+	})
+	if err != nil {
+		logger.Log.Warnf("failed to encode webhook payload: %v", err)
+		return
+	}
+	for _, hook := range subscribed {
+		if _, err := database.EnqueueWebhookDelivery(hook.ID, event, string(payload), nil, now); err != nil {
+			logger.Log.Warnf("failed to queue webhook delivery: %v", err)
+		}
+	}
+	kickWebhookQueue()
+}
+
+// emitProjectEventByID is emitProjectEvent for handlers that only hold the
+// project's id.
+func emitProjectEventByID(projectID int64, event string, actorID int64, data gin.H) {
+	project, err := database.QueryProject(int(projectID))
+	if err != nil || project == nil {
+		return
+	}
+	emitProjectEvent(project, event, actorID, data)
+}
+
+// kickWebhookQueue asks the delivery worker to run soon. Kicks that arrive
+// while it is busy collapse into one more run.
+func kickWebhookQueue() {
+	webhookQueue.kick()
+}
+
+// StartWebhookWorker drains the webhook queue every interval, which picks up
+// retries that nothing else would wake the worker for.
+func StartWebhookWorker(interval time.Duration) {
+	runEvery(interval, kickWebhookQueue)
+}
+
+// ProcessWebhookQueue sends every webhook delivery due at now and prunes old
+// entries from the delivery and inbound event logs. It is safe to run from
+// several processes at once.
+func ProcessWebhookQueue(now time.Time) {
+	maxAttempts := int(readPositiveIntEnv("DEVBITS_WEBHOOK_MAX_ATTEMPTS", 8))
+	disableAfter := int(readPositiveIntEnv("DEVBITS_WEBHOOK_DISABLE_AFTER", 15))
+	for {
+		deliveries, err := database.ClaimWebhookDeliveries(now, now.Add(webhookClaimLease), webhookClaimBatch)
+		if err != nil {
+			logger.Log.Warnf("failed to claim webhook deliveries: %v", err)
+			break
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		indexes := make(chan int)
+		for worker := 0; worker < min(webhookSendWorkers, len(deliveries)); worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for index := range indexes {
+					sendWebhookDelivery(deliveries[index], now, maxAttempts, disableAfter)
+				}
+			}()
+		}
+		for index := range deliveries {
+			indexes <- index
+		}
+		close(indexes)
+		wg.Wait()
+	}
+
+	retention := time.Duration(readPositiveIntEnv("DEVBITS_WEBHOOK_LOG_RETENTION_HOURS", 720)) * time.Hour
+	recordWebhookError(database.PruneWebhookDeliveries(now.Add(-retention)))
+	recordWebhookError(database.PruneInboundWebhookEvents(now.Add(-retention)))
+}
+
+// sendWebhookDelivery makes one attempt at a claimed delivery and records how
+// it went. Every failed attempt counts toward turning the webhook off.
+func sendWebhookDelivery(delivery database.WebhookDelivery, now time.Time, maxAttempts int, disableAfter int) {
+	hook, err := database.GetProjectWebhook(delivery.WebhookID)
+	if err != nil {
+		recordWebhookError(err)
+		return
+	}
+	if hook == nil {
+		return
+	}
+
+	result := webhookSender.Send(context.Background(), hook.URL, hook.Secret, delivery.Event, delivery.ID, delivery.Payload)
+	attempt := database.WebhookAttempt{
+		ResponseCode: result.StatusCode,
+		ResponseBody: result.Body,
+		Duration:     result.Duration,
+	}
+	if result.OK() {
+		recordWebhookError(database.RecordWebhookAttempt(delivery.ID, database.WebhookDelivered, attempt, now, now))
+		recordWebhookError(database.ResetWebhookFailures(hook.ID))
+		return
+	}
+
+	attempt.Error = result.Err.Error()
+	if delivery.Attempts >= maxAttempts {
+		recordWebhookError(database.RecordWebhookAttempt(delivery.ID, database.WebhookFailed, attempt, now, now))
+	} else {
+		next := now.Add(retryDelay(delivery.Attempts, webhookRetryBase, webhookRetryMax))
+		recordWebhookError(database.RecordWebhookAttempt(delivery.ID, database.WebhookPending, attempt, next, now))
+	}
+
+	disabled, err := database.RecordWebhookFailure(hook.ID, disableAfter, now)
+	recordWebhookError(err)
+	if disabled {
+		logger.Log.WithFields(map[string]interface{}{
+			"webhook_id": hook.ID,
+			"project_id": hook.ProjectID,
+			"err":        attempt.Error,
+		}).Warn("Disabled webhook after repeated failures")
+	}
+}
+
+func recordWebhookError(err error) {
+	if err != nil {
+		logger.Log.Warnf("webhook queue: %v", err)
+	}
+}
@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/netguard"
+	"backend/api/internal/webhooks"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxProjectWebhooks     = 10
+	minWebhookSecretLength = 16
+)
+
+// webhookRequest is the body of POST and PUT /projects/:project_id/webhooks.
+// Fields left out of a PUT keep their values.
+type webhookRequest struct {
+	URL          *string  `json:"url"`
+	Events       []string `json:"events"`
+	Secret       *string  `json:"secret"`
+	Active       *bool    `json:"active"`
+	RotateSecret bool     `json:"rotate_secret"`
+}
+
+// loadOwnedProject loads the project named in the path and checks the caller
+// owns it, responding with an error if not.
+func loadOwnedProject(context *gin.Context) (*database.Project, bool) {
+	return loadProjectOwnedBy(context, "Only the owner can manage webhooks")
+}
+
+// loadProjectOwnedBy is loadOwnedProject with forbidden as the message for
+// callers who do not own the project.
+func loadProjectOwnedBy(context *gin.Context, forbidden string) (*database.Project, bool) {
+	projectID, err := strconv.Atoi(context.Param("project_id"))
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse project_id: %v", err))
+		return nil, false
+	}
+	project, err := database.QueryProject(projectID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load project: %v", err))
+		return nil, false
+	}
+	if project == nil {
+		RespondWithError(context, http.StatusNotFound, "Project not found")
+		return nil, false
+	}
+	authUserID, ok := GetAuthUserID(context)
+	if !ok || project.Owner != authUserID {
+		RespondWithError(context, http.StatusForbidden, forbidden)
+		return nil, false
+	}
+	return project, true
+}
+
+// loadOwnedWebhook is loadOwnedProject plus the webhook named in the path.
+func loadOwnedWebhook(context *gin.Context) (*database.ProjectWebhook, bool) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return nil, false
+	}
+	webhookID, err := strconv.ParseInt(context.Param("webhook_id"), 10, 64)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse webhook_id: %v", err))
+		return nil, false
+	}
+	hook, err := database.QueryProjectWebhook(project.ID, webhookID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return nil, false
+	}
+	if hook == nil {
+		RespondWithError(context, http.StatusNotFound, "Webhook not found")
+		return nil, false
+	}
+	return hook, true
+}
+
+// normalizeWebhookEvents validates and de-duplicates the events a webhook
+// subscribes to.
+func normalizeWebhookEvents(events []string) ([]string, string) {
+	if len(events) == 0 {
+		return nil, "events must list at least one event"
+	}
+	normalized := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if !webhooks.KnownEvent(event) {
+			return nil, fmt.Sprintf("Unknown webhook event '%s'", event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			normalized = append(normalized, event)
+		}
+	}
+	return normalized, ""
+}
+
+func validateWebhookURL(raw string) (string, string) {
+	raw = strings.TrimSpace(raw)
+	if err := netguard.CheckURL(raw, allowPrivateWebhooks()); err != nil {
+		return "", fmt.Sprintf("Invalid webhook url: %v", err)
+	}
+	return raw, ""
+}
+
+func validateWebhookSecret(secret string) string {
+	if len(secret) < minWebhookSecretLength {
+		return fmt.Sprintf("Webhook secret must be at least %d characters", minWebhookSecretLength)
+	}
+	return ""
+}
+
+// GetProjectWebhooks handles GET /projects/:project_id/webhooks. Secrets are
+// only ever shown when set.
+func GetProjectWebhooks(context *gin.Context) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return
+	}
+	hooks, err := database.QueryProjectWebhooks(project.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch webhooks: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"webhooks": hooks, "events": webhooks.Events})
+}
+
+// CreateProjectWebhook handles POST /projects/:project_id/webhooks. Events
+// default to all of them and the secret to a generated one, which the
+// response includes.
+func CreateProjectWebhook(context *gin.Context) {
+	project, ok := loadOwnedProject(context)
+	if !ok {
+		return
+	}
+	var request webhookRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+	if request.URL == nil {
+		RespondWithError(context, http.StatusBadRequest, "A webhook url is required")
+		return
+	}
+	hookURL, message := validateWebhookURL(*request.URL)
+	if message != "" {
+		RespondWithError(context, http.StatusBadRequest, message)
+		return
+	}
+	events := []string{webhooks.EventAll}
+	if request.Events != nil {
+		if events, message = normalizeWebhookEvents(request.Events); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	}
+	var secret string
+	if request.Secret != nil {
+		secret = *request.Secret
+		if message := validateWebhookSecret(secret); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	} else {
+		generated, err := webhooks.NewSecret()
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, err.Error())
+			return
+		}
+		secret = generated
+	}
+
+	existing, err := database.QueryProjectWebhooks(project.ID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch webhooks: %v", err))
+		return
+	}
+	if len(existing) >= maxProjectWebhooks {
+		RespondWithError(context, http.StatusConflict, fmt.Sprintf("A project can have at most %d webhooks", maxProjectWebhooks))
+		return
+	}
+
+	authUserID, _ := GetAuthUserID(context)
+	hook := database.ProjectWebhook{
+		ProjectID: project.ID,
+		URL:       hookURL,
+		Secret:    secret,
+		Events:    events,
+		Active:    request.Active == nil || *request.Active,
+		CreatedBy: &authUserID,
+	}
+	id, err := database.CreateProjectWebhook(hook, time.Now())
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to create webhook: %v", err))
+		return
+	}
+	created, err := database.QueryProjectWebhook(project.ID, id)
+	if err != nil || created == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return
+	}
+	context.JSON(http.StatusCreated, gin.H{"message": "Webhook created", "webhook": created, "secret": secret})
+}
+
+// UpdateProjectWebhook handles PUT /projects/:project_id/webhooks/:webhook_id.
+// Setting active to true turns a disabled webhook back on with a clean
+// failure streak. rotate_secret generates a new secret, which the response
+// includes.
+func UpdateProjectWebhook(context *gin.Context) {
+	hook, ok := loadOwnedWebhook(context)
+	if !ok {
+		return
+	}
+	var request webhookRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to bind to JSON: %v", err))
+		return
+	}
+
+	var message string
+	if request.URL != nil {
+		if hook.URL, message = validateWebhookURL(*request.URL); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	}
+	if request.Events != nil {
+		if hook.Events, message = normalizeWebhookEvents(request.Events); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+	}
+	if request.Secret != nil && request.RotateSecret {
+		RespondWithError(context, http.StatusBadRequest, "Set secret or rotate_secret, not both")
+		return
+	}
+	response := gin.H{"message": "Webhook updated"}
+	if request.Secret != nil {
+		if message := validateWebhookSecret(*request.Secret); message != "" {
+			RespondWithError(context, http.StatusBadRequest, message)
+			return
+		}
+		hook.Secret = *request.Secret
+		response["secret"] = hook.Secret
+	}
+	if request.RotateSecret {
+		generated, err := webhooks.NewSecret()
+		if err != nil {
+			RespondWithError(context, http.StatusInternalServerError, err.Error())
+			return
+		}
+		hook.Secret = generated
+		response["secret"] = hook.Secret
+	}
+	if request.Active != nil {
+		hook.Active = *request.Active
+	}
+
+	if err := database.UpdateProjectWebhook(*hook); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to update webhook: %v", err))
+		return
+	}
+	updated, err := database.QueryProjectWebhook(hook.ProjectID, hook.ID)
+	if err != nil || updated == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load webhook: %v", err))
+		return
+	}
+	if updated.Active {
+		// Deliveries that were waiting out a retry go as soon as possible.
+		kickWebhookQueue()
+	}
+	response["webhook"] = updated
+	context.JSON(http.StatusOK, response)
+}
+
+// DeleteProjectWebhook handles DELETE /projects/:project_id/webhooks/:webhook_id,
+// which also drops its delivery log.
+func DeleteProjectWebhook(context *gin.Context) {
+	hook, ok := loadOwnedWebhook(context)
+	if !ok {
+		return
+	}
+	if _, err := database.DeleteProjectWebhook(hook.ProjectID, hook.ID); err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to delete webhook: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// GetWebhookDeliveries handles GET /projects/:project_id/webhooks/:webhook_id/deliveries,
+// the delivery log, newest first, paged with start and count.
+func GetWebhookDeliveries(context *gin.Context) {
+	hook, ok := loadOwnedWebhook(context)
+	if !ok {
+		return
+	}
+	start, count := parseConversationPaging(context, 50)
+	deliveries, err := database.QueryWebhookDeliveries(hook.ID, start, count)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch deliveries: %v", err))
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// RedeliverWebhookDelivery handles
+// POST /projects/:project_id/webhooks/:webhook_id/deliveries/:delivery_id/redeliver.
+// The payload is queued again as a new delivery, so the log keeps both.
+func RedeliverWebhookDelivery(context *gin.Context) {
+	hook, ok := loadOwnedWebhook(context)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(context.Param("delivery_id"), 10, 64)
+	if err != nil {
+		RespondWithError(context, http.StatusBadRequest, fmt.Sprintf("Failed to parse delivery_id: %v", err))
+		return
+	}
+	original, err := database.QueryWebhookDelivery(hook.ID, deliveryID)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load delivery: %v", err))
+		return
+	}
+	if original == nil {
+		RespondWithError(context, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if !hook.Active {
+		RespondWithError(context, http.StatusConflict, "Webhook is disabled. Turn it back on before redelivering")
+		return
+	}
+
+	id, err := database.EnqueueWebhookDelivery(hook.ID, original.Event, string(original.Payload), &original.ID, time.Now())
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to queue delivery: %v", err))
+		return
+	}
+	kickWebhookQueue()
+
+	delivery, err := database.QueryWebhookDelivery(hook.ID, id)
+	if err != nil || delivery == nil {
+		RespondWithError(context, http.StatusInternalServerError, fmt.Sprintf("Failed to load delivery: %v", err))
+		return
+	}
+	context.JSON(http.StatusAccepted, gin.H{"message": "Redelivery queued", "delivery": delivery})
+}
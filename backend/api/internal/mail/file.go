@@ -0,0 +1,34 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes each email to an .eml file instead of sending it, for
+// local development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (m *FileMailer) Send(message Message) error {
+	body, err := Compose(m.From, message)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), randomID()[:8])
+	if err := os.WriteFile(filepath.Join(m.Dir, name), body, 0o644); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	return nil
+}
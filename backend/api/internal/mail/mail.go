@@ -0,0 +1,112 @@
+// Package mail sends email through a pluggable Mailer.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is one email with a plain text body and, optionally, an HTML
+// alternative.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Headers are added as is, such as List-Unsubscribe.
+	Headers map[string]string
+}
+
+type Mailer interface {
+	Send(message Message) error
+}
+
+// Compose renders message as an RFC 5322 email from from.
+func Compose(from string, message Message) ([]byte, error) {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, fmt.Errorf("mail addresses must not contain line breaks")
+	}
+
+	var buffer bytes.Buffer
+	header := func(name string, value string) {
+		fmt.Fprintf(&buffer, "%s: %s\r\n", name, value)
+	}
+	header("From", from)
+	header("To", message.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header("Date", time.Now().UTC().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomID()+"@devbits>")
+	header("MIME-Version", "1.0")
+	names := make([]string, 0, len(message.Headers))
+	for name := range message.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := message.Headers[name]
+		if strings.ContainsAny(name+value, "\r\n") {
+			return nil, fmt.Errorf("mail header %s must not contain line breaks", name)
+		}
+		header(name, value)
+	}
+
+	if message.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buffer.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buffer, message.Text); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buffer)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buffer.WriteString("\r\n")
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(writer, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	encoder := quotedprintable.NewWriter(w)
+	if _, err := encoder.Write([]byte(body)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func randomID() string {
+	raw := make([]byte, 12)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer sends through an SMTP server, upgrading to TLS when the server
+// offers it.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer sends through addr ("host:port") as from. Credentials are
+// optional; without them the server must accept unauthenticated mail.
+func NewSMTPMailer(addr string, from string, username string, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address: %w", err)
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	mailer := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		mailer.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+	body, err := Compose(m.From, message)
+	if err != nil {
+		return err
+	}
+	if err := smtp.SendMail(m.Addr, m.Auth, from.Address, []string{to.Address}, body); err != nil {
+		return fmt.Errorf("smtp send failed: %w", err)
+	}
+	return nil
+}
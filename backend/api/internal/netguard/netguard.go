@@ -0,0 +1,79 @@
+// Package netguard keeps requests to URLs that users hand DevBits, such as
+// webhook receivers and Web Push endpoints, off loopback and private
+// addresses.
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress reports a URL that points inside the network DevBits
+// runs in.
+var ErrPrivateAddress = errors.New("address is not public")
+
+// CheckURL validates a user supplied URL: absolute http or https, and, unless
+// allowPrivate, not naming a loopback or private host outright. Names that
+// resolve to such addresses are refused when dialing.
+func CheckURL(raw string, allowPrivate bool) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if parsed.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// NewClient returns a client for URLs that users hand DevBits. Its
+// connections refuse loopback and private addresses unless allowPrivate says
+// otherwise at dial time, and it does not follow redirects.
+func NewClient(timeout time.Duration, allowPrivate func() bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			if allowPrivate != nil && allowPrivate() {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
@@ -0,0 +1,187 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultExpoURL is Expo's push API.
+const DefaultExpoURL = "https://exp.host/--/api/v2/push/send"
+
+// maxExpoBatch is the most messages Expo accepts in one request.
+const maxExpoBatch = 100
+
+type ExpoMessage struct {
+	To    string                 `json:"to"`
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+// ExpoTicket is Expo's immediate answer for one message. A receipt with the
+// same shape becomes available under the ticket id later.
+type ExpoTicket struct {
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Details struct {
+		Error string `json:"error,omitempty"`
+	} `json:"details"`
+}
+
+type ExpoTicketResponse struct {
+	Data []ExpoTicket `json:"data"`
+}
+
+type ExpoReceiptResponse struct {
+	Data map[string]ExpoTicket `json:"data"`
+}
+
+// ExpoProvider sends to Expo push tokens, which cover both iOS and Android.
+type ExpoProvider struct {
+	URL string
+	// ReceiptsURL is where delivery receipts are fetched; it defaults to the
+	// getReceipts endpoint next to URL.
+	ReceiptsURL string
+	Client      *http.Client
+}
+
+func NewExpoProvider(url string) *ExpoProvider {
+	if url == "" {
+		url = DefaultExpoURL
+	}
+	return &ExpoProvider{
+		URL:         url,
+		ReceiptsURL: strings.TrimSuffix(url, "/send") + "/getReceipts",
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *ExpoProvider) Normalize(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, "ExponentPushToken[") && !strings.HasPrefix(token, "ExpoPushToken[") {
+		return "", fmt.Errorf("not an Expo push token")
+	}
+	return token, nil
+}
+
+func (p *ExpoProvider) Send(token string, message Message) error {
+	outcomes, err := p.SendBatch([]Delivery{{Token: token, Message: message}})
+	if err != nil {
+		return err
+	}
+	return outcomes[0].Err
+}
+
+func (p *ExpoProvider) MaxBatch() int {
+	return maxExpoBatch
+}
+
+func (p *ExpoProvider) SendBatch(deliveries []Delivery) ([]Outcome, error) {
+	if len(deliveries) > maxExpoBatch {
+		return nil, fmt.Errorf("expo accepts at most %d messages per request", maxExpoBatch)
+	}
+	messages := make([]ExpoMessage, len(deliveries))
+	for index, delivery := range deliveries {
+		messages[index] = ExpoMessage{
+			To:    delivery.Token,
+			Title: delivery.Message.Title,
+			Body:  delivery.Message.Body,
+			Data:  delivery.Message.Data,
+		}
+	}
+
+	var tickets ExpoTicketResponse
+	if err := p.post(p.URL, messages, &tickets); err != nil {
+		return nil, err
+	}
+	if len(tickets.Data) != len(deliveries) {
+		return nil, fmt.Errorf("expo returned %d tickets for %d messages", len(tickets.Data), len(deliveries))
+	}
+
+	outcomes := make([]Outcome, len(deliveries))
+	for index, ticket := range tickets.Data {
+		if ticket.Status == "ok" {
+			outcomes[index] = Outcome{ReceiptID: ticket.ID}
+			continue
+		}
+		outcomes[index] = Outcome{Err: expoTicketError(ticket)}
+	}
+	return outcomes, nil
+}
+
+func (p *ExpoProvider) CheckReceipts(ids []string) (map[string]error, error) {
+	var receipts ExpoReceiptResponse
+	if err := p.post(p.ReceiptsURL, map[string][]string{"ids": ids}, &receipts); err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]error, len(receipts.Data))
+	for id, receipt := range receipts.Data {
+		if receipt.Status == "ok" {
+			results[id] = nil
+			continue
+		}
+		results[id] = expoTicketError(receipt)
+	}
+	return results, nil
+}
+
+func (p *ExpoProvider) post(url string, payload interface{}, target interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("expo push failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		return rateLimited(response.Header.Get("Retry-After"))
+	}
+	responseBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read expo response: %w", err)
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("expo push rejected with status %d", response.StatusCode)
+	}
+	if err := json.Unmarshal(responseBytes, target); err != nil {
+		return fmt.Errorf("failed to decode expo response: %w", err)
+	}
+	return nil
+}
+
+// expoTicketError turns an error ticket or receipt into an error, mapping the
+// codes the queue acts on to ErrTokenGone and RateLimitError.
+func expoTicketError(ticket ExpoTicket) error {
+	errorCode := strings.ToLower(strings.TrimSpace(ticket.Details.Error))
+	message := strings.ToLower(strings.TrimSpace(ticket.Message))
+	switch {
+	case errorCode == "devicenotregistered" || strings.Contains(message, "not a registered push notification recipient"):
+		return ErrTokenGone
+	case errorCode == "messagerateexceeded":
+		return &RateLimitError{RetryAfter: defaultRetryAfter}
+	case ticket.Details.Error != "":
+		return fmt.Errorf("expo push failed: %s", ticket.Details.Error)
+	case ticket.Message != "":
+		return errors.New("expo push failed: " + ticket.Message)
+	}
+	return fmt.Errorf("expo push failed with status %q", ticket.Status)
+}
@@ -0,0 +1,87 @@
+// Package push delivers notifications to devices through a provider chosen
+// by the platform a token was registered for.
+package push
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTokenGone reports that the provider no longer knows the token, so it
+// should be forgotten.
+var ErrTokenGone = errors.New("push token is no longer registered")
+
+// Message is what a device shows, plus data the client uses to navigate.
+type Message struct {
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+type Provider interface {
+	// Normalize returns token in the form it is stored, or an error if the
+	// provider cannot deliver to it.
+	Normalize(token string) (string, error)
+	Send(token string, message Message) error
+}
+
+// Delivery is one message for one token.
+type Delivery struct {
+	Token   string
+	Message Message
+}
+
+// Outcome is the result of one delivery in a batch. ReceiptID, when the
+// provider issues one, is checked later with a ReceiptChecker.
+type Outcome struct {
+	ReceiptID string
+	Err       error
+}
+
+// BatchSender is a Provider that can send several deliveries per request.
+type BatchSender interface {
+	// MaxBatch is the most deliveries SendBatch accepts at once.
+	MaxBatch() int
+	// SendBatch returns one outcome per delivery, in order, or an error if
+	// the whole request failed.
+	SendBatch(deliveries []Delivery) ([]Outcome, error)
+}
+
+// ReceiptChecker is a Provider that confirms deliveries after the fact.
+type ReceiptChecker interface {
+	// CheckReceipts returns the receipts that are ready, keyed by id, with a
+	// nil error for delivered pushes. Receipts missing from the result are
+	// not ready yet.
+	CheckReceipts(ids []string) (map[string]error, error)
+}
+
+// RateLimitError reports that the provider asked to slow down.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("push provider rate limited, retry after %s", e.RetryAfter)
+}
+
+// defaultRetryAfter is used when a provider rate limits without saying for
+// how long, and is the shortest wait honored when it does.
+const defaultRetryAfter = 30 * time.Second
+
+// rateLimited builds a RateLimitError from a Retry-After header, which holds
+// either seconds or an HTTP date. A zero or past Retry-After still waits
+// defaultRetryAfter, so a rate limit never sends the queue straight back.
+func rateLimited(header string) *RateLimitError {
+	wait := defaultRetryAfter
+	header = strings.TrimSpace(header)
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		wait = time.Until(at)
+	}
+	return &RateLimitError{RetryAfter: max(wait, defaultRetryAfter)}
+}
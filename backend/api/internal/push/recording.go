@@ -0,0 +1,52 @@
+package push
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RecordingProvider keeps pushes in memory instead of sending them, for tests
+// and local development. It accepts any non-empty token.
+type RecordingProvider struct {
+	mu         sync.Mutex
+	deliveries []Delivery
+	gone       map[string]bool
+}
+
+func NewRecordingProvider() *RecordingProvider {
+	return &RecordingProvider{gone: make(map[string]bool)}
+}
+
+func (p *RecordingProvider) Normalize(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("push token is required")
+	}
+	return token, nil
+}
+
+func (p *RecordingProvider) Send(token string, message Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gone[token] {
+		return ErrTokenGone
+	}
+	p.deliveries = append(p.deliveries, Delivery{Token: token, Message: message})
+	return nil
+}
+
+// Forget makes later sends to token fail with ErrTokenGone, as when a user
+// uninstalls the app.
+func (p *RecordingProvider) Forget(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gone[token] = true
+}
+
+// Deliveries returns the pushes accepted so far, oldest first.
+func (p *RecordingProvider) Deliveries() []Delivery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Delivery(nil), p.deliveries...)
+}
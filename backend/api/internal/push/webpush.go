@@ -0,0 +1,275 @@
+package push
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/netguard"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// webPushRecordSize is the aes128gcm record size advertised in the header.
+// Payloads fit in one record, so it only has to exceed the message.
+const webPushRecordSize = 4096
+
+// maxWebPushPayload is the largest plaintext push services must accept.
+const maxWebPushPayload = 3993
+
+// WebPushSubscription is a browser PushSubscription as serialized by
+// PushSubscription.toJSON(). Its JSON is the stored token.
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// WebPushProvider sends standard Web Push messages: payloads are encrypted
+// for the subscriber (RFC 8291) and requests are signed with the
+// application server's VAPID key (RFC 8292).
+type WebPushProvider struct {
+	// Client refuses loopback and private addresses, as subscriptions come
+	// from browsers, unless AllowPrivate is set.
+	Client *http.Client
+	// TTL is how long the push service keeps a message for an offline
+	// browser.
+	TTL time.Duration
+	// AllowPrivate lets subscriptions point at loopback and private
+	// addresses, for tests and push services on the local network.
+	AllowPrivate bool
+
+	subject    string
+	privateKey *ecdsa.PrivateKey
+	publicKey  string
+}
+
+// NewWebPushProvider takes the VAPID private key as the base64url encoded
+// 32-byte scalar that web-push tooling generates, and a contact subject such
+// as "mailto:ops@devbits.app".
+func NewWebPushProvider(privateKey string, subject string) (*WebPushProvider, error) {
+	raw, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	subject = strings.TrimSpace(subject)
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, fmt.Errorf("VAPID subject must be a mailto: or https: URL")
+	}
+
+	public := key.PublicKey().Bytes()
+	provider := &WebPushProvider{
+		TTL:     24 * time.Hour,
+		subject: subject,
+		privateKey: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(public[1:33]),
+				Y:     new(big.Int).SetBytes(public[33:]),
+			},
+			D: new(big.Int).SetBytes(raw),
+		},
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+	}
+	provider.Client = netguard.NewClient(4*time.Second, func() bool { return provider.AllowPrivate })
+	return provider, nil
+}
+
+// PublicKey is the applicationServerKey browsers subscribe with.
+func (p *WebPushProvider) PublicKey() string {
+	return p.publicKey
+}
+
+func (p *WebPushProvider) Normalize(token string) (string, error) {
+	subscription, err := parseWebPushSubscription(token, p.AllowPrivate)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := json.Marshal(subscription)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// parseWebPushSubscription reads a stored subscription. Unless allowPrivate,
+// endpoints naming a loopback or private host are refused.
+func parseWebPushSubscription(token string, allowPrivate bool) (*WebPushSubscription, error) {
+	var subscription WebPushSubscription
+	if err := json.Unmarshal([]byte(token), &subscription); err != nil {
+		return nil, fmt.Errorf("not a push subscription: %w", err)
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("push subscription endpoint must be an https URL")
+	}
+	if err := netguard.CheckURL(subscription.Endpoint, allowPrivate); err != nil {
+		return nil, fmt.Errorf("push subscription endpoint must be public")
+	}
+	if key, err := decodeBase64URL(subscription.Keys.P256dh); err != nil || len(key) != 65 {
+		return nil, fmt.Errorf("push subscription p256dh key is invalid")
+	}
+	if secret, err := decodeBase64URL(subscription.Keys.Auth); err != nil || len(secret) != 16 {
+		return nil, fmt.Errorf("push subscription auth secret is invalid")
+	}
+	return &subscription, nil
+}
+
+func (p *WebPushProvider) Send(token string, message Message) error {
+	subscription, err := parseWebPushSubscription(token, p.AllowPrivate)
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(plaintext) > maxWebPushPayload {
+		return fmt.Errorf("web push payload is %d bytes, limit is %d", len(plaintext), maxWebPushPayload)
+	}
+
+	body, err := encryptWebPush(subscription, plaintext)
+	if err != nil {
+		return err
+	}
+	authorization, err := p.vapidAuthorization(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", strconv.Itoa(int(p.TTL.Seconds())))
+	request.Header.Set("Authorization", authorization)
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("web push failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return ErrTokenGone
+	case response.StatusCode == http.StatusTooManyRequests:
+		return rateLimited(response.Header.Get("Retry-After"))
+	case response.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("web push rejected with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// vapidAuthorization signs a short-lived token for the endpoint's origin.
+func (p *WebPushProvider) vapidAuthorization(endpoint string) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.MapClaims{
+		"aud": parsed.Scheme + "://" + parsed.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.subject,
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(p.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign VAPID token: %w", err)
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, p.publicKey), nil
+}
+
+// encryptWebPush encrypts plaintext as a single aes128gcm record keyed for
+// the subscription, per RFC 8291 section 3.
+func encryptWebPush(subscription *WebPushSubscription, plaintext []byte) ([]byte, error) {
+	subscriberKey, _ := decodeBase64URL(subscription.Keys.P256dh)
+	authSecret, _ := decodeBase64URL(subscription.Keys.Auth)
+
+	subscriberPublic, err := ecdh.P256().NewPublicKey(subscriberKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscriber key: %w", err)
+	}
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := local.ECDH(subscriberPublic)
+	if err != nil {
+		return nil, err
+	}
+	localPublic := local.PublicKey().Bytes()
+
+	keyPRK, err := hkdf.Extract(sha256.New, sharedSecret, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(subscriberKey) + string(localPublic)
+	ikm, err := hkdf.Expand(sha256.New, keyPRK, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The 0x02 delimiter marks the last (here, only) record.
+	record := append(append([]byte{}, plaintext...), 0x02)
+
+	header := make([]byte, 0, 16+4+1+len(localPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(localPublic)))
+	header = append(header, localPublic...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+}
@@ -0,0 +1,69 @@
+// Package realtime carries websocket events between API instances.
+//
+// Each instance's hub publishes every event to a Broker and delivers to its
+// local sockets only what the Broker hands back, so one node and many behave
+// the same way.
+package realtime
+
+import (
+	"sync"
+)
+
+// Handler receives every event published on any node. Topics are normalized
+// usernames.
+type Handler func(topic string, payload []byte)
+
+type Broker interface {
+	Publish(topic string, payload []byte) error
+	// Subscribe registers handler and returns a function that removes it.
+	Subscribe(handler Handler) (func(), error)
+	Close() error
+}
+
+// MemoryBroker delivers events synchronously within the process. It is the
+// default for single-instance deployments; several hubs subscribed to one
+// MemoryBroker behave like separate nodes sharing a bus.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[int]Handler
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{handlers: make(map[int]Handler)}
+}
+
+func (b *MemoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler Handler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = make(map[int]Handler)
+	return nil
+}
@@ -0,0 +1,192 @@
+package realtime
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"backend/api/internal/logger"
+
+	"github.com/lib/pq"
+)
+
+// PostgresChannel is the LISTEN/NOTIFY channel shared by every API instance.
+const PostgresChannel = "devbits_realtime"
+
+// NOTIFY payloads are capped at 8000 bytes. Larger events are written to
+// realtimepayloads and the notification carries only the row id.
+const maxNotifyPayload = 7900
+
+// Spilled payloads only need to outlive delivery to the other nodes.
+const spilledPayloadTTL = 5 * time.Minute
+
+type postgresEnvelope struct {
+	Topic   string `json:"t,omitempty"`
+	Payload string `json:"p,omitempty"`
+	Ref     int64  `json:"r,omitempty"`
+}
+
+// PostgresBroker fans events out through Postgres LISTEN/NOTIFY so every
+// instance connected to the same database sees them. Notifications are
+// delivered to the publishing instance too; that is its only delivery path.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[int]Handler
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPostgresBroker publishes through db and listens on a dedicated
+// connection opened from dsn.
+func NewPostgresBroker(db *sql.DB, dsn string) (*PostgresBroker, error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Log.WithFields(map[string]interface{}{
+				"event": event,
+				"err":   err.Error(),
+			}).Warn("Realtime listener connection problem")
+		}
+	})
+	if err := listener.Listen(PostgresChannel); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", PostgresChannel, err)
+	}
+
+	broker := &PostgresBroker{
+		db:       db,
+		listener: listener,
+		handlers: make(map[int]Handler),
+		done:     make(chan struct{}),
+	}
+	go broker.run()
+	return broker, nil
+}
+
+func (b *PostgresBroker) Publish(topic string, payload []byte) error {
+	encoded, err := json.Marshal(postgresEnvelope{Topic: topic, Payload: string(payload)})
+	if err != nil {
+		return fmt.Errorf("failed to encode realtime event: %w", err)
+	}
+
+	if len(encoded) > maxNotifyPayload {
+		var ref int64
+		err := b.db.QueryRow(
+			`INSERT INTO realtimepayloads (topic, payload, created_at) VALUES ($1, $2, $3) RETURNING id;`,
+			topic,
+			string(payload),
+			time.Now().UTC(),
+		).Scan(&ref)
+		if err != nil {
+			return fmt.Errorf("failed to store realtime payload: %w", err)
+		}
+		encoded, err = json.Marshal(postgresEnvelope{Ref: ref})
+		if err != nil {
+			return fmt.Errorf("failed to encode realtime event: %w", err)
+		}
+	}
+
+	if _, err := b.db.Exec(`SELECT pg_notify($1, $2);`, PostgresChannel, string(encoded)); err != nil {
+		return fmt.Errorf("failed to notify realtime event: %w", err)
+	}
+	return nil
+}
+
+func (b *PostgresBroker) Subscribe(handler Handler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}, nil
+}
+
+func (b *PostgresBroker) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+	})
+	return err
+}
+
+func (b *PostgresBroker) run() {
+	pingTicker := time.NewTicker(90 * time.Second)
+	defer pingTicker.Stop()
+	cleanupTicker := time.NewTicker(spilledPayloadTTL)
+	defer cleanupTicker.Stop()
+
+	for {
+		select {
+		case notification, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			if notification == nil {
+				// The listener reconnected; anything sent meanwhile is gone.
+				logger.Log.Warn("Realtime listener reconnected, events may have been missed")
+				continue
+			}
+			b.dispatch(notification.Extra)
+		case <-pingTicker.C:
+			go func() {
+				_ = b.listener.Ping()
+			}()
+		case <-cleanupTicker.C:
+			cutoff := time.Now().UTC().Add(-spilledPayloadTTL)
+			if _, err := b.db.Exec(`DELETE FROM realtimepayloads WHERE created_at < $1;`, cutoff); err != nil {
+				logger.Log.WithFields(map[string]interface{}{
+					"err": err.Error(),
+				}).Warn("Failed to clean up realtime payloads")
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *PostgresBroker) dispatch(raw string) {
+	var envelope postgresEnvelope
+	if err := json.Unmarshal([]byte(raw), &envelope); err != nil {
+		logger.Log.WithFields(map[string]interface{}{
+			"err": err.Error(),
+		}).Warn("Dropping malformed realtime notification")
+		return
+	}
+
+	if envelope.Ref != 0 {
+		err := b.db.QueryRow(
+			`SELECT topic, payload FROM realtimepayloads WHERE id = $1;`,
+			envelope.Ref,
+		).Scan(&envelope.Topic, &envelope.Payload)
+		if err != nil {
+			logger.Log.WithFields(map[string]interface{}{
+				"ref": envelope.Ref,
+				"err": err.Error(),
+			}).Warn("Failed to load realtime payload")
+			return
+		}
+	}
+
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(envelope.Topic, []byte(envelope.Payload))
+	}
+}
@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+var block_tests = []TestCase{
+
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/blocks/backend_guru4",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"You cannot do that to yourself"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/blocks/nobody_here",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"User not found"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	// only the user themselves may block on their behalf
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/blocks/ui_designer5",
+		ExpectedStatus: http.StatusForbidden,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/blocks/ui_designer5",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Blocked ui_designer5"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// blocks apply in both directions
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/backend_guru4",
+		Input:          `{"content":"hello?","media":[]}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"You cannot message this user"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/backend_guru4/with/ui_designer5",
+		Input:          `{"content":"hello?","media":[]}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"You cannot message this user"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/ui_designer5/follow/backend_guru4",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"You cannot follow this user"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations",
+		Input:          `{"title":"Blocked","participants":["backend_guru4"]}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"You cannot add 'backend_guru4' to a conversation"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-project/4",
+		Input:          `{"user":5,"content":"Nice work"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"You cannot comment on this user's content"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/backend_guru4/blocks",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/users/backend_guru4/blocks/ui_designer5",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Unblocked ui_designer5"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/users/backend_guru4/blocks/ui_designer5",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"ui_designer5 is not blocked"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/backend_guru4/blocks",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"blocks":[],"message":"Successfully got blocked users"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// muting only hides content, so it does not stop follows
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/mutes/ui_designer5",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Muted ui_designer5"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/ui_designer5/follow/backend_guru4",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"ui_designer5 now follows backend_guru4"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/ui_designer5/unfollow/backend_guru4",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"ui_designer5 unfollowed backend_guru4"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/users/backend_guru4/mutes/ui_designer5",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Unmuted ui_designer5"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/backend_guru4/mutes",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Successfully got muted users","mutes":[]}`,
+		AuthAs:         "backend_guru4:4",
+	},
+}
+
+func TestBlockedAndMutedUsersHidden(t *testing.T) {
+	server := newTestServer(t)
+
+	type user struct {
+		Username string `json:"username"`
+	}
+	type post struct {
+		User int64 `json:"user"`
+	}
+	search := func(query string, authAs string) []string {
+		t.Helper()
+		var users []user
+		step := TestCase{Method: http.MethodGet, Endpoint: "/users/search?" + query, ExpectedStatus: http.StatusOK, AuthAs: authAs}
+		step.Fetch(t, server.URL, &users)
+		usernames := make([]string, 0, len(users))
+		for _, found := range users {
+			usernames = append(usernames, found.Username)
+		}
+		return usernames
+	}
+	feedAuthors := func(authAs string) []int64 {
+		t.Helper()
+		var posts []post
+		step := TestCase{Method: http.MethodGet, Endpoint: "/feed/posts?type=recent&start=0&count=50", ExpectedStatus: http.StatusOK, AuthAs: authAs}
+		step.Fetch(t, server.URL, &posts)
+		authors := make([]int64, 0, len(posts))
+		for _, found := range posts {
+			authors = append(authors, found.User)
+		}
+		return authors
+	}
+	send := func(method string, endpoint string) {
+		t.Helper()
+		step := TestCase{Method: method, Endpoint: endpoint, ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"}
+		step.Fetch(t, server.URL, nil)
+	}
+
+	if !slices.Contains(feedAuthors("backend_guru4:4"), 3) {
+		t.Fatalf("Expected data_scientist3's posts in the feed before blocking")
+	}
+	if got := search("q=d&count=1", "backend_guru4:4"); !slices.Equal(got, []string{"data_scientist3"}) {
+		t.Fatalf("Expected data_scientist3 to lead the search before blocking, got %v", got)
+	}
+
+	send(http.MethodPost, "/users/backend_guru4/blocks/data_scientist3")
+
+	if slices.Contains(feedAuthors("backend_guru4:4"), 3) {
+		t.Fatalf("Expected a blocked user's posts to leave the feed")
+	}
+	// The limit applies after blocked users are left out, so a blocked match
+	// does not use up the page.
+	if got := search("q=d&count=1", "backend_guru4:4"); !slices.Equal(got, []string{"dev_user1"}) {
+		t.Fatalf("Expected the next match in place of the blocked user, got %v", got)
+	}
+	if got := search("q=backend", "data_scientist3:3"); len(got) != 0 {
+		t.Fatalf("Expected the blocker to be hidden from the blocked user's search, got %v", got)
+	}
+	if got := search("q=data", ""); !slices.Contains(got, "data_scientist3") {
+		t.Fatalf("Expected anonymous searches to be unaffected, got %v", got)
+	}
+
+	send(http.MethodDelete, "/users/backend_guru4/blocks/data_scientist3")
+	send(http.MethodPost, "/users/backend_guru4/mutes/data_scientist3")
+
+	// Muting hides content but not the account.
+	if slices.Contains(feedAuthors("backend_guru4:4"), 3) {
+		t.Fatalf("Expected a muted user's posts to leave the feed")
+	}
+	if got := search("q=data", "backend_guru4:4"); !slices.Contains(got, "data_scientist3") {
+		t.Fatalf("Expected a muted user to stay searchable, got %v", got)
+	}
+}
@@ -0,0 +1,368 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"backend/api/internal/database"
+)
+
+var bot_tests = []TestCase{
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/dev_user1/bots",
+		Input:          `{"username":"tech_writer2"}`,
+		ExpectedStatus: http.StatusConflict,
+		ExpectedBody:   `{"error":"Conflict","message":"Username already taken"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/bots/tech_writer2/tokens",
+		Input:          `{"name":"CI","scopes":["posts:write"]}`,
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Bot not found"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/3/bots",
+		Input:          `{"username":"ml_ci"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the owner can manage bots"}`,
+		AuthAs:         "dev_user1:1",
+	},
+}
+
+// botAuth signs a request in with a bot token.
+func botAuth(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// createBotToken makes a token for bot as authAs and returns it.
+func createBotToken(t *testing.T, serverURL string, bot string, scopes string, authAs string) (string, int64) {
+	t.Helper()
+
+	var created struct {
+		Token  database.BotToken `json:"token"`
+		Secret string            `json:"secret"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/bots/" + bot + "/tokens",
+		Input:          `{"name":"CI","scopes":` + scopes + `}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         authAs,
+	}.Fetch(t, serverURL, &created)
+	if !strings.HasPrefix(created.Secret, "dbb_") || !strings.HasPrefix(created.Secret, created.Token.Prefix) {
+		t.Fatalf("Unexpected bot token %+v", created)
+	}
+	return created.Secret, created.Token.ID
+}
+
+func TestBotAccounts(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/dev_user1/bots",
+			Input:          `{"username":"release_bot"}`,
+			ExpectedStatus: http.StatusForbidden,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/dev_user1/bots",
+			Input:          `{"username":"release bot!"}`,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"Bot usernames must be 3 to 50 letters, digits or underscores"}`,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/dev_user1/bots",
+			Input:          `{"username":"release_bot","bio":"Announces releases."}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/auth/login",
+			Input:          `{"username":"release_bot","password":"anything"}`,
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   `{"error":"Unauthorized","message":"Invalid credentials"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/bots/release_bot/tokens",
+			Input:          `{"name":"CI","scopes":["posts:write"]}`,
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Only the bot's owner can manage it"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/bots/release_bot/tokens",
+			Input:          `{"name":"CI","scopes":["admin"]}`,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"Unknown token scope 'admin'"}`,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	// Bots are marked as such, along with who runs them.
+	var bot database.ApiUser
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/release_bot",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &bot)
+	if !bot.IsBot || bot.BotOwner == nil || bot.BotOwner.Username != "dev_user1" || bot.BotOwner.ProjectID != 0 {
+		t.Fatalf("Expected release_bot to be marked as dev_user1's bot, got %+v", bot)
+	}
+	var person database.ApiUser
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/dev_user1",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &person)
+	if person.IsBot || person.BotOwner != nil {
+		t.Fatalf("Expected dev_user1 not to be a bot, got %+v", person)
+	}
+
+	token, tokenID := createBotToken(t, server.URL, "release_bot", `["posts:write"]`, "dev_user1:1")
+	var me map[string]interface{}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/auth/me",
+		ExpectedStatus: http.StatusOK,
+		Headers:        botAuth(token),
+	}.Fetch(t, server.URL, &me)
+	if me["username"] != "release_bot" || me["is_bot"] != true {
+		t.Fatalf("Expected the token to sign in as release_bot, got %v", me)
+	}
+
+	post := fmt.Sprintf(`{"user":%d,"project":1,"content":"v1.2.0 is out"}`, bot.Id)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          post,
+		ExpectedStatus: http.StatusForbidden,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPut,
+			Endpoint:       "/bots/release_bot/projects/1",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Only the owner can grant bots access"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPut,
+			Endpoint:       "/bots/release_bot/projects/1",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"release_bot can now post to OpenAPI Toolkit"}`,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/1/builders/release_bot",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"Bots cannot be builders. Grant the bot access to the project instead"}`,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	// Granted projects take bot posts; others still refuse them.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          post,
+		ExpectedStatus: http.StatusCreated,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+	var posts []database.Post
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       fmt.Sprintf("/posts/by-user/%d", bot.Id),
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &posts)
+	if len(posts) != 1 || posts[0].Content != "v1.2.0 is out" || posts[0].Project != 1 {
+		t.Fatalf("Expected release_bot's post in project 1, got %+v", posts)
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          fmt.Sprintf(`{"user":%d,"project":2,"content":"wrong stream"}`, bot.Id),
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"This bot has not been granted access to this stream"}`,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+
+	// Tokens only reach the routes their scopes cover.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-post/1",
+		Input:          fmt.Sprintf(`{"user":%d,"content":"Shipped","parent_comment":null}`, bot.Id),
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Token is missing the 'comments:write' scope"}`,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Bot tokens cannot use this endpoint"}`,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/release_bot/bots",
+		Input:          `{"username":"nested_bot"}`,
+		ExpectedStatus: http.StatusForbidden,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+
+	var tokens struct {
+		Tokens []database.BotToken `json:"tokens"`
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/bots/release_bot/tokens",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &tokens)
+	if len(tokens.Tokens) != 1 || tokens.Tokens[0].LastUsedAt == nil {
+		t.Fatalf("Expected one used token, got %+v", tokens.Tokens)
+	}
+
+	// Revoked tokens stop working at once.
+	TestCase{
+		Method:         http.MethodDelete,
+		Endpoint:       fmt.Sprintf("/bots/release_bot/tokens/%d", tokenID),
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, nil)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/auth/me",
+		ExpectedStatus: http.StatusUnauthorized,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+
+	var grants struct {
+		Projects []database.BotProjectGrant `json:"projects"`
+	}
+	TestCase{
+		Method:         http.MethodDelete,
+		Endpoint:       "/bots/release_bot/projects/1",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, nil)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/bots/release_bot",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &grants)
+	if len(grants.Projects) != 0 {
+		t.Fatalf("Expected no grants after revoking, got %+v", grants.Projects)
+	}
+}
+
+func TestProjectOwnedBots(t *testing.T) {
+	server := newTestServer(t)
+
+	var created struct {
+		Bot database.ApiUser `json:"bot"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/3/bots",
+		Input:          `{"username":"ml_ci","bio":"Training runs"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "data_scientist3:3",
+	}.Fetch(t, server.URL, &created)
+	if !created.Bot.IsBot || created.Bot.BotOwner == nil || created.Bot.BotOwner.ProjectID != 3 || created.Bot.BotOwner.ProjectName != "ML Research" {
+		t.Fatalf("Expected ml_ci to be owned by project 3, got %+v", created.Bot)
+	}
+
+	var listed struct {
+		Bots []database.ApiUser `json:"bots"`
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/projects/3/bots",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &listed)
+	if len(listed.Bots) != 1 || listed.Bots[0].Username != "ml_ci" || !listed.Bots[0].IsBot {
+		t.Fatalf("Expected project 3 to list ml_ci, got %+v", listed.Bots)
+	}
+
+	// The project's own bot needs no grant there.
+	token, _ := createBotToken(t, server.URL, "ml_ci", `["posts:write","comments:write"]`, "data_scientist3:3")
+	botID := created.Bot.Id
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          fmt.Sprintf(`{"user":%d,"project":3,"content":"Run 42 finished"}`, botID),
+		ExpectedStatus: http.StatusCreated,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-post/3",
+		Input:          fmt.Sprintf(`{"user":%d,"content":"Accuracy 0.93","parent_comment":null}`, botID),
+		ExpectedStatus: http.StatusCreated,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-post/1",
+		Input:          fmt.Sprintf(`{"user":%d,"content":"Off topic","parent_comment":null}`, botID),
+		ExpectedStatus: http.StatusForbidden,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       "/bots/ml_ci",
+		Input:          `{"bio":"Nightly training runs"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Fetch(t, server.URL, nil)
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       "/bots/ml_ci",
+		Input:          `{"bio":"hijacked"}`,
+		ExpectedStatus: http.StatusForbidden,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+
+	// Bots go with the project that owns them.
+	TestCase{
+		Method:         http.MethodDelete,
+		Endpoint:       "/projects/3",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Fetch(t, server.URL, nil)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/ml_ci",
+		ExpectedStatus: http.StatusNotFound,
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/auth/me",
+		ExpectedStatus: http.StatusUnauthorized,
+		Headers:        botAuth(token),
+	}.Run(t, server.URL)
+}
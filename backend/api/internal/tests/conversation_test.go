@@ -0,0 +1,280 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var conversation_tests = []TestCase{
+
+	// a group needs someone besides the creator
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations",
+		Input:          `{"title":"Team","participants":["dev_user1"]}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"A conversation needs at least one other participant"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations",
+		Input:          `{"title":"Team","participants":["nobody_here"]}`,
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"User 'nobody_here' not found"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations",
+		Input:          `{"title":"Team","participants":["data_scientist3"]}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	},
+
+	// outsiders cannot see the conversation at all
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/conversations/1",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/messages",
+		Input:          `{"content":"hi all","media":[]}`,
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/messages",
+		Input:          `{"content":"hi all","media":[]}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "data_scientist3:3",
+	},
+
+	// the sender has read their own message, the owner has not
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/conversations/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"unread_count":0}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/conversations/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"unread_count":1}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/read",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"last_read_message_id":1,"message":"Conversation marked read"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/conversations/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"unread_count":0}`,
+		AuthAs:         "dev_user1:1",
+	},
+
+	// only owners and admins manage the conversation
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/conversations/1",
+		Input:          `{"title":"Renamed"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only conversation admins can change the title"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/conversations/1",
+		Input:          `{"title":"Renamed"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/participants",
+		Input:          `{"username":"ui_designer5"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only conversation admins can add participants"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/participants",
+		Input:          `{"username":"ui_designer5"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/participants",
+		Input:          `{"username":"ui_designer5"}`,
+		ExpectedStatus: http.StatusConflict,
+		ExpectedBody:   `{"error":"Conflict","message":"User is already a participant"}`,
+		AuthAs:         "dev_user1:1",
+	},
+
+	// admins add members, but only the owner hands out admin
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/conversations/1/participants/data_scientist3",
+		Input:          `{"role":"admin"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/participants",
+		Input:          `{"username":"tech_writer2","role":"admin"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the conversation owner can add admins"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/conversations/1/participants/dev_user1",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"The conversation owner cannot be removed"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+
+	// ad-hoc groups are invite-only
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/join",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	// project chats are for the project's team
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/projects/4/conversation",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the project's builders can use its chat"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/projects/4/conversation",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "backend_guru4:4",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/2/join",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+
+	// the longest-standing participant inherits ownership
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/conversations/1/leave",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Left conversation"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/conversations/1",
+		Input:          `{"title":"Still here"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/conversations/1/messages",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+		AuthAs:         "dev_user1:1",
+	},
+}
+
+func TestProjectConversationMembership(t *testing.T) {
+	server := newTestServer(t)
+
+	type conversationResponse struct {
+		Conversation struct {
+			ID           int64 `json:"id"`
+			Participants []struct {
+				Username string `json:"username"`
+				Role     string `json:"role"`
+			} `json:"participants"`
+		} `json:"conversation"`
+	}
+	openChat := func(authAs string) conversationResponse {
+		t.Helper()
+		var response conversationResponse
+		step := TestCase{Method: http.MethodGet, Endpoint: "/projects/4/conversation", ExpectedStatus: http.StatusOK, AuthAs: authAs}
+		step.Fetch(t, server.URL, &response)
+		return response
+	}
+	roles := func(response conversationResponse) string {
+		parts := make([]string, 0, len(response.Conversation.Participants))
+		for _, participant := range response.Conversation.Participants {
+			parts = append(parts, participant.Username+":"+participant.Role)
+		}
+		return strings.Join(parts, ",")
+	}
+
+	for _, step := range []TestCase{
+		{Method: http.MethodPost, Endpoint: "/projects/4/builders/data_scientist3", ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"},
+		{Method: http.MethodPost, Endpoint: "/projects/4/builders/tech_writer2", ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"},
+	} {
+		step.Fetch(t, server.URL, nil)
+	}
+	chat := openChat("backend_guru4:4")
+	if got := roles(chat); got != "backend_guru4:owner,data_scientist3:member,tech_writer2:member" {
+		t.Fatalf("Unexpected project chat members %s", got)
+	}
+	chatPath := fmt.Sprintf("/conversations/%d", chat.Conversation.ID)
+
+	for _, step := range []TestCase{
+		// a removed builder is taken out of the project chat
+		{Method: http.MethodDelete, Endpoint: "/projects/4/builders/tech_writer2", ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       chatPath,
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"Not Found","message":"Conversation not found"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		// the owner leaving hands the chat to the next member
+		{Method: http.MethodPost, Endpoint: chatPath + "/leave", ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"},
+	} {
+		step.Fetch(t, server.URL, nil)
+	}
+
+	var current conversationResponse
+	step := TestCase{Method: http.MethodGet, Endpoint: chatPath, ExpectedStatus: http.StatusOK, AuthAs: "data_scientist3:3"}
+	step.Fetch(t, server.URL, &current)
+	if got := roles(current); got != "data_scientist3:owner" {
+		t.Fatalf("Expected data_scientist3 to own the chat, got %s", got)
+	}
+
+	// once nobody is left the chat is closed and the team starts a new one
+	step = TestCase{Method: http.MethodPost, Endpoint: chatPath + "/leave", ExpectedStatus: http.StatusOK, AuthAs: "data_scientist3:3"}
+	step.Fetch(t, server.URL, nil)
+	reopened := openChat("backend_guru4:4")
+	if reopened.Conversation.ID == chat.Conversation.ID || roles(reopened) != "backend_guru4:owner,data_scientist3:member" {
+		t.Fatalf("Expected a fresh project chat, got %d with %s", reopened.Conversation.ID, roles(reopened))
+	}
+}
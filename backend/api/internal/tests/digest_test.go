@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/handlers"
+	"backend/api/internal/mail"
+)
+
+var digest_tests = []TestCase{
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"digest":{"frequency":"daily"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"An email address is required for digests"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"digest":{"frequency":"hourly","email":"writer@example.com"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Digest frequency must be off, daily or weekly"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"digest":{"frequency":"daily","email":"not an address"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid digest email address"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+}
+
+func TestEmailDigest(t *testing.T) {
+	server := newTestServer(t)
+	mailDir := t.TempDir()
+	fileMailer, err := mail.NewFileMailer(mailDir, "DevBits <no-reply@devbits.app>")
+	if err != nil {
+		t.Fatalf("Failed to create mailer: %v", err)
+	}
+	handlers.UseMailer(fileMailer)
+	t.Cleanup(func() { handlers.UseMailer(nil) })
+	t.Setenv("DEVBITS_PUBLIC_URL", "https://devbits.test")
+
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"digest":{"frequency":"Daily","email":" writer@example.com "},"types":{"like_project":{"email":false}}}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+
+	settings, err := database.GetDigestSettings(2)
+	if err != nil {
+		t.Fatalf("Failed to get digest settings: %v", err)
+	}
+	if settings.Frequency != database.DigestDaily || settings.Email != nil ||
+		settings.PendingEmail == nil || *settings.PendingEmail != "writer@example.com" {
+		t.Fatalf("Expected the address to wait for confirmation, got %+v", settings)
+	}
+
+	// A new address is mailed a signed link to confirm it.
+	confirmation, text, _ := readDigest(t, expectDigestCount(t, mailDir, 1)[0])
+	if confirmation.Header.Get("To") != "writer@example.com" || confirmation.Header.Get("Subject") != "Confirm your DevBits digest address" {
+		t.Fatalf("Unexpected confirmation headers: %+v", confirmation.Header)
+	}
+	confirm := text[strings.Index(text, "https://devbits.test/notifications/digest/confirm?"):]
+	confirm = strings.TrimPrefix(strings.Fields(confirm)[0], "https://devbits.test")
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/dev_user1/follow/tech_writer2",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/posts/data_scientist3/likes/2",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/user/data_scientist3/likes/2",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/backend_guru4/with/tech_writer2",
+			Input:          `{"content":"are you free to review <my> PR?","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "backend_guru4:4",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/backend_guru4/with/tech_writer2",
+			Input:          `{"content":"it is small","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "backend_guru4:4",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	// Nothing goes to an address before it is confirmed.
+	now := time.Now().Add(time.Minute)
+	handlers.SendEmailDigests(now)
+	expectDigestCount(t, mailDir, 1)
+
+	// Following the link only asks for confirmation, like unsubscribing.
+	response, err := http.Get(server.URL + confirm)
+	if err != nil {
+		t.Fatalf("Failed to open confirmation link: %v", err)
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(page), `<form method="post"`) {
+		t.Fatalf("Expected a confirmation page, got %d:\n%s", response.StatusCode, page)
+	}
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       strings.Replace(confirm, "writer%40example.com", "someone%40example.com", 1),
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Invalid confirmation link"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       confirm,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Digest email address confirmed"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       confirm,
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"Not Found","message":"No digest address is waiting for this confirmation"}`,
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	settings, err = database.GetDigestSettings(2)
+	if err != nil {
+		t.Fatalf("Failed to get digest settings: %v", err)
+	}
+	if settings.Email == nil || *settings.Email != "writer@example.com" || settings.PendingEmail != nil {
+		t.Fatalf("Expected the address to be confirmed, got %+v", settings)
+	}
+
+	// The first digest covers the last day.
+	handlers.SendEmailDigests(now)
+	digests := expectDigestCount(t, mailDir, 2)
+	message, text, html := readDigest(t, digests[1])
+
+	if message.Header.Get("To") != "writer@example.com" || message.Header.Get("Subject") != "Your DevBits daily digest" {
+		t.Fatalf("Unexpected digest headers: %+v", message.Header)
+	}
+	if message.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Fatalf("Expected a one-click unsubscribe header, got %+v", message.Header)
+	}
+	for _, want := range []string{
+		"Hi tech_writer2,",
+		"- dev_user1 followed you\n  https://devbits.test/user/dev_user1",
+		"- data_scientist3 liked your byte\n  https://devbits.test/post/2",
+		`- backend_guru4 sent you 2 messages: "it is small"`,
+		"https://devbits.test/conversation/backend_guru4",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("Expected the text digest to contain %q, got:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "liked your stream") {
+		t.Fatalf("Expected types with email off to be left out, got:\n%s", text)
+	}
+	if !strings.Contains(html, `<a href="https://devbits.test/post/2"`) || !strings.Contains(html, "data_scientist3 liked your byte") {
+		t.Fatalf("Unexpected HTML digest:\n%s", html)
+	}
+
+	// A digest goes out once a day, and only with something new in it.
+	handlers.SendEmailDigests(now.Add(time.Hour))
+	expectDigestCount(t, mailDir, 2)
+	handlers.SendEmailDigests(now.Add(25 * time.Hour))
+	expectDigestCount(t, mailDir, 2)
+
+	unsubscribe := strings.Trim(message.Header.Get("List-Unsubscribe"), "<>")
+	if !strings.HasPrefix(unsubscribe, "https://devbits.test/notifications/digest/unsubscribe?") {
+		t.Fatalf("Unexpected unsubscribe link %q", unsubscribe)
+	}
+	unsubscribe = strings.TrimPrefix(unsubscribe, "https://devbits.test")
+
+	// Following the link only asks for confirmation.
+	response, err = http.Get(server.URL + unsubscribe)
+	if err != nil {
+		t.Fatalf("Failed to open unsubscribe link: %v", err)
+	}
+	page, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(string(page), `<form method="post"`) {
+		t.Fatalf("Expected a confirmation page, got %d:\n%s", response.StatusCode, page)
+	}
+	settings, err = database.GetDigestSettings(2)
+	if err != nil {
+		t.Fatalf("Failed to get digest settings: %v", err)
+	}
+	if settings.Frequency == database.DigestOff {
+		t.Fatalf("Expected opening the unsubscribe link to leave the digest on")
+	}
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications/digest/unsubscribe?user=3&" + strings.SplitN(unsubscribe, "&", 2)[1],
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Invalid unsubscribe link"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/notifications/digest/unsubscribe?user=3&" + strings.SplitN(unsubscribe, "&", 2)[1],
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Invalid unsubscribe link"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       unsubscribe,
+			Input:          "List-Unsubscribe=One-Click",
+			Headers:        map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Unsubscribed from email digests"}`,
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	settings, err = database.GetDigestSettings(2)
+	if err != nil {
+		t.Fatalf("Failed to get digest settings: %v", err)
+	}
+	if settings.Frequency != database.DigestOff {
+		t.Fatalf("Expected the digest to be off after unsubscribing, got %+v", settings)
+	}
+}
+
+func expectDigestCount(t *testing.T, dir string, count int) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatalf("Failed to list mail: %v", err)
+	}
+	if len(files) != count {
+		t.Fatalf("Expected %d emails, got %d", count, len(files))
+	}
+	return files
+}
+
+// readDigest parses an email written by the file mailer and returns its text
+// and HTML bodies.
+func readDigest(t *testing.T, path string) (*netmail.Message, string, string) {
+	t.Helper()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read mail: %v", err)
+	}
+	message, err := netmail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("Failed to parse mail: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected a multipart/alternative email, got %q", message.Header.Get("Content-Type"))
+	}
+
+	bodies := map[string]string{}
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read mail part: %v", err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatalf("Failed to decode mail part: %v", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		bodies[partType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+	}
+	return message, bodies["text/plain"], bodies["text/html"]
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"net/http"
+)
+
+var direct_message_tests = []TestCase{
+
+	// the replay point must be a stream cursor or message id
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/tech_writer2/stream?since=-1",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"since must be a stream cursor or message id"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/tech_writer2/stream?since=4.2",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"since must be a stream cursor or message id"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	// the event stream fallback uses the same checks
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/tech_writer2/events",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Forbidden"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// no conversations yet
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/ui_designer5/threads",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Successfully got message threads","threads":[]}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// a message needs text or media
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+		Input:          `{"content":"  ","media":[]}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Message content cannot be empty"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// media goes through the regular ingest checks
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+		Input:          `{"content":"look","media":["ftp://example.com/shot.png"]}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid media reference"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// private media must belong to the sender
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+		Input:          `{"content":"look","media":["/media/private/u2_abcdef.png"]}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid media reference"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+		Input:          `{"content":"hello","media":[]}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// the recipient now has one unread message
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/tech_writer2/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"unread_count":1}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/tech_writer2/with/ui_designer5/read",
+		Input:          `{"up_to_id":-1}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"up_to_id must be >= 0"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/tech_writer2/with/ui_designer5/read",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Messages marked read","updated":1}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/tech_writer2/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"unread_count":0}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	// marking again is a no-op
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/tech_writer2/with/ui_designer5/read",
+		Input:          `{"up_to_id":1000}`,
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Messages marked read","updated":0}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	// chat peers carry presence; nobody is connected to the stream in tests
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/messages/ui_designer5/peers",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Successfully got chat peers","peers":["tech_writer2"],"presence":[{"username":"tech_writer2","online":false,"last_seen_at":null}]}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// only the sender may edit or delete a message
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/messages/tech_writer2/with/ui_designer5/1",
+		Input:          `{"content":"not mine"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the sender can change this message"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2/1",
+		Input:          `{"content":"hello again"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2/1",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// deleted messages stay as tombstones and can't be changed again
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2/1",
+		Input:          `{"content":"resurrect"}`,
+		ExpectedStatus: http.StatusGone,
+		ExpectedBody:   `{"error":"Gone","message":"Direct message was deleted"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+
+	// messages outside the conversation are not found
+	{
+		Method:         http.MethodDelete,
+		Endpoint:       "/messages/ui_designer5/with/dev_user1/1",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Direct message not found"}`,
+		AuthAs:         "ui_designer5:5",
+	},
+}
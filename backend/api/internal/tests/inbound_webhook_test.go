@@ -0,0 +1,320 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"backend/api/internal/database"
+	"backend/api/internal/webhooks"
+)
+
+const inboundTestSecret = "inbound-secret-12345"
+
+const gitHubPushPayload = `{
+	"ref": "refs/heads/main",
+	"compare": "https://github.com/devbits/toolkit/compare/abc...def",
+	"pusher": {"name": "dev_user1"},
+	"repository": {"full_name": "devbits/toolkit", "html_url": "https://github.com/devbits/toolkit"},
+	"commits": [
+		{"id": "1111111aaaaaaa", "message": "Add schema loader\n\nLong description", "author": {"name": "Dev", "username": "dev_user1"}},
+		{"id": "2222222bbbbbbb", "message": "Fix tests", "author": {"name": "Tech Writer"}}
+	]
+}`
+
+const gitLabReleasePayload = `{
+	"action": "create",
+	"tag": "v2.0.0",
+	"name": "Toolkit 2.0",
+	"description": "Faster validation.",
+	"url": "https://gitlab.com/devbits/toolkit/-/releases/v2.0.0",
+	"project": {"path_with_namespace": "devbits/toolkit", "web_url": "https://gitlab.com/devbits/toolkit"}
+}`
+
+var inbound_webhook_tests = []TestCase{
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the owner can manage webhooks"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI","templates":{"deploy":"{{.Text}}"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Unknown template kind 'deploy'"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI","templates":{"push":"{{.Branch}}"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI","posts_per_hour":0}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"posts_per_hour must be between 1 and 600"}`,
+		AuthAs:         "dev_user1:1",
+	},
+}
+
+// inboundCall is one request to an inbound webhook URL.
+type inboundCall struct {
+	Headers        map[string]string
+	Body           string
+	ExpectedStatus int
+}
+
+func callInboundWebhook(t *testing.T, url string, call inboundCall) map[string]interface{} {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(call.Body))
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range call.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to call inbound webhook: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != call.ExpectedStatus {
+		t.Fatalf("Expected status %d from the inbound webhook, got %d: %s", call.ExpectedStatus, response.StatusCode, body)
+	}
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("Failed to decode inbound webhook response %q: %v", body, err)
+	}
+	if call.ExpectedStatus == http.StatusTooManyRequests && response.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected a Retry-After header when rate limited")
+	}
+	return decoded
+}
+
+func TestInboundWebhooks(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv("DEVBITS_PUBLIC_URL", "https://devbits.test")
+
+	var created struct {
+		Webhook struct {
+			database.InboundWebhook
+			URL string `json:"url"`
+		} `json:"webhook"`
+		Secret string `json:"secret"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI","secret":"` + inboundTestSecret + `","posts_per_hour":3,"templates":{"generic":"Build {{.Payload.status}}: {{.Text}}"}}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &created)
+	if created.Secret != inboundTestSecret || created.Webhook.PostsPerHour != 3 || !strings.HasPrefix(created.Webhook.URL, "https://devbits.test/webhooks/inbound/") {
+		t.Fatalf("Unexpected created webhook: %+v", created)
+	}
+	hookURL := server.URL + strings.TrimPrefix(created.Webhook.URL, "https://devbits.test")
+	hookPath := fmt.Sprintf("/projects/1/inbound-webhooks/%d", created.Webhook.ID)
+
+	// Calls must prove they hold the secret.
+	callInboundWebhook(t, hookURL, inboundCall{Body: `{"text":"hi"}`, ExpectedStatus: http.StatusUnauthorized})
+	callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        map[string]string{webhooks.SignatureHeader: webhooks.Sign("some-other-secret", []byte(`{"text":"hi"}`))},
+		Body:           `{"text":"hi"}`,
+		ExpectedStatus: http.StatusUnauthorized,
+	})
+	callInboundWebhook(t, server.URL+"/webhooks/inbound/nope", inboundCall{Body: `{}`, ExpectedStatus: http.StatusNotFound})
+
+	pushHeaders := map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-GitHub-Delivery":   "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+		"X-Hub-Signature-256": webhooks.Sign(inboundTestSecret, []byte(gitHubPushPayload)),
+	}
+	pushed := callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        pushHeaders,
+		Body:           gitHubPushPayload,
+		ExpectedStatus: http.StatusCreated,
+	})
+	// GitHub redelivers with the same delivery id; that must not post twice.
+	redelivered := callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        pushHeaders,
+		Body:           gitHubPushPayload,
+		ExpectedStatus: http.StatusOK,
+	})
+	if redelivered["message"] != "Delivery already received" {
+		t.Fatalf("Expected the redelivery to be acknowledged, got %v", redelivered)
+	}
+	var post database.Post
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       fmt.Sprintf("/posts/%v", pushed["post_id"]),
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &post)
+	wantPush := "dev_user1 pushed 2 commits to main in devbits/toolkit\n\n" +
+		"- 2222222 Fix tests (Tech Writer)\n" +
+		"- 1111111 Add schema loader (dev_user1)\n\n" +
+		"https://github.com/devbits/toolkit/compare/abc...def"
+	if post.Content != wantPush || post.Project != 1 {
+		t.Fatalf("Unexpected push post %+v, want content:\n%s", post, wantPush)
+	}
+
+	var bot database.ApiUser
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       fmt.Sprintf("/users/id/%d", post.User),
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &bot)
+	if bot.Username != "openapi_toolkit_bot" || !bot.IsBot || bot.BotOwner == nil || bot.BotOwner.ProjectID != 1 {
+		t.Fatalf("Expected the post to come from the project bot, got %+v", bot)
+	}
+	// Followers hear about bot posts like any other.
+	waitForNotification(t, server.URL, "tech_writer2:2", "project_post")
+
+	released := callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        map[string]string{"X-Gitlab-Event": "Release Hook", "X-Gitlab-Token": inboundTestSecret},
+		Body:           gitLabReleasePayload,
+		ExpectedStatus: http.StatusCreated,
+	})
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       fmt.Sprintf("/posts/%v", released["post_id"]),
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &post)
+	if post.Content != "devbits/toolkit released Toolkit 2.0 (v2.0.0)\n\nFaster validation.\n\nhttps://gitlab.com/devbits/toolkit/-/releases/v2.0.0" || post.User != int64(bot.Id) {
+		t.Fatalf("Unexpected release post %+v", post)
+	}
+
+	ignored := callInboundWebhook(t, hookURL, inboundCall{
+		Headers: map[string]string{
+			"X-GitHub-Event":      "ping",
+			"X-Hub-Signature-256": webhooks.Sign(inboundTestSecret, []byte(`{"zen":"Keep it simple."}`)),
+		},
+		Body:           `{"zen":"Keep it simple."}`,
+		ExpectedStatus: http.StatusAccepted,
+	})
+	if ignored["reason"] != "ping" {
+		t.Fatalf("Expected the ping to be ignored, got %v", ignored)
+	}
+
+	generic := `{"status":"passed","text":"All 212 tests green"}`
+	built := callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        map[string]string{webhooks.SignatureHeader: webhooks.Sign(inboundTestSecret, []byte(generic))},
+		Body:           generic,
+		ExpectedStatus: http.StatusCreated,
+	})
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       fmt.Sprintf("/posts/%v", built["post_id"]),
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &post)
+	if post.Content != "Build passed: All 212 tests green" {
+		t.Fatalf("Expected the custom template to render the post, got %q", post.Content)
+	}
+
+	// A fourth post within the hour is over the limit.
+	callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        map[string]string{webhooks.SignatureHeader: webhooks.Sign(inboundTestSecret, []byte(generic))},
+		Body:           generic,
+		ExpectedStatus: http.StatusTooManyRequests,
+	})
+
+	var log struct {
+		Events []database.InboundWebhookEvent `json:"events"`
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       hookPath + "/events",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &log)
+	statuses := make([]string, len(log.Events))
+	for index, event := range log.Events {
+		statuses[index] = event.Source + "/" + event.Status
+	}
+	if strings.Join(statuses, ",") != "generic/rejected,generic/posted,github/ignored,gitlab/posted,github/ignored,github/posted" {
+		t.Fatalf("Unexpected event log %v", statuses)
+	}
+
+	var updated struct {
+		Webhook database.InboundWebhook `json:"webhook"`
+	}
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       hookPath,
+		Input:          `{"active":false,"templates":{"generic":""}}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &updated)
+	if updated.Webhook.Active || len(updated.Webhook.Templates) != 0 {
+		t.Fatalf("Expected the webhook to be off with default templates, got %+v", updated.Webhook)
+	}
+	callInboundWebhook(t, hookURL, inboundCall{
+		Headers:        map[string]string{webhooks.SignatureHeader: webhooks.Sign(inboundTestSecret, []byte(generic))},
+		Body:           generic,
+		ExpectedStatus: http.StatusForbidden,
+	})
+}
+
+func TestInboundWebhookRateLimitUnderLoad(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv("DEVBITS_PUBLIC_URL", "https://devbits.test")
+
+	var created struct {
+		Webhook struct {
+			database.InboundWebhook
+			URL string `json:"url"`
+		} `json:"webhook"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/inbound-webhooks",
+		Input:          `{"name":"CI","secret":"` + inboundTestSecret + `","posts_per_hour":2}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &created)
+	hookURL := server.URL + strings.TrimPrefix(created.Webhook.URL, "https://devbits.test")
+
+	// Concurrent calls must not all see room under the limit.
+	const calls = 8
+	statuses := make(chan int, calls)
+	var wait sync.WaitGroup
+	for index := 0; index < calls; index++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			body := fmt.Sprintf(`{"text":"build %d"}`, index)
+			request, _ := http.NewRequest(http.MethodPost, hookURL, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set(webhooks.SignatureHeader, webhooks.Sign(inboundTestSecret, []byte(body)))
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			response.Body.Close()
+			statuses <- response.StatusCode
+		}()
+	}
+	wait.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 2 || counts[http.StatusTooManyRequests] != calls-2 {
+		t.Fatalf("Expected 2 posts and %d rate limited calls, got %v", calls-2, counts)
+	}
+}
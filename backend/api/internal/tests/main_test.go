@@ -13,16 +13,19 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"backend/api/internal/auth"
 	"backend/api/internal/database"
 	"backend/api/internal/handlers"
 	"backend/api/internal/logger"
+	"backend/api/internal/realtime"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -38,7 +41,8 @@ type TestCase struct {
 	Input          string
 	ExpectedStatus int
 	ExpectedBody   string
-	AuthAs         string // optional: "username" or "username:id"
+	AuthAs         string            // optional: "username" or "username:id"
+	Headers        map[string]string // optional: extra headers, set after AuthAs
 }
 
 var main_tests = []TestCase{
@@ -58,12 +62,14 @@ var main_tests = []TestCase{
 	},
 }
 
-// setupTestRouter builds a gin.Engine with all API routes registered.
+// setupTestRouter builds a gin.Engine with all API routes registered,
+// streaming and publishing through hub.
 // It does NOT start a listener; use httptest.NewServer to serve requests.
-func setupTestRouter() *gin.Engine {
+func setupTestRouter(hub *handlers.RealtimeHub) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
 	router.HandleMethodNotAllowed = true
+	router.Use(handlers.WithRealtimeHub(hub))
 
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowAllOrigins = true
@@ -80,23 +86,114 @@ func setupTestRouter() *gin.Engine {
 	router.GET("/auth/me", handlers.RequireAuth(), handlers.GetMe)
 
 	router.GET("/users", handlers.GetUsers)
-	router.GET("/users/search", handlers.SearchUsers)
+	router.GET("/users/search", handlers.OptionalAuth(), handlers.SearchUsers)
 	router.GET("/users/:username", handlers.GetUserByUsername)
 	router.GET("/users/id/:user_id", handlers.GetUserById)
 	router.POST("/users", handlers.RequireAuth(), handlers.CreateUser)
 	router.PUT("/users/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UpdateUserInfo)
 	router.DELETE("/users/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.DeleteUser)
+	router.GET("/users/:username/media", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetUserManagedMedia)
+	router.POST("/media/upload", handlers.RequireAuth(), handlers.UploadMedia)
+	router.POST("/media/uploads", handlers.RequireAuth(), handlers.CreateUploadSession)
+	router.HEAD("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.GetUploadSessionOffset)
+	router.PATCH("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.AppendUploadChunk)
+	router.POST("/media/uploads/:upload_id/complete", handlers.RequireAuth(), handlers.CompleteUploadSession)
+	router.DELETE("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.AbortUploadSession)
+	router.POST("/media/private", handlers.RequireAuth(), handlers.UploadPrivateMedia)
+	router.GET("/media/private/:filename", handlers.ServePrivateMedia)
+	router.GET("/media/private/:filename/url", handlers.RequireAuth(), handlers.GetPrivateMediaURL)
+
+	router.GET("/messages/:username/peers", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectChatPeers)
+	router.GET("/messages/:username/threads", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectMessageThreads)
+	router.GET("/messages/:username/with/:other", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectMessages)
+	router.POST("/messages/:username/with/:other", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.CreateDirectMessage)
+	router.POST("/messages/:username/with/:other/read", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.MarkDirectMessagesRead)
+	router.PUT("/messages/:username/with/:other/:message_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UpdateDirectMessage)
+	router.DELETE("/messages/:username/with/:other/:message_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.DeleteDirectMessage)
+	router.GET("/messages/:username/unread-count", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetUnreadDirectMessageCount)
+	router.GET("/messages/:username/stream", handlers.StreamDirectMessages)
+	router.GET("/messages/:username/events", handlers.StreamDirectMessageEvents)
+
+	router.POST("/conversations", handlers.RequireAuth(), handlers.CreateConversation)
+	router.GET("/conversations", handlers.RequireAuth(), handlers.GetConversations)
+	router.GET("/conversations/unread-count", handlers.RequireAuth(), handlers.GetConversationUnreadCount)
+	router.GET("/conversations/:conversation_id", handlers.RequireAuth(), handlers.GetConversation)
+	router.PUT("/conversations/:conversation_id", handlers.RequireAuth(), handlers.UpdateConversation)
+	router.GET("/conversations/:conversation_id/messages", handlers.RequireAuth(), handlers.GetConversationMessages)
+	router.POST("/conversations/:conversation_id/messages", handlers.RequireAuth(), handlers.CreateConversationMessage)
+	router.POST("/conversations/:conversation_id/read", handlers.RequireAuth(), handlers.MarkConversationRead)
+	router.POST("/conversations/:conversation_id/join", handlers.RequireAuth(), handlers.JoinConversation)
+	router.POST("/conversations/:conversation_id/leave", handlers.RequireAuth(), handlers.LeaveConversation)
+	router.POST("/conversations/:conversation_id/participants", handlers.RequireAuth(), handlers.AddConversationParticipant)
+	router.PUT("/conversations/:conversation_id/participants/:username", handlers.RequireAuth(), handlers.UpdateConversationParticipant)
+	router.DELETE("/conversations/:conversation_id/participants/:username", handlers.RequireAuth(), handlers.RemoveConversationParticipant)
+	router.GET("/projects/:project_id/conversation", handlers.RequireAuth(), handlers.GetProjectConversation)
 
 	router.GET("/users/:username/followers", handlers.GetUsersFollowers)
 	router.GET("/users/:username/follows", handlers.GetUsersFollowing)
 	router.POST("/users/:username/follow/:new_follow", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.FollowUser)
 	router.POST("/users/:username/unfollow/:unfollow", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnfollowUser)
 
-	router.GET("/projects/:project_id", handlers.GetProjectById)
+	router.GET("/users/:username/blocks", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetBlockedUsers)
+	router.POST("/users/:username/blocks/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.BlockUser)
+	router.DELETE("/users/:username/blocks/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnblockUser)
+	router.GET("/users/:username/mutes", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetMutedUsers)
+	router.POST("/users/:username/mutes/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.MuteUser)
+	router.DELETE("/users/:username/mutes/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnmuteUser)
+
+	router.GET("/users/:username/bots", handlers.GetUserBots)
+	router.POST("/users/:username/bots", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.CreateUserBot)
+
+	router.POST("/notifications/push-token", handlers.RequireAuth(), handlers.RegisterPushToken)
+	router.GET("/notifications/web-push-key", handlers.GetWebPushKey)
+	router.GET("/admin/push/stats", handlers.RequireAdmin(), handlers.AdminPushStats)
+	router.GET("/admin/users/:username/storage", handlers.RequireAdmin(), handlers.AdminGetUserStorage)
+	router.POST("/admin/users/:username/storage", handlers.RequireAdmin(), handlers.AdminSetUserStorage)
+	router.GET("/notifications", handlers.RequireAuth(), handlers.GetNotifications)
+	router.GET("/notifications/unread-count", handlers.RequireAuth(), handlers.GetNotificationCount)
+	router.GET("/notifications/preferences", handlers.RequireAuth(), handlers.GetNotificationPreferences)
+	router.PUT("/notifications/preferences", handlers.RequireAuth(), handlers.UpdateNotificationPreferences)
+	router.GET("/notifications/digest/unsubscribe", handlers.ConfirmEmailDigestUnsubscribe)
+	router.POST("/notifications/digest/unsubscribe", handlers.UnsubscribeEmailDigest)
+	router.GET("/notifications/digest/confirm", handlers.ShowDigestEmailConfirmation)
+	router.POST("/notifications/digest/confirm", handlers.ConfirmDigestEmail)
+	router.POST("/notifications/read-all", handlers.RequireAuth(), handlers.MarkAllNotificationsRead)
+	router.POST("/notifications/read", handlers.RequireAuth(), handlers.MarkNotificationsRead)
+	router.POST("/notifications/delete", handlers.RequireAuth(), handlers.DeleteNotifications)
+	router.POST("/notifications/:notification_id/read", handlers.RequireAuth(), handlers.MarkNotificationRead)
+	router.DELETE("/notifications/:notification_id", handlers.RequireAuth(), handlers.DeleteNotification)
+	router.DELETE("/notifications", handlers.RequireAuth(), handlers.ClearNotifications)
+
+	router.GET("/projects/:project_id", handlers.OptionalAuth(), handlers.GetProjectById)
 	router.POST("/projects", handlers.RequireAuth(), handlers.CreateProject)
 	router.PUT("/projects/:project_id", handlers.RequireAuth(), handlers.UpdateProjectInfo)
 	router.DELETE("/projects/:project_id", handlers.RequireAuth(), handlers.DeleteProject)
 	router.GET("/projects/by-user/:user_id", handlers.GetProjectsByUserId)
+	router.POST("/projects/:project_id/builders/:username", handlers.RequireAuth(), handlers.AddProjectBuilder)
+	router.DELETE("/projects/:project_id/builders/:username", handlers.RequireAuth(), handlers.RemoveProjectBuilder)
+	router.GET("/projects/:project_id/webhooks", handlers.RequireAuth(), handlers.GetProjectWebhooks)
+	router.POST("/projects/:project_id/webhooks", handlers.RequireAuth(), handlers.CreateProjectWebhook)
+	router.PUT("/projects/:project_id/webhooks/:webhook_id", handlers.RequireAuth(), handlers.UpdateProjectWebhook)
+	router.DELETE("/projects/:project_id/webhooks/:webhook_id", handlers.RequireAuth(), handlers.DeleteProjectWebhook)
+	router.GET("/projects/:project_id/webhooks/:webhook_id/deliveries", handlers.RequireAuth(), handlers.GetWebhookDeliveries)
+	router.POST("/projects/:project_id/webhooks/:webhook_id/deliveries/:delivery_id/redeliver", handlers.RequireAuth(), handlers.RedeliverWebhookDelivery)
+	router.GET("/projects/:project_id/inbound-webhooks", handlers.RequireAuth(), handlers.GetInboundWebhooks)
+	router.POST("/projects/:project_id/inbound-webhooks", handlers.RequireAuth(), handlers.CreateInboundWebhook)
+	router.PUT("/projects/:project_id/inbound-webhooks/:webhook_id", handlers.RequireAuth(), handlers.UpdateInboundWebhook)
+	router.DELETE("/projects/:project_id/inbound-webhooks/:webhook_id", handlers.RequireAuth(), handlers.DeleteInboundWebhook)
+	router.GET("/projects/:project_id/inbound-webhooks/:webhook_id/events", handlers.RequireAuth(), handlers.GetInboundWebhookEvents)
+	router.POST("/webhooks/inbound/:key", handlers.ReceiveInboundWebhook)
+	router.GET("/projects/:project_id/bots", handlers.GetProjectBots)
+	router.POST("/projects/:project_id/bots", handlers.RequireAuth(), handlers.CreateProjectBot)
+
+	router.GET("/bots/:username", handlers.GetBot)
+	router.PUT("/bots/:username", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.UpdateUserInfo)
+	router.DELETE("/bots/:username", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.DeleteUser)
+	router.GET("/bots/:username/tokens", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.GetBotTokens)
+	router.POST("/bots/:username/tokens", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.CreateBotToken)
+	router.DELETE("/bots/:username/tokens/:token_id", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.DeleteBotToken)
+	router.PUT("/bots/:username/projects/:project_id", handlers.RequireAuth(), handlers.GrantBotProject)
+	router.DELETE("/bots/:username/projects/:project_id", handlers.RequireAuth(), handlers.RevokeBotProject)
 
 	router.GET("/projects/:project_id/followers", handlers.GetProjectFollowers)
 	router.GET("/projects/follows/:username", handlers.GetProjectFollowing)
@@ -109,7 +206,7 @@ func setupTestRouter() *gin.Engine {
 	router.POST("/projects/user/:username/unlikes/:project_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnlikeProject)
 	router.GET("/projects/does-like/:username/:project_id", handlers.IsProjectLiked)
 
-	router.GET("/posts/:post_id", handlers.GetPostById)
+	router.GET("/posts/:post_id", handlers.OptionalAuth(), handlers.GetPostById)
 	router.POST("/posts", handlers.RequireAuth(), handlers.CreatePost)
 	router.PUT("/posts/:post_id", handlers.RequireAuth(), handlers.UpdatePostInfo)
 	router.DELETE("/posts/:post_id", handlers.RequireAuth(), handlers.DeletePost)
@@ -134,6 +231,9 @@ func setupTestRouter() *gin.Engine {
 	router.POST("/comments/:username/unlikes/:comment_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnlikeComment)
 	router.GET("/comments/does-like/:username/:comment_id", handlers.IsCommentLiked)
 
+	router.GET("/feed/posts", handlers.OptionalAuth(), handlers.GetPostsFeed)
+	router.GET("/feed/projects", handlers.OptionalAuth(), handlers.GetProjectsFeed)
+
 	return router
 }
 
@@ -168,8 +268,9 @@ func loadSQLFile(db *sql.DB, filename string, replacements ...string) error {
 	return nil
 }
 
-// Run executes the test case against the given server URL.
-func (tc *TestCase) Run(t *testing.T, serverURL string) {
+// send makes the request the test case describes and returns the response
+// along with its body.
+func (tc TestCase) send(t *testing.T, serverURL string) (*http.Response, []byte) {
 	t.Helper()
 
 	url := serverURL + tc.Endpoint
@@ -199,6 +300,9 @@ func (tc *TestCase) Run(t *testing.T, serverURL string) {
 		}
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	for key, value := range tc.Headers {
+		req.Header.Set(key, value)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -211,6 +315,14 @@ func (tc *TestCase) Run(t *testing.T, serverURL string) {
 	if err != nil {
 		t.Fatalf("Failed to read response body: %v", err)
 	}
+	return resp, body
+}
+
+// Run executes the test case against the given server URL.
+func (tc TestCase) Run(t *testing.T, serverURL string) {
+	t.Helper()
+
+	resp, body := tc.send(t, serverURL)
 
 	assert.Equal(t, tc.ExpectedStatus, resp.StatusCode, "Status code mismatch for %s %s", tc.Method, tc.Endpoint)
 
@@ -234,12 +346,41 @@ func (tc *TestCase) Run(t *testing.T, serverURL string) {
 	}
 }
 
-func TestAPI(t *testing.T) {
+// Fetch is Run for steps whose response later steps depend on: it stops the
+// test unless the status matches, decodes the JSON body into target when
+// target is not nil, and returns the response headers.
+func (tc TestCase) Fetch(t *testing.T, serverURL string, target interface{}) http.Header {
+	t.Helper()
+
+	resp, body := tc.send(t, serverURL)
+	if resp.StatusCode != tc.ExpectedStatus {
+		t.Fatalf("Expected status %d for %s %s, got %d: %s", tc.ExpectedStatus, tc.Method, tc.Endpoint, resp.StatusCode, body)
+	}
+	if target != nil {
+		if err := json.Unmarshal(body, target); err != nil {
+			t.Fatalf("Failed to decode %s %s: %v", tc.Method, tc.Endpoint, err)
+		}
+	}
+	return resp.Header
+}
+
+// newTestServer loads the schema and fixtures into a fresh sqlite database
+// and serves the API from an in-process HTTP server.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	setupTestDatabase(t)
+	return startTestNode(t, realtime.NewMemoryBroker())
+}
+
+// setupTestDatabase points database.DB at a fresh sqlite database loaded with
+// the schema and test data.
+func setupTestDatabase(t *testing.T) {
+	t.Helper()
 	logger.InitLogger()
 
 	database.DB = nil
 	testDbPath := filepath.Join(t.TempDir(), "api_tests.sqlite3")
-	db, err := sql.Open("sqlite", testDbPath)
+	db, err := sql.Open("sqlite", testDbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		t.Fatalf("Failed to open test sqlite database: %v", err)
 	}
@@ -258,12 +399,60 @@ func TestAPI(t *testing.T) {
 	}
 
 	database.DB = db
+	loadTestSchema(t, db, "SERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT")
+}
+
+// setupPostgresTestDatabase points database.DB at a fresh schema in the
+// PostgreSQL database at dsn, loaded with the schema and test data, and
+// returns a DSN that connects to that schema. The schema is dropped when the
+// test ends.
+func setupPostgresTestDatabase(t *testing.T, dsn string) string {
+	t.Helper()
+	logger.InitLogger()
 
-	if err := loadSQLFile(
-		db,
-		"create_tables.sql",
-		"SERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
-	); err != nil {
+	database.DB = nil
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	schema := fmt.Sprintf("devbits_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		_ = admin.Close()
+		t.Fatalf("Failed to create test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		_ = admin.Close()
+	})
+
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("Expected a postgres:// URL, got %q: %v", dsn, err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	schemaDSN := parsed.String()
+
+	db, err := sql.Open("postgres", schemaDSN)
+	if err != nil {
+		t.Fatalf("Failed to open postgres test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	database.DB = db
+	loadTestSchema(t, db)
+	return schemaDSN
+}
+
+// loadTestSchema loads create_tables.sql, rewritten by replacements, and the
+// test data into db.
+func loadTestSchema(t *testing.T, db *sql.DB, replacements ...string) {
+	t.Helper()
+
+	if err := loadSQLFile(db, "create_tables.sql", replacements...); err != nil {
 		t.Fatalf("Failed to load schema: %v", err)
 	}
 	if err := loadSQLFile(db, "create_test_data.sql"); err != nil {
@@ -273,18 +462,55 @@ func TestAPI(t *testing.T) {
 	if _, err := db.Exec(`INSERT INTO users (id, username, picture, bio, links, settings, creation_date) VALUES (-1, 'deleted_user', '', '', '[]', '{}', '1970-01-01 00:00:00')`); err != nil {
 		t.Fatalf("Failed to insert sentinel deleted user: %v", err)
 	}
+}
 
+// startTestNode starts an in-process API server with its own realtime hub on
+// broker, sharing the test database. Several nodes on one broker behave like
+// separate API instances.
+func startTestNode(t *testing.T, broker realtime.Broker) *httptest.Server {
+	t.Helper()
+
+	hub, err := handlers.NewRealtimeHub(broker)
+	if err != nil {
+		t.Fatalf("Failed to start realtime hub: %v", err)
+	}
 	// Start an in-process HTTP test server — no external daemon needed.
-	router := setupTestRouter()
+	router := setupTestRouter(hub)
 	server := httptest.NewServer(router)
-	defer server.Close()
+	// Like shutdown in main: end streams and background work, then wait
+	// for anything the last requests started before the database closes.
+	t.Cleanup(func() {
+		handlers.StopBackgroundWork(10 * time.Second)
+		server.Close()
+		if !handlers.StopBackgroundWork(10 * time.Second) {
+			t.Errorf("Background work did not finish")
+		}
+		if err := hub.Close(); err != nil {
+			t.Errorf("Failed to close realtime hub: %v", err)
+		}
+	})
+	return server
+}
+
+func TestAPI(t *testing.T) {
+	server := newTestServer(t)
 
 	tests := map[string][]TestCase{
-		"Main Tests":    main_tests,
-		"User Tests":    user_tests,
-		"Project Tests": project_tests,
-		"Comment Tests": comment_tests,
-		"Post Tests":    post_tests,
+		"Main Tests":            main_tests,
+		"User Tests":            user_tests,
+		"Project Tests":         project_tests,
+		"Comment Tests":         comment_tests,
+		"Post Tests":            post_tests,
+		"Media Tests":           media_tests,
+		"Direct Message Tests":  direct_message_tests,
+		"Conversation Tests":    conversation_tests,
+		"Block Tests":           block_tests,
+		"Notification Tests":    notification_tests,
+		"Digest Tests":          digest_tests,
+		"Push Tests":            push_tests,
+		"Bot Tests":             bot_tests,
+		"Webhook Tests":         webhook_tests,
+		"Inbound Webhook Tests": inbound_webhook_tests,
 	}
 
 	// Run each category sequentially to avoid shared-database race conditions.
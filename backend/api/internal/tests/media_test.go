@@ -0,0 +1,642 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/api/internal/auth"
+)
+
+var media_tests = []TestCase{
+
+	// managed media listing reports storage usage against the default limits
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/backend_guru4/media",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"items":[],"usage":{"used_bytes":0,"quota_bytes":1073741824,"uploads_last_hour":0,"uploads_per_hour":60}}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// usage is private to the owner
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/users/backend_guru4/media",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Forbidden"}`,
+		AuthAs:         "dev_user1:1",
+	},
+
+	// resumable uploads require a positive declared size
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/media/uploads",
+		Input:          `{"filename":"clip.mp4","content_type":"video/mp4","size":0}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"size must be > 0"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// unsupported types are rejected before any data is sent
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/media/uploads",
+		Input:          `{"filename":"notes.txt","content_type":"text/plain","size":10}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"unsupported file type"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// unknown sessions are not found
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/media/uploads/does-not-exist/complete",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Upload session not found"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+
+	// private media is only served through a valid signed link
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/media/private/u4_abcdef.png?viewer=4&expires=4102444800&signature=00",
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Invalid or expired media link"}`,
+	},
+
+	// signed links are not issued for unknown media
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/media/private/u4_abcdef.png/url",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Media not found"}`,
+		AuthAs:         "backend_guru4:4",
+	},
+}
+
+// fileUpload returns a multipart body holding content as an upload named
+// filename alongside fields, and the headers to send it with.
+func fileUpload(t *testing.T, filename string, contentType string, content []byte, fields map[string]string) (string, map[string]string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range fields {
+		_ = writer.WriteField(key, value)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("Failed to build upload: %v", err)
+	}
+	_, _ = part.Write(content)
+	_ = writer.Close()
+	return body.String(), map[string]string{"Content-Type": writer.FormDataContentType()}
+}
+
+// pngUpload is fileUpload for a PNG of size bytes.
+func pngUpload(t *testing.T, size int) (string, map[string]string) {
+	t.Helper()
+
+	content := make([]byte, size)
+	copy(content, "\x89PNG\r\n\x1a\n")
+	return fileUpload(t, "shot.png", "image/png", content, nil)
+}
+
+func TestMediaUploadLimits(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+	t.Setenv("DEVBITS_ADMIN_KEY", "test-admin-key")
+	admin := map[string]string{"X-Admin-Key": "test-admin-key"}
+
+	upload := func(size int, status int) {
+		t.Helper()
+		body, headers := pngUpload(t, size)
+		step := TestCase{Method: http.MethodPost, Endpoint: "/media/upload", Input: body, ExpectedStatus: status, AuthAs: "backend_guru4:4", Headers: headers}
+		step.Fetch(t, server.URL, nil)
+	}
+
+	for _, step := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/admin/users/backend_guru4/storage",
+			Input:          `{"quota_mb":1}`,
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   `{"error":"Unauthorized","message":"Admin authentication required"}`,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/admin/users/backend_guru4/storage",
+			Input:          `{"quota_mb":1,"uploads_per_hour":3}`,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Storage limits updated for backend_guru4"}`,
+			Headers:        admin,
+		},
+	} {
+		step.Run(t, server.URL)
+	}
+
+	// Only one of several concurrent uploads fits in the quota.
+	statuses := make(chan int, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, headers := pngUpload(t, 600<<10)
+			step := TestCase{Method: http.MethodPost, Endpoint: "/media/upload", Input: body, AuthAs: "backend_guru4:4", Headers: headers}
+			response, _ := step.send(t, server.URL)
+			statuses <- response.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusRequestEntityTooLarge] != 3 {
+		t.Fatalf("Expected one upload within the quota and three over it, got %v", counts)
+	}
+
+	// The override also caps uploads per hour.
+	upload(10<<10, http.StatusOK)
+	upload(10<<10, http.StatusOK)
+	upload(10<<10, http.StatusTooManyRequests)
+
+	var storage struct {
+		Usage struct {
+			UsedBytes       int64 `json:"used_bytes"`
+			QuotaBytes      int64 `json:"quota_bytes"`
+			UploadsLastHour int   `json:"uploads_last_hour"`
+		} `json:"usage"`
+	}
+	step := TestCase{Method: http.MethodGet, Endpoint: "/admin/users/backend_guru4/storage", ExpectedStatus: http.StatusOK, Headers: admin}
+	step.Fetch(t, server.URL, &storage)
+	if storage.Usage.UsedBytes != (600+20)<<10 || storage.Usage.QuotaBytes != 1<<20 || storage.Usage.UploadsLastHour != 3 {
+		t.Fatalf("Unexpected storage usage %+v", storage.Usage)
+	}
+
+	// Clearing the override restores the defaults.
+	step = TestCase{Method: http.MethodPost, Endpoint: "/admin/users/backend_guru4/storage", Input: `{}`, ExpectedStatus: http.StatusOK, Headers: admin}
+	step.Fetch(t, server.URL, nil)
+	upload(600<<10, http.StatusOK)
+}
+
+func TestResumableUpload(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+
+	content := make([]byte, 20)
+	copy(content, "\x89PNG\r\n\x1a\n")
+
+	var created struct {
+		Upload struct {
+			ID string `json:"id"`
+		} `json:"upload"`
+	}
+	step := TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/media/uploads",
+		Input:          `{"filename":"shot.png","content_type":"image/png","size":20}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "backend_guru4:4",
+	}
+	step.Fetch(t, server.URL, &created)
+	sessionPath := "/media/uploads/" + created.Upload.ID
+
+	chunk := func(offset string, data []byte) TestCase {
+		return TestCase{
+			Method:   http.MethodPatch,
+			Endpoint: sessionPath,
+			Input:    string(data),
+			AuthAs:   "backend_guru4:4",
+			Headers:  map[string]string{"Upload-Offset": offset, "Content-Type": "application/offset+octet-stream"},
+		}
+	}
+	expectOffset := func(want string) {
+		t.Helper()
+		step := TestCase{Method: http.MethodHead, Endpoint: sessionPath, ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"}
+		if got := step.Fetch(t, server.URL, nil).Get("Upload-Offset"); got != want {
+			t.Fatalf("Expected Upload-Offset %s, got %s", want, got)
+		}
+	}
+
+	expectOffset("0")
+
+	// A chunk sent out of order is refused and nothing is written.
+	step = chunk("5", content[5:10])
+	step.ExpectedStatus = http.StatusConflict
+	step.ExpectedBody = `{"error":"Conflict","message":"Upload-Offset 5 does not match current offset 0"}`
+	step.Run(t, server.URL)
+	expectOffset("0")
+
+	step = chunk("0", content[:8])
+	step.ExpectedStatus = http.StatusOK
+	step.Fetch(t, server.URL, nil)
+
+	for _, step := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       sessionPath + "/complete",
+			ExpectedStatus: http.StatusConflict,
+			ExpectedBody:   `{"error":"Conflict","message":"Upload incomplete: 8 of 20 bytes received"}`,
+			AuthAs:         "backend_guru4:4",
+		},
+		{
+			Method:         http.MethodHead,
+			Endpoint:       sessionPath,
+			ExpectedStatus: http.StatusNotFound,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		step.Run(t, server.URL)
+	}
+
+	// The client resumes from wherever the server says it got to.
+	expectOffset("8")
+	step = chunk("8", content[8:])
+	step.ExpectedStatus = http.StatusOK
+	step.Fetch(t, server.URL, nil)
+	expectOffset("20")
+
+	step = chunk("20", []byte("x"))
+	step.ExpectedStatus = http.StatusRequestEntityTooLarge
+	step.ExpectedBody = `{"error":"Request Entity Too Large","message":"Chunk exceeds declared upload size"}`
+	step.Run(t, server.URL)
+
+	// Two completes racing store the file once.
+	statuses := make(chan int, 2)
+	bodies := make(chan []byte, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			step := TestCase{Method: http.MethodPost, Endpoint: sessionPath + "/complete", AuthAs: "backend_guru4:4"}
+			response, body := step.send(t, server.URL)
+			statuses <- response.StatusCode
+			bodies <- body
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	close(bodies)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusNotFound] != 1 {
+		t.Fatalf("Expected one complete to store the file and the other to find no session, got %v", counts)
+	}
+	var stored struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	for body := range bodies {
+		if json.Unmarshal(body, &stored) == nil && stored.Filename != "" {
+			break
+		}
+	}
+	saved, err := os.ReadFile(filepath.Join("uploads", stored.Filename))
+	if err != nil || !bytes.Equal(saved, content) || stored.Size != 20 {
+		t.Fatalf("Expected the assembled upload to be stored intact, got %q (%v) for %+v", saved, err, stored)
+	}
+
+	var storage struct {
+		Usage struct {
+			UsedBytes int64 `json:"used_bytes"`
+		} `json:"usage"`
+	}
+	step = TestCase{Method: http.MethodGet, Endpoint: "/users/backend_guru4/media", ExpectedStatus: http.StatusOK, AuthAs: "backend_guru4:4"}
+	step.Fetch(t, server.URL, &storage)
+	if storage.Usage.UsedBytes != 20 {
+		t.Fatalf("Expected the upload to be counted once, got %d bytes", storage.Usage.UsedBytes)
+	}
+}
+
+func TestSVGSanitizer(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+
+	const open = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10">`
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string // empty when the upload is rejected
+	}{
+		{
+			name:  "clean svg is unchanged",
+			input: open + `<g fill="red"><circle cx="5" cy="5" r="4"></circle><use href="#dot"></use></g></svg>`,
+			want:  open + `<g fill="red"><circle cx="5" cy="5" r="4"></circle><use href="#dot"></use></g></svg>`,
+		},
+		{
+			name:  "script elements",
+			input: open + `<script>alert(1)</script><SCRIPT type="text/javascript"><![CDATA[alert(2)]]></SCRIPT><rect width="1"></rect></svg>`,
+			want:  open + `<rect width="1"></rect></svg>`,
+		},
+		{
+			name:  "event handlers",
+			input: open + `<rect width="1" onload="alert(1)" ONCLICK="alert(2)" onmouseover="x()"></rect></svg>`,
+			want:  open + `<rect width="1"></rect></svg>`,
+		},
+		{
+			name:  "javascript urls",
+			input: open + `<a href="javascript:alert(1)"><text>hi</text></a><a xlink:href=" JavaScript:alert(2)"></a></svg>`,
+			want:  open + `<a><text>hi</text></a><a></a></svg>`,
+		},
+		{
+			name:  "external references",
+			input: open + `<image href="https://evil.test/x.png"></image><use xlink:href="http://evil.test/s.svg#a"></use><image xlink:href="data:image/png;base64,AAAA"></image></svg>`,
+			want:  open + `<image></image><use></use><image xlink:href="data:image/png;base64,AAAA"></image></svg>`,
+		},
+		{
+			name:  "external stylesheets",
+			input: open + `<style>@import url(https://evil.test/a.css);</style><rect style="fill:url(https://evil.test/#p)" fill="url(#grad)"></rect></svg>`,
+			want:  open + `<rect fill="url(#grad)"></rect></svg>`,
+		},
+		{
+			name:  "foreign objects",
+			input: open + `<foreignObject width="10" height="10"><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="https://evil.test"></iframe></body></foreignObject><rect width="1"></rect></svg>`,
+			want:  open + `<rect width="1"></rect></svg>`,
+		},
+		{
+			name:  "animations that retarget links",
+			input: open + `<a><set attributeName="href" to="javascript:alert(1)"></set><animate attributeName="opacity" from="0" to="1"></animate></a></svg>`,
+			want:  open + `<a><animate attributeName="opacity" from="0" to="1"></animate></a></svg>`,
+		},
+		{
+			name:  "doctype and comments are dropped",
+			input: `<?xml version="1.0"?><!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd"><!-- note -->` + open + `<rect width="1"></rect></svg>`,
+			want:  open + `<rect width="1"></rect></svg>`,
+		},
+		{
+			name:  "external entities",
+			input: `<!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]>` + open + `<text>&xxe;</text></svg>`,
+		},
+		{
+			name:  "entity expansion",
+			input: `<!DOCTYPE svg [<!ENTITY a "aaaaaaaaaa"><!ENTITY b "&a;&a;&a;&a;&a;">]>` + open + `<text>&b;</text></svg>`,
+		},
+		{
+			name:  "html disguised as svg",
+			input: `<html><body><script>alert(1)</script></body></html>`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, headers := fileUpload(t, "drawing.svg", "image/svg+xml", []byte(tc.input), nil)
+			step := TestCase{Method: http.MethodPost, Endpoint: "/media/upload", Input: body, AuthAs: "backend_guru4:4", Headers: headers}
+			if tc.want == "" {
+				step.ExpectedStatus = http.StatusBadRequest
+				step.Fetch(t, server.URL, nil)
+				return
+			}
+
+			var stored struct {
+				Filename string `json:"filename"`
+			}
+			step.ExpectedStatus = http.StatusOK
+			step.Fetch(t, server.URL, &stored)
+			saved, err := os.ReadFile(filepath.Join("uploads", stored.Filename))
+			if err != nil {
+				t.Fatalf("Failed to read stored svg: %v", err)
+			}
+			if string(saved) != tc.want {
+				t.Fatalf("Sanitized svg mismatch\n got: %s\nwant: %s", saved, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrivateMediaAccess(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+
+	content := make([]byte, 64)
+	copy(content, "\x89PNG\r\n\x1a\n")
+
+	type signedMedia struct {
+		URL      string `json:"url"`
+		Filename string `json:"filename"`
+	}
+	uploadFor := func(resourceType string) signedMedia {
+		t.Helper()
+		body, headers := fileUpload(t, "shot.png", "image/png", content, map[string]string{"resource_type": resourceType, "resource_id": "1"})
+		var uploaded signedMedia
+		step := TestCase{Method: http.MethodPost, Endpoint: "/media/private", Input: body, ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1", Headers: headers}
+		step.Fetch(t, server.URL, &uploaded)
+		return uploaded
+	}
+	signFor := func(filename string, authAs string) string {
+		t.Helper()
+		var signed signedMedia
+		step := TestCase{Method: http.MethodGet, Endpoint: "/media/private/" + filename + "/url", ExpectedStatus: http.StatusOK, AuthAs: authAs}
+		step.Fetch(t, server.URL, &signed)
+		return signed.URL
+	}
+
+	post := uploadFor("post")
+	project := uploadFor("project")
+
+	// A signed link serves the file to the viewer it was minted for.
+	viewerURL := signFor(post.Filename, "tech_writer2:2")
+	response, err := http.Get(server.URL + viewerURL)
+	if err != nil {
+		t.Fatalf("Failed to fetch private media: %v", err)
+	}
+	served, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !bytes.Equal(served, content) || !strings.HasPrefix(response.Header.Get("Cache-Control"), "private") {
+		t.Fatalf("Expected the signed link to serve the file privately, got %d %q", response.StatusCode, response.Header.Get("Cache-Control"))
+	}
+
+	// Links minted before the viewer blocked the author stop working.
+	blockedURL := signFor(post.Filename, "ui_designer5:5")
+	signFor(project.Filename, "ui_designer5:5")
+
+	expired := time.Now().Add(-time.Minute)
+	forbidden := `{"error":"Forbidden","message":"Invalid or expired media link"}`
+	notFound := `{"error":"Not Found","message":"Media not found"}`
+	for _, step := range []TestCase{
+		{
+			Method:         http.MethodGet,
+			Endpoint:       fmt.Sprintf("/media/private/%s?viewer=2&expires=%d&signature=%s", post.Filename, expired.Unix(), auth.SignMediaURL(post.Filename, 2, expired)),
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   forbidden,
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       strings.Replace(viewerURL, "viewer=2", "viewer=3", 1),
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   forbidden,
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/ui_designer5/blocks/dev_user1",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       blockedURL,
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   notFound,
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/media/private/" + post.Filename + "/url",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   notFound,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/media/private/" + project.Filename + "/url",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   notFound,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/posts/1",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"Not Found","message":"Post with id '1' not found"}`,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/projects/1",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"Not Found","message":"Project with id '1' not found"}`,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/posts/1",
+			ExpectedStatus: http.StatusOK,
+		},
+	} {
+		step.Run(t, server.URL)
+	}
+
+	// Other viewers are unaffected.
+	signFor(project.Filename, "tech_writer2:2")
+}
+
+func TestPrivateMediaInMessages(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+
+	content := make([]byte, 64)
+	copy(content, "\x89PNG\r\n\x1a\n")
+	body, headers := fileUpload(t, "shot.png", "image/png", content, nil)
+	var uploaded struct {
+		Filename string `json:"filename"`
+	}
+	upload := TestCase{Method: http.MethodPost, Endpoint: "/media/private", Input: body, ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1", Headers: headers}
+	upload.Fetch(t, server.URL, &uploaded)
+
+	// The same file sent twice at once attaches to exactly one message.
+	input := `{"content":"look","media":["/media/private/` + uploaded.Filename + `","/media/private/` + uploaded.Filename + `"]}`
+	statuses := make(chan int, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send := TestCase{Method: http.MethodPost, Endpoint: "/messages/dev_user1/with/tech_writer2", Input: input, AuthAs: "dev_user1:1"}
+			response, _ := send.send(t, server.URL)
+			statuses <- response.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusBadRequest] != 1 {
+		t.Fatalf("Expected one message to claim the media and one to be rejected, got %v", counts)
+	}
+
+	var messages []map[string]interface{}
+	thread := TestCase{Method: http.MethodGet, Endpoint: "/messages/dev_user1/with/tech_writer2", ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1"}
+	thread.Fetch(t, server.URL, &messages)
+	if len(messages) != 1 {
+		t.Fatalf("Expected the rejected send to store nothing, got %d messages", len(messages))
+	}
+}
+
+func TestDeletedMessageReleasesMedia(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+
+	upload := func(size int) string {
+		t.Helper()
+		body, headers := pngUpload(t, size)
+		var uploaded struct {
+			Filename string `json:"filename"`
+		}
+		step := TestCase{Method: http.MethodPost, Endpoint: "/media/upload", Input: body, ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1", Headers: headers}
+		step.Fetch(t, server.URL, &uploaded)
+		return uploaded.Filename
+	}
+	send := func(media ...string) int64 {
+		t.Helper()
+		encoded, _ := json.Marshal(media)
+		var sent struct {
+			DirectMessage struct {
+				ID int64 `json:"id"`
+			} `json:"direct_message"`
+		}
+		step := TestCase{Method: http.MethodPost, Endpoint: "/messages/dev_user1/with/tech_writer2", Input: `{"content":"look","media":` + string(encoded) + `}`, ExpectedStatus: http.StatusCreated, AuthAs: "dev_user1:1"}
+		step.Fetch(t, server.URL, &sent)
+		return sent.DirectMessage.ID
+	}
+	usedBytes := func() int64 {
+		t.Helper()
+		var storage struct {
+			Usage struct {
+				UsedBytes int64 `json:"used_bytes"`
+			} `json:"usage"`
+		}
+		step := TestCase{Method: http.MethodGet, Endpoint: "/users/dev_user1/media", ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1"}
+		step.Fetch(t, server.URL, &storage)
+		return storage.Usage.UsedBytes
+	}
+
+	only := upload(100)
+	shared := upload(200)
+	first := send("/uploads/"+only, "/uploads/"+shared)
+	send("/uploads/" + shared)
+	if used := usedBytes(); used != 300 {
+		t.Fatalf("Expected both uploads to count, got %d bytes", used)
+	}
+
+	step := TestCase{Method: http.MethodDelete, Endpoint: fmt.Sprintf("/messages/dev_user1/with/tech_writer2/%d", first), ExpectedStatus: http.StatusOK, AuthAs: "dev_user1:1"}
+	step.Fetch(t, server.URL, nil)
+
+	// Only the upload no other message shows is released.
+	if used := usedBytes(); used != 200 {
+		t.Fatalf("Expected the deleted message's own upload to be released, got %d bytes", used)
+	}
+	if _, err := os.Stat(filepath.Join("uploads", only)); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", only, err)
+	}
+	if _, err := os.Stat(filepath.Join("uploads", shared)); err != nil {
+		t.Fatalf("Expected %s to be kept for the other message: %v", shared, err)
+	}
+}
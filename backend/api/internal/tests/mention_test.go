@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"backend/api/internal/database"
+)
+
+func TestMentions(t *testing.T) {
+	server := newTestServer(t)
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          `{"user":3,"project":3,"content":"🎉 Thanks @dev_user1 and @Tech_Writer2! Mail a@b.com or @nobody_here."}`,
+		ExpectedStatus: http.StatusCreated,
+		ExpectedBody:   `{"message":"Post created successfully with id '4'"}`,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+
+	var post database.Post
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/posts/4",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &post)
+	expectMentions(t, post.Mentions, []database.Mention{
+		{Offset: 10, Length: 10, UserID: 1},
+		{Offset: 25, Length: 13, UserID: 2},
+	})
+	mention := waitForNotification(t, server.URL, "dev_user1:1", "mention")
+	waitForNotification(t, server.URL, "tech_writer2:2", "mention")
+
+	// Editing keeps dev_user1 and adds ui_designer5; only the new name is notified.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       fmt.Sprintf("/notifications/%d/read", mention.ID),
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       "/posts/4",
+		Input:          `{"content":"Thanks @dev_user1 and @ui_designer5."}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/posts/4",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &post)
+	expectMentions(t, post.Mentions, []database.Mention{
+		{Offset: 7, Length: 10, UserID: 1},
+		{Offset: 22, Length: 13, UserID: 5},
+	})
+	waitForNotification(t, server.URL, "ui_designer5:5", "mention")
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"count":0}`,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+
+	// A blocked user is neither linked nor notified.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/backend_guru4/blocks/data_scientist3",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "backend_guru4:4",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-project/1",
+		Input:          `{"user":3,"content":"@backend_guru4 @dev_user1 look"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+	var comment database.Comment
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/comments/13",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &comment)
+	expectMentions(t, comment.Mentions, []database.Mention{{Offset: 15, Length: 10, UserID: 1}})
+	for _, group := range fetchNotifications(t, server.URL, "backend_guru4:4") {
+		if group.Type == "mention" {
+			t.Fatalf("Expected no mention notification for a blocking user, got %+v", group)
+		}
+	}
+
+	// Authors do not mention themselves.
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       "/projects/3",
+		Input:          `{"about_md":"Maintained with @ui_designer5 by @data_scientist3"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+	var project database.Project
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/projects/3",
+		ExpectedStatus: http.StatusOK,
+	}.Fetch(t, server.URL, &project)
+	expectMentions(t, project.Mentions, []database.Mention{{Offset: 16, Length: 13, UserID: 5}})
+}
+
+func expectMentions(t *testing.T, got []database.Mention, want []database.Mention) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected mentions %+v, got %+v", want, got)
+	}
+}
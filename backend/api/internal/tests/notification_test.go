@@ -0,0 +1,559 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+)
+
+var notification_tests = []TestCase{
+
+	{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/preferences",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"preferences":{"digest":{"email":null,"frequency":"off","pending_email":null},"quiet_hours":null,"types":{"builder_added":{"email":true,"in_app":true,"push":true},"comment_post":{"email":true,"in_app":true,"push":true},"comment_project":{"email":true,"in_app":true,"push":true},"comment_reply":{"email":true,"in_app":true,"push":true},"conversation_message":{"email":true,"in_app":true,"push":true},"direct_message":{"email":true,"in_app":true,"push":true},"follow_user":{"email":true,"in_app":true,"push":true},"like_comment":{"email":true,"in_app":true,"push":true},"like_post":{"email":true,"in_app":true,"push":true},"like_project":{"email":true,"in_app":true,"push":true},"mention":{"email":true,"in_app":true,"push":true},"project_post":{"email":true,"in_app":true,"push":true},"save_post":{"email":true,"in_app":true,"push":true},"save_project":{"email":true,"in_app":true,"push":true}}}}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"types":{"poke":{"push":false}}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Unknown notification type 'poke'"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"quiet_hours":{"start":"25:00","end":"07:00"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Quiet hours start must be HH:MM"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"quiet_hours":{"start":"22:00","end":"07:00","time_zone":"Mars/Olympus"}}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Unknown time zone 'Mars/Olympus'"}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"types":{"save_post":{"push":false}},"quiet_hours":{"start":"22:00","end":"7:30","time_zone":"Europe/Berlin"}}`,
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Notification preferences updated","preferences":{"digest":{"email":null,"frequency":"off","pending_email":null},"quiet_hours":{"end":"07:30","start":"22:00","time_zone":"Europe/Berlin"},"types":{"builder_added":{"email":true,"in_app":true,"push":true},"comment_post":{"email":true,"in_app":true,"push":true},"comment_project":{"email":true,"in_app":true,"push":true},"comment_reply":{"email":true,"in_app":true,"push":true},"conversation_message":{"email":true,"in_app":true,"push":true},"direct_message":{"email":true,"in_app":true,"push":true},"follow_user":{"email":true,"in_app":true,"push":true},"like_comment":{"email":true,"in_app":true,"push":true},"like_post":{"email":true,"in_app":true,"push":true},"like_project":{"email":true,"in_app":true,"push":true},"mention":{"email":true,"in_app":true,"push":true},"project_post":{"email":true,"in_app":true,"push":true},"save_post":{"email":true,"in_app":true,"push":false},"save_project":{"email":true,"in_app":true,"push":true}}}}`,
+		AuthAs:         "data_scientist3:3",
+	},
+	// omitted channels and quiet hours are left alone, null clears them
+	{
+		Method:         http.MethodPut,
+		Endpoint:       "/notifications/preferences",
+		Input:          `{"types":{"save_post":{"email":true}},"quiet_hours":null}`,
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Notification preferences updated","preferences":{"digest":{"email":null,"frequency":"off","pending_email":null},"quiet_hours":null,"types":{"builder_added":{"email":true,"in_app":true,"push":true},"comment_post":{"email":true,"in_app":true,"push":true},"comment_project":{"email":true,"in_app":true,"push":true},"comment_reply":{"email":true,"in_app":true,"push":true},"conversation_message":{"email":true,"in_app":true,"push":true},"direct_message":{"email":true,"in_app":true,"push":true},"follow_user":{"email":true,"in_app":true,"push":true},"like_comment":{"email":true,"in_app":true,"push":true},"like_post":{"email":true,"in_app":true,"push":true},"like_project":{"email":true,"in_app":true,"push":true},"mention":{"email":true,"in_app":true,"push":true},"project_post":{"email":true,"in_app":true,"push":true},"save_post":{"email":true,"in_app":true,"push":false},"save_project":{"email":true,"in_app":true,"push":true}}}}`,
+		AuthAs:         "data_scientist3:3",
+	},
+}
+
+// TestNotificationInAppPreference checks that turning a type off in-app hides
+// it from the list and the unread count, and turning it back on restores it.
+func TestNotificationInAppPreference(t *testing.T) {
+	server := newTestServer(t)
+
+	steps := []TestCase{
+		{
+			Method:         http.MethodPut,
+			Endpoint:       "/notifications/preferences",
+			Input:          `{"types":{"direct_message":{"in_app":false}}}`,
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+			Input:          `{"content":"quietly","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications/unread-count",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"count":0}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `[]`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPut,
+			Endpoint:       "/notifications/preferences",
+			Input:          `{"types":{"direct_message":{"in_app":true}}}`,
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications/unread-count",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"count":1}`,
+			AuthAs:         "tech_writer2:2",
+		},
+	}
+	for _, step := range steps {
+		step.Run(t, server.URL)
+	}
+}
+
+// TestNotificationGrouping checks that follows from several users collapse
+// into one unread group, and that reading it makes the next follow start a
+// new group.
+func TestNotificationGrouping(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, follower := range []string{"dev_user1:1", "data_scientist3:3", "backend_guru4:4"} {
+		username := strings.SplitN(follower, ":", 2)[0]
+		TestCase{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/" + username + "/follow/tech_writer2",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         follower,
+		}.Run(t, server.URL)
+	}
+
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"count":1}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+
+	groups := fetchNotifications(t, server.URL, "tech_writer2:2")
+	if len(groups) != 1 {
+		t.Fatalf("Expected one notification group, got %d", len(groups))
+	}
+	group := groups[0]
+	if group.ActorCount != 3 || group.ActorName != "backend_guru4" || group.ReadAt != nil {
+		t.Fatalf("Unexpected group: %+v", group)
+	}
+	var sampled []string
+	for _, actor := range group.Actors {
+		sampled = append(sampled, actor.Name)
+	}
+	if strings.Join(sampled, ",") != "backend_guru4,data_scientist3,dev_user1" {
+		t.Fatalf("Unexpected sample actors: %v", sampled)
+	}
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       fmt.Sprintf("/notifications/%d/read", group.ID),
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"count":0}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/ui_designer5/follow/tech_writer2",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "ui_designer5:5",
+	}.Run(t, server.URL)
+
+	groups = fetchNotifications(t, server.URL, "tech_writer2:2")
+	if len(groups) != 2 || groups[0].ActorCount != 1 || groups[0].ReadAt != nil || groups[1].ReadAt == nil {
+		t.Fatalf("Expected a new unread group ahead of the read one, got %+v", groups)
+	}
+}
+
+// TestMessageNotificationGrouping checks that direct messages group per
+// sender and group chat messages per conversation.
+func TestMessageNotificationGrouping(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, sender := range []string{"dev_user1:1", "backend_guru4:4", "dev_user1:1"} {
+		username := strings.SplitN(sender, ":", 2)[0]
+		step := TestCase{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/" + username + "/with/tech_writer2",
+			Input:          `{"content":"ping","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         sender,
+		}
+		step.Run(t, server.URL)
+	}
+
+	var conversationIDs []int64
+	for _, title := range []string{"Design", "Infra"} {
+		var created struct {
+			Conversation database.Conversation `json:"conversation"`
+		}
+		step := TestCase{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations",
+			Input:          `{"title":"` + title + `","participants":["tech_writer2"]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		}
+		step.Fetch(t, server.URL, &created)
+		conversationIDs = append(conversationIDs, created.Conversation.ID)
+	}
+	for _, conversationID := range []int64{conversationIDs[0], conversationIDs[1], conversationIDs[0]} {
+		step := TestCase{
+			Method:         http.MethodPost,
+			Endpoint:       fmt.Sprintf("/conversations/%d/messages", conversationID),
+			Input:          `{"content":"hi all","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		}
+		step.Run(t, server.URL)
+	}
+
+	senders := map[string]int{}
+	conversations := map[int64]int{}
+	for _, group := range fetchNotifications(t, server.URL, "tech_writer2:2") {
+		switch group.Type {
+		case "direct_message":
+			if group.ActorCount != 1 {
+				t.Fatalf("Expected direct messages to group per sender, got %+v", group)
+			}
+			senders[group.ActorName]++
+		case "conversation_message":
+			if group.ConversationID == nil {
+				t.Fatalf("Expected group chat notifications to carry their conversation, got %+v", group)
+			}
+			conversations[*group.ConversationID]++
+		}
+	}
+	if len(senders) != 2 || senders["dev_user1"] != 1 || senders["backend_guru4"] != 1 {
+		t.Fatalf("Expected one direct message group per sender, got %v", senders)
+	}
+	if len(conversations) != 2 || conversations[conversationIDs[0]] != 1 || conversations[conversationIDs[1]] != 1 {
+		t.Fatalf("Expected one group chat group per conversation, got %v", conversations)
+	}
+}
+
+func TestActivityNotifications(t *testing.T) {
+	server := newTestServer(t)
+
+	// dev_user1 posts in their own project, which tech_writer2 follows.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          `{"user":1,"project":1,"content":"Shipped the new parser"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	// ui_designer5 replies to backend_guru4's comment on post 1.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-comment/7",
+		Input:          `{"user":5,"content":"Agreed","parent_comment":7}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "ui_designer5:5",
+	}.Run(t, server.URL)
+	// data_scientist3 comments on tech_writer2's project and likes post 1.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/comments/for-project/2",
+		Input:          `{"user":3,"content":"Nice stream"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts/data_scientist3/likes/1",
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+
+	waitForNotification(t, server.URL, "tech_writer2:2", "project_post")
+	waitForNotification(t, server.URL, "backend_guru4:4", "comment_reply")
+	waitForNotification(t, server.URL, "tech_writer2:2", "comment_project")
+	waitForNotification(t, server.URL, "dev_user1:1", "like_post")
+
+	// Unliking takes the notification back.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts/data_scientist3/unlikes/1",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+	for _, group := range fetchNotifications(t, server.URL, "dev_user1:1") {
+		if group.Type == "like_post" {
+			t.Fatalf("Expected the like notification to be removed, got %+v", group)
+		}
+	}
+}
+
+// TestNoSelfNotifications checks that acting on your own content, including
+// posting in a project you follow, notifies nobody but the others involved.
+func TestNoSelfNotifications(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, step := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/user/dev_user1/follow/1",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/comments/for-project/1",
+			Input:          `{"user":1,"content":"Notes to self"}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/posts/dev_user1/likes/1",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/posts",
+			Input:          `{"user":1,"project":1,"content":"Shipped the new parser"}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		step.Run(t, server.URL)
+	}
+
+	// The fan-out goes in id order, so once tech_writer2 has the post,
+	// dev_user1 has been passed over.
+	waitForNotification(t, server.URL, "tech_writer2:2", "project_post")
+	if groups := fetchNotifications(t, server.URL, "dev_user1:1"); len(groups) != 0 {
+		t.Fatalf("Expected no notifications about your own activity, got %+v", groups)
+	}
+}
+
+func TestBulkNotifications(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/dev_user1/follow/tech_writer2",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/posts/data_scientist3/likes/2",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/user/data_scientist3/likes/2",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "data_scientist3:3",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/user/ui_designer5/likes/2",
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/users/tech_writer2/follow/dev_user1",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "tech_writer2:2",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+
+	groupTypes := func(groups []database.Notification) []string {
+		types := make([]string, len(groups))
+		for index, group := range groups {
+			types[index] = group.Type
+		}
+		return types
+	}
+	expectTypes := func(query string, want ...string) []database.Notification {
+		t.Helper()
+		groups := fetchFilteredNotifications(t, server.URL, "tech_writer2:2", query)
+		if got := groupTypes(groups); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("Expected %v for %q, got %v", want, query, got)
+		}
+		return groups
+	}
+
+	groups := expectTypes("", "like_project", "like_post", "follow_user")
+	expectTypes("?type=like_post,follow_user", "like_post", "follow_user")
+	expectTypes("?type=like_post&type=like_project", "like_project", "like_post")
+	// Project filters cover the project and the posts in it.
+	expectTypes("?project_id=2", "like_project", "like_post")
+	expectTypes("?project_id=1")
+
+	followID := groups[2].ID
+	mine := fetchNotifications(t, server.URL, "dev_user1:1")
+	if len(mine) != 1 {
+		t.Fatalf("Expected dev_user1 to have one notification, got %+v", mine)
+	}
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications?type=poke",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"Unknown notification type 'poke'"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       "/notifications?unread=maybe",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"unread must be true or false"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/notifications/read",
+			Input:          `{"ids":[]}`,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"Bad Request","message":"ids must list at least one notification"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		// Someone else's notification is ignored.
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/notifications/read",
+			Input:          fmt.Sprintf(`{"ids":[%d,%d]}`, followID, mine[0].ID),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Notifications marked read","updated":1}`,
+			AuthAs:         "tech_writer2:2",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+	expectTypes("?unread=true", "like_project", "like_post")
+	expectTypes("?unread=false", "like_project", "like_post", "follow_user")
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/notifications/read-all",
+			Input:          `{"types":["like_post"]}`,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Notifications marked read","updated":1}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/notifications/read-all",
+			Input:          `{"before":"2000-01-01T00:00:00Z"}`,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Notifications marked read","updated":0}`,
+			AuthAs:         "tech_writer2:2",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+	expectTypes("?unread=true", "like_project")
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/read-all",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Notifications marked read","updated":2}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	expectTypes("?unread=true")
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/unread-count",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"count":0}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+
+	// Deleting by id removes the whole group.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/delete",
+		Input:          fmt.Sprintf(`{"ids":[%d,%d]}`, groups[0].ID, mine[0].ID),
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   `{"message":"Notifications deleted","deleted":2}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	expectTypes("", "like_post", "follow_user")
+	if len(fetchNotifications(t, server.URL, "dev_user1:1")) != 1 {
+		t.Fatalf("Expected dev_user1's notification to survive another user's bulk delete")
+	}
+}
+
+// waitForNotification polls until authAs has a notification of nType, since
+// fan-out to followers happens in the background.
+func waitForNotification(t *testing.T, serverURL string, authAs string, nType string) database.Notification {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, group := range fetchNotifications(t, serverURL, authAs) {
+			if group.Type == nType {
+				return group
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a %s notification for %s", nType, authAs)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func fetchNotifications(t *testing.T, serverURL string, authAs string) []database.Notification {
+	t.Helper()
+	return fetchFilteredNotifications(t, serverURL, authAs, "")
+}
+
+// fetchFilteredNotifications lists authAs's notification groups with the
+// query string filters applied.
+func fetchFilteredNotifications(t *testing.T, serverURL string, authAs string, query string) []database.Notification {
+	t.Helper()
+
+	parts := strings.SplitN(authAs, ":", 2)
+	userID, _ := strconv.ParseInt(parts[1], 10, 64)
+	token, err := auth.GenerateToken(userID, parts[0])
+	if err != nil {
+		t.Fatalf("Failed to generate auth token: %v", err)
+	}
+	request, _ := http.NewRequest(http.MethodGet, serverURL+"/notifications"+query, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to fetch notifications: %v", err)
+	}
+	defer response.Body.Close()
+
+	var groups []database.Notification
+	if err := json.NewDecoder(response.Body).Decode(&groups); err != nil {
+		t.Fatalf("Failed to decode notifications: %v", err)
+	}
+	return groups
+}
@@ -0,0 +1,489 @@
+package tests
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/handlers"
+	"backend/api/internal/netguard"
+	"backend/api/internal/push"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var push_tests = []TestCase{
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          `{"token":"not-a-token","platform":"ios"}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid push token: not an Expo push token"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+}
+
+func resetPushProviders(t *testing.T) {
+	t.Cleanup(func() {
+		handlers.UsePushProvider("", push.NewExpoProvider(push.DefaultExpoURL))
+		handlers.UsePushProvider("web", nil)
+	})
+}
+
+func TestPushTokenRegistration(t *testing.T) {
+	server := newTestServer(t)
+	resetPushProviders(t)
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          `{"token":"{}","platform":"web"}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Push is not available for platform 'web'"}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/web-push-key",
+		ExpectedStatus: http.StatusNotFound,
+		ExpectedBody:   `{"error":"Not Found","message":"Web push is not configured"}`,
+	}.Run(t, server.URL)
+
+	vapidKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	webPush, err := push.NewWebPushProvider(base64.RawURLEncoding.EncodeToString(vapidKey.Bytes()), "mailto:ops@devbits.app")
+	if err != nil {
+		t.Fatalf("Failed to create web push provider: %v", err)
+	}
+	handlers.UsePushProvider("web", webPush)
+
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/notifications/web-push-key",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   fmt.Sprintf(`{"public_key":%q}`, base64.RawURLEncoding.EncodeToString(vapidKey.PublicKey().Bytes())),
+	}.Run(t, server.URL)
+	subscription, _ := newTestSubscription(t, "http://push.example.com/send/1")
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          fmt.Sprintf(`{"token":%q,"platform":"web"}`, subscription),
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid push token: push subscription endpoint must be an https URL"}`,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	subscription, _ = newTestSubscription(t, "https://push.example.com/send/1")
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          fmt.Sprintf(`{"token":%q,"platform":"Web"}`, subscription),
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+
+	// With the recording provider, a follow is pushed to every registered device.
+	recorder := push.NewRecordingProvider()
+	handlers.UsePushProvider("", recorder)
+	handlers.UsePushProvider("web", recorder)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          `{"token":"ExponentPushToken[phone]","platform":"ios"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/data_scientist3/follow/tech_writer2",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "data_scientist3:3",
+	}.Run(t, server.URL)
+
+	deliveries := waitForDeliveries(t, recorder, 2)
+	for _, delivery := range deliveries {
+		if delivery.Message.Body != "data_scientist3 followed you" || delivery.Message.Data["type"] != "follow_user" {
+			t.Fatalf("Unexpected push: %+v", delivery)
+		}
+	}
+}
+
+func TestExpoPushDelivery(t *testing.T) {
+	server := newTestServer(t)
+	resetPushProviders(t)
+
+	received := make(chan push.ExpoMessage, 4)
+	expo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var messages []push.ExpoMessage
+		_ = json.NewDecoder(r.Body).Decode(&messages)
+		for _, message := range messages {
+			received <- message
+		}
+		if len(messages) == 1 && messages[0].To == "ExponentPushToken[uninstalled]" {
+			_, _ = w.Write([]byte(`{"data":[{"status":"error","message":"not registered","details":{"error":"DeviceNotRegistered"}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":[{"status":"ok","id":"ticket"}]}`))
+	}))
+	defer expo.Close()
+	handlers.UsePushProvider("", push.NewExpoProvider(expo.URL))
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/notifications/push-token",
+		Input:          `{"token":"ExponentPushToken[uninstalled]","platform":"android"}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/dev_user1/follow/tech_writer2",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+
+	select {
+	case message := <-received:
+		if message.To != "ExponentPushToken[uninstalled]" || message.Body != "dev_user1 followed you" {
+			t.Fatalf("Unexpected Expo message: %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the Expo push")
+	}
+
+	// The DeviceNotRegistered ticket drops the token.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tokens, _, err := database.QueryPushTokens(2)
+		if err != nil {
+			t.Fatalf("Failed to query push tokens: %v", err)
+		}
+		if len(tokens) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the unregistered token to be removed, still have %+v", tokens)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPushQueue(t *testing.T) {
+	server := newTestServer(t)
+	resetPushProviders(t)
+
+	const devices = 130
+	const stale = "ExponentPushToken[stale]"
+
+	var mu sync.Mutex
+	var batches []int
+	rateLimited := false
+	expo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/getReceipts" {
+			var request struct {
+				IDs []string `json:"ids"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			receipts := make(map[string]interface{}, len(request.IDs))
+			for _, id := range request.IDs {
+				receipts[id] = map[string]interface{}{"status": "ok"}
+			}
+			receipts["receipt-"+stale] = map[string]interface{}{
+				"status":  "error",
+				"message": "not registered",
+				"details": map[string]string{"error": "DeviceNotRegistered"},
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": receipts})
+			return
+		}
+
+		if !rateLimited {
+			rateLimited = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		var messages []push.ExpoMessage
+		_ = json.NewDecoder(r.Body).Decode(&messages)
+		batches = append(batches, len(messages))
+		tickets := make([]map[string]string, len(messages))
+		for index, message := range messages {
+			tickets[index] = map[string]string{"status": "ok", "id": "receipt-" + message.To}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": tickets})
+	}))
+	defer expo.Close()
+	handlers.UsePushProvider("", push.NewExpoProvider(expo.URL+"/send"))
+
+	for index := 0; index < devices; index++ {
+		if _, err := database.UpsertPushToken(2, fmt.Sprintf("ExponentPushToken[device-%d]", index), "ios"); err != nil {
+			t.Fatalf("Failed to register push token: %v", err)
+		}
+	}
+	if _, err := database.UpsertPushToken(2, stale, "ios"); err != nil {
+		t.Fatalf("Failed to register push token: %v", err)
+	}
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/dev_user1/follow/tech_writer2",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+
+	// The 429 puts every push back without spending an attempt, and even a
+	// zero Retry-After holds them for a while rather than retrying at once.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := database.GetPushQueueStats()
+		if err != nil {
+			t.Fatalf("Failed to fetch push stats: %v", err)
+		}
+		mu.Lock()
+		limited := rateLimited
+		mu.Unlock()
+		if limited && stats.Pending == devices+1 && stats.Sending == 0 {
+			if stats.Retrying != 0 {
+				t.Fatalf("Expected rate limited pushes to keep their attempts, got %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all pushes to wait out the rate limit, got %+v", stats)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	handlers.ProcessPushQueue(time.Now().Add(2 * time.Second))
+	mu.Lock()
+	if len(batches) != 0 {
+		t.Fatalf("Expected rate limited pushes to wait, got batches %v", batches)
+	}
+	mu.Unlock()
+
+	handlers.ProcessPushQueue(time.Now().Add(time.Minute))
+	mu.Lock()
+	if len(batches) != 2 || batches[0] != 100 || batches[1] != devices+1-100 {
+		t.Fatalf("Expected batches of 100 and %d, got %v", devices+1-100, batches)
+	}
+	mu.Unlock()
+
+	// Receipts are only fetched once they are due, and the stale device's
+	// receipt prunes its token.
+	handlers.ProcessPushQueue(time.Now().Add(20 * time.Minute))
+	tokens, _, err := database.QueryPushTokens(2)
+	if err != nil {
+		t.Fatalf("Failed to query push tokens: %v", err)
+	}
+	if len(tokens) != devices {
+		t.Fatalf("Expected %d push tokens, got %d", devices, len(tokens))
+	}
+	for _, token := range tokens {
+		if token.Token == stale {
+			t.Fatalf("Expected the stale token to be pruned")
+		}
+	}
+
+	if err := database.SetUserAdmin(1, nil, true); err != nil {
+		t.Fatalf("Failed to grant admin: %v", err)
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/admin/push/stats",
+		ExpectedStatus: http.StatusForbidden,
+		AuthAs:         "tech_writer2:2",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/admin/push/stats",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody: `{"pending":0,"sending":0,"sent":130,"failed":1,"retrying":0,"awaiting_receipt":0,"oldest_pending_at":null,
+			"platforms":{"ios":{"pending":0,"sending":0,"sent":130,"failed":1}}}`,
+		AuthAs: "dev_user1:1",
+	}.Run(t, server.URL)
+}
+
+func TestWebPushDelivery(t *testing.T) {
+	vapidKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	provider, err := push.NewWebPushProvider(base64.RawURLEncoding.EncodeToString(vapidKey.Bytes()), "mailto:ops@devbits.app")
+	if err != nil {
+		t.Fatalf("Failed to create web push provider: %v", err)
+	}
+
+	var subscriber *ecdh.PrivateKey
+	var authSecret []byte
+	status := http.StatusCreated
+	received := make(chan push.Message, 1)
+	service := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := status
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			t.Errorf("Unexpected headers: %v", r.Header)
+		}
+		verifyVAPID(t, r.Header.Get("Authorization"), "https://"+r.Host, vapidKey.PublicKey())
+
+		body, _ := io.ReadAll(r.Body)
+		plaintext := decryptWebPush(t, subscriber, authSecret, body)
+		var message push.Message
+		if err := json.Unmarshal(plaintext, &message); err != nil {
+			t.Errorf("Failed to decode push payload %q: %v", plaintext, err)
+		}
+		received <- message
+		w.WriteHeader(reply)
+	}))
+	defer service.Close()
+
+	// Subscriptions come from browsers, so by default they may not point
+	// inside the network, by name or by what the name resolves to.
+	var token string
+	token, subscriber = newTestSubscription(t, service.URL+"/send/abc")
+	for _, endpoint := range []string{service.URL + "/send/abc", "https://localhost/send/abc", "https://10.0.0.8/send/abc"} {
+		private, _ := newTestSubscription(t, endpoint)
+		if _, err := provider.Normalize(private); err == nil {
+			t.Fatalf("Expected a subscription at %s to be refused", endpoint)
+		}
+	}
+	if _, err := provider.Client.Get(service.URL); !errors.Is(err, netguard.ErrPrivateAddress) {
+		t.Fatalf("Expected the push client to refuse private addresses, got %v", err)
+	}
+
+	provider.AllowPrivate = true
+	provider.Client = service.Client()
+	var subscription push.WebPushSubscription
+	_ = json.Unmarshal([]byte(token), &subscription)
+	authSecret, _ = base64.RawURLEncoding.DecodeString(subscription.Keys.Auth)
+
+	message := push.Message{Title: "DevBits", Body: "dev_user1 followed you", Data: map[string]interface{}{"type": "follow_user"}}
+	if err := provider.Send(token, message); err != nil {
+		t.Fatalf("Failed to send web push: %v", err)
+	}
+	got := <-received
+	if got.Title != message.Title || got.Body != message.Body || got.Data["type"] != "follow_user" {
+		t.Fatalf("Unexpected decrypted message: %+v", got)
+	}
+
+	status = http.StatusGone
+	if err := provider.Send(token, message); err != push.ErrTokenGone {
+		t.Fatalf("Expected ErrTokenGone for an expired subscription, got %v", err)
+	}
+	<-received
+}
+
+// newTestSubscription returns a browser-style subscription for endpoint and
+// the subscriber's private key.
+func newTestSubscription(t *testing.T, endpoint string) (string, *ecdh.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate subscriber key: %v", err)
+	}
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+
+	subscription, _ := json.Marshal(map[string]interface{}{
+		"endpoint": endpoint,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(secret),
+		},
+	})
+	return string(subscription), key
+}
+
+func verifyVAPID(t *testing.T, header string, audience string, public *ecdh.PublicKey) {
+	t.Helper()
+
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[name] = value
+	}
+	if fields["k"] != base64.RawURLEncoding.EncodeToString(public.Bytes()) {
+		t.Errorf("Unexpected VAPID key %q", fields["k"])
+	}
+
+	raw := public.Bytes()
+	verifier := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(raw[1:33]), Y: new(big.Int).SetBytes(raw[33:])}
+	token, err := jwt.Parse(fields["t"], func(*jwt.Token) (interface{}, error) { return verifier, nil },
+		jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(audience))
+	if err != nil || !token.Valid {
+		t.Errorf("Invalid VAPID token: %v", err)
+	}
+}
+
+// decryptWebPush reverses RFC 8291 encryption as a browser would. It runs
+// in the stand-in push service, so failures are reported with t.Errorf.
+func decryptWebPush(t *testing.T, subscriber *ecdh.PrivateKey, authSecret []byte, body []byte) []byte {
+	t.Helper()
+
+	salt := body[:16]
+	recordSize := binary.BigEndian.Uint32(body[16:20])
+	keyLength := int(body[20])
+	senderKey := body[21 : 21+keyLength]
+	ciphertext := body[21+keyLength:]
+	if recordSize < uint32(len(ciphertext)) {
+		t.Errorf("Record size %d is smaller than the %d byte record", recordSize, len(ciphertext))
+		return nil
+	}
+
+	senderPublic, err := ecdh.P256().NewPublicKey(senderKey)
+	if err != nil {
+		t.Errorf("Invalid sender key: %v", err)
+		return nil
+	}
+	shared, _ := subscriber.ECDH(senderPublic)
+	keyPRK, _ := hkdf.Extract(sha256.New, shared, authSecret)
+	ikm, _ := hkdf.Expand(sha256.New, keyPRK, "WebPush: info\x00"+string(subscriber.PublicKey().Bytes())+string(senderKey), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	contentKey, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(contentKey)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Errorf("Failed to decrypt push: %v", err)
+		return nil
+	}
+	if record[len(record)-1] != 0x02 {
+		t.Errorf("Expected a final record delimiter, got %x", record[len(record)-1])
+		return nil
+	}
+	return record[:len(record)-1]
+}
+
+func waitForDeliveries(t *testing.T, recorder *push.RecordingProvider, count int) []push.Delivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := recorder.Deliveries()
+		if len(deliveries) >= count {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pushes, got %d", count, len(deliveries))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,816 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/api/internal/auth"
+	"backend/api/internal/database"
+	"backend/api/internal/realtime"
+
+	"github.com/gorilla/websocket"
+)
+
+type socketEvent struct {
+	Type     string `json:"type"`
+	Cursor   string `json:"cursor"`
+	Presence *struct {
+		Username string `json:"username"`
+		Online   bool   `json:"online"`
+	} `json:"presence"`
+	DirectMessage *struct {
+		Content string `json:"content"`
+	} `json:"direct_message"`
+	ReadReceipt *struct {
+		UpToID int64 `json:"up_to_id"`
+		Count  int64 `json:"count"`
+	} `json:"read_receipt"`
+	ConversationRead *struct {
+		Reader string `json:"reader"`
+	} `json:"conversation_read"`
+	Notification *struct {
+		Type string `json:"type"`
+	} `json:"notification"`
+	NotificationCount *struct {
+		Unread int64 `json:"unread"`
+	} `json:"notification_count"`
+	Resync *struct {
+		Reason string `json:"reason"`
+		Cursor string `json:"cursor"`
+	} `json:"resync"`
+}
+
+// setupRealtimeBackend prepares the database two API nodes share and
+// returns the brokers they publish through. For memory both nodes share one
+// broker over the sqlite test database, the way hubs in one process would.
+// For postgres each node has its own broker on one PostgreSQL database, as
+// separate API instances do.
+func setupRealtimeBackend(t *testing.T, backend string) (realtime.Broker, realtime.Broker) {
+	t.Helper()
+
+	if backend == "memory" {
+		setupTestDatabase(t)
+		broker := realtime.NewMemoryBroker()
+		return broker, broker
+	}
+
+	dsn := os.Getenv("DEVBITS_TEST_POSTGRES_URL")
+	if dsn == "" {
+		t.Skip("DEVBITS_TEST_POSTGRES_URL not set")
+	}
+	schemaDSN := setupPostgresTestDatabase(t, dsn)
+
+	brokers := make([]realtime.Broker, 2)
+	for index := range brokers {
+		broker, err := realtime.NewPostgresBroker(database.DB, schemaDSN)
+		if err != nil {
+			t.Fatalf("Failed to start postgres broker: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = broker.Close()
+		})
+		brokers[index] = broker
+	}
+	return brokers[0], brokers[1]
+}
+
+// nextSocketEvent reads until an event matching accept arrives and returns it.
+func nextSocketEvent(t *testing.T, connection *websocket.Conn, description string, accept func(socketEvent) bool) socketEvent {
+	t.Helper()
+
+	_ = connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, payload, err := connection.ReadMessage()
+		if err != nil {
+			t.Fatalf("Did not receive %s: %v", description, err)
+		}
+		var event socketEvent
+		if json.Unmarshal(payload, &event) == nil && accept(event) {
+			return event
+		}
+	}
+}
+
+func waitForSocketEvent(t *testing.T, connection *websocket.Conn, eventType string) {
+	t.Helper()
+	nextSocketEvent(t, connection, strconv.Quote(eventType)+" event", func(event socketEvent) bool {
+		return event.Type == eventType
+	})
+}
+
+// openTestStream opens username's websocket stream, resuming after since
+// unless it is empty.
+func openTestStream(t *testing.T, serverURL string, userID int64, username string, since string) *websocket.Conn {
+	t.Helper()
+
+	token, err := auth.GenerateToken(userID, username)
+	if err != nil {
+		t.Fatalf("Failed to generate auth token: %v", err)
+	}
+	streamURL := "ws" + strings.TrimPrefix(serverURL, "http") + "/messages/" + username + "/stream?token=" + token
+	if since != "" {
+		streamURL += "&since=" + since
+	}
+	connection, _, err := websocket.DefaultDialer.Dial(streamURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = connection.Close()
+	})
+	return connection
+}
+
+// TestRealtimeCrossNode runs two API nodes on one database and checks that
+// messages, typing, notifications and presence work for users connected to
+// different nodes.
+func TestRealtimeCrossNode(t *testing.T) {
+	for _, backend := range []string{"memory", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			brokerA, brokerB := setupRealtimeBackend(t, backend)
+			nodeA := startTestNode(t, brokerA)
+			nodeB := startTestNode(t, brokerB)
+
+			writerSocket := openTestStream(t, nodeB.URL, 2, "tech_writer2", "")
+
+			// A message sent through node A reaches the socket on node B.
+			sendTestDirectMessage(t, nodeA.URL, "across nodes")
+			waitForSocketEvent(t, writerSocket, "direct_message")
+
+			// A typing frame sent to node A reaches the socket on node B.
+			designerSocket := openTestStream(t, nodeA.URL, 5, "ui_designer5", "")
+			if err := designerSocket.WriteMessage(websocket.TextMessage, []byte(`{"type":"typing_start","peer":"tech_writer2"}`)); err != nil {
+				t.Fatalf("Failed to send typing frame: %v", err)
+			}
+			waitForSocketEvent(t, writerSocket, "typing")
+
+			// A follow through node A notifies the socket on node B and
+			// updates its unread count.
+			TestCase{
+				Method:         http.MethodPost,
+				Endpoint:       "/users/data_scientist3/follow/tech_writer2",
+				ExpectedStatus: http.StatusOK,
+				AuthAs:         "data_scientist3:3",
+			}.Fetch(t, nodeA.URL, nil)
+			nextSocketEvent(t, writerSocket, "follow notification", func(event socketEvent) bool {
+				return event.Type == "notification" && event.Notification != nil && event.Notification.Type == "follow_user"
+			})
+			nextSocketEvent(t, writerSocket, "unread count", func(event socketEvent) bool {
+				return event.Type == "notification_count" && event.NotificationCount != nil && event.NotificationCount.Unread > 0
+			})
+
+			// Node A sees tech_writer2 online while they are connected to
+			// node B, and offline once they leave.
+			peers := TestCase{
+				Method:         http.MethodGet,
+				Endpoint:       "/messages/ui_designer5/peers",
+				ExpectedStatus: http.StatusOK,
+				AuthAs:         "ui_designer5:5",
+			}
+			var presence struct {
+				Presence []struct {
+					Username string `json:"username"`
+					Online   bool   `json:"online"`
+				} `json:"presence"`
+			}
+			peers.Fetch(t, nodeA.URL, &presence)
+			if len(presence.Presence) != 1 || !presence.Presence[0].Online {
+				t.Fatalf("Expected tech_writer2 online from node A, got %+v", presence.Presence)
+			}
+
+			_ = writerSocket.Close()
+			nextSocketEvent(t, designerSocket, "offline presence", func(event socketEvent) bool {
+				return event.Type == "presence" && event.Presence != nil &&
+					event.Presence.Username == "tech_writer2" && !event.Presence.Online
+			})
+			peers.Fetch(t, nodeA.URL, &presence)
+			if len(presence.Presence) != 1 || presence.Presence[0].Online {
+				t.Fatalf("Expected tech_writer2 offline from node A, got %+v", presence.Presence)
+			}
+		})
+	}
+}
+
+// sendTestDirectMessage sends content from ui_designer5 to tech_writer2.
+func sendTestDirectMessage(t *testing.T, serverURL string, content string) {
+	t.Helper()
+
+	input, err := json.Marshal(map[string]interface{}{"content": content, "media": []string{}})
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+		Input:          string(input),
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "ui_designer5:5",
+	}.Fetch(t, serverURL, nil)
+}
+
+// TestStreamReplayOnReconnect checks that ?since= replays only the messages a
+// client missed, then carries on live.
+func TestStreamReplayOnReconnect(t *testing.T) {
+	server := newTestServer(t)
+
+	sendTestDirectMessage(t, server.URL, "first")
+	sendTestDirectMessage(t, server.URL, `"second"`)
+
+	connection := openTestStream(t, server.URL, 2, "tech_writer2", "1")
+	nextMessage := func(description string) string {
+		t.Helper()
+		event := nextSocketEvent(t, connection, description, func(event socketEvent) bool {
+			return event.Type == "direct_message"
+		})
+		return event.DirectMessage.Content
+	}
+
+	if content := nextMessage("replay of the second message"); content != `"second"` {
+		t.Fatalf("Expected replay of the second message, got %q", content)
+	}
+
+	sendTestDirectMessage(t, server.URL, "third")
+	if content := nextMessage("live delivery of the third message"); content != "third" {
+		t.Fatalf("Expected live delivery of the third message, got %q", content)
+	}
+}
+
+// readSocketEvent returns the next event on connection.
+func readSocketEvent(t *testing.T, connection *websocket.Conn) socketEvent {
+	t.Helper()
+
+	_ = connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, payload, err := connection.ReadMessage()
+	if err != nil {
+		t.Fatalf("Stream ended early: %v", err)
+	}
+	var event socketEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("Invalid stream event %q: %v", payload, err)
+	}
+	return event
+}
+
+// TestReadReceiptNamesLastMessage checks that marking a whole conversation
+// read reports the newest message it covered, not 0.
+func TestReadReceiptNamesLastMessage(t *testing.T) {
+	server := newTestServer(t)
+
+	connection := openTestStream(t, server.URL, 2, "tech_writer2", "")
+	sendTestDirectMessage(t, server.URL, "first")
+	waitForSocketEvent(t, connection, "direct_message")
+	sendTestDirectMessage(t, server.URL, "second")
+	waitForSocketEvent(t, connection, "direct_message")
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/tech_writer2/with/ui_designer5/read",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}.Fetch(t, server.URL, nil)
+	nextSocketEvent(t, connection, "read receipt up to message 2", func(event socketEvent) bool {
+		return event.Type == "read_receipt" && event.ReadReceipt.UpToID == 2 && event.ReadReceipt.Count == 2
+	})
+}
+
+// TestStreamReplayCoversChanges checks that a reconnect replays group
+// messages, edits and read receipts as well as new direct messages, in the
+// order they happened.
+func TestStreamReplayCoversChanges(t *testing.T) {
+	server := newTestServer(t)
+
+	connection := openTestStream(t, server.URL, 2, "tech_writer2", "")
+	sendTestDirectMessage(t, server.URL, "first")
+	first := readSocketEvent(t, connection)
+	if first.Type != "direct_message" || first.Cursor == "" {
+		t.Fatalf("Expected the first message with a cursor, got %+v", first)
+	}
+	connection.Close()
+
+	// While tech_writer2 is away the first message is edited, a second one
+	// arrives, they read both on another device and a group chat starts.
+	steps := []TestCase{
+		{
+			Method:         http.MethodPut,
+			Endpoint:       "/messages/ui_designer5/with/tech_writer2/1",
+			Input:          `{"content":"first, edited"}`,
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/ui_designer5/with/tech_writer2",
+			Input:          `{"content":"second","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/messages/tech_writer2/with/ui_designer5/read",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations",
+			Input:          `{"title":"Docs","participants":["tech_writer2"]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations/1/messages",
+			Input:          `{"content":"hello group","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations/1/read",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "tech_writer2:2",
+		},
+	}
+	for _, step := range steps {
+		step.Fetch(t, server.URL, nil)
+	}
+
+	connection = openTestStream(t, server.URL, 2, "tech_writer2", first.Cursor)
+	expected := []string{
+		"direct_message:second",
+		"conversation_message",
+		"direct_message_updated:first, edited",
+		"read_receipt",
+		"conversation_read:ui_designer5",
+		"conversation_read:tech_writer2",
+	}
+	for _, want := range expected {
+		event := readSocketEvent(t, connection)
+		got := event.Type
+		if event.DirectMessage != nil {
+			got += ":" + event.DirectMessage.Content
+		}
+		if event.ConversationRead != nil {
+			got += ":" + event.ConversationRead.Reader
+		}
+		if got != want {
+			t.Fatalf("Expected replay of %s, got %s", want, got)
+		}
+		if event.Cursor == "" {
+			t.Fatalf("Replayed %s without a cursor", got)
+		}
+	}
+}
+
+// TestStreamReplayLimit checks that a client too far behind gets the replay
+// limit's worth of messages and a resync cursor it can resume from.
+func TestStreamReplayLimit(t *testing.T) {
+	server := newTestServer(t)
+
+	const missed = 520
+	_, err := database.DB.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < $1)
+		INSERT INTO directmessages (sender_id, recipient_id, content, media, creation_date)
+		SELECT 5, 2, 'missed ' || i, '[]', '2025-01-01 00:00:00' FROM n;`, missed)
+	if err != nil {
+		t.Fatalf("Failed to insert messages: %v", err)
+	}
+
+	connection := openTestStream(t, server.URL, 2, "tech_writer2", "0.0.0")
+	replayed := 0
+	var resync socketEvent
+	for resync.Resync == nil {
+		event := readSocketEvent(t, connection)
+		if event.Type == "direct_message" {
+			replayed++
+		} else if event.Type == "resync" {
+			resync = event
+		}
+	}
+	if replayed != 500 || resync.Resync.Reason != "replay_limit" {
+		t.Fatalf("Expected 500 messages then a replay_limit resync, got %d and %+v", replayed, resync.Resync)
+	}
+	connection.Close()
+
+	// Resuming from the resync cursor delivers the rest, then live messages.
+	connection = openTestStream(t, server.URL, 2, "tech_writer2", resync.Resync.Cursor)
+	sendTestDirectMessage(t, server.URL, "live")
+	remaining := 0
+	for {
+		event := readSocketEvent(t, connection)
+		if event.Type == "resync" {
+			t.Fatalf("Unexpected second resync: %+v", event.Resync)
+		}
+		if event.DirectMessage == nil {
+			continue
+		}
+		if event.DirectMessage.Content == "live" {
+			break
+		}
+		remaining++
+	}
+	if remaining != missed-500 {
+		t.Fatalf("Expected %d remaining messages, got %d", missed-500, remaining)
+	}
+}
+
+// floodStream publishes large events to username while the client is not
+// reading, until the socket buffers and the stream's queue are full.
+func floodStream(t *testing.T, broker realtime.Broker, username string) {
+	t.Helper()
+
+	padding := strings.Repeat("x", 16*1024)
+	typing := []byte(`{"type":"typing","typing":{"username":"` + padding + `","peer":"` + username + `","typing":true}}`)
+	for range 4096 {
+		if err := broker.Publish(username, typing); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+}
+
+// TestStreamSlowConsumer checks that a stream which cannot keep up is told to
+// resync and closed instead of silently losing events.
+func TestStreamSlowConsumer(t *testing.T) {
+	setupTestDatabase(t)
+	broker := realtime.NewMemoryBroker()
+	server := startTestNode(t, broker)
+
+	connection := openTestStream(t, server.URL, 2, "tech_writer2", "")
+	sendTestDirectMessage(t, server.URL, "before")
+
+	floodStream(t, broker, "tech_writer2")
+
+	var resync *socketEvent
+	for resync == nil {
+		event := readSocketEvent(t, connection)
+		if event.Type == "resync" {
+			resync = &event
+		}
+	}
+	if resync.Resync.Reason != "slow_consumer" || !strings.HasPrefix(resync.Resync.Cursor, "1.") {
+		t.Fatalf("Expected a slow_consumer resync after message 1, got %+v", resync.Resync)
+	}
+
+	_ = connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := connection.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("Expected the stream to close after the resync, got %v", err)
+	}
+}
+
+type sseFrame struct {
+	Event   string
+	ID      string
+	Data    string
+	Comment string
+}
+
+// openEventStream opens username's Server-Sent Events stream, resuming from
+// lastEventID unless it is empty.
+func openEventStream(t *testing.T, serverURL string, userID int64, username string, lastEventID string) *bufio.Scanner {
+	t.Helper()
+
+	token, err := auth.GenerateToken(userID, username)
+	if err != nil {
+		t.Fatalf("Failed to generate auth token: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/messages/"+username+"/events", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() {
+		response.Body.Close()
+	})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 opening event stream, got %d", response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", contentType)
+	}
+	lines := bufio.NewScanner(response.Body)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	return lines
+}
+
+// readSSEFrame returns the next event or comment on the stream, skipping the
+// retry hint.
+func readSSEFrame(t *testing.T, lines *bufio.Scanner) sseFrame {
+	t.Helper()
+
+	var frame sseFrame
+	for lines.Scan() {
+		line := lines.Text()
+		if line == "" {
+			if frame != (sseFrame{}) {
+				return frame
+			}
+			continue
+		}
+		if value, found := strings.CutPrefix(line, "event: "); found {
+			frame.Event = value
+		} else if value, found := strings.CutPrefix(line, "id: "); found {
+			frame.ID = value
+		} else if value, found := strings.CutPrefix(line, "data: "); found {
+			frame.Data = value
+		} else if value, found := strings.CutPrefix(line, ": "); found {
+			frame.Comment = value
+		}
+	}
+	t.Fatalf("Event stream ended: %v", lines.Err())
+	return frame
+}
+
+// TestEventStreamResume checks the SSE fallback stamps message events with
+// the stream cursor and resumes from Last-Event-ID, a plain message id
+// included.
+func TestEventStreamResume(t *testing.T) {
+	server := newTestServer(t)
+
+	sendTestDirectMessage(t, server.URL, "first")
+	sendTestDirectMessage(t, server.URL, "second")
+
+	lines := openEventStream(t, server.URL, 2, "tech_writer2", "1")
+	frame := readSSEFrame(t, lines)
+	if frame.Event != "direct_message" || frame.ID == "" || !strings.Contains(frame.Data, `"content":"second"`) {
+		t.Fatalf("Expected replay of the second message with an id, got %+v", frame)
+	}
+
+	// Group messages carry an id too.
+	steps := []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations",
+			Input:          `{"title":"Docs","participants":["tech_writer2"]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/conversations/1/messages",
+			Input:          `{"content":"hello group","media":[]}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "ui_designer5:5",
+		},
+	}
+	for _, step := range steps {
+		step.Fetch(t, server.URL, nil)
+	}
+	for frame.Event != "conversation_message" {
+		frame = readSSEFrame(t, lines)
+	}
+	if frame.ID == "" {
+		t.Fatalf("Expected the conversation message to carry an id, got %+v", frame)
+	}
+
+	// Resuming from it skips everything already seen.
+	sendTestDirectMessage(t, server.URL, "third")
+	lines = openEventStream(t, server.URL, 2, "tech_writer2", frame.ID)
+	frame = readSSEFrame(t, lines)
+	if frame.Event != "direct_message" || !strings.Contains(frame.Data, `"content":"third"`) {
+		t.Fatalf("Expected only the third message after resuming, got %+v", frame)
+	}
+}
+
+// TestEventStreamHeartbeat checks an idle SSE stream sends keep-alive
+// comments.
+func TestEventStreamHeartbeat(t *testing.T) {
+	t.Setenv("DEVBITS_SSE_HEARTBEAT_SECONDS", "1")
+	server := newTestServer(t)
+
+	lines := openEventStream(t, server.URL, 2, "tech_writer2", "")
+	if frame := readSSEFrame(t, lines); frame.Comment != "heartbeat" {
+		t.Fatalf("Expected a heartbeat, got %+v", frame)
+	}
+}
+
+// TestEventStreamSlowConsumer checks the SSE stream ends with a resync event
+// when the client falls too far behind.
+func TestEventStreamSlowConsumer(t *testing.T) {
+	setupTestDatabase(t)
+	broker := realtime.NewMemoryBroker()
+	server := startTestNode(t, broker)
+
+	lines := openEventStream(t, server.URL, 2, "tech_writer2", "")
+	sendTestDirectMessage(t, server.URL, "before")
+	if frame := readSSEFrame(t, lines); frame.Event != "direct_message" {
+		t.Fatalf("Expected the first message, got %+v", frame)
+	}
+
+	floodStream(t, broker, "tech_writer2")
+
+	frame := readSSEFrame(t, lines)
+	for frame.Event != "resync" {
+		frame = readSSEFrame(t, lines)
+	}
+	if !strings.Contains(frame.Data, `"reason":"slow_consumer"`) || !strings.Contains(frame.Data, `"cursor":"1.`) {
+		t.Fatalf("Expected a slow_consumer resync after message 1, got %+v", frame)
+	}
+	for lines.Scan() {
+		// Drain until the server hangs up.
+	}
+	if err := lines.Err(); err != nil {
+		t.Fatalf("Expected the stream to end after the resync, got %v", err)
+	}
+}
+
+// TestNotificationStream checks that notifications and unread-count changes
+// arrive on the same socket as direct messages.
+func TestNotificationStream(t *testing.T) {
+	server := newTestServer(t)
+
+	token, err := auth.GenerateToken(2, "tech_writer2")
+	if err != nil {
+		t.Fatalf("Failed to generate auth token: %v", err)
+	}
+	streamURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/messages/tech_writer2/stream?token=" + token
+	connection, _, err := websocket.DefaultDialer.Dial(streamURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer connection.Close()
+
+	type streamEvent struct {
+		Type         string `json:"type"`
+		Notification *struct {
+			ID        int64  `json:"id"`
+			Type      string `json:"type"`
+			ActorName string `json:"actor_name"`
+		} `json:"notification"`
+		NotificationCount *struct {
+			Unread int64 `json:"unread"`
+		} `json:"notification_count"`
+	}
+	readEvent := func(eventType string) streamEvent {
+		t.Helper()
+		_ = connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, payload, err := connection.ReadMessage()
+			if err != nil {
+				t.Fatalf("Did not receive %q event: %v", eventType, err)
+			}
+			var event streamEvent
+			if json.Unmarshal(payload, &event) == nil && event.Type == eventType {
+				return event
+			}
+		}
+	}
+
+	// A direct message notifies the recipient and bumps their unread count.
+	sendTestDirectMessage(t, server.URL, "ping")
+	readEvent("direct_message")
+
+	created := readEvent("notification")
+	if created.Notification == nil || created.Notification.Type != "direct_message" || created.Notification.ActorName != "ui_designer5" {
+		t.Fatalf("Unexpected notification event: %+v", created.Notification)
+	}
+	count := readEvent("notification_count")
+	if count.NotificationCount == nil || count.NotificationCount.Unread != 1 {
+		t.Fatalf("Expected one unread notification, got %+v", count.NotificationCount)
+	}
+
+	// Reading it publishes the new count.
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/notifications/"+strconv.FormatInt(created.Notification.ID, 10)+"/read", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to mark notification read: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 marking notification read, got %d", response.StatusCode)
+	}
+
+	count = readEvent("notification_count")
+	if count.NotificationCount == nil || count.NotificationCount.Unread != 0 {
+		t.Fatalf("Expected no unread notifications, got %+v", count.NotificationCount)
+	}
+}
+
+// TestTypingIndicators checks typing frames only reach peers the sender
+// shares a conversation with and neither has blocked.
+func TestTypingIndicators(t *testing.T) {
+	server := newTestServer(t)
+
+	dial := func(userID int64, username string) *websocket.Conn {
+		t.Helper()
+		token, err := auth.GenerateToken(userID, username)
+		if err != nil {
+			t.Fatalf("Failed to generate auth token: %v", err)
+		}
+		connection, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/messages/"+username+"/stream?token="+token, nil)
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		t.Cleanup(func() {
+			connection.Close()
+		})
+		return connection
+	}
+	sendFrame := func(connection *websocket.Conn, frame string) {
+		t.Helper()
+		if err := connection.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("Failed to send frame: %v", err)
+		}
+	}
+	// nextEvent returns the next direct_message or typing event.
+	nextEvent := func(connection *websocket.Conn) (string, bool) {
+		t.Helper()
+		_ = connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, payload, err := connection.ReadMessage()
+			if err != nil {
+				t.Fatalf("Stream ended early: %v", err)
+			}
+			var event struct {
+				Type   string `json:"type"`
+				Typing *struct {
+					Typing bool `json:"typing"`
+				} `json:"typing"`
+			}
+			if json.Unmarshal(payload, &event) != nil {
+				continue
+			}
+			if event.Type == "direct_message" {
+				return event.Type, false
+			}
+			if event.Type == "typing" && event.Typing != nil {
+				return event.Type, event.Typing.Typing
+			}
+		}
+	}
+
+	// ui_designer5 already talks to dev_user1 but not yet to tech_writer2.
+	(&TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/dev_user1",
+		Input:          `{"content":"hi","media":[]}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "ui_designer5:5",
+	}).Fetch(t, server.URL, nil)
+
+	sender := dial(5, "ui_designer5")
+	writer := dial(2, "tech_writer2")
+	designer := dial(1, "dev_user1")
+	guru := dial(4, "backend_guru4")
+
+	// Frames are handled in order, so once dev_user1 sees the second
+	// indicator the first has been dropped rather than delayed.
+	sendFrame(sender, `{"type":"typing_start","peer":"backend_guru4"}`)
+	sendFrame(sender, `{"type":"typing_start","peer":"dev_user1"}`)
+	if eventType, typing := nextEvent(designer); eventType != "typing" || !typing {
+		t.Fatalf("Expected dev_user1 to see ui_designer5 typing, got %s", eventType)
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/messages/ui_designer5/with/backend_guru4",
+		Input:          `{"content":"hello","media":[]}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "ui_designer5:5",
+	}.Fetch(t, server.URL, nil)
+	if eventType, _ := nextEvent(guru); eventType != "direct_message" {
+		t.Fatalf("Expected no typing indicator without a shared conversation, got %s", eventType)
+	}
+
+	// A repeated start is not sent again; the next event is the stop.
+	sendFrame(sender, `{"type":"typing_start","peer":"dev_user1"}`)
+	sendFrame(sender, `{"type":"typing_stop","peer":"dev_user1"}`)
+	if eventType, typing := nextEvent(designer); eventType != "typing" || typing {
+		t.Fatalf("Expected only the typing stop after a repeated start, got %s typing=%v", eventType, typing)
+	}
+
+	sendTestDirectMessage(t, server.URL, "hello")
+	if eventType, _ := nextEvent(writer); eventType != "direct_message" {
+		t.Fatalf("Expected the message to tech_writer2, got %s", eventType)
+	}
+	sendFrame(sender, `{"type":"typing_start","peer":"tech_writer2"}`)
+	if eventType, typing := nextEvent(writer); eventType != "typing" || !typing {
+		t.Fatalf("Expected tech_writer2 to see ui_designer5 typing, got %s", eventType)
+	}
+
+	// After a block only the stop for the running indicator gets through.
+	(&TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/users/tech_writer2/blocks/ui_designer5",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "tech_writer2:2",
+	}).Fetch(t, server.URL, nil)
+	sendFrame(sender, `{"type":"typing_start","peer":"tech_writer2"}`)
+	sendFrame(sender, `{"type":"typing_stop","peer":"tech_writer2"}`)
+	if eventType, typing := nextEvent(writer); eventType != "typing" || typing {
+		t.Fatalf("Expected only the typing stop once blocked, got %s typing=%v", eventType, typing)
+	}
+}
@@ -0,0 +1,401 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/api/internal/database"
+	"backend/api/internal/handlers"
+	"backend/api/internal/webhooks"
+)
+
+var webhook_tests = []TestCase{
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"http://127.0.0.1:8080/hook"}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid webhook url: address is not public"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"https://example.com/hook"}`,
+		ExpectedStatus: http.StatusForbidden,
+		ExpectedBody:   `{"error":"Forbidden","message":"Only the owner can manage webhooks"}`,
+		AuthAs:         "tech_writer2:2",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"ftp://example.com/hook"}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Invalid webhook url: url must be an absolute http or https URL"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"https://example.com/hook","events":["post.deleted"]}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Unknown webhook event 'post.deleted'"}`,
+		AuthAs:         "dev_user1:1",
+	},
+	{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"https://example.com/hook","secret":"short"}`,
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   `{"error":"Bad Request","message":"Webhook secret must be at least 16 characters"}`,
+		AuthAs:         "dev_user1:1",
+	},
+}
+
+const webhookTestSecret = "integration-secret-123"
+
+type receivedWebhook struct {
+	Event     string
+	Delivery  string
+	Signature string
+	Body      []byte
+}
+
+// webhookReceiver stands in for a team's own tool, answering each delivery
+// with the next queued status, or the last one once the queue runs out.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []receivedWebhook
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	receiver.mu.Lock()
+	receiver.received = append(receiver.received, receivedWebhook{
+		Event:     r.Header.Get("X-DevBits-Event"),
+		Delivery:  r.Header.Get("X-DevBits-Delivery"),
+		Signature: r.Header.Get(webhooks.SignatureHeader),
+		Body:      body,
+	})
+	status := receiver.statuses[0]
+	if len(receiver.statuses) > 1 {
+		receiver.statuses = receiver.statuses[1:]
+	}
+	receiver.mu.Unlock()
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"status":%d}`, status)
+}
+
+func (receiver *webhookReceiver) respondWith(statuses ...int) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.statuses = statuses
+}
+
+func (receiver *webhookReceiver) count() int {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return len(receiver.received)
+}
+
+// waitFor polls until the receiver has count deliveries.
+func (receiver *webhookReceiver) waitFor(t *testing.T, count int) []receivedWebhook {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		receiver.mu.Lock()
+		received := append([]receivedWebhook(nil), receiver.received...)
+		receiver.mu.Unlock()
+		if len(received) >= count {
+			return received
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d webhook deliveries, got %d", count, len(received))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestProjectWebhooks(t *testing.T) {
+	server := newTestServer(t)
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+	endpoint := httptest.NewServer(receiver)
+	t.Cleanup(endpoint.Close)
+	t.Setenv("DEVBITS_WEBHOOK_MAX_ATTEMPTS", "5")
+	t.Setenv("DEVBITS_WEBHOOK_DISABLE_AFTER", "3")
+
+	t.Setenv("DEVBITS_WEBHOOK_ALLOW_PRIVATE", "true")
+
+	var created struct {
+		Webhook database.ProjectWebhook `json:"webhook"`
+		Secret  string                  `json:"secret"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/projects/1/webhooks",
+		Input:          `{"url":"` + endpoint.URL + `/hook","events":["post.created","Comment.Created","builder.added","post.created"],"secret":"` + webhookTestSecret + `"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &created)
+	if created.Secret != webhookTestSecret || !created.Webhook.Active {
+		t.Fatalf("Unexpected created webhook: %+v", created)
+	}
+	if strings.Join(created.Webhook.Events, ",") != "post.created,comment.created,builder.added" {
+		t.Fatalf("Expected events to be normalized, got %v", created.Webhook.Events)
+	}
+	hookPath := fmt.Sprintf("/projects/1/webhooks/%d", created.Webhook.ID)
+
+	// The first attempt fails and is retried with backoff.
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          `{"user":1,"project":1,"content":"Shipped the webhook receiver"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	log := waitForWebhookLog(t, server.URL, hookPath, func(log []database.WebhookDelivery) bool {
+		return len(log) == 1 && log[0].Attempts == 1 && log[0].Status == database.WebhookPending
+	})
+	if log[0].ResponseCode == nil || *log[0].ResponseCode != http.StatusInternalServerError || log[0].NextAttemptAt == nil {
+		t.Fatalf("Expected the failed attempt to be logged, got %+v", log[0])
+	}
+	handlers.ProcessWebhookQueue(time.Now())
+	if receiver.count() != 1 {
+		t.Fatalf("Expected the retry to wait out its backoff, got %d deliveries", receiver.count())
+	}
+
+	handlers.ProcessWebhookQueue(time.Now().Add(time.Minute))
+	log = waitForWebhookLog(t, server.URL, hookPath, func(log []database.WebhookDelivery) bool {
+		return len(log) == 1 && log[0].Status == database.WebhookDelivered
+	})
+	postDelivery := log[0]
+	if postDelivery.Attempts != 2 || *postDelivery.ResponseCode != http.StatusOK || postDelivery.DeliveredAt == nil {
+		t.Fatalf("Unexpected delivered entry: %+v", postDelivery)
+	}
+
+	received := receiver.waitFor(t, 2)
+	delivery := received[1]
+	if delivery.Event != webhooks.EventPostCreated || delivery.Delivery != strconv.FormatInt(postDelivery.ID, 10) {
+		t.Fatalf("Unexpected delivery headers: %+v", delivery)
+	}
+	if !webhooks.Verify(webhookTestSecret, delivery.Body, delivery.Signature) || webhooks.Verify("wrong-secret-value", delivery.Body, delivery.Signature) {
+		t.Fatalf("Signature %q does not match the body", delivery.Signature)
+	}
+	var payload struct {
+		Event   string `json:"event"`
+		Project struct {
+			ID int64 `json:"id"`
+		} `json:"project"`
+		Actor struct {
+			Username string `json:"username"`
+		} `json:"actor"`
+		Data struct {
+			Post database.Post `json:"post"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(delivery.Body, &payload); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if payload.Event != webhooks.EventPostCreated || payload.Project.ID != 1 || payload.Actor.Username != "dev_user1" ||
+		payload.Data.Post.Content != "Shipped the webhook receiver" {
+		t.Fatalf("Unexpected payload: %s", delivery.Body)
+	}
+
+	// Only subscribed events are delivered.
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/user/data_scientist3/follow/1",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "data_scientist3:3",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/comments/for-post/1",
+			Input:          `{"user":2,"content":"Nice work","parent_comment":null}`,
+			ExpectedStatus: http.StatusCreated,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodPost,
+			Endpoint:       "/projects/1/builders/data_scientist3",
+			ExpectedStatus: http.StatusOK,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+	received = receiver.waitFor(t, 4)
+	events := []string{received[2].Event, received[3].Event}
+	if !(strings.Contains(strings.Join(events, ","), webhooks.EventCommentCreated) && strings.Contains(strings.Join(events, ","), webhooks.EventBuilderAdded)) {
+		t.Fatalf("Expected comment and builder events, got %v", events)
+	}
+	waitForWebhookLog(t, server.URL, hookPath, func(log []database.WebhookDelivery) bool {
+		return len(log) == 3 && log[0].Status == database.WebhookDelivered && log[1].Status == database.WebhookDelivered
+	})
+
+	// Redelivery queues the same payload as a new delivery.
+	var redelivered struct {
+		Delivery database.WebhookDelivery `json:"delivery"`
+	}
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       fmt.Sprintf("%s/deliveries/%d/redeliver", hookPath, postDelivery.ID),
+		ExpectedStatus: http.StatusAccepted,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &redelivered)
+	if redelivered.Delivery.RedeliveryOf == nil || *redelivered.Delivery.RedeliveryOf != postDelivery.ID {
+		t.Fatalf("Unexpected redelivery: %+v", redelivered.Delivery)
+	}
+	received = receiver.waitFor(t, 5)
+	if !bytes.Equal(received[4].Body, received[1].Body) || received[4].Delivery != strconv.FormatInt(redelivered.Delivery.ID, 10) {
+		t.Fatalf("Expected the original payload under a new delivery id, got %+v", received[4])
+	}
+
+	// A webhook that keeps failing is turned off and its queue dropped.
+	receiver.respondWith(http.StatusBadGateway)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          `{"user":1,"project":1,"content":"Nobody is listening"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	waitForWebhookLog(t, server.URL, hookPath, func(log []database.WebhookDelivery) bool {
+		return len(log) == 5 && log[0].Attempts == 1 && log[0].Status == database.WebhookPending
+	})
+	handlers.ProcessWebhookQueue(time.Now().Add(time.Hour))
+	handlers.ProcessWebhookQueue(time.Now().Add(2 * time.Hour))
+	log = waitForWebhookLog(t, server.URL, hookPath, func(log []database.WebhookDelivery) bool {
+		return log[0].Status == database.WebhookFailed
+	})
+	if log[0].Attempts != 3 || *log[0].ResponseCode != http.StatusBadGateway || log[0].Error == nil {
+		t.Fatalf("Unexpected failed entry: %+v", log[0])
+	}
+
+	var listed struct {
+		Webhooks []database.ProjectWebhook `json:"webhooks"`
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       "/projects/1/webhooks",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &listed)
+	if len(listed.Webhooks) != 1 || listed.Webhooks[0].Active || listed.Webhooks[0].ConsecutiveFailures != 3 || listed.Webhooks[0].DisabledAt == nil {
+		t.Fatalf("Expected the webhook to be disabled, got %+v", listed.Webhooks)
+	}
+
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       fmt.Sprintf("%s/deliveries/%d/redeliver", hookPath, log[0].ID),
+		ExpectedStatus: http.StatusConflict,
+		ExpectedBody:   `{"error":"Conflict","message":"Webhook is disabled. Turn it back on before redelivering"}`,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	TestCase{
+		Method:         http.MethodPost,
+		Endpoint:       "/posts",
+		Input:          `{"user":1,"project":1,"content":"Still nobody"}`,
+		ExpectedStatus: http.StatusCreated,
+		AuthAs:         "dev_user1:1",
+	}.Run(t, server.URL)
+	if log = fetchWebhookLog(t, server.URL, hookPath); len(log) != 5 {
+		t.Fatalf("Expected no deliveries for a disabled webhook, got %d entries", len(log))
+	}
+
+	var updated struct {
+		Webhook database.ProjectWebhook `json:"webhook"`
+		Secret  *string                 `json:"secret"`
+	}
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       hookPath,
+		Input:          `{"active":true}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &updated)
+	if !updated.Webhook.Active || updated.Webhook.ConsecutiveFailures != 0 || updated.Webhook.DisabledAt != nil || updated.Secret != nil {
+		t.Fatalf("Expected the webhook to be back on, got %+v", updated)
+	}
+	TestCase{
+		Method:         http.MethodPut,
+		Endpoint:       hookPath,
+		Input:          `{"rotate_secret":true}`,
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, server.URL, &updated)
+	if updated.Secret == nil || !strings.HasPrefix(*updated.Secret, "whsec_") {
+		t.Fatalf("Expected a rotated secret, got %+v", updated)
+	}
+
+	for _, tc := range []TestCase{
+		{
+			Method:         http.MethodGet,
+			Endpoint:       hookPath + "/deliveries",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   `{"error":"Forbidden","message":"Only the owner can manage webhooks"}`,
+			AuthAs:         "tech_writer2:2",
+		},
+		{
+			Method:         http.MethodDelete,
+			Endpoint:       hookPath,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"message":"Webhook deleted"}`,
+			AuthAs:         "dev_user1:1",
+		},
+		{
+			Method:         http.MethodGet,
+			Endpoint:       hookPath + "/deliveries",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"Not Found","message":"Webhook not found"}`,
+			AuthAs:         "dev_user1:1",
+		},
+	} {
+		tc.Run(t, server.URL)
+	}
+}
+
+func fetchWebhookLog(t *testing.T, serverURL string, hookPath string) []database.WebhookDelivery {
+	t.Helper()
+
+	var response struct {
+		Deliveries []database.WebhookDelivery `json:"deliveries"`
+	}
+	TestCase{
+		Method:         http.MethodGet,
+		Endpoint:       hookPath + "/deliveries",
+		ExpectedStatus: http.StatusOK,
+		AuthAs:         "dev_user1:1",
+	}.Fetch(t, serverURL, &response)
+	return response.Deliveries
+}
+
+// waitForWebhookLog polls the delivery log until ready accepts it, since
+// deliveries are sent in the background.
+func waitForWebhookLog(t *testing.T, serverURL string, hookPath string, ready func([]database.WebhookDelivery) bool) []database.WebhookDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		log := fetchWebhookLog(t, serverURL, hookPath)
+		if len(log) > 0 && ready(log) {
+			return log
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the webhook log, got %+v", log)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
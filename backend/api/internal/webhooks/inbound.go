@@ -0,0 +1,377 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// Where an inbound call came from, judged by its headers.
+const (
+	SourceGitHub  = "github"
+	SourceGitLab  = "gitlab"
+	SourceGeneric = "generic"
+)
+
+// Kinds of inbound event, each rendered by its own template.
+const (
+	KindPush    = "push"
+	KindRelease = "release"
+	KindGeneric = "generic"
+)
+
+// Kinds lists the template kinds an inbound webhook can override.
+var Kinds = []string{KindPush, KindRelease, KindGeneric}
+
+// maxListedCommits is how many commits a push lists before summing up the
+// rest.
+const maxListedCommits = 5
+
+// maxDeliveryID is the longest delivery id kept to spot redeliveries.
+const maxDeliveryID = 100
+
+// DefaultTemplates render inbound events for webhooks that do not set their
+// own. Templates are text/template over an InboundEvent.
+var DefaultTemplates = map[string]string{
+	KindPush: `{{.Pusher}} pushed {{.CommitCount}} commit{{if ne .CommitCount 1}}s{{end}} to {{.Ref}} in {{.Repository}}
+{{range .Commits}}
+- {{.ShortID}} {{.Message}}{{if .Author}} ({{.Author}}){{end}}{{end}}{{if .MoreCommits}}
+- and {{.MoreCommits}} more{{end}}{{if .CompareURL}}
+
+{{.CompareURL}}{{end}}`,
+	KindRelease: `{{.Repository}} released {{if .ReleaseName}}{{.ReleaseName}}{{else}}{{.Tag}}{{end}}{{if and .ReleaseName (ne .ReleaseName .Tag)}} ({{.Tag}}){{end}}{{if .ReleaseBody}}
+
+{{.ReleaseBody}}{{end}}{{if .ReleaseURL}}
+
+{{.ReleaseURL}}{{end}}`,
+	KindGeneric: `{{if .Title}}{{.Title}}
+{{end}}{{.Text}}{{if .URL}}
+
+{{.URL}}{{end}}`,
+}
+
+// InboundCommit is one commit in a push.
+type InboundCommit struct {
+	ID      string
+	ShortID string
+	Message string
+	Author  string
+	URL     string
+}
+
+// InboundEvent is an inbound call reduced to what templates need. Payload
+// holds the decoded JSON, so templates can reach fields this does not name.
+type InboundEvent struct {
+	Source string
+	// Event is the event the sender named, such as "push" or "Push Hook".
+	Event string
+	// DeliveryID is the sender's id for this call, which stays the same
+	// when it is redelivered. It is empty if the sender gave none.
+	DeliveryID string
+	// Kind is the template that renders the event. It is empty when the
+	// event should not become a post, and Ignored says why.
+	Kind    string
+	Ignored string
+
+	Repository    string
+	RepositoryURL string
+	// Ref is the branch or tag pushed to.
+	Ref         string
+	Pusher      string
+	Commits     []InboundCommit
+	CommitCount int
+	MoreCommits int
+	CompareURL  string
+
+	Action      string
+	Tag         string
+	ReleaseName string
+	ReleaseBody string
+	ReleaseURL  string
+
+	Title string
+	Text  string
+	URL   string
+
+	Payload map[string]interface{}
+}
+
+// VerifyInbound checks that body was sent by someone holding secret: a
+// GitHub X-Hub-Signature-256, a GitLab X-Gitlab-Token, or an
+// X-DevBits-Signature made the way Sign makes them.
+func VerifyInbound(header http.Header, body []byte, secret string) bool {
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		return Verify(secret, body, signature)
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		return hmac.Equal([]byte(token), []byte(secret))
+	}
+	if signature := header.Get(SignatureHeader); signature != "" {
+		return Verify(secret, body, signature)
+	}
+	return false
+}
+
+// ParseInbound decodes an inbound call. GitHub and GitLab push and release
+// events are recognized by their event headers; anything else is generic
+// JSON, which should carry "text" (or "content" or "message") and may add
+// "title" and "url".
+func ParseInbound(header http.Header, body []byte) (*InboundEvent, error) {
+	if strings.HasPrefix(header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		// GitHub can be set to send the JSON as a form field.
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid form payload: %w", err)
+		}
+		body = []byte(form.Get("payload"))
+	}
+
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil || payload == nil {
+		return nil, errors.New("payload must be a JSON object")
+	}
+
+	event := &InboundEvent{Payload: payload}
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		event.Source = SourceGitHub
+		event.Event = header.Get("X-GitHub-Event")
+		event.DeliveryID = header.Get("X-GitHub-Delivery")
+		parseGitHub(event)
+	case header.Get("X-Gitlab-Event") != "":
+		event.Source = SourceGitLab
+		event.Event = header.Get("X-Gitlab-Event")
+		event.DeliveryID = header.Get("X-Gitlab-Event-UUID")
+		parseGitLab(event)
+	default:
+		event.Source = SourceGeneric
+		event.Event = KindGeneric
+		event.DeliveryID = header.Get("X-DevBits-Delivery")
+		parseGeneric(event)
+	}
+	event.DeliveryID = strings.TrimSpace(event.DeliveryID)
+	if len(event.DeliveryID) > maxDeliveryID {
+		event.DeliveryID = event.DeliveryID[:maxDeliveryID]
+	}
+	return event, nil
+}
+
+func parseGitHub(event *InboundEvent) {
+	payload := event.Payload
+	event.Repository = stringAt(payload, "repository", "full_name")
+	event.RepositoryURL = stringAt(payload, "repository", "html_url")
+	switch event.Event {
+	case "push":
+		event.Ref = shortRef(stringAt(payload, "ref"))
+		event.Pusher = firstString(stringAt(payload, "pusher", "name"), stringAt(payload, "sender", "login"))
+		event.CompareURL = stringAt(payload, "compare")
+		commits, _ := payload["commits"].([]interface{})
+		setCommits(event, commits, len(commits), func(commit map[string]interface{}) string {
+			return firstString(stringAt(commit, "author", "username"), stringAt(commit, "author", "name"))
+		})
+		switch {
+		case truthy(payload["deleted"]):
+			event.Ignored = "ref deleted"
+		case event.CommitCount == 0:
+			event.Ignored = "no commits"
+		default:
+			event.Kind = KindPush
+		}
+	case "release":
+		event.Action = stringAt(payload, "action")
+		event.Tag = stringAt(payload, "release", "tag_name")
+		event.ReleaseName = stringAt(payload, "release", "name")
+		event.ReleaseBody = stringAt(payload, "release", "body")
+		event.ReleaseURL = stringAt(payload, "release", "html_url")
+		if event.Action != "published" {
+			event.Ignored = fmt.Sprintf("release %s", event.Action)
+			return
+		}
+		event.Kind = KindRelease
+	case "ping":
+		event.Ignored = "ping"
+	default:
+		event.Ignored = fmt.Sprintf("unsupported GitHub event %q", event.Event)
+	}
+}
+
+func parseGitLab(event *InboundEvent) {
+	payload := event.Payload
+	event.Repository = stringAt(payload, "project", "path_with_namespace")
+	event.RepositoryURL = stringAt(payload, "project", "web_url")
+	switch event.Event {
+	case "Push Hook", "Tag Push Hook":
+		event.Ref = shortRef(stringAt(payload, "ref"))
+		event.Pusher = firstString(stringAt(payload, "user_username"), stringAt(payload, "user_name"))
+		commits, _ := payload["commits"].([]interface{})
+		total := len(commits)
+		if count, err := json.Number(stringAt(payload, "total_commits_count")).Int64(); err == nil && int(count) > total {
+			total = int(count)
+		}
+		setCommits(event, commits, total, func(commit map[string]interface{}) string {
+			return stringAt(commit, "author", "name")
+		})
+		before, after := stringAt(payload, "before"), stringAt(payload, "after")
+		if event.RepositoryURL != "" && before != "" && strings.Trim(before, "0") != "" && after != "" {
+			event.CompareURL = fmt.Sprintf("%s/-/compare/%s...%s", event.RepositoryURL, before, after)
+		}
+		if strings.Trim(after, "0") == "" {
+			event.Ignored = "ref deleted"
+			return
+		}
+		if event.CommitCount == 0 {
+			event.Ignored = "no commits"
+			return
+		}
+		event.Kind = KindPush
+	case "Release Hook":
+		event.Action = stringAt(payload, "action")
+		event.Tag = stringAt(payload, "tag")
+		event.ReleaseName = stringAt(payload, "name")
+		event.ReleaseBody = stringAt(payload, "description")
+		event.ReleaseURL = stringAt(payload, "url")
+		if event.Action != "create" {
+			event.Ignored = fmt.Sprintf("release %s", event.Action)
+			return
+		}
+		event.Kind = KindRelease
+	default:
+		event.Ignored = fmt.Sprintf("unsupported GitLab event %q", event.Event)
+	}
+}
+
+func parseGeneric(event *InboundEvent) {
+	payload := event.Payload
+	event.Title = stringAt(payload, "title")
+	event.Text = firstString(stringAt(payload, "text"), stringAt(payload, "content"), stringAt(payload, "message"))
+	event.URL = stringAt(payload, "url")
+	event.Kind = KindGeneric
+}
+
+// setCommits lists a push's commits, most recent first, keeping only the
+// first line of each message.
+func setCommits(event *InboundEvent, commits []interface{}, total int, author func(map[string]interface{}) string) {
+	event.CommitCount = total
+	for index := len(commits) - 1; index >= 0 && len(event.Commits) < maxListedCommits; index-- {
+		commit, ok := commits[index].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id := stringAt(commit, "id")
+		short := id
+		if len(short) > 7 {
+			short = short[:7]
+		}
+		message, _, _ := strings.Cut(strings.TrimSpace(stringAt(commit, "message")), "\n")
+		event.Commits = append(event.Commits, InboundCommit{
+			ID:      id,
+			ShortID: short,
+			Message: strings.TrimSpace(message),
+			Author:  author(commit),
+			URL:     stringAt(commit, "url"),
+		})
+	}
+	event.MoreCommits = max(total-len(event.Commits), 0)
+}
+
+// stringAt follows keys into nested JSON objects and returns the string, or
+// number, found there.
+func stringAt(value map[string]interface{}, keys ...string) string {
+	var current interface{} = value
+	for _, key := range keys {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = object[key]
+	}
+	switch found := current.(type) {
+	case string:
+		return found
+	case json.Number:
+		return found.String()
+	}
+	return ""
+}
+
+func firstString(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func truthy(value interface{}) bool {
+	found, ok := value.(bool)
+	return ok && found
+}
+
+func shortRef(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
+
+// sampleEvent fills every field, so checking a template against it catches
+// misspelled field names before any real event arrives.
+var sampleEvent = InboundEvent{
+	Source:        SourceGitHub,
+	Event:         "push",
+	Kind:          KindPush,
+	Repository:    "devbits/app",
+	RepositoryURL: "https://example.com/devbits/app",
+	Ref:           "main",
+	Pusher:        "octocat",
+	Commits:       []InboundCommit{{ID: "0123456789abcdef", ShortID: "0123456", Message: "Fix it", Author: "octocat", URL: "https://example.com/commit"}},
+	CommitCount:   1,
+	CompareURL:    "https://example.com/compare",
+	Action:        "published",
+	Tag:           "v1.0.0",
+	ReleaseName:   "1.0",
+	ReleaseBody:   "Notes",
+	ReleaseURL:    "https://example.com/release",
+	Title:         "Build passed",
+	Text:          "All green",
+	URL:           "https://example.com/build",
+	Payload:       map[string]interface{}{},
+}
+
+// CheckTemplate reports whether text parses and renders the sample event.
+func CheckTemplate(text string) error {
+	parsed, err := template.New("post").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return err
+	}
+	return parsed.Execute(&bytes.Buffer{}, &sampleEvent)
+}
+
+// Render turns event into post text with templates[event.Kind], falling back
+// to the default template for the kind.
+func Render(templates map[string]string, event *InboundEvent) (string, error) {
+	text, ok := templates[event.Kind]
+	if !ok || strings.TrimSpace(text) == "" {
+		text = DefaultTemplates[event.Kind]
+	}
+	parsed, err := template.New(event.Kind).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, event); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered.String()), nil
+}
@@ -0,0 +1,79 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/api/internal/netguard"
+)
+
+// maxResponseBody is how much of a receiver's response is kept for the
+// delivery log.
+const maxResponseBody = 2048
+
+// Result is what came of one delivery attempt. StatusCode is zero when the
+// receiver could not be reached.
+type Result struct {
+	StatusCode int
+	Body       string
+	Duration   time.Duration
+	Err        error
+}
+
+// OK reports whether the receiver accepted the delivery with a 2xx.
+func (result Result) OK() bool {
+	return result.Err == nil && result.StatusCode >= 200 && result.StatusCode < 300
+}
+
+// Sender posts signed deliveries. Redirects are not followed, so a receiver
+// cannot bounce a delivery somewhere it was not registered for.
+type Sender struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+// NewSender returns a Sender whose connections refuse loopback and private
+// addresses unless allowPrivate says otherwise at dial time.
+func NewSender(allowPrivate func() bool) *Sender {
+	return &Sender{
+		Client:    netguard.NewClient(10*time.Second, allowPrivate),
+		UserAgent: "DevBits-Webhooks/1.0",
+	}
+}
+
+// Send posts body to url as delivery deliveryID of event, signed with secret.
+func (sender *Sender) Send(ctx context.Context, url string, secret string, event string, deliveryID int64, body []byte) Result {
+	started := time.Now()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: fmt.Errorf("failed to build webhook request: %w", err)}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", sender.UserAgent)
+	request.Header.Set("X-DevBits-Event", event)
+	request.Header.Set("X-DevBits-Delivery", strconv.FormatInt(deliveryID, 10))
+	request.Header.Set(SignatureHeader, Sign(secret, body))
+
+	response, err := sender.Client.Do(request)
+	if err != nil {
+		return Result{Duration: time.Since(started), Err: err}
+	}
+	defer response.Body.Close()
+
+	raw, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseBody))
+	result := Result{
+		StatusCode: response.StatusCode,
+		Body:       strings.ToValidUTF8(string(raw), "\uFFFD"),
+		Duration:   time.Since(started),
+	}
+	if !result.OK() {
+		result.Err = fmt.Errorf("webhook receiver responded with status %d", response.StatusCode)
+	}
+	return result
+}
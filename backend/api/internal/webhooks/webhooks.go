@@ -0,0 +1,90 @@
+// Package webhooks signs and sends project events to endpoints outside
+// DevBits, and reads the events CI systems and git hosts send in.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Project events a webhook can subscribe to.
+const (
+	EventPostCreated     = "post.created"
+	EventCommentCreated  = "comment.created"
+	EventBuilderAdded    = "builder.added"
+	EventBuilderRemoved  = "builder.removed"
+	EventFollowerAdded   = "follower.added"
+	EventFollowerRemoved = "follower.removed"
+	// EventAll subscribes to every event, including ones added later.
+	EventAll = "*"
+)
+
+// Events lists every project event, in the order the docs give them.
+var Events = []string{
+	EventPostCreated,
+	EventCommentCreated,
+	EventBuilderAdded,
+	EventBuilderRemoved,
+	EventFollowerAdded,
+	EventFollowerRemoved,
+}
+
+// SignatureHeader carries the body's HMAC, in the form Sign returns.
+const SignatureHeader = "X-DevBits-Signature"
+
+// KnownEvent reports whether a webhook may subscribe to event.
+func KnownEvent(event string) bool {
+	if event == EventAll {
+		return true
+	}
+	for _, known := range Events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribed reports whether a webhook subscribed to events hears event.
+func Subscribed(events []string, event string) bool {
+	for _, subscribed := range events {
+		if subscribed == EventAll || subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret returns a random secret for signing a webhook's deliveries.
+func NewSecret() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(raw), nil
+}
+
+// NewKey returns a random key naming an inbound webhook in its URL.
+func NewKey() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate webhook key: %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Sign returns "sha256=" and the hex HMAC-SHA256 of body keyed by secret, the
+// value of SignatureHeader. Receivers recompute it over the raw body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, body)))
+}
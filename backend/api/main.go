@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"github.com/joho/godotenv"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"backend/api/internal/database"
 	"backend/api/internal/handlers"
@@ -21,6 +26,10 @@ const debugEnvKey = "DEVBITS_DEBUG"
 const corsOriginsEnvKey = "DEVBITS_CORS_ORIGINS"
 const listenAddrEnvKey = "DEVBITS_API_ADDR"
 
+// shutdownTimeout bounds how long shutdown waits for requests and
+// background work to finish.
+const shutdownTimeout = 20 * time.Second
+
 func isDebugMode() bool {
 	return os.Getenv(debugEnvKey) == "1"
 }
@@ -95,10 +104,29 @@ func main() {
 
 	// Initialize the database connection
 	database.Connect()
+	handlers.StartUploadSessionJanitor(time.Hour)
+	handlers.StartScheduledPushDispatcher(time.Minute)
+	handlers.StartPushQueueWorker(15 * time.Second)
+	broker, err := handlers.RealtimeBrokerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure realtime broker: %v", err)
+	}
+	hub, err := handlers.NewRealtimeHub(broker)
+	if err != nil {
+		log.Fatalf("Failed to start realtime hub: %v", err)
+	}
+	if err := handlers.ConfigurePushProviders(); err != nil {
+		log.Fatalf("Failed to configure push providers: %v", err)
+	}
+	if err := handlers.ConfigureMailer(); err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	handlers.StartEmailDigestWorker(15 * time.Minute)
+	handlers.StartWebhookWorker(30 * time.Second)
 
 	router := gin.New()
 	router.MaxMultipartMemory = 64 << 20
-	router.Use(gin.Logger(), gin.Recovery())
+	router.Use(gin.Logger(), gin.Recovery(), handlers.WithRealtimeHub(hub))
 	router.Use(func(context *gin.Context) {
 		path := context.Request.URL.Path
 		if strings.HasPrefix(path, "/uploads/") {
@@ -106,6 +134,11 @@ func main() {
 			// it is safe to aggressively cache on the client.
 			context.Header("Cache-Control", "public, max-age=31536000, immutable")
 			context.Header("X-Content-Type-Options", "nosniff")
+			if strings.HasSuffix(strings.ToLower(path), ".svg") {
+				// SVGs are sanitized on upload; the sandbox also covers files
+				// stored before sanitization existed.
+				context.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox")
+			}
 			context.Next()
 			return
 		}
@@ -126,8 +159,9 @@ func main() {
 
 	// Apply CORS middleware to the router
 	corsConfig := cors.Config{
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Upload-Offset", "Last-Event-ID"},
+		ExposeHeaders:    []string{"Location", "Upload-Offset", "Upload-Length", "Upload-Expires"},
 		AllowCredentials: true,
 	}
 	if isDebugMode() {
@@ -178,12 +212,15 @@ func main() {
 	adminApi.POST("/users/:username/ban", handlers.AdminBanUser)
 	adminApi.POST("/users/:username/unban", handlers.AdminUnbanUser)
 	adminApi.DELETE("/users/:username", handlers.AdminDeleteUser)
+	adminApi.GET("/users/:username/storage", handlers.AdminGetUserStorage)
+	adminApi.POST("/users/:username/storage", handlers.AdminSetUserStorage)
 	adminApi.GET("/posts", handlers.AdminListPosts)
 	adminApi.DELETE("/posts/:post_id", handlers.AdminDeletePost)
 	adminApi.GET("/projects", handlers.AdminListProjects)
 	adminApi.DELETE("/projects/:project_id", handlers.AdminDeleteProject)
 	adminApi.GET("/comments", handlers.AdminListComments)
 	adminApi.DELETE("/comments/:comment_id", handlers.AdminDeleteComment)
+	adminApi.GET("/push/stats", handlers.AdminPushStats)
 
 	if strings.TrimSpace(os.Getenv("DEVBITS_ADMIN_KEY")) == "" {
 		log.Printf("WARN: DEVBITS_ADMIN_KEY is empty; admin API calls will be rejected")
@@ -221,9 +258,18 @@ func main() {
 	router.GET("/auth/me", handlers.RequireAuth(), handlers.GetMe)
 
 	router.POST("/media/upload", handlers.RequireAuth(), handlers.UploadMedia)
+	router.POST("/media/uploads", handlers.RequireAuth(), handlers.CreateUploadSession)
+	router.HEAD("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.GetUploadSessionOffset)
+	router.PATCH("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.AppendUploadChunk)
+	router.POST("/media/uploads/:upload_id/complete", handlers.RequireAuth(), handlers.CompleteUploadSession)
+	router.DELETE("/media/uploads/:upload_id", handlers.RequireAuth(), handlers.AbortUploadSession)
+	router.POST("/media/private", handlers.RequireAuth(), handlers.UploadPrivateMedia)
+	router.GET("/media/private/:filename", handlers.ServePrivateMedia)
+	router.GET("/media/private/:filename/url", handlers.RequireAuth(), handlers.GetPrivateMediaURL)
+	router.DELETE("/media/private/:filename", handlers.RequireAuth(), handlers.DeletePrivateMedia)
 
 	router.GET("/users", handlers.GetUsers)
-	router.GET("/users/search", handlers.SearchUsers)
+	router.GET("/users/search", handlers.OptionalAuth(), handlers.SearchUsers)
 	router.GET("/users/:username", handlers.GetUserByUsername)
 	router.GET("/users/id/:user_id", handlers.GetUserById)
 	router.POST("/users", handlers.RequireAuth(), handlers.CreateUser)
@@ -242,13 +288,43 @@ func main() {
 	router.POST("/users/:username/follow/:new_follow", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.FollowUser)
 	router.POST("/users/:username/unfollow/:unfollow", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnfollowUser)
 
+	router.GET("/users/:username/blocks", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetBlockedUsers)
+	router.POST("/users/:username/blocks/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.BlockUser)
+	router.DELETE("/users/:username/blocks/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnblockUser)
+	router.GET("/users/:username/mutes", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetMutedUsers)
+	router.POST("/users/:username/mutes/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.MuteUser)
+	router.DELETE("/users/:username/mutes/:target", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnmuteUser)
+
+	router.GET("/users/:username/bots", handlers.GetUserBots)
+	router.POST("/users/:username/bots", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.CreateUserBot)
+
 	router.GET("/messages/:username/peers", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectChatPeers)
 	router.GET("/messages/:username/threads", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectMessageThreads)
 	router.GET("/messages/:username/with/:other", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetDirectMessages)
 	router.POST("/messages/:username/with/:other", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.CreateDirectMessage)
+	router.POST("/messages/:username/with/:other/read", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.MarkDirectMessagesRead)
+	router.PUT("/messages/:username/with/:other/:message_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UpdateDirectMessage)
+	router.DELETE("/messages/:username/with/:other/:message_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.DeleteDirectMessage)
+	router.GET("/messages/:username/unread-count", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetUnreadDirectMessageCount)
 	router.GET("/messages/:username/stream", handlers.StreamDirectMessages)
-
-	router.GET("/projects/:project_id", handlers.GetProjectById)
+	router.GET("/messages/:username/events", handlers.StreamDirectMessageEvents)
+
+	router.POST("/conversations", handlers.RequireAuth(), handlers.CreateConversation)
+	router.GET("/conversations", handlers.RequireAuth(), handlers.GetConversations)
+	router.GET("/conversations/unread-count", handlers.RequireAuth(), handlers.GetConversationUnreadCount)
+	router.GET("/conversations/:conversation_id", handlers.RequireAuth(), handlers.GetConversation)
+	router.PUT("/conversations/:conversation_id", handlers.RequireAuth(), handlers.UpdateConversation)
+	router.GET("/conversations/:conversation_id/messages", handlers.RequireAuth(), handlers.GetConversationMessages)
+	router.POST("/conversations/:conversation_id/messages", handlers.RequireAuth(), handlers.CreateConversationMessage)
+	router.POST("/conversations/:conversation_id/read", handlers.RequireAuth(), handlers.MarkConversationRead)
+	router.POST("/conversations/:conversation_id/join", handlers.RequireAuth(), handlers.JoinConversation)
+	router.POST("/conversations/:conversation_id/leave", handlers.RequireAuth(), handlers.LeaveConversation)
+	router.POST("/conversations/:conversation_id/participants", handlers.RequireAuth(), handlers.AddConversationParticipant)
+	router.PUT("/conversations/:conversation_id/participants/:username", handlers.RequireAuth(), handlers.UpdateConversationParticipant)
+	router.DELETE("/conversations/:conversation_id/participants/:username", handlers.RequireAuth(), handlers.RemoveConversationParticipant)
+	router.GET("/projects/:project_id/conversation", handlers.RequireAuth(), handlers.GetProjectConversation)
+
+	router.GET("/projects/:project_id", handlers.OptionalAuth(), handlers.GetProjectById)
 	router.POST("/projects", handlers.RequireAuth(), handlers.CreateProject)
 	router.PUT("/projects/:project_id", handlers.RequireAuth(), handlers.UpdateProjectInfo)
 	router.DELETE("/projects/:project_id", handlers.RequireAuth(), handlers.DeleteProject)
@@ -259,6 +335,30 @@ func main() {
 	router.POST("/projects/:project_id/builders/:username", handlers.RequireAuth(), handlers.AddProjectBuilder)
 	router.DELETE("/projects/:project_id/builders/:username", handlers.RequireAuth(), handlers.RemoveProjectBuilder)
 
+	router.GET("/projects/:project_id/webhooks", handlers.RequireAuth(), handlers.GetProjectWebhooks)
+	router.POST("/projects/:project_id/webhooks", handlers.RequireAuth(), handlers.CreateProjectWebhook)
+	router.PUT("/projects/:project_id/webhooks/:webhook_id", handlers.RequireAuth(), handlers.UpdateProjectWebhook)
+	router.DELETE("/projects/:project_id/webhooks/:webhook_id", handlers.RequireAuth(), handlers.DeleteProjectWebhook)
+	router.GET("/projects/:project_id/webhooks/:webhook_id/deliveries", handlers.RequireAuth(), handlers.GetWebhookDeliveries)
+	router.POST("/projects/:project_id/webhooks/:webhook_id/deliveries/:delivery_id/redeliver", handlers.RequireAuth(), handlers.RedeliverWebhookDelivery)
+	router.GET("/projects/:project_id/inbound-webhooks", handlers.RequireAuth(), handlers.GetInboundWebhooks)
+	router.POST("/projects/:project_id/inbound-webhooks", handlers.RequireAuth(), handlers.CreateInboundWebhook)
+	router.PUT("/projects/:project_id/inbound-webhooks/:webhook_id", handlers.RequireAuth(), handlers.UpdateInboundWebhook)
+	router.DELETE("/projects/:project_id/inbound-webhooks/:webhook_id", handlers.RequireAuth(), handlers.DeleteInboundWebhook)
+	router.GET("/projects/:project_id/inbound-webhooks/:webhook_id/events", handlers.RequireAuth(), handlers.GetInboundWebhookEvents)
+	router.POST("/webhooks/inbound/:key", handlers.ReceiveInboundWebhook)
+	router.GET("/projects/:project_id/bots", handlers.GetProjectBots)
+	router.POST("/projects/:project_id/bots", handlers.RequireAuth(), handlers.CreateProjectBot)
+
+	router.GET("/bots/:username", handlers.GetBot)
+	router.PUT("/bots/:username", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.UpdateUserInfo)
+	router.DELETE("/bots/:username", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.DeleteUser)
+	router.GET("/bots/:username/tokens", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.GetBotTokens)
+	router.POST("/bots/:username/tokens", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.CreateBotToken)
+	router.DELETE("/bots/:username/tokens/:token_id", handlers.RequireAuth(), handlers.RequireBotManager(), handlers.DeleteBotToken)
+	router.PUT("/bots/:username/projects/:project_id", handlers.RequireAuth(), handlers.GrantBotProject)
+	router.DELETE("/bots/:username/projects/:project_id", handlers.RequireAuth(), handlers.RevokeBotProject)
+
 	router.GET("/projects/:project_id/followers", handlers.GetProjectFollowers)
 	router.GET("/projects/follows/:username", handlers.GetProjectFollowing)
 	router.GET("/projects/:project_id/followers/usernames", handlers.GetProjectFollowersUsernames)
@@ -271,7 +371,7 @@ func main() {
 	router.POST("/projects/user/:username/unlikes/:project_id", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.UnlikeProject)
 	router.GET("/projects/does-like/:username/:project_id", handlers.IsProjectLiked)
 
-	router.GET("/posts/:post_id", handlers.GetPostById)
+	router.GET("/posts/:post_id", handlers.OptionalAuth(), handlers.GetPostById)
 	router.POST("/posts", handlers.RequireAuth(), handlers.CreatePost)
 	router.PUT("/posts/:post_id", handlers.RequireAuth(), handlers.UpdatePostInfo)
 	router.DELETE("/posts/:post_id", handlers.RequireAuth(), handlers.DeletePost)
@@ -303,27 +403,69 @@ func main() {
 	router.GET("/comments/does-like/:username/:comment_id", handlers.IsCommentLiked)
 	router.GET("/comments/can-edit/:comment_id", handlers.IsCommentEditable)
 
-	router.GET("/feed/posts", handlers.GetPostsFeed)
-	router.GET("/feed/projects", handlers.GetProjectsFeed)
+	router.GET("/feed/posts", handlers.OptionalAuth(), handlers.GetPostsFeed)
+	router.GET("/feed/projects", handlers.OptionalAuth(), handlers.GetProjectsFeed)
 	router.GET("/feed/posts/following/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetFollowingPostsFeed)
 	router.GET("/feed/posts/saved/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetSavedPostsFeed)
 	router.GET("/feed/projects/following/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetFollowingProjectsFeed)
 	router.GET("/feed/projects/saved/:username", handlers.RequireAuth(), handlers.RequireSameUser(), handlers.GetSavedProjectsFeed)
 
 	router.POST("/notifications/push-token", handlers.RequireAuth(), handlers.RegisterPushToken)
+	router.GET("/notifications/web-push-key", handlers.GetWebPushKey)
 	router.GET("/notifications", handlers.RequireAuth(), handlers.GetNotifications)
 	router.GET("/notifications/unread-count", handlers.RequireAuth(), handlers.GetNotificationCount)
+	router.GET("/notifications/preferences", handlers.RequireAuth(), handlers.GetNotificationPreferences)
+	router.PUT("/notifications/preferences", handlers.RequireAuth(), handlers.UpdateNotificationPreferences)
+	router.GET("/notifications/digest/unsubscribe", handlers.ConfirmEmailDigestUnsubscribe)
+	router.POST("/notifications/digest/unsubscribe", handlers.UnsubscribeEmailDigest)
+	router.GET("/notifications/digest/confirm", handlers.ShowDigestEmailConfirmation)
+	router.POST("/notifications/digest/confirm", handlers.ConfirmDigestEmail)
+	router.POST("/notifications/read-all", handlers.RequireAuth(), handlers.MarkAllNotificationsRead)
+	router.POST("/notifications/read", handlers.RequireAuth(), handlers.MarkNotificationsRead)
+	router.POST("/notifications/delete", handlers.RequireAuth(), handlers.DeleteNotifications)
 	router.POST("/notifications/:notification_id/read", handlers.RequireAuth(), handlers.MarkNotificationRead)
 	router.DELETE("/notifications/:notification_id", handlers.RequireAuth(), handlers.DeleteNotification)
 	router.DELETE("/notifications", handlers.RequireAuth(), handlers.ClearNotifications)
 
 	listenAddr := getListenAddr()
 	log.Printf("INFO: API listen address: %s", listenAddr)
-	if err := router.Run(listenAddr); err != nil {
+	server := &http.Server{Addr: listenAddr, Handler: router}
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
 		log.Printf("ERROR: failed to start API server on %s: %v", listenAddr, err)
 		if isDebugMode() {
 			log.Println("HINT: address is likely in use. Set DEVBITS_API_ADDR (e.g. 127.0.0.1:18080) or stop the existing process.")
 		}
 		os.Exit(1)
+	case <-stop.Done():
+	}
+
+	log.Println("INFO: shutting down")
+	shutdownContext, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- server.Shutdown(shutdownContext)
+	}()
+	// Open streams are background work; stopping it lets Shutdown finish.
+	// Whatever the last requests started is waited for once they are done.
+	handlers.StopBackgroundWork(shutdownTimeout)
+	if err := <-shutdownDone; err != nil {
+		log.Printf("WARN: API server did not shut down cleanly: %v", err)
+	}
+	if !handlers.StopBackgroundWork(shutdownTimeout) {
+		log.Println("WARN: background work did not finish before shutdown")
+	}
+	if err := hub.Close(); err != nil {
+		log.Printf("WARN: failed to close realtime hub: %v", err)
 	}
+	_ = broker.Close()
+	_ = database.DB.Close()
 }